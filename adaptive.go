@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Time to keep the rounds of jobs for their feedback.
+const roundTTL = 24 * time.Hour
+
+// round is an adaptive round of a job with a Corpus.  Once the job's
+// feedback reaches the threshold of accepted corrections, the
+// uncorrected tokens are profiled again.  The new job profits from
+// the recorded feedback of the corpus.
+type round struct {
+	path      string
+	request   submission
+	threshold int
+	accepted  int
+	corrected map[string]bool // lower case OCR
+	created   time.Time
+}
+
+var rounds = struct {
+	m map[string]*round // token -> round
+	l sync.Mutex
+}{m: make(map[string]*round)}
+
+// Return the number of accepted corrections after which the request
+// is re-profiled (0 if it is not re-profiled).  Requests without a
+// Corpus are never re-profiled.
+func reprofileThreshold(request api.Request) int {
+	switch {
+	case request.Corpus == "" || request.Reprofile < 0:
+		return 0
+	case request.Reprofile > 0:
+		return request.Reprofile
+	default:
+		return int(reprofileAfter)
+	}
+}
+
+// Register the round of a new job.
+func registerRound(id, path string, request submission) {
+	n := reprofileThreshold(request.Request)
+	if n == 0 {
+		return
+	}
+	rounds.l.Lock()
+	defer rounds.l.Unlock()
+	cleanRounds()
+	rounds.m[id] = &round{
+		path:      path,
+		request:   request,
+		threshold: n,
+		corrected: make(map[string]bool),
+		created:   time.Now(),
+	}
+}
+
+// Remove expired rounds.  Must be called with the rounds locked.
+func cleanRounds() {
+	for id, r := range rounds.m {
+		if time.Since(r.created) > roundTTL {
+			delete(rounds.m, id)
+		}
+	}
+}
+
+// Report accepted corrections of a job: [POST] jobs/{token}/feedback.
+// The corrections are recorded for the Corpus of the job.  If the job
+// reaches its threshold of accepted corrections, its uncorrected
+// tokens are re-profiled in a new job.
+func postJobFeedback(w http.ResponseWriter, r *http.Request) interface{} {
+	id := pathParam(r, "token")
+	if !mayAccess(r, id) {
+		return http.StatusForbidden
+	}
+	var fb api.Feedback
+	if err := decodeBody(r, &fb); err != nil {
+		return decodeError(err)
+	}
+	rounds.l.Lock()
+	cleanRounds()
+	rd, ok := rounds.m[id]
+	if !ok {
+		rounds.l.Unlock()
+		return api.Error{
+			Status:  http.StatusNotFound,
+			Message: fmt.Sprintf("no adaptive round for job %s", id),
+		}
+	}
+	n, err := recordFeedback(rd.request.Corpus, fb.Corrections)
+	if err != nil {
+		rounds.l.Unlock()
+		return err
+	}
+	for _, c := range fb.Corrections {
+		if c.OCR != "" && c.Correction != "" {
+			rd.corrected[strings.ToLower(c.OCR)] = true
+		}
+	}
+	rd.accepted += n
+	res := api.JobFeedback{
+		Token:     api.Token{ID: id},
+		Recorded:  n,
+		Accepted:  rd.accepted,
+		Threshold: rd.threshold,
+	}
+	if rd.accepted < rd.threshold {
+		rounds.l.Unlock()
+		return res
+	}
+	// The new job registers its own round.
+	delete(rounds.m, id)
+	rounds.l.Unlock()
+	next, failure := reprofile(id, rd)
+	if failure != nil { // keep the round for the next feedback
+		rounds.l.Lock()
+		rounds.m[id] = rd
+		rounds.l.Unlock()
+		return failure
+	}
+	res.Reprofile = next
+	return res
+}
+
+// Submit a new job for the uncorrected tokens of the round.  The job
+// joins the group of the original job if the group still accepts
+// jobs.  If the job cannot be submitted, the failed result of the
+// submission is returned.
+func reprofile(id string, rd *round) (*api.Token, interface{}) {
+	request := rd.request
+	request.Request = remainingTokens(request.Request, rd.corrected)
+	request.ID = ""
+	request.received = time.Now()
+	if len(request.Tokens) == 0 {
+		log.Infof("job %s: no tokens left to re-profile", id)
+		return nil, nil
+	}
+	if request.Group != "" {
+		groups.l.Lock()
+		if _, ok := groups.accepts(request.Group); !ok {
+			request.Group = ""
+		}
+		groups.l.Unlock()
+	}
+	switch res := profile(rd.path, request).(type) {
+	case api.Token:
+		log.Infof("job %s: re-profiling %d tokens in job %s", id, len(request.Tokens), res.ID)
+		publish(api.Event{
+			Time:     time.Now(),
+			Event:    "reprofiled",
+			Token:    res.ID,
+			Language: request.Language,
+			Group:    request.Group,
+			Source:   id,
+		})
+		return &res, nil
+	default:
+		log.Infof("job %s: cannot re-profile tokens: %v", id, res)
+		return nil, res
+	}
+}
+
+// Return the request without the corrected tokens.  The positions and
+// segments of the remaining tokens are kept.
+func remainingTokens(request api.Request, corrected map[string]bool) api.Request {
+	res := request
+	res.Tokens = nil
+	res.Positions = nil
+	res.Segments = nil
+	index := make([]int, len(request.Tokens)+1) // old -> new index
+	for i, t := range request.Tokens {
+		index[i] = len(res.Tokens)
+		if t.LE == "" && corrected[strings.ToLower(t.OCR)] {
+			continue
+		}
+		res.Tokens = append(res.Tokens, t)
+		if i < len(request.Positions) {
+			res.Positions = append(res.Positions, request.Positions[i])
+		}
+	}
+	index[len(request.Tokens)] = len(res.Tokens)
+	for _, s := range request.Segments {
+		start, end := index[s.Start], index[s.Start+s.Length]
+		if start == end {
+			continue
+		}
+		s.Start, s.Length = start, end-start
+		res.Segments = append(res.Segments, s)
+	}
+	return res
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/finkf/gofilerd/listeners"
+	log "github.com/sirupsen/logrus"
+)
+
+// Register the administrative, metrics and debugging routes.  They
+// are served on the -admin-listen address, which is easy to firewall,
+// or on the public address if -admin-listen is empty.  The routes of
+// the admin key are still protected by the key.
+func handleAdmin(rt *router) {
+	rt.handle("/profile", methods{http.MethodPatch: withAdmin(withExtension(extendJob))})
+	rt.handle("/jobs", methods{http.MethodDelete: withAdmin(purgeJobs)})
+	rt.handle("/profiles/import", methods{http.MethodPost: withAdmin(importProfile)})
+	rt.handle("/feedback", methods{http.MethodPost: withAdmin(postFeedback)})
+	rt.handle("/frequencies", methods{
+		http.MethodPut:    withAdmin(putFrequencies),
+		http.MethodDelete: withAdmin(deleteFrequencies),
+	})
+	rt.handle("/profiler", methods{
+		http.MethodGet: withAdmin(getProfiler),
+		http.MethodPut: withAdmin(putProfiler),
+	})
+	rt.handle("/repository/gc", methods{
+		http.MethodGet:  withAdmin(getGC),
+		http.MethodPost: withAdmin(postGC),
+	})
+	rt.handle("/webhooks/dead-letters", methods{http.MethodGet: withAdmin(getDeadLetters)})
+	rt.handle("/webhooks/dead-letters/{delivery}", methods{
+		http.MethodPost:   withAdmin(redeliverDeadLetter),
+		http.MethodDelete: withAdmin(deleteDeadLetter),
+	})
+	rt.handle("/cache", methods{
+		http.MethodGet:    withAdmin(getCacheStats),
+		http.MethodDelete: withAdmin(flushCache),
+	})
+	rt.handle("/cache/warm", methods{http.MethodPost: withAdmin(warmCache)})
+	rt.handle("/usage", methods{http.MethodGet: withAdmin(getUsage)})
+	rt.handle("/stats", methods{http.MethodGet: getStats})
+	rt.handle("/scale", methods{http.MethodGet: getScale})
+	rt.handleFunc("/debug/vars", http.MethodGet, expvar.Handler().ServeHTTP)
+	rt.handleFunc("/debug/pprof", http.MethodGet, pprof.Index)
+	rt.handleFunc("/debug/pprof/{profile}", http.MethodGet, pprof.Index)
+	rt.handleFunc("/debug/pprof/cmdline", http.MethodGet, pprof.Cmdline)
+	rt.handleFunc("/debug/pprof/profile", http.MethodGet, pprof.Profile)
+	rt.handleFunc("/debug/pprof/trace", http.MethodGet, pprof.Trace)
+	rt.handleFunc("/debug/pprof/symbol", http.MethodGet, pprof.Symbol)
+	rt.handleFunc("/debug/pprof/symbol", http.MethodPost, pprof.Symbol)
+}
+
+// Serve the administrative routes.
+func serveAdmin(ls listeners.List, rt *router) {
+	log.Fatal(ls.Serve(func(l net.Listener) net.Listener { return l }, rt))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+)
+
+// Report at most this many invalid tokens of a request.
+const maxInvalidTokens = 100
+
+// Load the alphabet of the language configuration: the letters the
+// profiler can handle.  The alphabet is the optional alphabet key of
+// the language_model section.  Returns nil if the configuration has
+// no alphabet.
+func loadAlphabet(config string) (map[rune]bool, error) {
+	cfg, err := readINI(config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read language configuration: %v", err)
+	}
+	letters := cfg["language_model"]["alphabet"]
+	if letters == "" {
+		return nil, nil
+	}
+	alphabet := make(map[rune]bool)
+	for _, r := range letters {
+		alphabet[r] = true
+	}
+	return alphabet, nil
+}
+
+// Return the characters of the token that the profiler cannot handle:
+// invalid UTF-8, control characters, replacement characters and
+// letters that are not in the alphabet (if not nil).
+func invalidCharacters(token string, alphabet map[rune]bool) string {
+	var invalid []rune
+	for _, r := range token {
+		switch {
+		case r == utf8.RuneError: // invalid UTF-8 or U+FFFD
+		case unicode.IsControl(r):
+		case alphabet != nil && unicode.IsLetter(r) && !alphabet[r]:
+		default:
+			continue
+		}
+		if !strings.ContainsRune(string(invalid), r) {
+			invalid = append(invalid, r)
+		}
+	}
+	return string(invalid)
+}
+
+// Check the tokens of the request against the alphabet of the
+// language.  Tokens with invalid characters are reported with their
+// positions instead of letting the profiler mangle or skip them.
+func checkAlphabet(lc gofiler.LanguageConfiguration, request api.Request) (api.Error, bool) {
+	alphabet, err := loadAlphabet(lc.Path)
+	if err != nil {
+		return api.Error{
+			Status:  http.StatusInternalServerError,
+			Message: err.Error(),
+		}, false
+	}
+	var invalid []api.InvalidToken
+	n := 0
+	for i, t := range request.Tokens {
+		if t.LE != "" {
+			continue
+		}
+		chars := invalidCharacters(t.OCR, alphabet)
+		if chars == "" {
+			continue
+		}
+		if n++; len(invalid) == maxInvalidTokens {
+			continue
+		}
+		it := api.InvalidToken{Index: i, OCR: t.OCR, Characters: chars}
+		if i < len(request.Positions) {
+			pos := request.Positions[i]
+			it.Position = &pos
+		}
+		invalid = append(invalid, it)
+	}
+	if n == 0 {
+		return api.Error{}, true
+	}
+	return api.Error{
+		Status: http.StatusBadRequest,
+		Message: fmt.Sprintf("%d tokens with characters not supported by %s",
+			n, request.Language),
+		Invalid: invalid,
+	}, false
+}
@@ -2,16 +2,119 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
+	"time"
+
 	"github.com/finkf/gofiler"
 )
 
 // Version defines the version of the gofilerd api.
 const Version = "1.0"
 
+// VersionInfo is the result for any [GET] version request.
+type VersionInfo struct {
+	Version string // The version of the api
+}
+
 // Languages is the list of the available profiler languages. It the
 // result for any [GET] profile/languages request.
 type Languages struct {
-	Languages []string // Available languages
+	Languages []string            // Available languages
+	Checksums map[string]string   // Checksums of the language configurations
+	Conflicts map[string][]string `json:",omitempty"` // Ambiguous languages (not in Languages) and their configurations
+
+	Verification map[string]string `json:",omitempty"` // verified or why the verification failed (if the daemon uses a manifest)
+}
+
+// Patterns are the pattern sets of a language configuration:
+// [GET] languages/NAME/patterns.  OCR error patterns are learned for
+// each document by the profiler; OCR holds the settings that control
+// them (e.g. language_model.patternCutoff_ocr).
+type Patterns struct {
+	Language   string            // The language
+	Historical []PatternRule     // Historical spelling patterns
+	OCR        map[string]string `json:",omitempty"` // OCR pattern settings by section.key
+}
+
+// PatternRule is a rewrite rule that maps the modern Left to the
+// historical (or erroneous) Right.
+type PatternRule struct {
+	Left   string  // Left side of the pattern
+	Right  string  // Right side of the pattern
+	Weight float64 // Weight of the pattern (0 if unknown)
+}
+
+// Spellings are the spelling variants of a word:
+// [GET] languages/NAME/variants?q=WORD&to=historical|modern
+type Spellings struct {
+	Language  string     // The language
+	Word      string     // The expanded word
+	To        string     // historical or modern
+	Spellings []Spelling // The variants ordered by their score
+}
+
+// Spelling is a spelling variant of a word.
+type Spelling struct {
+	Spelling string  // The variant
+	Score    float64 // Product of the weights of the applied patterns
+}
+
+// Lookup is the result of a lexicon lookup:
+// [GET] languages/NAME/lookup?q=WORD
+type Lookup struct {
+	Language string    // The language
+	Word     string    // The looked up word
+	Found    bool      // True if the word is in the lexica
+	Variants []Variant // Lexicon entries of which the word is a historical variant
+}
+
+// CacheStats is the result of a [GET] cache request.  The cache holds
+// the results of lexicon lookups.  Hits and misses are counted since
+// the start of the daemon.
+type CacheStats struct {
+	Entries   int                           // Number of cached lookups
+	Capacity  int                           // Maximal number of cached lookups
+	Hits      int                           // Number of lookups answered from the cache
+	Misses    int                           // Number of lookups that ran the profiler
+	HitRate   float64                       // Hits / (Hits + Misses)
+	MissRate  float64                       // Misses / (Hits + Misses)
+	Languages map[string]LanguageCacheStats // Statistics per language
+}
+
+// LanguageCacheStats are the cache statistics of a language since the
+// start of the daemon.
+type LanguageCacheStats struct {
+	Entries int     // Number of cached lookups
+	Hits    int     // Number of lookups answered from the cache
+	Misses  int     // Number of lookups that ran the profiler
+	HitRate float64 // Hits / (Hits + Misses)
+	Warming bool    // The cache is pre-warmed
+}
+
+// CacheFlush is the result of a [DELETE] cache?language=LANGUAGE
+// request.
+type CacheFlush struct {
+	Language string `json:",omitempty"` // The flushed language (all if empty)
+	Removed  int    // Number of removed lookups
+}
+
+// CacheWarming is the result of a [POST]
+// cache/warm?language=LANGUAGE&namespace=NAMESPACE&limit=N request.
+// The most frequent forms of the frequency list of the namespace (or
+// of the posted FrequencyList without a namespace) are looked up in
+// the background.
+type CacheWarming struct {
+	Language  string // The language
+	Namespace string // The namespace of the frequency list (empty for posted lists)
+	Words     int    // Number of words to look up
+}
+
+// Variant is a lexicon entry with its modern form.
+type Variant struct {
+	Suggestion string // The historical spelling
+	Modern     string // The modern lexicon entry
+	Dict       string // Name of the lexicon
 }
 
 // Token is a unique token to identify background profiling
@@ -32,14 +135,688 @@ func (t Token) String() string {
 type Profile struct {
 	Profile  gofiler.Profile // The profile
 	Token    Token           // The profiling token id
-	Language string          // The language
+	Language string          // The language (the fallback language if Requested is set)
+	Checksum string          // Checksum of the language configuration
 	Status   string          // Status string of the profiling
+	Phase    string          // queued, running, postprocessing or done
+	Elapsed  float64         // Seconds since the job was submitted
 	Done     bool            // True if the profiling has finished
+	Partial  bool            // True if Profile holds the finished chunks of a running job (partial=true)
+
+	Preprocessing *Preprocessing        // Changes of the preprocessing hook (nil if not used)
+	Positions     map[string][]Position `json:",omitempty"` // Positions of the tokens of each entry (if given in the Request)
+	Segments      []Segment             `json:",omitempty"` // Segments of the Request with their words
+	Skipped       map[string]string     `json:",omitempty"` // Tokens that bypassed the profiler and their skip rule
+	Warnings      []string              `json:",omitempty"` // Warnings of the profiler (e.g. unknown characters)
+	Classes       map[string]string     `json:",omitempty"` // Class of each entry (see ClassLexicon)
+	Summary       *Summary              `json:",omitempty"` // Quality summary of the document (finished profiles only)
+	Timeline      []JobEvent            `json:",omitempty"` // Lifecycle events of the job
+	Requested     string                `json:",omitempty"` // The requested language if a fallback language was used
+	Backend       string                `json:",omitempty"` // The backend that served the job (default or canary)
+
+	Signature          string // Base64 encoded signature of finished profiles
+	SignatureAlgorithm string // hmac-sha256 or ed25519
+}
+
+// Classes of the entries of a profile.  The class is derived from
+// the patterns of the best candidate of the entry.
+const (
+	ClassLexicon    = "lexicon"    // The word is in the lexicon
+	ClassHistorical = "historical" // Historical spelling variant of a word in the lexicon
+	ClassOCRError   = "ocr-error"  // Probable OCR error
+	ClassUnknown    = "unknown"    // No candidates (unknown words and names)
+	ClassVerified   = "verified"   // The word is in the whitelist of the corpus
+)
+
+// Summary is the quality summary of a profiled document.  Tokens are
+// counted by the classes of their entries.  Imported profiles count
+// every entry once.
+type Summary struct {
+	Tokens     int            // Number of profiled tokens
+	Lexicon    int            // Tokens in the lexicon
+	Historical int            // Historical variants
+	Suspicious int            // Probable OCR errors
+	Unknown    int            // Tokens without candidates
+	Verified   int            // Whitelisted tokens
+	Coverage   float64        // (Lexicon + Historical + Verified) / Tokens
+	ErrorRate  float64        // Estimated OCR error rate (based on the weights of the candidates with OCR patterns)
+	Patterns   []PatternCount `json:",omitempty"` // The most frequent OCR error patterns of the suspicious tokens
+}
+
+// PatternCount is the number of tokens with a pattern.
+type PatternCount struct {
+	Left   string // The true characters
+	Right  string // The characters in the OCR
+	Tokens int    // Number of tokens
+}
+
+// Preprocessing records the transformation of the tokens by the
+// preprocessing hook of the daemon.
+type Preprocessing struct {
+	Tokens  int // Number of submitted tokens
+	Result  int // Number of profiled tokens
+	Changed int // Number of changed, inserted or deleted tokens
+}
+
+// SignaturePayload returns the signed data of a profile.  It is the
+// JSON encoding of the profile with an empty Signature.
+func SignaturePayload(p Profile) ([]byte, error) {
+	p.Signature = ""
+	return json.Marshal(p)
+}
+
+// SigningKey is the public key to verify the signatures of profiles.
+// It is the result for any [GET] signing-key request.
+type SigningKey struct {
+	Algorithm string // The signature algorithm
+	PublicKey string // Base64 encoded public key
+}
+
+// Headers of webhook deliveries.  The delivery ID increases
+// monotonically and stays the same for all attempts of a delivery, so
+// receivers can discard replayed deliveries.  The signature is the hex
+// encoded HMAC-SHA256 of the WebhookSignaturePayload with the secret
+// of -webhook-secret (sha256=HEX).
+const (
+	HeaderWebhookDelivery    = "X-Webhook-Delivery"     // ID of the delivery
+	HeaderWebhookTimestamp   = "X-Webhook-Timestamp"    // Unix time of the attempt
+	HeaderWebhookAttempt     = "X-Webhook-Attempt"      // Number of the attempt (starting with 1)
+	HeaderWebhookMaxAttempts = "X-Webhook-Max-Attempts" // Maximal number of attempts
+	HeaderWebhookSignature   = "X-Webhook-Signature"    // Signature of the delivery
+)
+
+// WebhookSignaturePayload returns the signed data of a webhook
+// delivery: TIMESTAMP.DELIVERY.BODY
+func WebhookSignaturePayload(timestamp, delivery string, body []byte) []byte {
+	payload := make([]byte, 0, len(timestamp)+len(delivery)+len(body)+2)
+	payload = append(payload, timestamp...)
+	payload = append(payload, '.')
+	payload = append(payload, delivery...)
+	payload = append(payload, '.')
+	return append(payload, body...)
+}
+
+// WebhookTest is the post data structure of [POST] webhooks/test.  A
+// test event is delivered to the URL.
+type WebhookTest struct {
+	URL string // The URL of the receiver
+}
+
+// DeadLetter is a webhook delivery that failed all its attempts.  Dead
+// letters are listed with [GET] webhooks/dead-letters and delivered
+// again with [POST] webhooks/dead-letters/{delivery}.
+type DeadLetter struct {
+	Delivery uint64          // ID of the delivery
+	URL      string          // The URL of the receiver
+	Payload  json.RawMessage // The delivered data
+	Attempts int             // Number of failed attempts
+	Error    string          // Error of the last attempt
+	Failed   time.Time       // Time of the last attempt
+}
+
+// DeadLetters is the result of a [GET] webhooks/dead-letters request.
+// The dead letters are ordered by their delivery ID.
+type DeadLetters struct {
+	Letters []DeadLetter
+	Dropped int // Number of dead letters dropped since the start
+}
+
+// WebhookTestResult is the result of a [POST] webhooks/test request.
+type WebhookTestResult struct {
+	URL      string // The URL of the receiver
+	Delivery uint64 // ID of the delivery
+	Signed   bool   // True if the delivery was signed
+	Status   int    `json:",omitempty"` // HTTP status of the receiver
+	Error    string `json:",omitempty"` // Error of the delivery
 }
 
 // Request is the post data structure to order a document
 // profile.
 type Request struct {
-	Language string          // The language of the document
-	Tokens   []gofiler.Token // Tokens of the document to profile
+	ID             string          `json:",omitempty"` // Optional client-supplied token of at least -token-length characters (resubmissions return the existing job)
+	Language       string          // The language of the document
+	Checksum       string          // Optional expected checksum of the language configuration
+	Group          string          // Optional ID of the job group
+	Rerank         bool            // Re-rank the candidates using the language model of the language
+	Corpus         string          // Optional namespace of the frequency list and feedback to boost candidates
+	MaxParallelism int             // Optional number of parallel profiler processes (bounded by the daemon)
+	Checkpoint     bool            // Profile in chunks and resume from the last finished chunk after failures
+	MaxCandidates  int             // Optional maximal number of candidates per entry
+	Fallback       bool            // Use the fallback language if the language is unavailable
+	Lowercase      bool            // Profile the lowercased tokens
+	PreserveCase   bool            // Apply the capitalization of the OCR tokens to the suggestions (not with Lowercase)
+	SentenceCase   bool            // Lowercase capitalized tokens at the beginning of sentences
+	Reprofile      int             // Re-profile the uncorrected tokens after this many corrections of the job (0 uses the daemon's default, negative disables)
+	Keep           bool            // Keep the finished profile in the profile repository ([GET] profiles)
+	Labels         []string        `json:",omitempty"` // Optional labels of the kept profile
+	Retention      string          `json:",omitempty"` // Retention of the kept profile (RetentionForever, RetentionUntilFetched or days like 30d)
+	Skip           []string        `json:",omitempty"` // Rules of tokens that bypass the profiler (see SkipNumbers or regular expressions)
+	Priority       string          `json:",omitempty"` // Priority of the job (PriorityHigh or PriorityNormal, the default); high only for namespaces with priority high
+	Tokens         []gofiler.Token // Tokens of the document to profile
+	Positions      []Position      `json:",omitempty"` // Optional positions of the tokens (in the order of Tokens)
+	Segments       []Segment       `json:",omitempty"` // Optional lines or sentences of the tokens
+}
+
+// Segment groups consecutive tokens of a request into a line or a
+// sentence.  Re-ranking does not use context across the boundaries
+// of segments.  The segments of a request are returned with the
+// finished profile.
+type Segment struct {
+	ID     string   `json:",omitempty"` // Optional ID of the segment (e.g. of an ALTO or PAGE TextLine)
+	Type   string   `json:",omitempty"` // SegmentLine or SegmentSentence
+	Start  int      // Index of the first token of the segment
+	Length int      // Number of tokens of the segment
+	Words  []string `json:",omitempty"` // OCR of the tokens of the segment (profiles only)
+}
+
+// Priorities of jobs.  If the daemon is overloaded (more jobs than
+// -soft-max-jobs), only jobs with high priority are accepted.
+const (
+	PriorityHigh   = "high"   // Interactive jobs
+	PriorityNormal = "normal" // Batch jobs
+)
+
+// Built-in skip rules.  Other skip rules are regular expressions that
+// must match the whole token.
+const (
+	SkipNumbers       = "numbers"       // Numbers (e.g. 1648, 3. or 1,5)
+	SkipRoman         = "roman"         // Roman numerals (e.g. XIV or iij.)
+	SkipSingle        = "single"        // Single characters
+	SkipAbbreviations = "abbreviations" // Abbreviations with trailing period (e.g. Dr. or z.B.)
+)
+
+// Types of segments.
+const (
+	SegmentLine     = "line"
+	SegmentSentence = "sentence"
+)
+
+// Validation is the result of a [POST] profile/validate request.
+// The request was checked like a [POST] profile request, but no job
+// was submitted.
+type Validation struct {
+	Request  Request  // The normalized request
+	Estimate Estimate // Estimated cost of the job
+}
+
+// Estimate is the estimated cost of a job.  It is based on the cost
+// of previous jobs of the same language.
+type Estimate struct {
+	Known        bool    // False if there were no previous jobs of the language
+	Seconds      float64 // Estimated run time in seconds
+	Memory       uint64  // Estimated peak memory in bytes
+	Observations int     // Number of previous jobs the estimate is based on
+}
+
+// EstimateRequest is the post data structure to estimate the cost of
+// a job: [POST] estimate.  The estimate is based on the number of
+// tokens or, if Tokens is 0, on the number of types.
+type EstimateRequest struct {
+	Language string // The language of the document
+	Tokens   int    // Number of tokens of the document
+	Types    int    // Number of distinct tokens of the document
+}
+
+// Position is the position of a token in the document.  Positions
+// are carried through unchanged into the Positions of the Profile.
+type Position struct {
+	ID     string `json:",omitempty"` // ID of the token
+	Page   int    `json:",omitempty"` // Page number
+	Line   int    `json:",omitempty"` // Line number
+	Offset int    `json:",omitempty"` // Offset of the token in the line
+}
+
+// UnmarshalJSON decodes a request.  The position of a token may be
+// given as ID, Page, Line and Offset fields of the token itself
+// instead of the Positions of the request.  Instead of Tokens, the
+// tokens may be given as Tokens of the Segments of the request.
+func (r *Request) UnmarshalJSON(data []byte) error {
+	return r.Decode(data, json.Unmarshal)
+}
+
+// Decode decodes a request using the given unmarshal function.  It
+// can be used to decode requests with a faster JSON implementation
+// that is compatible with encoding/json.
+func (r *Request) Decode(data []byte, unmarshal func([]byte, interface{}) error) error {
+	type request Request // without the UnmarshalJSON method
+	type token struct {
+		gofiler.Token
+		Position
+	}
+	var aux struct {
+		request
+		Tokens   []token
+		Segments []struct {
+			Segment
+			Tokens []token
+		}
+	}
+	if err := unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*r = Request(aux.request)
+	nested := false
+	for _, s := range aux.Segments {
+		nested = nested || len(s.Tokens) > 0
+	}
+	if nested && len(aux.Tokens) > 0 {
+		return errors.New("tokens given in Tokens and Segments")
+	}
+	for _, s := range aux.Segments {
+		if nested {
+			s.Start, s.Length = len(aux.Tokens), len(s.Tokens)
+			aux.Tokens = append(aux.Tokens, s.Tokens...)
+		}
+		r.Segments = append(r.Segments, s.Segment)
+	}
+	r.Tokens = make([]gofiler.Token, len(aux.Tokens))
+	inline := false
+	for i, t := range aux.Tokens {
+		r.Tokens[i] = t.Token
+		if t.Position != (Position{}) {
+			inline = true
+		}
+	}
+	if inline {
+		r.Positions = make([]Position, len(aux.Tokens))
+		for i, t := range aux.Tokens {
+			r.Positions[i] = t.Position
+		}
+	}
+	return nil
+}
+
+// Error is the response body of failed requests.
+type Error struct {
+	Status     int      // The HTTP status code
+	Message    string   // Description of the error
+	RequestID  string   // The ID of the failed request
+	Candidates []string `json:",omitempty"` // Conflicting language configurations
+	Reason     string   `json:",omitempty"` // Why jobs are refused (draining, at capacity or overloaded)
+	RetryAfter int      `json:",omitempty"` // Suggested delay in seconds before retrying (also sent as Retry-After)
+
+	Submission *Submission    `json:",omitempty"` // Existing job of a conflicting client-supplied ID
+	Invalid    []InvalidToken `json:",omitempty"` // Tokens with characters the language cannot handle
+}
+
+// InvalidToken is a token of a request with characters that are not
+// in the alphabet of the language.
+type InvalidToken struct {
+	Index      int       // Index of the token in the Tokens of the request
+	OCR        string    // The token
+	Characters string    // The invalid characters of the token
+	Position   *Position `json:",omitempty"` // Position of the token (if given in the request)
+}
+
+// Submission describes the submission of an existing job.
+type Submission struct {
+	Token     Token     // The token of the job
+	Hash      string    // Hash of the submitted request
+	Submitted time.Time // Time of the submission
+}
+
+// Readiness is the result of a [GET] ready request of a daemon that
+// accepts new jobs.  Otherwise the request fails with an Error.
+type Readiness struct {
+	Ready bool // True if the daemon accepts new jobs
+}
+
+// DeletionReport lists everything that was removed by a [DELETE]
+// jobs request.
+type DeletionReport struct {
+	Owner        string   `json:",omitempty"` // The address whose data was removed
+	Namespace    string   `json:",omitempty"` // The namespace whose data was removed
+	Token        string   `json:",omitempty"` // The token of the removed job
+	Jobs         []string // The tokens of all removed jobs
+	SharedJobs   []string // The tokens of the jobs removed from the shared store (-redis)
+	AuditRecords int      // Number of removed audit log records
+	KeptProfiles []string // The IDs of the removed kept profiles
+	DeadLetters  []uint64 // The deliveries of the removed dead letters
+	Lookups      int      // Number of removed cached lookups
+	Feedback     []string // The namespaces whose feedback was removed
+	UsageRecords int      // Number of removed usage records
+}
+
+// Stats holds the statistics of the daemon.  It is the result for any
+// [GET] stats request.  All durations are given in seconds.
+type Stats struct {
+	Uptime    float64        // Uptime of the daemon
+	Jobs      JobCounts      // Number of jobs by state since startup
+	Languages map[string]int // Number of finished jobs per language
+	Windows   []WindowStats  // Statistics over rolling time windows
+	Cache     CacheStats     // Statistics of the lookup cache
+	Usage     []UsageRecord  `json:",omitempty"` // Usage of the current month
+}
+
+// UsageRecord is the usage of a namespace (identified by its key) for
+// a language in a calendar month (UTC).  Requests without a namespace
+// are accounted for the empty namespace.
+type UsageRecord struct {
+	Namespace string // Name of the namespace
+	Month     string // The month (2006-01)
+	Language  string // Language of the jobs
+	Jobs      int    // Number of successfully finished jobs
+	Tokens    int    // Number of profiled tokens
+}
+
+// UsageReport is the result of a [GET]
+// usage?month=MONTH&namespace=NAMESPACE&language=LANGUAGE request.  The
+// records are ordered by month, namespace and language.
+type UsageReport struct {
+	Records []UsageRecord
+	Jobs    int // Total number of jobs of the records
+	Tokens  int // Total number of tokens of the records
+}
+
+// JobCounts counts jobs by their state.
+type JobCounts struct {
+	Submitted int // Accepted jobs
+	Rejected  int // Jobs rejected because the daemon was busy
+	Running   int // Jobs with a running profiler
+	Pending   int // Finished jobs that were not fetched yet
+	Done      int // Successfully finished jobs
+	Failed    int // Failed jobs
+}
+
+// Scale is the load of the daemon.  It is meant as external metric
+// for autoscalers: [GET] scale
+type Scale struct {
+	Jobs        int     // Number of jobs in the job map
+	Queued      int     // Jobs waiting for the profiler
+	Running     int     // Jobs with a running profiler
+	Pending     int     // Finished jobs that were not fetched yet
+	Capacity    int     // Maximal number of jobs
+	Utilization float64 // (Queued + Running) / Capacity
+	Backlog     float64 // Estimated seconds to finish all queued and running jobs
+}
+
+// WindowStats holds the statistics of the jobs that finished within
+// a rolling time window.
+type WindowStats struct {
+	Window      string                   // Length of the window (e.g. 24h)
+	Jobs        int                      // Number of finished jobs
+	Failed      int                      // Number of failed jobs
+	FailureRate float64                  // Failed / Jobs
+	Languages   map[string]LanguageStats // Statistics per language
+}
+
+// LanguageStats holds the statistics of finished jobs for one
+// language.
+type LanguageStats struct {
+	Jobs         int     // Number of finished jobs
+	Failed       int     // Number of failed jobs
+	FailureRate  float64 // Failed / Jobs
+	MeanDuration float64 // Mean run time
+	P50Duration  float64 // Median run time
+	P90Duration  float64 // 90th percentile of the run time
+	P99Duration  float64 // 99th percentile of the run time
+}
+
+// Extension is the patch data structure to extend the deadlines of a
+// running profiling job: [PATCH] profile?token=Token.ID
+type Extension struct {
+	ExtendBy string // Duration to add to the deadlines (e.g. 15m)
+}
+
+// Deadlines are the deadlines of a profiling job.  It is the result
+// for any [PATCH] profile request.
+type Deadlines struct {
+	Token    Token     // The profiling token
+	Timeout  time.Time // Jobs without progress are canceled after the timeout
+	Deadline time.Time // Jobs are canceled after the deadline (zero if unlimited)
+}
+
+// TokenList is the post data structure for bulk requests on many
+// profiling jobs at once: [POST] profile/status, [POST]
+// profile/cancel and [POST] profile/ack
+type TokenList struct {
+	Tokens []Token // The tokens of the jobs
+}
+
+// Statuses is the result for any [POST] profile/status request.  It
+// contains the status of each requested job in the order of the
+// request.
+type Statuses struct {
+	Statuses []Status
+}
+
+// Status is the status of a profiling job.  Querying the status does
+// not fetch the profile.
+type Status struct {
+	Token   Token   // The profiling token
+	Found   bool    // False if there is no job for the token
+	Status  string  // Status string of the profiling
+	Phase   string  // queued, running, postprocessing or done
+	Elapsed float64 // Seconds since the job was submitted
+	Done    bool    // True if the profile can be fetched
+
+	Invocation *Invocation `json:",omitempty"` // How the profiler is invoked for the job
+	Timeline   []JobEvent  `json:",omitempty"` // Lifecycle events of the job
+}
+
+// JobEvent is a timestamped lifecycle event of a job: received,
+// queued, started, first-output, finished, failed or fetched.
+type JobEvent struct {
+	Event string    // Name of the event
+	Time  time.Time // Time of the event
+}
+
+// Profiler is the profiler executable of new jobs: [GET] profiler.
+// Only the Executable is needed to replace it: [PUT] profiler.
+type Profiler struct {
+	Executable string            // Absolute path to the profiler executable
+	Checksum   string            // Checksum of the executable
+	Languages  map[string]string `json:",omitempty"` // Executables of languages with their own profiler
+}
+
+// Invocation records how the profiler is invoked for a job.
+type Invocation struct {
+	Command  []string // Profiler executable and its arguments
+	Env      []string `json:",omitempty"` // Relevant environment variables (KEY=VALUE)
+	Checksum string   // Checksum of the language configuration
+	Binary   string   // Checksum of the profiler executable
+	Gofiler  string   // Version of the gofiler library
+	Sandbox  bool     `json:",omitempty"` // True if the profiler runs in a sandbox
+}
+
+// Removed is the result for any [POST] profile/cancel or [POST]
+// profile/ack request.
+type Removed struct {
+	Removed  []Token // Removed jobs
+	Skipped  []Token // Jobs that were not removed (still running)
+	NotFound []Token // Tokens without jobs
+}
+
+// GroupRequest is the post data structure to create a new job
+// group: [POST] groups
+type GroupRequest struct {
+	Callback string // Optional URL that gets the Group posted once it is done
+}
+
+// Group is a group of profiling jobs.  Jobs are added to a group with
+// the Group field of their Request.  A group is done if it was closed
+// ([POST] groups/close?id=Group.ID) and all of its jobs are finished.
+// It is the result for any [POST] groups, [GET] groups?id=Group.ID
+// and [POST] groups/close?id=Group.ID request.
+type Group struct {
+	ID     string     // Unique ID of the group
+	Closed bool       // True if no more jobs can be added
+	Done   bool       // True if the group is closed and all jobs are finished
+	Jobs   []GroupJob // The jobs of the group
+}
+
+// GroupJob is the state of a job in a group.
+type GroupJob struct {
+	Token  Token  // The profiling token
+	Phase  string // queued, running, postprocessing, done or removed
+	Failed bool   // True if the job failed
+	Error  string // The error of failed jobs
+}
+
+// Event is a job lifecycle event that is published to the
+// notification backend.
+type Event struct {
+	Time     time.Time // Time of the event
+	Event    string    // submitted, preempted, requeued, done, failed, group-done, reprofiled or test
+	Token    string    `json:",omitempty"` // The profiling token
+	Language string    `json:",omitempty"` // Language of the job
+	Group    string    `json:",omitempty"` // Group of the job
+	Error    string    `json:",omitempty"` // The error of failed jobs
+	Source   string    `json:",omitempty"` // The job whose feedback triggered the job (reprofiled)
+}
+
+// FrequencyList is the list of word frequencies of a corpus.  It is
+// used to boost the candidates of requests with the according Corpus:
+// [GET|PUT|DELETE] frequencies?namespace=Namespace
+type FrequencyList struct {
+	Namespace   string         // Name of the corpus
+	Frequencies map[string]int // Frequencies of the (case insensitive) forms
+}
+
+// Whitelist is the list of known-good tokens of a corpus (e.g. proper
+// names and recurring abbreviations).  Whitelisted tokens of requests
+// with the according Corpus bypass the profiler and are marked as
+// verified: [GET|PUT|DELETE] whitelist?namespace=Namespace
+type Whitelist struct {
+	Namespace string   // Name of the corpus
+	Tokens    []string // The (case insensitive) tokens
+}
+
+// WhitelistChanges is the post data structure to edit a whitelist:
+// [POST] whitelist?namespace=NAMESPACE
+type WhitelistChanges struct {
+	Add    []string `json:",omitempty"` // Tokens to add
+	Remove []string `json:",omitempty"` // Tokens to remove
+}
+
+// Feedback is the post data structure to report corrections that were
+// accepted by the users: [POST] feedback?namespace=NAMESPACE.  The
+// accepted candidates are boosted in later profiles of requests with
+// the according Corpus.
+type Feedback struct {
+	Corrections []Correction
+}
+
+// Correction is an accepted correction of an OCR token.
+type Correction struct {
+	OCR        string // The OCR token
+	Correction string // The accepted candidate
+}
+
+// JobFeedback is the response of [POST] jobs/{token}/feedback.  The
+// corrections are recorded for the Corpus of the job.  Once Accepted
+// reaches the Threshold, the uncorrected tokens of the job are
+// re-profiled in a new job.
+type JobFeedback struct {
+	Token     Token  // The token of the job
+	Recorded  int    // Number of recorded corrections
+	Accepted  int    // Number of accepted corrections of the job
+	Threshold int    // Number of corrections that trigger the re-profiling
+	Reprofile *Token `json:",omitempty"` // The job that re-profiles the uncorrected tokens
+}
+
+// ProfileInfo describes a profile of the profile repository.
+type ProfileInfo struct {
+	ID        string     // ID of the profile (the token of its job)
+	Language  string     // The language of the profile
+	Checksum  string     // Checksum of the language configuration
+	Labels    []string   `json:",omitempty"` // Labels of the profiling request
+	Namespace string     `json:",omitempty"` // Namespace of the submitting client
+	Created   time.Time  // Time the profile was kept
+	Retention string     // The retention class of the profile
+	Expires   *time.Time `json:",omitempty"` // Time the profile is removed (if its retention is a duration)
+	Tokens    int        // Number of profiled tokens
+	Entries   int        // Number of entries of the profile
+}
+
+// Retention classes of kept profiles.  Other retention classes are
+// durations in days (e.g. 30d).
+const (
+	RetentionForever      = "forever"       // Keep the profile until it is deleted
+	RetentionUntilFetched = "until-fetched" // Remove the profile once it was fetched from the repository
+)
+
+// GCReport is the result of [GET|POST] repository/gc requests.  A
+// POST request runs the garbage collection of the profile repository.
+type GCReport struct {
+	Profiles    int            // Number of stored profiles
+	ByRetention map[string]int // Number of stored profiles by retention class
+	Expired     int            // Number of expired profiles that were not removed yet
+	Removed     int            // Number of profiles removed since the start of the daemon
+	LastRun     *time.Time     `json:",omitempty"` // Time of the last garbage collection
+	RemovedIDs  []string       `json:",omitempty"` // Profiles removed by this request
+}
+
+// StoredProfile is a profile of the profile repository:
+// [GET|DELETE] profiles/{id}
+type StoredProfile struct {
+	ProfileInfo
+	Profile gofiler.Profile // The profile
+	Summary *Summary        `json:",omitempty"` // Quality summary of the document
+}
+
+// ProfileList is the result of a [GET] profiles request.  The profiles
+// are ordered by the time they were kept.
+type ProfileList struct {
+	Profiles []ProfileInfo
+}
+
+// SearchResult is the result of a [GET] profiles/search request.
+type SearchResult struct {
+	Query     string      // The (lower case) query
+	Hits      []SearchHit // Matching entries of the stored profiles
+	Truncated bool        // True if there are more hits than the limit
+}
+
+// SearchHit is an entry of a stored profile that matches a search.
+type SearchHit struct {
+	ID    string                 // ID of the stored profile
+	Entry gofiler.Interpretation // The matching entry
+}
+
+// MergeRequest is the post data structure of [POST] profiles/merge.
+// The profiles of the previous and the current adaptive round of a
+// document are given inline or as IDs of kept profiles.
+type MergeRequest struct {
+	Previous    gofiler.Profile `json:",omitempty"` // Profile of the previous round
+	PreviousID  string          `json:",omitempty"` // ID of the kept profile of the previous round
+	Current     gofiler.Profile `json:",omitempty"` // Profile of the current round
+	CurrentID   string          `json:",omitempty"` // ID of the kept profile of the current round
+	Corrections []Correction    `json:",omitempty"` // Accepted corrections of the document
+}
+
+// MergedProfile is the consolidated profile of two adaptive rounds.
+// Entries of the current round replace the entries of the previous
+// round and entries with an accepted correction keep the correction
+// as their only candidate.
+type MergedProfile struct {
+	Profile   gofiler.Profile    // The merged profile
+	Classes   map[string]string  `json:",omitempty"` // Class of each entry (see ClassLexicon)
+	Corrected map[string]string  `json:",omitempty"` // OCR token -> accepted correction
+	Changed   []SuggestionChange `json:",omitempty"` // Entries whose best suggestion changed
+}
+
+// SuggestionChange is an entry whose best suggestion changed between
+// two adaptive rounds.
+type SuggestionChange struct {
+	OCR      string // The OCR token
+	Previous string // Best suggestion of the previous round
+	Current  string // Best suggestion of the current round
+}
+
+// AdaptiveState is the accumulated feedback of a corpus:
+// [GET|DELETE] adaptive?namespace=NAMESPACE.  Every new profile of
+// requests with the according Corpus profits from the corrections and
+// the OCR error patterns learned from them.
+type AdaptiveState struct {
+	Namespace   string         // Name of the corpus
+	Corrections int            // Number of accepted corrections
+	Forms       int            // Number of corrected OCR tokens
+	Patterns    []PatternCount `json:",omitempty"` // Learned OCR error patterns with the number of corrections
+}
+
+// FeedbackReport is the response of [POST] feedback.
+type FeedbackReport struct {
+	Namespace string // Name of the corpus
+	Recorded  int    // Number of recorded corrections
 }
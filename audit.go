@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// auditRecord is one line of the audit log.  It never contains the
+// content of the profiled documents.
+type auditRecord struct {
+	Time      time.Time
+	Event     string // submitted, rejected, imported, done, failed or purged
+	Job       string `json:",omitempty"`
+	Language  string
+	Tokens    int
+	RemoteIP  string
+	Namespace string `json:",omitempty"`
+	RequestID string
+	Error     string `json:",omitempty"`
+
+	Invocation *api.Invocation `json:",omitempty"` // Only for submitted records
+}
+
+var auditLog struct {
+	path string
+	file *os.File
+	enc  *json.Encoder
+	l    sync.Mutex
+}
+
+// Open the audit log.  Records are only appended, except for the
+// records that are removed by purges (see purgeJobs).
+func openAuditLog(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	auditLog.path = path
+	auditLog.file = f
+	auditLog.enc = json.NewEncoder(f)
+	return nil
+}
+
+// Remove all records that match the given predicate from the audit
+// log.  The log is rewritten to a temporary file that replaces the
+// old log.  Returns the removed records.
+func purgeAuditLog(match func(auditRecord) bool) ([]auditRecord, error) {
+	auditLog.l.Lock()
+	defer auditLog.l.Unlock()
+	if auditLog.enc == nil {
+		return nil, nil
+	}
+	in, err := os.Open(auditLog.path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read audit log: %v", err)
+	}
+	defer in.Close()
+	tmp := auditLog.path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write audit log: %v", err)
+	}
+	defer out.Close()
+	var removed []auditRecord
+	dec := json.NewDecoder(in)
+	enc := json.NewEncoder(out)
+	for {
+		var rec auditRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read audit log: %v", err)
+		}
+		if match(rec) {
+			removed = append(removed, rec)
+			continue
+		}
+		if err := enc.Encode(rec); err != nil {
+			return nil, fmt.Errorf("cannot write audit log: %v", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		return nil, fmt.Errorf("cannot write audit log: %v", err)
+	}
+	if err := os.Rename(tmp, auditLog.path); err != nil {
+		return nil, fmt.Errorf("cannot replace audit log: %v", err)
+	}
+	auditLog.file.Close()
+	f, err := os.OpenFile(auditLog.path, os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		auditLog.enc = nil
+		return removed, fmt.Errorf("cannot reopen audit log: %v", err)
+	}
+	auditLog.file = f
+	auditLog.enc = json.NewEncoder(f)
+	return removed, nil
+}
+
+// Write an audit record for the given job event.  Does nothing if no
+// audit log is used.
+func auditJob(event, id string, request submission, err error) {
+	auditLog.l.Lock()
+	defer auditLog.l.Unlock()
+	if auditLog.enc == nil {
+		return
+	}
+	rec := auditRecord{
+		Time:      time.Now(),
+		Event:     event,
+		Job:       id,
+		Language:  request.Language,
+		Tokens:    len(request.Tokens),
+		RemoteIP:  request.remoteIP,
+		Namespace: request.namespace,
+		RequestID: request.requestID,
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	if event == "submitted" {
+		rec.Invocation = request.invocation
+	}
+	if err := auditLog.enc.Encode(rec); err != nil {
+		log.Errorf("cannot write audit log: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Accept only requests authenticated with the admin key as bearer
+// token.  If no admin key is configured, all administrative requests
+// are forbidden.
+func withAdmin(
+	h func(http.ResponseWriter, *http.Request) interface{},
+) func(http.ResponseWriter, *http.Request) interface{} {
+	return func(w http.ResponseWriter, r *http.Request) interface{} {
+		if adminKey == "" {
+			return http.StatusForbidden
+		}
+		if subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(adminKey)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return http.StatusUnauthorized
+		}
+		return h(w, r)
+	}
+}
+
+// Check if the request is authenticated with the admin key or with
+// the key of a namespace.
+func authenticated(r *http.Request) bool {
+	if bearerToken(r) == "" {
+		return false
+	}
+	ns, ok := findNamespace(r)
+	return ok && (ns != nil || isAdmin(r))
+}
+
+// Check if the request is authenticated with the admin key.
+func isAdmin(r *http.Request) bool {
+	return adminKey != "" &&
+		subtle.ConstantTimeCompare([]byte(bearerToken(r)), []byte(adminKey)) == 1
+}
+
+// Check if the routes with the path segments require authentication.
+// The -auth-required flag lists path prefixes (e.g. /profile,/jobs)
+// or all.
+func requiresAuth(segments []string) bool {
+	path := "/" + strings.Join(segments, "/")
+	for _, prefix := range strings.Split(authRequired, ",") {
+		if prefix = strings.TrimSpace(prefix); prefix == "" {
+			continue
+		}
+		prefix = "/" + strings.Trim(prefix, "/")
+		if prefix == "/all" || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the bearer token of the request's Authorization header.
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// Check if the client of the request may access the job.  Jobs of a
+// namespace are only accessible with the key of the namespace or with
+// the admin key.  Jobs of anonymous clients are accessible by anyone
+// who knows their token.
+func mayAccess(r *http.Request, id string) bool {
+	owner := jobNamespace(id)
+	if owner == "" {
+		return true
+	}
+	if isAdmin(r) {
+		return true
+	}
+	ns, ok := findNamespace(r)
+	return ok && ns != nil && ns.name == owner
+}
+
+// Return the namespace of the client that submitted the job.
+func jobNamespace(id string) string {
+	if j, ok := jobs.get(id); ok {
+		return j.namespace
+	}
+	if rec, ok := getSharedJob(id); ok {
+		return rec.Namespace
+	}
+	return ""
+}
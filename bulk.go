@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Return the status of many jobs at once.  The profiles of finished
+// jobs are not fetched.  Jobs of other namespaces are not found.
+func getStatuses(w http.ResponseWriter, r *http.Request) interface{} {
+	var req api.TokenList
+	if err := decodeBody(r, &req); err != nil {
+		return decodeError(err)
+	}
+	res := api.Statuses{Statuses: make([]api.Status, len(req.Tokens))}
+	for i, token := range req.Tokens {
+		if !mayAccess(r, token.ID) {
+			res.Statuses[i] = api.Status{Token: token}
+			continue
+		}
+		res.Statuses[i] = jobStatus(token, locale(r.Context()))
+	}
+	return res
+}
+
+func jobStatus(token api.Token, lang string) api.Status {
+	job, ok := jobs.get(token.ID)
+	if !ok {
+		return api.Status{Token: token}
+	}
+	phase := job.state.getPhase()
+	elapsed := time.Since(job.start)
+	status := doneStatus(lang)
+	if phase != phaseDone {
+		status = statusProvider()(phaseNames[phase], elapsed, lang)
+	}
+	return api.Status{
+		Token:   token,
+		Found:   true,
+		Status:  status,
+		Phase:   phaseNames[phase],
+		Elapsed: elapsed.Seconds(),
+		Done:    phase == phaseDone,
+
+		Invocation: job.invocation,
+		Timeline:   job.state.events(),
+	}
+}
+
+// Cancel many jobs at once.  Running jobs are canceled, finished jobs
+// are deleted together with their profiles.
+func cancelJobs(w http.ResponseWriter, r *http.Request) interface{} {
+	return removeJobs(r, func(job) bool { return true })
+}
+
+// Acknowledge many jobs at once.  The profiles of finished jobs are
+// deleted.  Running jobs are skipped.
+func ackJobs(w http.ResponseWriter, r *http.Request) interface{} {
+	return removeJobs(r, func(j job) bool {
+		_, finished := j.state.finishedAt()
+		return finished
+	})
+}
+
+func removeJobs(r *http.Request, match func(job) bool) interface{} {
+	var req api.TokenList
+	if err := decodeBody(r, &req); err != nil {
+		return decodeError(err)
+	}
+	ids := make(map[string]bool, len(req.Tokens))
+	for _, token := range req.Tokens {
+		ids[token.ID] = mayAccess(r, token.ID)
+	}
+	removed := make(map[string]bool)
+	for _, id := range jobs.purge(func(id string, j job) bool {
+		return ids[id] && match(j)
+	}) {
+		removed[id] = true
+	}
+	var res api.Removed
+	for _, token := range req.Tokens {
+		if removed[token.ID] {
+			res.Removed = append(res.Removed, token)
+		} else if _, ok := jobs.get(token.ID); ok && ids[token.ID] {
+			res.Skipped = append(res.Skipped, token)
+		} else {
+			res.NotFound = append(res.NotFound, token)
+		}
+	}
+	log.Infof("removed %d jobs", len(res.Removed))
+	return res
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+)
+
+// Add caching headers (Cache-Control and Expires) to the successful
+// responses of the handler.  Responses are cached for maxAge (no
+// headers are added if maxAge is 0).  Responses to authorized requests
+// are only cached privately.
+func withCache(
+	maxAge time.Duration,
+	h func(http.ResponseWriter, *http.Request) interface{},
+) func(http.ResponseWriter, *http.Request) interface{} {
+	return func(w http.ResponseWriter, r *http.Request) interface{} {
+		x := h(w, r)
+		if cacheable(x) {
+			private := r.Header.Get("Authorization") != ""
+			setCacheHeaders(w, maxAge, private, false)
+		}
+		return x
+	}
+}
+
+// Add caching headers to finished profiles.  Finished profiles never
+// change, so they are cached privately for -profile-cache-max-age and
+// marked as immutable.  Unfinished profiles must not be cached.
+func withProfileCache(
+	h func(http.ResponseWriter, *http.Request) interface{},
+) func(http.ResponseWriter, *http.Request) interface{} {
+	return func(w http.ResponseWriter, r *http.Request) interface{} {
+		x := h(w, r)
+		switch t := x.(type) {
+		case api.Profile:
+			if t.Done {
+				setCacheHeaders(w, profileCacheMaxAge, true, true)
+			} else {
+				w.Header().Set("Cache-Control", "no-store")
+			}
+		}
+		return x
+	}
+}
+
+// Return false for the results of handlers that are sent as errors.
+func cacheable(x interface{}) bool {
+	switch x.(type) {
+	case int, error, api.Error:
+		return false
+	default:
+		return true
+	}
+}
+
+func setCacheHeaders(w http.ResponseWriter, maxAge time.Duration, private, immutable bool) {
+	if maxAge <= 0 {
+		return
+	}
+	cc := "public"
+	if private {
+		cc = "private"
+	}
+	cc += ", max-age=" + strconv.FormatInt(int64(maxAge/time.Second), 10)
+	if immutable {
+		cc += ", immutable"
+	}
+	w.Header().Set("Cache-Control", cc)
+	w.Header().Set("Expires", time.Now().Add(maxAge).UTC().Format(http.TimeFormat))
+}
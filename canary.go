@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A percentage of the jobs of a language can be routed to the
+// configuration of the language in an alternative backend directory
+// (-canary german:10:/srv/backend-next).  Profiles report the backend
+// that served them (default or canary), so that updates of a backend
+// can be evaluated on live traffic.  Jobs that pin the checksum of
+// the language configuration are never routed to the canary.
+
+// Names of the backends that serve jobs.
+const (
+	backendDefault = "default"
+	backendCanary  = "canary"
+)
+
+type canary struct {
+	dir     string  // Alternative backend directory
+	percent float64 // Percentage of the jobs that are routed to dir
+}
+
+// Canary backends by language.
+var canaries map[string]canary
+
+// Parse the comma separated LANGUAGE:PERCENT:DIRECTORY triples.
+func parseCanaries(str string) (map[string]canary, error) {
+	m := make(map[string]canary)
+	for _, spec := range strings.Split(str, ",") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimSpace(spec), ":", 3)
+		if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid canary: %s", spec)
+		}
+		percent, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid canary percentage: %s", spec)
+		}
+		language := strings.ToLower(parts[0])
+		if _, ok := m[language]; ok {
+			return nil, fmt.Errorf("duplicate canary for %s", language)
+		}
+		if _, err := findLanguageIn(parts[2], language); err != nil {
+			return nil, fmt.Errorf("invalid canary %s: %v", spec, err)
+		}
+		m[language] = canary{dir: parts[2], percent: percent}
+	}
+	return m, nil
+}
+
+// Route the job to the canary backend of its language.  Returns the
+// path of the language configuration that serves the job.
+func routeCanary(config string, request *submission) string {
+	request.backend = backendDefault
+	c, ok := canaries[strings.ToLower(request.Language)]
+	if !ok || request.Checksum != "" || rand.Float64()*100 >= c.percent {
+		return config
+	}
+	lc, err := findLanguageIn(c.dir, request.Language)
+	if err != nil {
+		log.Errorf("cannot use canary of %s: %v", request.Language, err)
+		return config
+	}
+	if err := verifyLanguage(lc.Path); err != nil {
+		log.Errorf("cannot use canary of %s: %v", request.Language, err)
+		return config
+	}
+	sum, err := languageChecksum(lc.Path)
+	if err != nil {
+		log.Errorf("cannot use canary of %s: %v", request.Language, err)
+		return config
+	}
+	request.backend = backendCanary
+	request.checksum = sum
+	return lc.Path
+}
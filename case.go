@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+)
+
+// Fold the case of the tokens according to the options of the
+// request.  With Lowercase, all tokens are lowercased.  With
+// SentenceCase, the first letter of capitalized tokens at the
+// beginning of sentences is lowercased.  The profile is keyed by the
+// folded tokens.  The tokens are copied if they are changed.
+func foldCase(request api.Request, tokens []gofiler.Token) []gofiler.Token {
+	if !request.Lowercase && !request.SentenceCase {
+		return tokens
+	}
+	res := make([]gofiler.Token, len(tokens))
+	copy(res, tokens)
+	if request.Lowercase {
+		for i := range res {
+			res[i].OCR = strings.ToLower(res[i].OCR)
+			res[i].COR = strings.ToLower(res[i].COR)
+		}
+		return res
+	}
+	for i, initial := range sentenceInitial(request, tokens) {
+		if initial && capitalized(res[i].OCR) {
+			res[i].OCR = lowerFirst(res[i].OCR)
+		}
+	}
+	return res
+}
+
+// Mark the tokens at the beginning of sentences.  If the request has
+// sentence segments, the first token of each sentence is marked.
+// Otherwise the first token and every token after a token that ends
+// with '.', '!' or '?' are marked.
+func sentenceInitial(request api.Request, tokens []gofiler.Token) []bool {
+	res := make([]bool, len(tokens))
+	if len(tokens) == len(request.Tokens) {
+		found := false
+		for _, s := range request.Segments {
+			if s.Type == api.SegmentSentence && s.Length > 0 {
+				res[s.Start] = true
+				found = true
+			}
+		}
+		if found {
+			return res
+		}
+	}
+	initial := true
+	for i, t := range tokens {
+		if t.LE != "" {
+			continue
+		}
+		res[i] = initial
+		initial = strings.ContainsAny(lastRune(t.OCR), ".!?")
+	}
+	return res
+}
+
+// Apply the capitalization of the OCR of the entries to the
+// suggestions of their candidates: suggestions of upper case tokens
+// are upper cased, suggestions of capitalized tokens are capitalized.
+func preserveCase(p gofiler.Profile) {
+	for ocr, e := range p {
+		for i := range e.Candidates {
+			e.Candidates[i].Suggestion = applyCase(ocr, e.Candidates[i].Suggestion)
+		}
+	}
+}
+
+// Apply the capitalization of the pattern to the word.
+func applyCase(pattern, word string) string {
+	switch {
+	case upper(pattern):
+		return strings.ToUpper(word)
+	case capitalized(pattern):
+		r, n := utf8.DecodeRuneInString(word)
+		return string(unicode.ToUpper(r)) + word[n:]
+	default:
+		return word
+	}
+}
+
+// Return true if the word starts with an upper case letter and is not
+// upper case.
+func capitalized(word string) bool {
+	r, _ := utf8.DecodeRuneInString(word)
+	return unicode.IsUpper(r) && !upper(word)
+}
+
+// Return true if the word has at least two letters and all of them
+// are upper case.
+func upper(word string) bool {
+	letters := 0
+	for _, r := range word {
+		if unicode.IsLetter(r) {
+			if !unicode.IsUpper(r) {
+				return false
+			}
+			letters++
+		}
+	}
+	return letters > 1
+}
+
+func lowerFirst(word string) string {
+	r, n := utf8.DecodeRuneInString(word)
+	return string(unicode.ToLower(r)) + word[n:]
+}
+
+func lastRune(word string) string {
+	r, _ := utf8.DecodeLastRuneInString(word)
+	return string(r)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Jobs with checkpoints profile their tokens in chunks of
+// -checkpoint-size OCR tokens.  The request and the profile of every
+// finished chunk are stored below -data-dir/checkpoints/ID.  If the
+// profiler crashes, the failed chunk is retried once.  Jobs are
+// resumed from their checkpoints if the daemon restarts.  The
+// checkpoints are removed with the job.
+
+// checkpoint is the stored request of a job.
+type checkpoint struct {
+	Request   api.Request
+	RemoteIP  string
+	RequestID string
+	Checksum  string
+	Namespace string
+}
+
+func checkpointDir(id string) string {
+	return filepath.Join(dataDir, "checkpoints", id)
+}
+
+func chunkPath(id string, i int) string {
+	return filepath.Join(checkpointDir(id), fmt.Sprintf("chunk-%05d.json", i))
+}
+
+// Remove the checkpoints of a job if it has any.
+func removeCheckpoint(id string) {
+	if dataDir == "" {
+		return
+	}
+	if err := os.RemoveAll(checkpointDir(id)); err != nil {
+		log.Errorf("cannot remove checkpoints of job %s: %v", id, err)
+	}
+}
+
+// Store the request of the job unless it was stored before.
+func saveRequest(id string, request submission) error {
+	path := filepath.Join(checkpointDir(id), "request.json")
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(checkpointDir(id), 0750); err != nil {
+		return err
+	}
+	return writeJSON(path, checkpoint{
+		Request:   request.Request,
+		RemoteIP:  request.remoteIP,
+		RequestID: request.requestID,
+		Checksum:  request.checksum,
+		Namespace: request.namespace,
+	})
+}
+
+// Write the JSON encoded data to a temporary file that replaces the
+// file.  The data is encrypted with -data-key.
+func writeJSON(path string, x interface{}) error {
+	buf, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	if buf, err = seal(buf); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", buf, 0640); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Read the JSON encoded data written by writeJSON.
+func readJSON(path string, x interface{}) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if buf, err = unseal(buf); err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, x)
+}
+
+// Profile the tokens chunk by chunk.  Chunks with a checkpoint are
+// skipped; each chunk runs with n parallel processes.  The profiles
+// of finished chunks are added to the job's state.  Returns the
+// merged profile and the maximal peak memory of the chunks.
+func runChunks(
+	ctx context.Context, exe, config, id string, request submission,
+	tokens []gofiler.Token, n int, state *jobState,
+) (gofiler.Profile, uint64, error) {
+	if err := saveRequest(id, request); err != nil {
+		return nil, 0, fmt.Errorf("cannot save checkpoint: %v", err)
+	}
+	chunks := (countOCR(tokens) + int(checkpointSize) - 1) / int(checkpointSize)
+	if chunks < 1 {
+		chunks = 1
+	}
+	var profiles []gofiler.Profile
+	var peak uint64
+	for i, chunk := range splitTokens(tokens, chunks) {
+		var p gofiler.Profile
+		if err := readJSON(chunkPath(id, i), &p); err == nil {
+			log.Infof("job %s: chunk %d/%d: using checkpoint", id, i+1, chunks)
+			profiles = append(profiles, p)
+			state.addChunk(p)
+			continue
+		}
+		l := logger{state: state}
+		p, mem, err := runShards(ctx, exe, config, chunk, n, l)
+		if err != nil && ctx.Err() == nil {
+			log.Infof("job %s: chunk %d/%d: retrying: %v", id, i+1, chunks, err)
+			p, mem, err = runShards(ctx, exe, config, chunk, n, l)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if err := writeJSON(chunkPath(id, i), p); err != nil {
+			return nil, 0, fmt.Errorf("cannot save checkpoint: %v", err)
+		}
+		log.Infof("job %s: chunk %d/%d: done", id, i+1, chunks)
+		if mem > peak {
+			peak = mem
+		}
+		profiles = append(profiles, p)
+		state.addChunk(p)
+	}
+	return mergeProfiles(profiles), peak, nil
+}
+
+// Resume the jobs with checkpoints.  Jobs whose language
+// configuration changed are dropped.
+func resumeJobs() {
+	if dataDir == "" {
+		return
+	}
+	dirs, err := filepath.Glob(filepath.Join(dataDir, "checkpoints", "*"))
+	if err != nil {
+		log.Errorf("cannot resume jobs: %v", err)
+		return
+	}
+	for _, dir := range dirs {
+		id := filepath.Base(dir)
+		if err := resumeJob(id); err != nil {
+			log.Errorf("cannot resume job %s: %v", id, err)
+			removeCheckpoint(id)
+		}
+	}
+}
+
+func resumeJob(id string) error {
+	var cp checkpoint
+	if err := readJSON(filepath.Join(checkpointDir(id), "request.json"), &cp); err != nil {
+		return err
+	}
+	lc, err := findLanguage(cp.Request.Language)
+	if err != nil {
+		return err
+	}
+	sum, err := languageChecksum(lc.Path)
+	if err != nil {
+		return err
+	}
+	if sum != cp.Checksum {
+		return fmt.Errorf("language configuration %s changed", lc.Language)
+	}
+	request := submission{
+		Request:   cp.Request,
+		remoteIP:  cp.RemoteIP,
+		requestID: cp.RequestID,
+		checksum:  sum,
+		namespace: cp.Namespace,
+	}
+	// Groups do not survive a restart.
+	request.Group = ""
+	pchan := make(chan result, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	state := newJobState(0)
+	if jobs.put(id, job{
+		pending:   pchan,
+		cancel:    cancel,
+		state:     state,
+		language:  request.Language,
+		checksum:  request.checksum,
+		owner:     request.remoteIP,
+		namespace: request.namespace,
+	}) != putJobOK {
+		cancel()
+		return fmt.Errorf("cannot accept more jobs")
+	}
+	shareJob(id, sharedJob{
+		Phase:     phaseNames[phaseQueued],
+		Language:  request.Language,
+		Owner:     request.remoteIP,
+		Checksum:  request.checksum,
+		Namespace: request.namespace,
+	})
+	log.Infof("resuming job %s", id)
+	stats.submit()
+	go runProfiler(ctx, cancel, state, lc.Path, id, request, cost{}, pchan)
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The checksum of a language configuration covers the configuration
+// file (e.g. backend/german.ini) and all files in the directory of
+// the same name (e.g. backend/german/) if it exists.  Checksums are
+// cached and only recomputed if the size or modification time of any
+// of the files changes.
+var checksums struct {
+	m map[string]checksum // config path -> checksum
+	l sync.Mutex
+}
+
+type checksum struct {
+	stamp string // sizes and modification times of all files
+	sum   string
+}
+
+// Return the checksum of the language configuration.
+func languageChecksum(config string) (string, error) {
+	files, stamp, err := languageFiles(config)
+	if err != nil {
+		return "", fmt.Errorf("cannot compute checksum: %v", err)
+	}
+	checksums.l.Lock()
+	defer checksums.l.Unlock()
+	if c, ok := checksums.m[config]; ok && c.stamp == stamp {
+		return c.sum, nil
+	}
+	h := sha256.New()
+	for _, file := range files {
+		if err := hashFile(h, file); err != nil {
+			return "", fmt.Errorf("cannot compute checksum: %v", err)
+		}
+	}
+	sum := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if checksums.m == nil {
+		checksums.m = make(map[string]checksum)
+	}
+	checksums.m[config] = checksum{stamp: stamp, sum: sum}
+	return sum, nil
+}
+
+// Return the files of a language configuration (sorted) and a stamp
+// of their sizes and modification times.
+func languageFiles(config string) ([]string, string, error) {
+	fi, err := os.Stat(config)
+	if err != nil {
+		return nil, "", err
+	}
+	files := []string{config}
+	var stamp strings.Builder
+	fmt.Fprintf(&stamp, "%s:%d:%d;", config, fi.Size(), fi.ModTime().UnixNano())
+	dir := strings.TrimSuffix(config, filepath.Ext(config))
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return files, stamp.String(), nil
+	}
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		files = append(files, path)
+		fmt.Fprintf(&stamp, "%s:%d:%d;", path, fi.Size(), fi.ModTime().UnixNano())
+		return nil
+	})
+	return files, stamp.String(), err
+}
+
+// Write the file's name and content into the hash.
+func hashFile(w io.Writer, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fmt.Fprintf(w, "%s\n", filepath.Base(path))
+	_, err = io.Copy(w, in)
+	return err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+)
+
+// Return the classes of the entries of the profile, so that clients
+// can color-code the tokens of a document.
+func classify(p gofiler.Profile) map[string]string {
+	if len(p) == 0 {
+		return nil
+	}
+	classes := make(map[string]string, len(p))
+	for word, e := range p {
+		classes[word] = classifyCandidates(e.Candidates)
+	}
+	return classes
+}
+
+// Classify an entry by its best candidate: a candidate with OCR
+// patterns marks a probable OCR error, a candidate with historical
+// patterns only a historical variant and a candidate without
+// patterns a word of the lexicon.
+func classifyCandidates(cs []gofiler.Candidate) string {
+	if len(cs) == 0 {
+		return api.ClassUnknown
+	}
+	best := cs[0]
+	for _, c := range cs[1:] {
+		if c.Weight > best.Weight {
+			best = c
+		}
+	}
+	switch {
+	case best.Dict == whitelistDict:
+		return api.ClassVerified
+	case len(best.OCRPatterns) > 0:
+		return api.ClassOCRError
+	case len(best.HistPatterns) > 0:
+		return api.ClassHistorical
+	default:
+		return api.ClassLexicon
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// List of trusted reverse proxies.  X-Forwarded-For headers are only
+// honored for requests from these networks.
+var trustedNets []*net.IPNet
+
+// Parse a comma separated list of IP addresses or CIDR networks.
+func parseNets(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, str := range strings.Split(list, ",") {
+		str = strings.TrimSpace(str)
+		if str == "" {
+			continue
+		}
+		if !strings.Contains(str, "/") {
+			ip := net.ParseIP(str)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", str)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(str)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network: %s", str)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, str string) bool {
+	ip := net.ParseIP(str)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the host part of a host:port address.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Return the IP address of the client of the request.  If the
+// request comes from a trusted proxy, the X-Forwarded-For header is
+// searched from right to left for the first untrusted address.
+func remoteIP(r *http.Request) string {
+	ip := hostOf(r.RemoteAddr)
+	if !containsIP(trustedNets, ip) {
+		return ip
+	}
+	var hops []string
+	for _, val := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(val, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(trustedNets, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// Networks of clients that are allowed or denied access (-allow-cidr
+// and -deny-cidr).
+var allowedNets, deniedNets []*net.IPNet
+
+// Reject requests of denied clients and, if an allowlist is given,
+// of clients that are not allowed, before the request reaches any
+// handler.  The client address honors trusted proxies.
+func withIPFilter(h http.Handler) http.Handler {
+	if len(allowedNets) == 0 && len(deniedNets) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		if containsIP(deniedNets, ip) ||
+			(len(allowedNets) > 0 && !containsIP(allowedNets, ip)) {
+			log.Infof("denied request from %s: [%s] %s", ip, r.Method, r.URL)
+			http.Error(w, "", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
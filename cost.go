@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/finkf/gofiler"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximal number of observations per language.
+const maxObservations = 100
+
+// cost is the (estimated or measured) cost of a job.
+type cost struct {
+	seconds float64 // Run time in seconds
+	memory  float64 // Peak resident memory in bytes
+}
+
+type observation struct {
+	tokens int
+	types  int // Number of distinct OCR tokens
+	cost   cost
+}
+
+// costModel estimates the cost of jobs from the cost of previous
+// jobs of the same language.  The cost is modeled as a linear function
+// of the number of tokens (or of the number of types).
+type costModel struct {
+	m map[string][]observation
+	l sync.Mutex
+}
+
+var costs costModel
+
+// Record the measured cost of a finished job.
+func (c *costModel) observe(language string, tokens, types int, x cost) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.m == nil {
+		c.m = make(map[string][]observation)
+	}
+	obs := append(c.m[language], observation{tokens: tokens, types: types, cost: x})
+	if len(obs) > maxObservations {
+		obs = obs[len(obs)-maxObservations:]
+	}
+	c.m[language] = obs
+}
+
+// Estimate the cost of a job.  Returns false if there are no
+// observations for the language.
+func (c *costModel) estimate(language string, tokens int) (cost, bool) {
+	x, n := c.estimateBy(language, tokens, func(o observation) int { return o.tokens })
+	return x, n > 0
+}
+
+// Estimate the cost of a job from the given number of tokens or types
+// (selected by key).  Returns the number of observations that were
+// used.
+func (c *costModel) estimateBy(language string, x int, key func(observation) int) (cost, int) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	var xs, ts, ms, mxs []float64
+	for _, o := range c.m[language] {
+		k := key(o)
+		xs = append(xs, float64(k))
+		ts = append(ts, o.cost.seconds)
+		// The memory is unknown if it could not be measured.
+		if o.cost.memory > 0 {
+			mxs = append(mxs, float64(k))
+			ms = append(ms, o.cost.memory)
+		}
+	}
+	return cost{
+		seconds: predict(xs, ts, float64(x)),
+		memory:  predict(mxs, ms, float64(x)),
+	}, len(xs)
+}
+
+// Return the number of distinct OCR tokens.
+func countTypes(tokens []gofiler.Token) int {
+	types := make(map[string]bool)
+	for _, t := range tokens {
+		if t.LE == "" {
+			types[t.OCR] = true
+		}
+	}
+	return len(types)
+}
+
+// Predict y for x using a least squares fit of the observations.
+func predict(xs, ys []float64, x float64) float64 {
+	n := float64(len(xs))
+	if n == 0 {
+		return 0
+	}
+	var sx, sy, sxx, sxy float64
+	for i := range xs {
+		sx += xs[i]
+		sy += ys[i]
+		sxx += xs[i] * xs[i]
+		sxy += xs[i] * ys[i]
+	}
+	d := n*sxx - sx*sx
+	if d == 0 { // all observations have the same number of tokens
+		return sy / n
+	}
+	b := (n*sxy - sx*sy) / d
+	a := (sy - b*sx) / n
+	if y := a + b*x; y > 0 {
+		return y
+	}
+	return 0
+}
+
+// budget keeps track of the estimated cost of the running jobs.
+type budget struct {
+	used cost
+	jobs int // Number of jobs that reserved their cost
+	l    sync.Mutex
+}
+
+var budgets budget
+
+// Reserve the estimated cost of a new job.  Returns false if the job
+// would exceed the -memory-budget or -cpu-budget.  A job is always
+// admitted if no other job is running.
+func (b *budget) acquire(x cost) bool {
+	b.l.Lock()
+	defer b.l.Unlock()
+	idle := b.jobs == 0
+	if !idle && memoryBudget > 0 && b.used.memory+x.memory > float64(memoryBudget)*(1<<20) {
+		log.Infof("memory budget exceeded: %.0fMB", (b.used.memory+x.memory)/(1<<20))
+		return false
+	}
+	if !idle && cpuBudget > 0 && b.used.seconds+x.seconds > float64(cpuBudget) {
+		log.Infof("cpu budget exceeded: %.0fs", b.used.seconds+x.seconds)
+		return false
+	}
+	b.used.memory += x.memory
+	b.used.seconds += x.seconds
+	b.jobs++
+	return true
+}
+
+// Release the reserved cost of a finished job.
+func (b *budget) release(x cost) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.used.memory -= x.memory
+	b.used.seconds -= x.seconds
+	b.jobs--
+	// Do not let rounding errors accumulate.
+	if b.jobs == 0 {
+		b.used = cost{}
+	}
+}
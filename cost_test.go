@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestBudgetIdleAfterFractionalCycles(t *testing.T) {
+	defer func(memory, cpu uint) {
+		memoryBudget, cpuBudget = memory, cpu
+	}(memoryBudget, cpuBudget)
+	memoryBudget, cpuBudget = 0, 1
+	var b budget
+	xs := []cost{{seconds: 0.1}, {seconds: 0.2}, {seconds: 0.3}, {seconds: 0.8}}
+	for i := 0; i < 100; i++ {
+		for _, x := range xs[:2] {
+			if !b.acquire(x) {
+				t.Fatalf("cycle %d: acquire(%v) failed", i, x)
+			}
+		}
+		// 0.1 + 0.2 + 0.8 exceeds the budget of 1 second.
+		if b.acquire(xs[3]) {
+			t.Fatalf("cycle %d: acquire(%v) exceeded the budget", i, xs[3])
+		}
+		b.release(xs[0])
+		if !b.acquire(xs[2]) {
+			t.Fatalf("cycle %d: acquire(%v) failed", i, xs[2])
+		}
+		b.release(xs[1])
+		b.release(xs[2])
+		if b.jobs != 0 || b.used != (cost{}) {
+			t.Fatalf("cycle %d: budget not idle: %d jobs, used %v", i, b.jobs, b.used)
+		}
+	}
+	// An idle budget admits jobs that exceed it.
+	if !b.acquire(cost{seconds: 2}) {
+		t.Fatalf("idle budget did not admit a job")
+	}
+	if b.acquire(cost{seconds: 0.1}) {
+		t.Fatalf("budget admitted a job beyond its limit")
+	}
+}
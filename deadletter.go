@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximal number of dead letters.  If there are more, the oldest dead
+// letters are dropped.
+const maxDeadLetters = 1000
+
+// Webhook deliveries that failed all their attempts are kept as dead
+// letters until they are delivered again or discarded with the admin
+// API.  They are persisted in dead-letters.json below -data-dir
+// (unless -no-content-logging is set, since the payloads contain the
+// errors of jobs).
+var deadLetters = struct {
+	m       map[uint64]*api.DeadLetter // delivery -> dead letter
+	dropped int
+	l       sync.Mutex
+}{m: make(map[uint64]*api.DeadLetter)}
+
+func deadLettersPath() string {
+	return filepath.Join(dataDir, "dead-letters.json")
+}
+
+// Load the persisted dead letters.
+func loadDeadLetters() error {
+	if dataDir == "" || noContentLogging {
+		return nil
+	}
+	var list []api.DeadLetter
+	if err := readJSON(deadLettersPath(), &list); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	deadLetters.l.Lock()
+	defer deadLetters.l.Unlock()
+	for i := range list {
+		deadLetters.m[list[i].Delivery] = &list[i]
+	}
+	log.Infof("loaded %d dead letters", len(deadLetters.m))
+	return nil
+}
+
+// Keep a failed delivery as dead letter.
+func addDeadLetter(dl api.DeadLetter) {
+	deadLetters.l.Lock()
+	defer deadLetters.l.Unlock()
+	deadLetters.m[dl.Delivery] = &dl
+	for _, l := range sortedDeadLetters()[:max(0, len(deadLetters.m)-maxDeadLetters)] {
+		log.Errorf("dropping dead letter %d to %s", l.Delivery, l.URL)
+		delete(deadLetters.m, l.Delivery)
+		deadLetters.dropped++
+	}
+	log.Errorf("delivery %d to %s is a dead letter: %s", dl.Delivery, dl.URL, dl.Error)
+	saveDeadLetters()
+}
+
+// Return the dead letters ordered by their delivery.  Must be called
+// with the dead letters locked.
+func sortedDeadLetters() []api.DeadLetter {
+	res := make([]api.DeadLetter, 0, len(deadLetters.m))
+	for _, dl := range deadLetters.m {
+		res = append(res, *dl)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Delivery < res[j].Delivery
+	})
+	return res
+}
+
+// Persist the dead letters.  Must be called with the dead letters
+// locked.
+func saveDeadLetters() {
+	if dataDir == "" || noContentLogging {
+		return
+	}
+	if err := os.MkdirAll(dataDir, 0750); err != nil {
+		log.Errorf("cannot save dead letters: %v", err)
+		return
+	}
+	if err := writeJSON(deadLettersPath(), sortedDeadLetters()); err != nil {
+		log.Errorf("cannot save dead letters: %v", err)
+	}
+}
+
+// Remove the dead letters that concern one of the given jobs (events
+// of the jobs and groups that contain them).  Returns the deliveries
+// of the removed dead letters.
+func purgeDeadLetters(tokens map[string]bool) []uint64 {
+	deadLetters.l.Lock()
+	defer deadLetters.l.Unlock()
+	var removed []uint64
+	for _, dl := range sortedDeadLetters() {
+		var payload struct {
+			Token string         // api.Event
+			Jobs  []api.GroupJob // api.Group
+		}
+		json.Unmarshal(dl.Payload, &payload)
+		match := tokens[payload.Token]
+		for _, j := range payload.Jobs {
+			match = match || tokens[j.Token.ID]
+		}
+		if match {
+			delete(deadLetters.m, dl.Delivery)
+			removed = append(removed, dl.Delivery)
+		}
+	}
+	if len(removed) > 0 {
+		saveDeadLetters()
+	}
+	return removed
+}
+
+// List the dead letters: [GET] webhooks/dead-letters
+func getDeadLetters(w http.ResponseWriter, r *http.Request) interface{} {
+	deadLetters.l.Lock()
+	defer deadLetters.l.Unlock()
+	return api.DeadLetters{Letters: sortedDeadLetters(), Dropped: deadLetters.dropped}
+}
+
+// Deliver a dead letter again: [POST] webhooks/dead-letters/{delivery}.
+// The delivery is attempted once with its original ID.  Delivered
+// dead letters are removed.
+func redeliverDeadLetter(w http.ResponseWriter, r *http.Request) interface{} {
+	deadLetters.l.Lock()
+	dl, ok := findDeadLetter(r)
+	if !ok {
+		deadLetters.l.Unlock()
+		return http.StatusNotFound
+	}
+	res := *dl
+	deadLetters.l.Unlock()
+	// Do not block failing deliveries while redelivering.
+	res.Attempts++
+	_, err := deliver(res.URL, res.Payload, res.Delivery, res.Attempts, res.Attempts)
+	deadLetters.l.Lock()
+	defer deadLetters.l.Unlock()
+	dl, ok = deadLetters.m[res.Delivery]
+	if err != nil {
+		res.Error = err.Error()
+		res.Failed = time.Now()
+		if ok { // not discarded in the meantime
+			*dl = res
+			saveDeadLetters()
+		}
+		return api.Error{
+			Status:  http.StatusBadGateway,
+			Message: fmt.Sprintf("cannot redeliver %d: %v", res.Delivery, err),
+		}
+	}
+	if ok {
+		delete(deadLetters.m, res.Delivery)
+		saveDeadLetters()
+	}
+	log.Infof("redelivered dead letter %d to %s", res.Delivery, res.URL)
+	return res
+}
+
+// Discard a dead letter: [DELETE] webhooks/dead-letters/{delivery}
+func deleteDeadLetter(w http.ResponseWriter, r *http.Request) interface{} {
+	deadLetters.l.Lock()
+	defer deadLetters.l.Unlock()
+	dl, ok := findDeadLetter(r)
+	if !ok {
+		return http.StatusNotFound
+	}
+	delete(deadLetters.m, dl.Delivery)
+	saveDeadLetters()
+	log.Infof("discarded dead letter %d", dl.Delivery)
+	return *dl
+}
+
+// Return the dead letter of the request's delivery parameter.  Must be
+// called with the dead letters locked.
+func findDeadLetter(r *http.Request) (*api.DeadLetter, bool) {
+	id, err := strconv.ParseUint(pathParam(r, "delivery"), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	dl, ok := deadLetters.m[id]
+	return dl, ok
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Reasons for refusing new jobs.
+const (
+	reasonDraining    = "draining"
+	reasonAtCapacity  = "at capacity"
+	reasonOverloaded  = "overloaded"  // only jobs with high priority are accepted
+	reasonUnavailable = "unavailable" // the circuit breaker of the language is open
+	reasonUnverified  = "unverified"  // the language configuration failed verification
+
+	reasonQuotaExceeded = "quota exceeded" // the namespace (or client) exceeded its quota or rate limit
+)
+
+// Suggested delay (in seconds) before clients retry a job that was
+// refused while the daemon drains.
+const drainRetryAfter = 30
+
+// Set while the daemon drains.
+var draining int32
+
+// Signals that stop the daemon.  The Windows service control
+// manager's stop requests are delivered as os.Interrupt.
+var stopSignals = make(chan os.Signal, 2)
+
+// Drain the daemon on SIGTERM or SIGINT.  New jobs are refused, but
+// running jobs finish and all jobs can still be fetched.  The daemon
+// exits if all jobs were fetched or after -drain-timeout.  A second
+// signal exits immediately.
+func handleSignals() {
+	signal.Notify(stopSignals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-stopSignals
+		log.Infof("received %v: draining", sig)
+		atomic.StoreInt32(&draining, 1)
+		go drain()
+		sig = <-stopSignals
+		log.Infof("received %v: exiting", sig)
+		exit(1)
+	}()
+}
+
+// Exit the daemon.  The lookups are saved and a Windows service
+// reports that it stopped first.
+func exit(code int) {
+	saveLookups()
+	stopService(code)
+	os.Exit(code)
+}
+
+func drain() {
+	deadline := time.Now().Add(drainTimeout)
+	for time.Now().Before(deadline) && jobs.len() > 0 {
+		time.Sleep(time.Second)
+	}
+	if n := jobs.len(); n > 0 {
+		log.Infof("drain timeout: exiting with %d jobs", n)
+	} else {
+		log.Infof("drained: exiting")
+	}
+	exit(0)
+}
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) != 0
+}
+
+// Return the error for jobs that are refused for the given reason.
+func refuseJob(reason string) api.Error {
+	retry := drainRetryAfter
+	if reason == reasonAtCapacity || reason == reasonOverloaded {
+		retry = retryAfter()
+	}
+	return api.Error{
+		Status:     http.StatusServiceUnavailable,
+		Message:    "cannot accept jobs: " + reason,
+		Reason:     reason,
+		RetryAfter: retry,
+	}
+}
+
+// Estimate the time (in seconds) until a running job finishes.
+func retryAfter() int {
+	const min, max, unknown = 1, 300, 30
+	best := -1.0
+	now := time.Now()
+	jobs.each(func(_ string, j job) {
+		if _, finished := j.state.finishedAt(); finished || j.est.seconds == 0 {
+			return
+		}
+		rest := j.est.seconds - now.Sub(j.start).Seconds()
+		if best < 0 || rest < best {
+			best = rest
+		}
+	})
+	switch {
+	case best < 0:
+		return unknown
+	case best < min:
+		return min
+	case best > max:
+		return max
+	default:
+		return int(best + 0.5)
+	}
+}
+
+// Report if the daemon accepts new jobs: [GET] ready?priority=PRIORITY.
+// Answers 503 with the reason and a Retry-After header if it does not.
+func getReady(w http.ResponseWriter, r *http.Request) interface{} {
+	if isDraining() {
+		return refuseJob(reasonDraining)
+	}
+	if n := jobs.len(); n >= int(maxJobs) {
+		return refuseJob(reasonAtCapacity)
+	} else if !admits(n, r.URL.Query().Get("priority")) {
+		return refuseJob(reasonOverloaded)
+	}
+	return api.Readiness{Ready: true}
+}
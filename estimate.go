@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+)
+
+// Estimate the cost of a job: [POST] estimate.  Schedulers can use the
+// estimates to plan the profiling of whole corpora.
+func postEstimate(w http.ResponseWriter, r *http.Request) interface{} {
+	var req api.EstimateRequest
+	if err := decodeBody(r, &req); err != nil {
+		return decodeError(err)
+	}
+	if req.Tokens < 0 || req.Types < 0 || req.Tokens == 0 && req.Types == 0 {
+		return api.Error{
+			Status:  http.StatusBadRequest,
+			Message: "missing number of tokens or types",
+		}
+	}
+	_, err := findLanguage(req.Language)
+	if err == gofiler.ErrorLanguageNotFound {
+		return http.StatusNotFound
+	}
+	if c, ok := err.(languageConflict); ok {
+		return c.apiError()
+	}
+	if err != nil {
+		return err
+	}
+	return estimate(req.Language, req.Tokens, req.Types)
+}
+
+// Estimate the cost of a job from the cost of previous jobs of the
+// language.  The number of types is only used if tokens is 0.
+func estimate(language string, tokens, types int) api.Estimate {
+	var x cost
+	var n int
+	if tokens > 0 || types == 0 {
+		x, n = costs.estimateBy(language, tokens, func(o observation) int { return o.tokens })
+	} else {
+		x, n = costs.estimateBy(language, types, func(o observation) int { return o.types })
+	}
+	return api.Estimate{
+		Known:        n > 0,
+		Seconds:      x.seconds,
+		Memory:       uint64(x.memory),
+		Observations: n,
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// A publisher delivers job events to a notification backend.
+type publisher interface {
+	publish(api.Event) error
+}
+
+// Notification backends by URL scheme.  Kafka and AMQP are not
+// supported; bridge them from NATS or a webhook instead.
+var publishers = map[string]func(*url.URL) (publisher, error){
+	"http":  newWebhook,
+	"https": newWebhook,
+	"nats":  newNATS,
+}
+
+// Events are published asynchronously.  If the backend cannot keep
+// up, events are dropped.
+var events chan api.Event
+
+// Open the notification backend for the given URL and start to
+// publish events.
+func openEvents(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	open, ok := publishers[u.Scheme]
+	if !ok {
+		return fmt.Errorf("unsupported notification backend: %s", u.Scheme)
+	}
+	p, err := open(u)
+	if err != nil {
+		return err
+	}
+	events = make(chan api.Event, 1024)
+	go func() {
+		for e := range events {
+			if err := p.publish(e); err != nil {
+				log.Errorf("cannot publish %s event: %v", e.Event, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Publish an event for the given job.  Does nothing if no
+// notification backend is used.
+func publishJob(event, id string, request submission, err error) {
+	if events == nil {
+		return
+	}
+	e := api.Event{
+		Time:     time.Now(),
+		Event:    event,
+		Token:    id,
+		Language: request.Language,
+		Group:    request.Group,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	publish(e)
+}
+
+// Queue an event for publishing.
+func publish(e api.Event) {
+	if events == nil {
+		return
+	}
+	select {
+	case events <- e:
+	default:
+		log.Errorf("dropping %s event", e.Event)
+	}
+}
+
+type webhook struct {
+	url string
+}
+
+func newWebhook(u *url.URL) (publisher, error) {
+	return webhook{url: u.String()}, nil
+}
+
+func (w webhook) publish(e api.Event) error {
+	return postJSON(w.url, e)
+}
+
+// natsPublisher publishes events to a NATS server.  The subject is
+// the path of the URL (nats://host:4222/subject) and defaults to
+// gofilerd.events.
+type natsPublisher struct {
+	conn    *natsConn
+	subject string
+}
+
+func newNATS(u *url.URL) (publisher, error) {
+	conn, err := dialNATS(u)
+	if err != nil {
+		return nil, err
+	}
+	subject := strings.Trim(u.Path, "/")
+	if subject == "" {
+		subject = "gofilerd.events"
+	}
+	return natsPublisher{conn: conn, subject: subject}, nil
+}
+
+func (n natsPublisher) publish(e api.Event) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return n.conn.publish(n.subject, buf)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+)
+
+// Export formats of finished profiles.
+var exportFormats = map[string]func(api.Profile, exportOptions) interface{}{
+	// The profiler's JSON output as imported by PoCoWeb and the
+	// cis-ocrd tools.
+	"pocoweb": func(p api.Profile, _ exportOptions) interface{} { return p.Profile },
+	// One line per candidate in the profiler's candidate notation:
+	// OCR@SUGGESTION:{MODERN+[(L:R,POS)...]}+ocr[(L:R,POS)...],voteWeight=W,levDistance=D,dict=DICT
+	"candidates": exportCandidates,
+	// One row per token with its best candidates and their weights
+	// for review in a spreadsheet.
+	"csv": func(p api.Profile, o exportOptions) interface{} { return exportTable(p, o, ',') },
+	"tsv": func(p api.Profile, o exportOptions) interface{} { return exportTable(p, o, '\t') },
+	// Workbook with sheets of the tokens, the candidates and the
+	// patterns.
+	"xlsx": exportXLSX,
+}
+
+// Default number of candidates per token of the csv and tsv exports.
+const exportCandidatesDefault = 3
+
+// exportOptions are the options of an export.
+type exportOptions struct {
+	candidates int // Maximal number of candidates per token
+}
+
+// Export the profile of a finished job:
+// [GET] profile/export?token=ID&format=FORMAT.  Exports do not fetch
+// the job: the profile can be exported any number of times until it is
+// fetched with GET profile.  The csv, tsv and xlsx formats list at most
+// candidates=N candidates per token (default 3).
+func exportProfile(w http.ResponseWriter, r *http.Request) interface{} {
+	format, ok := exportFormats[r.URL.Query().Get("format")]
+	if !ok {
+		return api.Error{
+			Status:  http.StatusBadRequest,
+			Message: fmt.Sprintf("invalid format: %q", r.URL.Query().Get("format")),
+		}
+	}
+	opts := exportOptions{candidates: exportCandidatesDefault}
+	if str := r.URL.Query().Get("candidates"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 1 {
+			return api.Error{
+				Status:  http.StatusBadRequest,
+				Message: fmt.Sprintf("invalid candidates: %q", str),
+			}
+		}
+		opts.candidates = n
+	}
+	res := withToken(peekProfile)(w, r)
+	p, ok := res.(api.Profile)
+	if !ok {
+		return res
+	}
+	if !p.Done {
+		return api.Error{
+			Status:  http.StatusConflict,
+			Message: fmt.Sprintf("job %s is not done yet", p.Token.ID),
+		}
+	}
+	return format(p, opts)
+}
+
+// Return the profile of a finished job without fetching it.  Unlike
+// getProfile, it does not wait for the job.
+func peekProfile(_ context.Context, token api.Token) interface{} {
+	j, ok := jobs.get(token.ID)
+	if !ok {
+		rec, ok := getSharedJob(token.ID)
+		if !ok {
+			return http.StatusNotFound
+		}
+		if rec.Error != "" {
+			return errors.New(rec.Error)
+		}
+		return api.Profile{
+			Profile:   rec.Profile,
+			Positions: rec.Positions,
+			Token:     token,
+			Done:      rec.Phase == phaseNames[phaseDone],
+		}
+	}
+	res, ok := j.state.peekResult()
+	if !ok {
+		return api.Profile{Token: token}
+	}
+	if res.err != nil {
+		return res.err
+	}
+	p, err := res.profile.get()
+	if err != nil {
+		return err
+	}
+	return api.Profile{Profile: p, Positions: res.pos, Token: token, Done: true}
+}
+
+func exportCandidates(ap api.Profile, _ exportOptions) interface{} {
+	p := ap.Profile
+	var ocrs []string
+	for ocr := range p {
+		ocrs = append(ocrs, ocr)
+	}
+	sort.Strings(ocrs)
+	var b strings.Builder
+	for _, ocr := range ocrs {
+		for _, c := range p[ocr].Candidates {
+			fmt.Fprintf(&b, "%s@%s:{%s+[%s]}+ocr[%s],voteWeight=%g,levDistance=%d,dict=%s\n",
+				ocr, c.Suggestion, c.Modern, formatPatterns(c.HistPatterns),
+				formatPatterns(c.OCRPatterns), c.Weight, c.Distance, c.Dict)
+		}
+	}
+	return text(b.String())
+}
+
+func formatPatterns(ps []gofiler.Pattern) string {
+	var b strings.Builder
+	for _, p := range ps {
+		fmt.Fprintf(&b, "(%s:%s,%d)", p.Left, p.Right, p.Pos)
+	}
+	return b.String()
+}
+
+// Export the table of the tokens (see tokenTable).
+func exportTable(p api.Profile, o exportOptions, comma rune) interface{} {
+	var b strings.Builder
+	b.WriteString("\ufeff") // spreadsheets detect UTF-8 by the byte order mark
+	w := csv.NewWriter(&b)
+	w.Comma = comma
+	header, rows := tokenTable(p, o.candidates)
+	w.Write(header)
+	for _, row := range rows {
+		rec := make([]string, len(row))
+		for i, cell := range row {
+			rec[i] = escapeFormula(formatCell(cell))
+		}
+		w.Write(rec)
+	}
+	w.Flush()
+	name := p.Token.ID + ".csv"
+	contentType := "text/csv; charset=utf-8"
+	if comma == '\t' {
+		name = p.Token.ID + ".tsv"
+		contentType = "text/tab-separated-values; charset=utf-8"
+	}
+	return file{name: name, contentType: contentType, data: []byte(b.String())}
+}
+
+// Return the table of the tokens: one row per token with the token,
+// its position and its n best candidates with their weights.  If the
+// request gave the positions of the tokens, the rows are in the order
+// of the positions; otherwise there is one row per profiled word.
+// Cells are strings, ints (0 for unset positions) or float64s.
+func tokenTable(p api.Profile, n int) ([]string, [][]interface{}) {
+	type token struct {
+		ocr string
+		pos api.Position
+	}
+	var tokens []token
+	for ocr := range p.Profile {
+		if len(p.Positions[ocr]) == 0 {
+			tokens = append(tokens, token{ocr: ocr})
+			continue
+		}
+		for _, pos := range p.Positions[ocr] {
+			tokens = append(tokens, token{ocr: ocr, pos: pos})
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		a, b := tokens[i].pos, tokens[j].pos
+		switch {
+		case a.Page != b.Page:
+			return a.Page < b.Page
+		case a.Line != b.Line:
+			return a.Line < b.Line
+		case a.Offset != b.Offset:
+			return a.Offset < b.Offset
+		case a.ID != b.ID:
+			return a.ID < b.ID
+		default:
+			return tokens[i].ocr < tokens[j].ocr
+		}
+	})
+	header := []string{"Token", "ID", "Page", "Line", "Offset"}
+	for i := 1; i <= n; i++ {
+		header = append(header, fmt.Sprintf("Candidate %d", i), fmt.Sprintf("Weight %d", i))
+	}
+	rows := make([][]interface{}, len(tokens))
+	for i, t := range tokens {
+		row := []interface{}{t.ocr, t.pos.ID, t.pos.Page, t.pos.Line, t.pos.Offset}
+		for _, c := range bestCandidates(p.Profile[t.ocr].Candidates, n) {
+			row = append(row, c.Suggestion, float64(c.Weight))
+		}
+		rows[i] = row
+	}
+	return header, rows
+}
+
+// Return the n candidates with the highest weights.
+func bestCandidates(cs []gofiler.Candidate, n int) []gofiler.Candidate {
+	cs = append([]gofiler.Candidate(nil), cs...)
+	sort.SliceStable(cs, func(i, j int) bool {
+		return cs[i].Weight > cs[j].Weight
+	})
+	if len(cs) > n {
+		cs = cs[:n]
+	}
+	return cs
+}
+
+// Escape cells that spreadsheets would evaluate as formulas (OCR
+// tokens like =SUM(A1) or -1+2) by prefixing them with a quote.
+// Formatted numbers are not escaped.
+func escapeFormula(cell string) string {
+	if cell == "" || strings.IndexByte("=+-@", cell[0]) < 0 {
+		return cell
+	}
+	if _, err := strconv.ParseFloat(cell, 64); err == nil {
+		return cell
+	}
+	return "'" + cell
+}
+
+// Format a cell of a table.  Zero ints (unset positions) are empty.
+func formatCell(cell interface{}) string {
+	switch t := cell.(type) {
+	case int:
+		if t == 0 {
+			return ""
+		}
+		return strconv.Itoa(t)
+	case float64:
+		return strconv.FormatFloat(t, 'g', 6, 64)
+	default:
+		return fmt.Sprint(t)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Read the token from the request's query and decode the
+// api.Extension of the request's body.
+func withExtension(
+	h func(api.Token, time.Duration) interface{},
+) func(http.ResponseWriter, *http.Request) interface{} {
+	return func(w http.ResponseWriter, r *http.Request) interface{} {
+		id := r.URL.Query().Get("token")
+		if id == "" {
+			return http.StatusBadRequest
+		}
+		var ext api.Extension
+		if err := json.NewDecoder(r.Body).Decode(&ext); err != nil {
+			log.Infof("cannot decode extension: %v", err)
+			return http.StatusBadRequest
+		}
+		d, err := time.ParseDuration(ext.ExtendBy)
+		if err != nil || d <= 0 {
+			log.Infof("invalid extension: %q", ext.ExtendBy)
+			return http.StatusBadRequest
+		}
+		return h(api.Token{ID: id}, d)
+	}
+}
+
+// Extend the deadlines of a running job.
+func extendJob(token api.Token, d time.Duration) interface{} {
+	job, ok := jobs.get(token.ID)
+	if !ok {
+		return http.StatusNotFound
+	}
+	if _, finished := job.state.finishedAt(); finished {
+		return http.StatusConflict
+	}
+	job.state.extend(d)
+	soft, hard := job.state.deadlines()
+	log.Infof("extended deadlines of job %s by %s", token, d)
+	return api.Deadlines{Token: token, Timeout: soft, Deadline: hard}
+}
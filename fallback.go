@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Requests with Fallback set are served by the fallback of their
+// language (-fallback german-dta=german,german=...) if the
+// configuration of the language is missing, failed its verification
+// (see -backend-manifest) or if its circuit breaker is open.  The
+// circuit breaker of a language opens after -breaker-threshold
+// consecutive failures of its profiler and stays open for
+// -breaker-cooldown.  Canceled runs are not failures, but stalled
+// jobs are.
+
+// Fallback languages by language.
+var fallbacks map[string]string
+
+// Parse the comma separated LANGUAGE=FALLBACK pairs.  Fallbacks may
+// be chained, but must not form cycles.
+func parseFallbacks(str string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(str, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid fallback: %s", pair)
+		}
+		from := strings.ToLower(strings.TrimSpace(kv[0]))
+		to := strings.ToLower(strings.TrimSpace(kv[1]))
+		if from == "" || to == "" {
+			return nil, fmt.Errorf("invalid fallback: %s", pair)
+		}
+		if _, ok := m[from]; ok {
+			return nil, fmt.Errorf("duplicate fallback for %s", from)
+		}
+		m[from] = to
+	}
+	for from := range m {
+		seen := map[string]bool{from: true}
+		for lang, ok := m[from]; ok; lang, ok = m[lang] {
+			if seen[lang] {
+				return nil, fmt.Errorf("fallback cycle: %s", from)
+			}
+			seen[lang] = true
+		}
+	}
+	return m, nil
+}
+
+// errBreakerOpen is the error of languages with an open circuit
+// breaker.
+type errBreakerOpen struct {
+	language string
+	until    time.Time
+}
+
+func (e errBreakerOpen) Error() string {
+	return fmt.Sprintf("language %s is unavailable", e.language)
+}
+
+func (e errBreakerOpen) apiError() api.Error {
+	return api.Error{
+		Status:     http.StatusServiceUnavailable,
+		Message:    e.Error(),
+		Reason:     reasonUnavailable,
+		RetryAfter: int(time.Until(e.until).Seconds()) + 1,
+	}
+}
+
+// Find the configuration of the requested language.  If the
+// configuration is missing, unverified or its circuit breaker is open
+// and the request allows it, the first usable fallback is used instead.  The
+// language of the request is replaced with the used language and the
+// requested language is kept in request.requested.
+func selectLanguage(request *submission) (gofiler.LanguageConfiguration, error) {
+	language := request.Language
+	for {
+		lc, err := findLanguage(language)
+		if err == nil {
+			if until, open := breakers.isOpen(lc.Language); open {
+				err = errBreakerOpen{language: lc.Language, until: until}
+			} else if verr := verifyLanguage(lc.Path); verr != nil {
+				err = errUnverified{language: lc.Language, err: verr}
+			}
+		}
+		_, open := err.(errBreakerOpen)
+		_, unverified := err.(errUnverified)
+		unavailable := open || unverified
+		next, ok := fallbacks[strings.ToLower(language)]
+		if err == nil || !request.Fallback || !ok ||
+			(err != gofiler.ErrorLanguageNotFound && !unavailable) {
+			if err == nil && language != request.Language {
+				request.requested = request.Language
+				request.Language = lc.Language
+			}
+			return lc, err
+		}
+		log.Infof("falling back from %s to %s: %v", language, next, err)
+		language = next
+	}
+}
+
+type breaker struct {
+	failures uint      // Consecutive failures
+	open     time.Time // The breaker is open until this time
+}
+
+type breakerMap struct {
+	m map[string]*breaker
+	l sync.Mutex
+}
+
+var breakers breakerMap
+
+// errStalled is recorded for jobs that were canceled because their
+// profiler stalled (see jobMap.clean).
+var errStalled = errors.New("profiler stalled")
+
+// Record the result of a profiler run of the language.  Runs that
+// were canceled by their client (ctx is done, e.g. the job was deleted
+// or reached its deadline) say nothing about the profiler and are not
+// recorded.
+func (b *breakerMap) record(ctx context.Context, language string, err error) {
+	if breakerThreshold == 0 || ctx.Err() != nil {
+		return
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.m == nil {
+		b.m = make(map[string]*breaker)
+	}
+	s, ok := b.m[language]
+	if !ok {
+		s = new(breaker)
+		b.m[language] = s
+	}
+	if err == nil {
+		s.failures = 0
+		return
+	}
+	s.failures++
+	if s.failures >= breakerThreshold {
+		log.Infof("opening circuit breaker of %s after %d failures", language, s.failures)
+		s.open = time.Now().Add(breakerCooldown)
+		s.failures = 0
+	}
+}
+
+// Check if the breaker of the language is open.  Returns the time
+// the breaker closes.
+func (b *breakerMap) isOpen(language string) (time.Time, bool) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	s, ok := b.m[language]
+	if !ok || time.Now().After(s.open) {
+		return time.Time{}, false
+	}
+	return s.open, true
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Accepted corrections of corpus namespaces.  Candidates that were
+// accepted as correction of the same OCR token are boosted in later
+// profiles of the namespace.  The corrections are persisted as JSON
+// files (NAMESPACE.json) in the feedback directory below -data-dir
+// (unless -no-content-logging is set).
+var feedback struct {
+	m map[string]map[string]map[string]int // namespace -> OCR -> correction -> count
+	l sync.RWMutex
+}
+
+func feedbackDir() string {
+	return filepath.Join(dataDir, "feedback")
+}
+
+// Load the persisted feedback.
+func loadFeedback() error {
+	feedback.l.Lock()
+	defer feedback.l.Unlock()
+	feedback.m = make(map[string]map[string]map[string]int)
+	if dataDir == "" || noContentLogging {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(feedbackDir(), "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		var m map[string]map[string]int
+		if err := readJSON(file, &m); err != nil {
+			return fmt.Errorf("invalid feedback %s: %v", file, err)
+		}
+		feedback.m[strings.TrimSuffix(filepath.Base(file), ".json")] = m
+	}
+	return nil
+}
+
+func hasFeedback(ns string) bool {
+	feedback.l.RLock()
+	defer feedback.l.RUnlock()
+	_, ok := feedback.m[ns]
+	return ok
+}
+
+// Boost candidates that were accepted as correction of the entry's
+// OCR token.  The weight of a candidate is multiplied with
+// 1 + b*log10(1+n), where n is the number of acceptances and b is
+// -frequency-boost.
+func boostAccepted(p gofiler.Profile, ns string) {
+	feedback.l.RLock()
+	defer feedback.l.RUnlock()
+	accepted := feedback.m[ns]
+	if len(accepted) == 0 {
+		return
+	}
+	for w, e := range p {
+		counts, ok := accepted[strings.ToLower(w)]
+		if !ok {
+			continue
+		}
+		factors := make([]float64, len(e.Candidates))
+		for j, c := range e.Candidates {
+			n := counts[strings.ToLower(c.Suggestion)]
+			factors[j] = 1 + frequencyBoost*math.Log10(1+float64(n))
+		}
+		p[w] = reweight(e, factors)
+	}
+}
+
+// Report accepted corrections: [POST] feedback?namespace=NAMESPACE.
+// Requires the admin key.
+func postFeedback(w http.ResponseWriter, r *http.Request) interface{} {
+	ns := r.URL.Query().Get("namespace")
+	if !validNamespace.MatchString(ns) {
+		return api.Error{
+			Status:  http.StatusBadRequest,
+			Message: fmt.Sprintf("invalid namespace: %q", ns),
+		}
+	}
+	var fb api.Feedback
+	if err := decodeBody(r, &fb); err != nil {
+		return decodeError(err)
+	}
+	n, err := recordFeedback(ns, fb.Corrections)
+	if err != nil {
+		return err
+	}
+	return api.FeedbackReport{Namespace: ns, Recorded: n}
+}
+
+// Record the accepted corrections of the namespace.  Returns the
+// number of recorded corrections.
+func recordFeedback(ns string, corrections []api.Correction) (int, error) {
+	feedback.l.Lock()
+	defer feedback.l.Unlock()
+	m := feedback.m[ns]
+	if m == nil {
+		m = make(map[string]map[string]int)
+	}
+	n := 0
+	for _, c := range corrections {
+		if c.OCR == "" || c.Correction == "" {
+			continue
+		}
+		ocr := strings.ToLower(c.OCR)
+		if m[ocr] == nil {
+			m[ocr] = make(map[string]int)
+		}
+		m[ocr][strings.ToLower(c.Correction)]++
+		n++
+	}
+	if dataDir != "" && !noContentLogging {
+		if err := writeFeedback(ns, m); err != nil {
+			return 0, err
+		}
+	}
+	feedback.m[ns] = m
+	log.Infof("recorded %d corrections for %s", n, ns)
+	return n, nil
+}
+
+// Remove the feedback of the given namespaces.  Returns the namespaces
+// whose feedback was removed.
+func purgeFeedback(namespaces ...string) []string {
+	feedback.l.Lock()
+	defer feedback.l.Unlock()
+	var removed []string
+	for _, ns := range namespaces {
+		if _, ok := feedback.m[ns]; !ok {
+			continue
+		}
+		if dataDir != "" {
+			err := os.Remove(filepath.Join(feedbackDir(), ns+".json"))
+			if err != nil && !os.IsNotExist(err) {
+				log.Errorf("cannot remove feedback of %s: %v", ns, err)
+				continue
+			}
+		}
+		delete(feedback.m, ns)
+		removed = append(removed, ns)
+	}
+	return removed
+}
+
+// Write the feedback to a temporary file that replaces the old file.
+func writeFeedback(ns string, m map[string]map[string]int) error {
+	if err := os.MkdirAll(feedbackDir(), 0750); err != nil {
+		return fmt.Errorf("cannot write feedback: %v", err)
+	}
+	if err := writeJSON(filepath.Join(feedbackDir(), ns+".json"), m); err != nil {
+		return fmt.Errorf("cannot write feedback: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Frequency lists of corpus namespaces.  Lists are persisted as
+// JSON files (NAMESPACE.json) in the frequencies directory below
+// -data-dir.  Without a data directory, lists are kept in memory only.
+var frequencies struct {
+	m map[string]map[string]int // namespace -> lower case form -> frequency
+	l sync.RWMutex
+}
+
+var validNamespace = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+func frequencyDir() string {
+	return filepath.Join(dataDir, "frequencies")
+}
+
+// Load the persisted frequency lists.
+func loadFrequencies() error {
+	frequencies.l.Lock()
+	defer frequencies.l.Unlock()
+	frequencies.m = make(map[string]map[string]int)
+	if dataDir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(frequencyDir(), "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		var list api.FrequencyList
+		if err := readJSON(file, &list); err != nil {
+			return fmt.Errorf("invalid frequency list %s: %v", file, err)
+		}
+		ns := strings.TrimSuffix(filepath.Base(file), ".json")
+		frequencies.m[ns] = normalizeFrequencies(list.Frequencies)
+	}
+	log.Infof("loaded %d frequency lists", len(frequencies.m))
+	return nil
+}
+
+// Frequencies are looked up case insensitively.
+func normalizeFrequencies(in map[string]int) map[string]int {
+	out := make(map[string]int, len(in))
+	for form, freq := range in {
+		if freq > 0 {
+			out[strings.ToLower(form)] += freq
+		}
+	}
+	return out
+}
+
+func hasFrequencies(ns string) bool {
+	frequencies.l.RLock()
+	defer frequencies.l.RUnlock()
+	_, ok := frequencies.m[ns]
+	return ok
+}
+
+// Boost the weights of candidates that are frequent in the corpus of
+// the namespace.  The weight of a candidate is multiplied with
+// 1 + b*log10(1+f), where f is the frequency of the candidate and b
+// is -frequency-boost.
+func boost(p gofiler.Profile, ns string) {
+	frequencies.l.RLock()
+	freqs := frequencies.m[ns]
+	frequencies.l.RUnlock()
+	if len(freqs) == 0 {
+		return
+	}
+	for w, e := range p {
+		factors := make([]float64, len(e.Candidates))
+		for j, c := range e.Candidates {
+			f := freqs[strings.ToLower(c.Suggestion)]
+			factors[j] = 1 + frequencyBoost*math.Log10(1+float64(f))
+		}
+		p[w] = reweight(e, factors)
+	}
+}
+
+// Get the frequency list of a namespace:
+// [GET] frequencies?namespace=NAMESPACE
+func getFrequencies(w http.ResponseWriter, r *http.Request) interface{} {
+	ns := r.URL.Query().Get("namespace")
+	frequencies.l.RLock()
+	defer frequencies.l.RUnlock()
+	freqs, ok := frequencies.m[ns]
+	if !ok {
+		return http.StatusNotFound
+	}
+	return api.FrequencyList{Namespace: ns, Frequencies: freqs}
+}
+
+// Upload (and replace) the frequency list of a namespace:
+// [PUT] frequencies?namespace=NAMESPACE
+func putFrequencies(w http.ResponseWriter, r *http.Request) interface{} {
+	ns := r.URL.Query().Get("namespace")
+	if !validNamespace.MatchString(ns) {
+		return api.Error{
+			Status:  http.StatusBadRequest,
+			Message: fmt.Sprintf("invalid namespace: %q", ns),
+		}
+	}
+	var list api.FrequencyList
+	if err := decodeBody(r, &list); err != nil {
+		return decodeError(err)
+	}
+	list.Namespace = ns
+	list.Frequencies = normalizeFrequencies(list.Frequencies)
+	frequencies.l.Lock()
+	defer frequencies.l.Unlock()
+	if dataDir != "" {
+		if err := writeFrequencies(list); err != nil {
+			return err
+		}
+	}
+	frequencies.m[ns] = list.Frequencies
+	log.Infof("stored frequency list %s (%d forms)", ns, len(list.Frequencies))
+	return list
+}
+
+// Delete the frequency list of a namespace:
+// [DELETE] frequencies?namespace=NAMESPACE
+func deleteFrequencies(w http.ResponseWriter, r *http.Request) interface{} {
+	ns := r.URL.Query().Get("namespace")
+	frequencies.l.Lock()
+	defer frequencies.l.Unlock()
+	if _, ok := frequencies.m[ns]; !ok {
+		return http.StatusNotFound
+	}
+	if dataDir != "" {
+		err := os.Remove(filepath.Join(frequencyDir(), ns+".json"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	delete(frequencies.m, ns)
+	log.Infof("deleted frequency list %s", ns)
+	return api.FrequencyList{Namespace: ns}
+}
+
+// Write the list to a temporary file that replaces the old list.
+func writeFrequencies(list api.FrequencyList) error {
+	if err := os.MkdirAll(frequencyDir(), 0750); err != nil {
+		return fmt.Errorf("cannot write frequency list: %v", err)
+	}
+	if err := writeJSON(filepath.Join(frequencyDir(), list.Namespace+".json"), list); err != nil {
+		return fmt.Errorf("cannot write frequency list: %v", err)
+	}
+	return nil
+}
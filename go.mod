@@ -1,6 +1,21 @@
 module github.com/finkf/gofilerd
 
+go 1.27.1
+
 require (
 	github.com/finkf/gofiler v0.0.0-20190130110509-27c6695cf379
+	github.com/json-iterator/go v1.1.12
 	github.com/sirupsen/logrus v1.3.0
+	golang.org/x/sys v0.0.0-20180905080454-ebe1bf3edb33
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/objx v0.1.1 // indirect
+	github.com/stretchr/testify v1.3.0 // indirect
+	golang.org/x/crypto v0.0.0-20180904163835-0709b304e793 // indirect
 )
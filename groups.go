@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// A group of jobs.  The group is done if it is closed and all of its
+// jobs are finished.  Its callback is notified once the group is done.
+type group struct {
+	id       string
+	callback string
+	closed   bool
+	jobs     []string                // tokens in order of submission
+	results  map[string]api.GroupJob // finished jobs
+	done     chan struct{}           // closed if the group is done
+	end      time.Time
+	created  time.Time
+}
+
+type groupMap struct {
+	m map[string]*group
+	l sync.Mutex
+}
+
+var groups groupMap
+
+// Create a new group with a unique ID.
+func (m *groupMap) create(callback string) api.Group {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if m.m == nil {
+		m.m = make(map[string]*group)
+	}
+	id := generateRandomID()
+	for _, ok := m.m[id]; ok; _, ok = m.m[id] {
+		id = generateRandomID()
+	}
+	g := &group{
+		id:       id,
+		callback: callback,
+		results:  make(map[string]api.GroupJob),
+		done:     make(chan struct{}),
+		created:  time.Now(),
+	}
+	m.m[id] = g
+	return g.snapshot()
+}
+
+// Add a job to an open group.  If the job cannot be added, the
+// according api.Error is returned.
+func (m *groupMap) add(id, token string) (api.Error, bool) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	if err, ok := m.accepts(id); !ok {
+		return err, false
+	}
+	m.m[id].jobs = append(m.m[id].jobs, token)
+	return api.Error{}, true
+}
+
+// Check if jobs can be added to the group.  The caller must hold the
+// lock.
+func (m *groupMap) accepts(id string) (api.Error, bool) {
+	g, ok := m.m[id]
+	if !ok {
+		return api.Error{Status: http.StatusNotFound, Message: "no such group: " + id}, false
+	}
+	if g.closed {
+		return api.Error{Status: http.StatusConflict, Message: "group is closed: " + id}, false
+	}
+	return api.Error{}, true
+}
+
+// Record the result of a job of the group.
+func (m *groupMap) finish(id, token string, err error) {
+	if id == "" {
+		return
+	}
+	m.l.Lock()
+	defer m.l.Unlock()
+	g, ok := m.m[id]
+	if !ok {
+		return
+	}
+	res := api.GroupJob{Token: api.Token{ID: token}, Phase: "done"}
+	if err != nil {
+		res.Failed = true
+		res.Error = err.Error()
+	}
+	g.results[token] = res
+	g.check()
+}
+
+// Close the group.  No more jobs can be added to a closed group.
+func (m *groupMap) close(id string) (api.Group, bool) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	g, ok := m.m[id]
+	if !ok {
+		return api.Group{}, false
+	}
+	g.closed = true
+	g.check()
+	return g.snapshot(), true
+}
+
+func (m *groupMap) get(id string) (api.Group, <-chan struct{}, bool) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	g, ok := m.m[id]
+	if !ok {
+		return api.Group{}, nil, false
+	}
+	return g.snapshot(), g.done, true
+}
+
+// Delete groups that are done since the timeout and open groups
+// without jobs older than the timeout.
+func (m *groupMap) clean() {
+	m.l.Lock()
+	defer m.l.Unlock()
+	delta := time.Duration(timeout) * time.Minute
+	now := time.Now()
+	for id, g := range m.m {
+		if (g.isDone() && now.After(g.end.Add(delta))) ||
+			(len(g.jobs) == 0 && now.After(g.created.Add(delta))) {
+			log.Debugf("deleting group %s", id)
+			delete(m.m, id)
+		}
+	}
+}
+
+func (g *group) isDone() bool {
+	return g.closed && len(g.results) == len(g.jobs)
+}
+
+// Check if the group is done and notify the waiting clients and the
+// callback.  Must be called with the group map locked.
+func (g *group) check() {
+	if !g.isDone() || !g.end.IsZero() {
+		return
+	}
+	g.end = time.Now()
+	close(g.done)
+	log.Infof("group %s is done", g.id)
+	publish(api.Event{Time: g.end, Event: "group-done", Group: g.id})
+	if g.callback != "" {
+		go notify(g.callback, g.snapshot())
+	}
+}
+
+func (g *group) snapshot() api.Group {
+	res := api.Group{ID: g.id, Closed: g.closed, Done: g.isDone()}
+	for _, token := range g.jobs {
+		if r, ok := g.results[token]; ok {
+			res.Jobs = append(res.Jobs, r)
+			continue
+		}
+		phase := "removed"
+		if job, ok := jobs.get(token); ok {
+			phase = phaseNames[job.state.getPhase()]
+		}
+		res.Jobs = append(res.Jobs, api.GroupJob{Token: api.Token{ID: token}, Phase: phase})
+	}
+	return res
+}
+
+// Post the group to its callback URL.
+func notify(callback string, g api.Group) {
+	if err := postJSON(callback, g); err != nil {
+		log.Errorf("cannot notify %s about group %s: %v", callback, g.ID, err)
+		return
+	}
+	log.Infof("notified %s about group %s", callback, g.ID)
+}
+
+// Create a new group: [POST] groups
+func createGroup(w http.ResponseWriter, r *http.Request) interface{} {
+	var req api.GroupRequest
+	if err := decodeBody(r, &req); err != nil {
+		return decodeError(err)
+	}
+	if req.Callback != "" {
+		if err := checkCallback(req.Callback); err != nil {
+			return api.Error{Status: http.StatusBadRequest, Message: err.Error()}
+		}
+	}
+	return groups.create(req.Callback)
+}
+
+// Get a group: [GET] groups?id=ID
+func getGroup(w http.ResponseWriter, r *http.Request) interface{} {
+	g, _, ok := groups.get(r.URL.Query().Get("id"))
+	if !ok {
+		return http.StatusNotFound
+	}
+	return g
+}
+
+// Close a group: [POST] groups/close?id=ID
+func closeGroup(w http.ResponseWriter, r *http.Request) interface{} {
+	g, ok := groups.close(r.URL.Query().Get("id"))
+	if !ok {
+		return http.StatusNotFound
+	}
+	return g
+}
+
+// Stream the completion of a group as server sent event: [GET]
+// groups/events?id=ID.  A single done event is sent once the group is
+// done.
+func groupEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	_, done, ok := groups.get(id)
+	if !ok {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		log.Infof("client %s disconnected", remoteIP(r))
+		return
+	}
+	g, _, ok := groups.get(id)
+	if !ok {
+		return
+	}
+	buf, err := json.Marshal(g)
+	if err != nil {
+		log.Errorf("cannot encode group %s: %v", id, err)
+		return
+	}
+	fmt.Fprintf(w, "event: done\ndata: %s\n\n", buf)
+	flusher.Flush()
+}
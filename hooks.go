@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+)
+
+// Maximal run time of a hook.
+const hookTimeout = 5 * time.Minute
+
+// Run an external hook.  The hook gets the JSON encoded input on
+// stdin and the language of the job in GOFILERD_LANGUAGE.  It must
+// write the JSON encoded output to stdout.
+func runHook(ctx context.Context, exe, language string, in, out interface{}) error {
+	buf, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, exe)
+	cmd.Env = append(os.Environ(), "GOFILERD_LANGUAGE="+language)
+	cmd.Stdin = bytes.NewReader(buf)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// The error ends up in the audit log, in events and in the
+		// log, and the hook could print document content to stderr.
+		if msg := strings.TrimSpace(stderr.String()); msg != "" && !noContentLogging {
+			return fmt.Errorf("hook %s: %v: %s", exe, err, msg)
+		}
+		return fmt.Errorf("hook %s: %v", exe, err)
+	}
+	if err := json.Unmarshal(stdout.Bytes(), out); err != nil {
+		return fmt.Errorf("hook %s: invalid output: %v", exe, err)
+	}
+	return nil
+}
+
+// Filter or augment a finished profile using the -postprocess hook.
+func postprocess(p gofiler.Profile, language string) (gofiler.Profile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	var res gofiler.Profile
+	if err := runHook(ctx, postprocessHook, language, p, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Transform the tokens of a job using the -preprocess hook.
+func preprocess(
+	ctx context.Context, tokens []gofiler.Token, language string,
+) ([]gofiler.Token, *api.Preprocessing, error) {
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	var res []gofiler.Token
+	if err := runHook(ctx, preprocessHook, language, tokens, &res); err != nil {
+		return nil, nil, err
+	}
+	pre := &api.Preprocessing{Tokens: len(tokens), Result: len(res)}
+	for i := 0; i < len(tokens) && i < len(res); i++ {
+		if tokens[i] != res[i] {
+			pre.Changed++
+		}
+	}
+	if len(tokens) > len(res) {
+		pre.Changed += len(tokens) - len(res)
+	} else {
+		pre.Changed += len(res) - len(tokens)
+	}
+	return res, pre, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/finkf/gofilerd/api"
+)
+
+// Clients may choose the token of a job themselves (api.Request.ID).
+// Resubmitting the same request with the same ID returns the token of
+// the existing job instead of starting a new one; submitting a
+// different request with an ID that is already in use fails with 409
+// and the submission of the existing job.  Since anonymous jobs can be
+// read by anyone who knows their token, client-supplied IDs must be at
+// least -token-length characters long.
+
+// Maximal length of client-supplied IDs.
+const maxClientIDLength = 64
+
+// Check that a client-supplied ID is URL and file name safe and not
+// shorter than generated tokens.
+func checkClientID(id string) error {
+	if id == "" {
+		return nil
+	}
+	if uint(len(id)) < tokenLength {
+		return fmt.Errorf("id too short: %d < %d", len(id), tokenLength)
+	}
+	if len(id) > maxClientIDLength {
+		return fmt.Errorf("id too long: %d > %d", len(id), maxClientIDLength)
+	}
+	for _, c := range id {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("invalid character %q in id", c)
+		}
+	}
+	return nil
+}
+
+// Return the hash of the request.  The ID is not part of the hash.
+func requestHash(request api.Request) string {
+	request.ID = ""
+	buf, err := json.Marshal(request)
+	if err != nil { // cannot happen
+		panic(err)
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(buf))
+}
+
+// Look up an existing job with the given client-supplied ID.  If the
+// job exists and was submitted with the same hash, its token is
+// returned.  If the hashes differ, a 409 api.Error is returned.  The
+// submission of jobs of other namespaces is never revealed.
+func existingJob(id, hash, namespace string) (interface{}, bool) {
+	if id == "" {
+		return nil, false
+	}
+	sub, owner, ok := findSubmission(id)
+	if !ok {
+		return nil, false
+	}
+	if owner != namespace {
+		return api.Error{
+			Status:  http.StatusConflict,
+			Message: fmt.Sprintf("id %s already in use", id),
+		}, true
+	}
+	if sub.Hash != hash {
+		return api.Error{
+			Status:     http.StatusConflict,
+			Message:    fmt.Sprintf("id %s already used by a different request", id),
+			Submission: &sub,
+		}, true
+	}
+	return api.Token{ID: id}, true
+}
+
+// Return the submission and the namespace of the job.
+func findSubmission(id string) (api.Submission, string, bool) {
+	if j, ok := jobs.get(id); ok {
+		return api.Submission{Token: api.Token{ID: id}, Hash: j.hash, Submitted: j.start},
+			j.namespace, true
+	}
+	if rec, ok := getSharedJob(id); ok {
+		return api.Submission{Token: api.Token{ID: id}, Hash: rec.Hash, Submitted: rec.Start},
+			rec.Namespace, true
+	}
+	return api.Submission{}, "", false
+}
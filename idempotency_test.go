@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckClientID(t *testing.T) {
+	defer func(n uint) { tokenLength = n }(tokenLength)
+	tokenLength = 16
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"", true},
+		{"my-document-00001", true},
+		{"abcdefghijklmnop", true},
+		{"A_b-C_d-0123456789", true},
+		{strings.Repeat("x", maxClientIDLength), true},
+		{"abcdefghijklmno", false},
+		{"short", false},
+		{strings.Repeat("x", maxClientIDLength+1), false},
+		{"my-document-0000/", false},
+		{"my document 00001", false},
+		{"my-document-0000ä", false},
+	}
+	for _, tc := range tests {
+		if err := checkClientID(tc.id); (err == nil) != tc.want {
+			t.Errorf("checkClientID(%q) = %v; want valid: %t", tc.id, err, tc.want)
+		}
+	}
+}
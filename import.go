@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Register an externally computed profile under a new token:
+// [POST] profiles/import?language=LANGUAGE[&namespace=NAMESPACE].  The
+// profile is served like the profile of a finished job, but it is
+// never signed.  Profiles imported with a namespace belong to the
+// namespace.  Requires the admin key.
+func importProfile(w http.ResponseWriter, r *http.Request) interface{} {
+	name := r.URL.Query().Get("namespace")
+	if name != "" && lookupNamespace(name) == nil {
+		return api.Error{
+			Status:  http.StatusNotFound,
+			Message: fmt.Sprintf("unknown namespace: %s", name),
+		}
+	}
+	var p gofiler.Profile
+	if err := decodeBody(r, &p); err != nil {
+		return decodeError(err)
+	}
+	request := submission{
+		Request:   api.Request{Language: r.URL.Query().Get("language")},
+		remoteIP:  remoteIP(r),
+		requestID: requestID(r),
+	}
+	request.namespace = name
+	pchan := make(chan result, 1)
+	state := newJobState(0)
+	state.finish()
+	summary := summarize(p, nil)
+	var token api.Token
+	for {
+		token.ID = generateRandomID()
+		res := jobs.put(token.ID, job{
+			pending:   pchan,
+			cancel:    func() {},
+			state:     state,
+			language:  request.Language,
+			owner:     request.remoteIP,
+			namespace: request.namespace,
+			imported:  true,
+		})
+		switch res {
+		case putJobOK:
+			if !shareJob(token.ID, sharedJob{
+				Phase:     phaseNames[phaseDone],
+				Start:     time.Now(),
+				Language:  request.Language,
+				Owner:     request.remoteIP,
+				Namespace: request.namespace,
+				Profile:   p,
+				Imported:  true,
+				Summary:   summary,
+			}) {
+				jobs.del(token.ID)
+				continue
+			}
+			state.deliver(pchan, result{profile: storeProfile(token.ID, "", p), summary: summary})
+			close(pchan)
+			log.Infof("imported profile %s", token.ID)
+			auditJob("imported", token.ID, request, nil)
+			return token
+		case putJobFull, putJobOverloaded:
+			log.Infof("cannot import profile: too many jobs")
+			return http.StatusServiceUnavailable
+		}
+	}
+}
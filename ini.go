@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ini holds the key value pairs of a language configuration by
+// section: [section] key = value.
+type ini map[string]map[string]string
+
+// Read the language configuration of the profiler.
+func readINI(path string) (ini, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	res := ini{"": make(map[string]string)}
+	section := ""
+	s := bufio.NewScanner(in)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if res[section] == nil {
+				res[section] = make(map[string]string)
+			}
+			continue
+		}
+		pos := strings.IndexByte(line, '=')
+		if pos == -1 {
+			return nil, fmt.Errorf("%s:%d: invalid line: %s", path, n, line)
+		}
+		key := strings.TrimSpace(line[:pos])
+		val := strings.Trim(strings.TrimSpace(line[pos+1:]), `"`)
+		res[section][key] = val
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Return the path of a file of the configuration.  Relative paths
+// are relative to the directory of the configuration file.  Returns
+// false if the key does not exist.
+func (i ini) path(config, section, key string) (string, bool) {
+	val, ok := i[section][key]
+	if !ok || val == "" {
+		return "", false
+	}
+	if filepath.IsAbs(val) {
+		return val, true
+	}
+	return filepath.Join(filepath.Dir(config), val), true
+}
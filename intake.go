@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Queue group of the intake subscription.  Requests are distributed
+// among all daemons that consume the same subject.
+const intakeQueue = "gofilerd"
+
+// Consume profiling requests from a NATS subject
+// (nats://host:4222/subject).  Each message is an api.Request.  The
+// result (an api.Profile or an api.Error) is published to the reply
+// subject of the message or to subject.results if the message has no
+// reply subject.
+func openIntake(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "nats" {
+		return fmt.Errorf("unsupported intake: %s", u.Scheme)
+	}
+	subject := strings.Trim(u.Path, "/")
+	if subject == "" {
+		return fmt.Errorf("missing intake subject: %s", rawurl)
+	}
+	conn, err := dialNATS(u)
+	if err != nil {
+		return err
+	}
+	return conn.subscribe(subject, intakeQueue, func(msg natsMsg) {
+		reply := msg.reply
+		if reply == "" {
+			reply = subject + ".results"
+		}
+		buf, err := json.Marshal(intake(msg))
+		if err != nil {
+			log.Errorf("cannot encode intake result: %v", err)
+			return
+		}
+		if err := conn.publish(reply, buf); err != nil {
+			log.Errorf("cannot publish intake result to %s: %v", reply, err)
+		}
+	})
+}
+
+// Run the profiler for the request of the message and wait for its
+// result.
+func intake(msg natsMsg) interface{} {
+	data := submission{remoteIP: "nats:" + msg.subject, requestID: generateRandomID()}
+	log.Infof("handling request %s from %s", data.requestID, data.remoteIP)
+	if err := unmarshalJSON(msg.data, &data.Request); err != nil {
+		log.Info(err)
+		return intakeError(data.requestID, http.StatusBadRequest)
+	}
+	res := withValidLanguage(profile)(data)
+	token, ok := res.(api.Token)
+	if !ok {
+		return intakeError(data.requestID, res)
+	}
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		res = getProfile(ctx, token)
+		cancel()
+		p, ok := res.(api.Profile)
+		if !ok {
+			return intakeError(data.requestID, res)
+		}
+		if p.Done {
+			return p
+		}
+	}
+}
+
+// Convert the result of a handler into an api.Error.
+func intakeError(id string, res interface{}) api.Error {
+	switch t := res.(type) {
+	case api.Error:
+		t.RequestID = id
+		return t
+	case int:
+		return api.Error{Status: t, Message: http.StatusText(t), RequestID: id}
+	case error:
+		return api.Error{Status: http.StatusInternalServerError, Message: t.Error(), RequestID: id}
+	default:
+		return api.Error{Status: http.StatusInternalServerError, Message: fmt.Sprintf("%v", t), RequestID: id}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// The files of the language configurations can be verified against a
+// manifest (-backend-manifest) in the format of sha256sum:
+//
+//	HEX  german.ini
+//	HEX  german/lexicon.fbdic
+//
+// Relative paths are relative to the directory of the manifest.  All
+// files of a configuration (see languageFiles) must be listed with
+// matching checksums.  Languages that fail the verification are not
+// served.  Configurations are verified on startup and again whenever
+// their files or the manifest change.
+
+const verified = "verified"
+
+var integrity struct {
+	path    string
+	stamp   string            // size and modification time of the manifest
+	sums    map[string]string // absolute path -> hex encoded sha256
+	results map[string]verification
+	l       sync.Mutex
+}
+
+type verification struct {
+	stamp string // stamp of the files of the configuration
+	err   error
+}
+
+// Open the manifest and verify all configurations of the backend.
+func openManifest(path string) error {
+	integrity.path = path
+	integrity.l.Lock()
+	err := loadManifest()
+	integrity.l.Unlock()
+	if err != nil {
+		return err
+	}
+	lcs, err := gofiler.ListLanguages(backend)
+	if err != nil {
+		return err
+	}
+	for _, lc := range lcs {
+		if err := verifyLanguage(lc.Path); err != nil {
+			log.Errorf("cannot verify %s: %v", lc.Path, err)
+		} else {
+			log.Infof("verified %s", lc.Path)
+		}
+	}
+	return nil
+}
+
+// (Re)load the manifest if it changed.  The caller must hold the lock.
+func loadManifest() error {
+	fi, err := os.Stat(integrity.path)
+	if err != nil {
+		return fmt.Errorf("cannot read manifest: %v", err)
+	}
+	stamp := fmt.Sprintf("%d:%d", fi.Size(), fi.ModTime().UnixNano())
+	if stamp == integrity.stamp {
+		return nil
+	}
+	in, err := os.Open(integrity.path)
+	if err != nil {
+		return fmt.Errorf("cannot read manifest: %v", err)
+	}
+	defer in.Close()
+	dir, err := filepath.Abs(filepath.Dir(integrity.path))
+	if err != nil {
+		return fmt.Errorf("cannot read manifest: %v", err)
+	}
+	sums := make(map[string]string)
+	s := bufio.NewScanner(in)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || len(fields[0]) != 2*sha256.Size {
+			return fmt.Errorf("invalid manifest %s: line %d", integrity.path, n)
+		}
+		// sha256sum marks files read in binary mode with '*'
+		path := strings.TrimPrefix(strings.TrimSpace(fields[1]), "*")
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		sums[filepath.Clean(path)] = strings.ToLower(fields[0])
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("cannot read manifest: %v", err)
+	}
+	integrity.stamp = stamp
+	integrity.sums = sums
+	integrity.results = make(map[string]verification)
+	log.Infof("loaded manifest %s (%d files)", integrity.path, len(sums))
+	return nil
+}
+
+// Verify the files of the language configuration against the
+// manifest.  Returns nil if no manifest is used.
+func verifyLanguage(config string) error {
+	if integrity.path == "" {
+		return nil
+	}
+	files, stamp, err := languageFiles(config)
+	if err != nil {
+		return fmt.Errorf("cannot verify %s", filepath.Base(config))
+	}
+	integrity.l.Lock()
+	defer integrity.l.Unlock()
+	if err := loadManifest(); err != nil {
+		return err
+	}
+	if v, ok := integrity.results[config]; ok && v.stamp == stamp {
+		return v.err
+	}
+	err = verifyFiles(filepath.Dir(config), files)
+	integrity.results[config] = verification{stamp: stamp, err: err}
+	return err
+}
+
+// Check the files against the manifest.  The errors name the files
+// relative to dir.  The caller must hold the lock.
+func verifyFiles(dir string, files []string) error {
+	for _, file := range files {
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			name = filepath.Base(file)
+		}
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return fmt.Errorf("cannot verify %s", name)
+		}
+		want, ok := integrity.sums[abs]
+		if !ok {
+			return fmt.Errorf("not in manifest: %s", name)
+		}
+		got, err := sha256File(file)
+		if err != nil {
+			return fmt.Errorf("cannot verify %s", name)
+		}
+		if got != want {
+			return fmt.Errorf("checksum mismatch: %s", name)
+		}
+	}
+	return nil
+}
+
+func sha256File(path string) (string, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, in); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Return the verification state of the language configuration:
+// verified or the reason why the verification failed.
+func verificationState(config string) string {
+	if err := verifyLanguage(config); err != nil {
+		return err.Error()
+	}
+	return verified
+}
+
+// errUnverified is the error of languages whose configuration failed
+// the verification.
+type errUnverified struct {
+	language string
+	err      error
+}
+
+func (e errUnverified) Error() string {
+	return fmt.Sprintf("language %s failed verification: %v", e.language, e.err)
+}
+
+func (e errUnverified) apiError() api.Error {
+	return api.Error{
+		Status:  http.StatusServiceUnavailable,
+		Message: fmt.Sprintf("language %s is unavailable", e.language),
+		Reason:  reasonUnverified,
+	}
+}
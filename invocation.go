@@ -0,0 +1,103 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Every job records how the profiler is invoked, so that results can
+// be reproduced later on: the command line, the environment variables
+// that influence the profiler, the checksums of the language
+// configuration and of the profiler executable and the version of the
+// gofiler library.  The
+// invocation is part of the job's status (GET /jobs/{token}) and of
+// the submitted record of the audit log.
+
+// Environment variables that are recorded with the invocation.  Other
+// variables are never recorded (they might contain secrets).  TMPDIR
+// is not recorded: every profiler process gets its own (see
+// setupScratchDir).
+var invocationEnv = []string{
+	"PATH",
+	"LANG",
+	"LANGUAGE",
+	"LC_ALL",
+	"LC_COLLATE",
+	"LC_CTYPE",
+	"LD_LIBRARY_PATH",
+}
+
+// Return the arguments of the profiler.  They must match the
+// arguments that runGofiler passes to the profiler.
+func profilerArgs(config string) []string {
+	return []string{
+		"--config", config,
+		"--types",
+		"--sourceFormat", "TXT",
+		"--sourceFile", profilerInput,
+		"--jsonOutput", profilerOutput,
+	}
+}
+
+// Return the invocation of the profiler for the given language
+// configuration and its checksum.
+func newInvocation(config, checksum, profiler string) *api.Invocation {
+	if path, err := filepath.Abs(config); err == nil {
+		config = path
+	}
+	if path, err := resolveProfiler(profiler); err == nil {
+		profiler = path
+	}
+	var env []string
+	for _, key := range invocationEnv {
+		if val, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+val)
+		}
+	}
+	binary, err := profilerChecksum(profiler)
+	if err != nil {
+		log.Errorf("cannot compute checksum of %s: %v", profiler, err)
+	}
+	return &api.Invocation{
+		Command:  append([]string{profiler}, profilerArgs(config)...),
+		Env:      env,
+		Checksum: checksum,
+		Binary:   binary,
+		Gofiler:  gofilerVersion(),
+		Sandbox:  sandboxExecutable != "",
+	}
+}
+
+var gofilerVersionOnce struct {
+	version string
+	once    sync.Once
+}
+
+// Return the version of the gofiler library the daemon was built
+// with.  Returns unknown if the daemon was built without module
+// information.
+func gofilerVersion() string {
+	gofilerVersionOnce.once.Do(func() {
+		gofilerVersionOnce.version = "unknown"
+		info, ok := debug.ReadBuildInfo()
+		if !ok {
+			return
+		}
+		for _, dep := range info.Deps {
+			if dep.Path != "github.com/finkf/gofiler" {
+				continue
+			}
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			gofilerVersionOnce.version = dep.Version
+			return
+		}
+	})
+	return gofilerVersionOnce.version
+}
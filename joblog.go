@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximal number of output lines of the profiler that are kept per
+// job.  Older lines are dropped.
+const maxLogLines = 10000
+
+// jobLog holds the captured output of the profiler of a job.  The
+// output is not captured if -no-content-logging is set.
+type jobLog struct {
+	lines   []string
+	dropped int           // Number of dropped lines
+	changed chan struct{} // Closed (and replaced) on every change
+	closed  bool          // Set once the profiler finished
+	l       sync.Mutex
+}
+
+// Append a line of the profiler's output.
+func (l *jobLog) append(line string) {
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.lines = append(l.lines, line)
+	if len(l.lines) > maxLogLines {
+		n := len(l.lines) - maxLogLines
+		l.lines = append(l.lines[:0], l.lines[n:]...)
+		l.dropped += n
+	}
+	l.notify()
+}
+
+// Close the log after the profiler finished.
+func (l *jobLog) close() {
+	l.l.Lock()
+	defer l.l.Unlock()
+	l.closed = true
+	l.notify()
+}
+
+// Wake up all readers.  The caller must hold the lock.
+func (l *jobLog) notify() {
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+}
+
+// Return the lines starting with the given line number, the number of
+// the next line, a channel that is closed on the next change and
+// whether the log is closed.
+func (l *jobLog) read(from int) ([]string, int, <-chan struct{}, bool) {
+	l.l.Lock()
+	defer l.l.Unlock()
+	if from < l.dropped {
+		from = l.dropped
+	}
+	lines := append([]string(nil), l.lines[from-l.dropped:]...)
+	if l.changed == nil {
+		l.changed = make(chan struct{})
+	}
+	return lines, l.dropped + len(l.lines), l.changed, l.closed
+}
+
+// Stream the captured output of the profiler of a job as plain text:
+// [GET] jobs/{token}/log.  With follow=true the connection is kept
+// open and new output is streamed until the profiler finishes or the
+// client disconnects.
+func getJobLog(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "token")
+	if !mayAccess(r, id) {
+		http.Error(w, "", http.StatusForbidden)
+		return
+	}
+	job, ok := jobs.get(id)
+	if !ok {
+		http.Error(w, "", http.StatusNotFound)
+		return
+	}
+	if noContentLogging {
+		http.Error(w, "profiler output is not recorded", http.StatusNotFound)
+		return
+	}
+	follow := r.URL.Query().Get("follow") == "true"
+	flusher, ok := w.(http.Flusher)
+	if follow && !ok {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	next := 0
+	for {
+		lines, n, changed, closed := job.state.console.read(next)
+		for _, line := range lines {
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return
+			}
+		}
+		next = n
+		if !follow || closed {
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			log.Infof("client %s disconnected", remoteIP(r))
+			return
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// REST resources of jobs:
+//   [POST] /jobs                 submit a job (like POST /profile)
+//   [GET] /jobs/{token}          status of the job
+//   [GET] /jobs/{token}/result   profile of the job (like GET /profile)
+//   [DELETE] /jobs/{token}       cancel the job (like POST /profile/cancel)
+//   [GET] /jobs/{token}/log      output of the profiler (follow=true streams it)
+
+// Return the status of the job.
+func getJob(w http.ResponseWriter, r *http.Request) interface{} {
+	if !mayAccess(r, pathParam(r, "token")) {
+		return http.StatusForbidden
+	}
+	status := jobStatus(api.Token{ID: pathParam(r, "token")}, locale(r.Context()))
+	if !status.Found {
+		return http.StatusNotFound
+	}
+	return status
+}
+
+// Cancel the job.  Finished jobs are deleted together with their
+// profiles.
+func deleteJob(w http.ResponseWriter, r *http.Request) interface{} {
+	token := api.Token{ID: pathParam(r, "token")}
+	if !mayAccess(r, token.ID) {
+		return http.StatusForbidden
+	}
+	if len(jobs.purge(func(id string, _ job) bool { return id == token.ID })) == 0 {
+		return http.StatusNotFound
+	}
+	log.Infof("removed job %v", token)
+	return api.Removed{Removed: []api.Token{token}}
+}
@@ -0,0 +1,25 @@
+//go:build !jsoniter
+// +build !jsoniter
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/finkf/gofilerd/api"
+)
+
+// The JSON implementation used for profiling requests and responses.
+// Build with -tags jsoniter to use github.com/json-iterator/go.
+
+func newJSONEncoder(w io.Writer) *json.Encoder {
+	return json.NewEncoder(w)
+}
+
+func unmarshalJSON(data []byte, x interface{}) error {
+	if r, ok := x.(*api.Request); ok {
+		return r.Decode(data, json.Unmarshal)
+	}
+	return json.Unmarshal(data, x)
+}
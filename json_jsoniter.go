@@ -0,0 +1,26 @@
+//go:build jsoniter
+// +build jsoniter
+
+package main
+
+import (
+	"io"
+
+	"github.com/finkf/gofilerd/api"
+	jsoniter "github.com/json-iterator/go"
+)
+
+// The JSON implementation used for profiling requests and responses.
+// Build without the jsoniter tag to use encoding/json.
+var jsonAPI = jsoniter.ConfigCompatibleWithStandardLibrary
+
+func newJSONEncoder(w io.Writer) *jsoniter.Encoder {
+	return jsonAPI.NewEncoder(w)
+}
+
+func unmarshalJSON(data []byte, x interface{}) error {
+	if r, ok := x.(*api.Request); ok {
+		return r.Decode(data, jsonAPI.Unmarshal)
+	}
+	return jsonAPI.Unmarshal(data, x)
+}
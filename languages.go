@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Find the configuration of the language.  Unlike
+// gofiler.FindLanguage, it fails with a languageConflict if more than
+// one configuration in the backend claims the language (e.g.
+// German.ini and german.ini).
+func findLanguage(language string) (gofiler.LanguageConfiguration, error) {
+	return findLanguageIn(backend, language)
+}
+
+// Find the configuration of the language in the given backend
+// directory.
+func findLanguageIn(dir, language string) (gofiler.LanguageConfiguration, error) {
+	lcs, err := gofiler.ListLanguages(dir)
+	if err != nil {
+		return gofiler.LanguageConfiguration{}, err
+	}
+	var found []gofiler.LanguageConfiguration
+	for _, lc := range lcs {
+		if lc.Language == strings.ToLower(language) {
+			found = append(found, lc)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return gofiler.LanguageConfiguration{}, gofiler.ErrorLanguageNotFound
+	case 1:
+		return found[0], nil
+	default:
+		return gofiler.LanguageConfiguration{}, languageConflict{
+			language:   found[0].Language,
+			candidates: configNames(found),
+		}
+	}
+}
+
+// Group the names of the configurations of all languages that are
+// claimed by more than one configuration.
+func languageConflicts(lcs []gofiler.LanguageConfiguration) map[string][]string {
+	byLanguage := make(map[string][]gofiler.LanguageConfiguration)
+	for _, lc := range lcs {
+		byLanguage[lc.Language] = append(byLanguage[lc.Language], lc)
+	}
+	var conflicts map[string][]string
+	for language, found := range byLanguage {
+		if len(found) < 2 {
+			continue
+		}
+		if conflicts == nil {
+			conflicts = make(map[string][]string)
+		}
+		conflicts[language] = configNames(found)
+	}
+	return conflicts
+}
+
+func configNames(lcs []gofiler.LanguageConfiguration) []string {
+	names := make([]string, len(lcs))
+	for i, lc := range lcs {
+		names[i] = filepath.Base(lc.Path)
+	}
+	return names
+}
+
+// languageConflict is the error of ambiguous languages.
+type languageConflict struct {
+	language   string
+	candidates []string
+}
+
+func (c languageConflict) Error() string {
+	return fmt.Sprintf("ambiguous language %s: %s",
+		c.language, strings.Join(c.candidates, ", "))
+}
+
+func (c languageConflict) apiError() api.Error {
+	return api.Error{
+		Status:     http.StatusConflict,
+		Message:    c.Error(),
+		Candidates: c.candidates,
+	}
+}
+
+// Find the language configuration of the {language} path parameter.
+func withLanguage(
+	h func(gofiler.LanguageConfiguration, *http.Request) interface{},
+) func(http.ResponseWriter, *http.Request) interface{} {
+	return func(w http.ResponseWriter, r *http.Request) interface{} {
+		lc, res := usableLanguage(pathParam(r, "language"))
+		if res != nil {
+			return res
+		}
+		return h(lc, r)
+	}
+}
+
+// Find the language configuration and verify it.  If the language
+// cannot be used, the according response is returned.
+func usableLanguage(language string) (gofiler.LanguageConfiguration, interface{}) {
+	lc, err := findLanguage(language)
+	if err == gofiler.ErrorLanguageNotFound {
+		return lc, http.StatusNotFound
+	}
+	if c, ok := err.(languageConflict); ok {
+		return lc, c.apiError()
+	}
+	if err != nil {
+		return lc, err
+	}
+	if err := verifyLanguage(lc.Path); err != nil {
+		e := errUnverified{language: lc.Language, err: err}
+		log.Errorf("cannot serve %s: %v", lc.Language, e)
+		return lc, e.apiError()
+	}
+	return lc, nil
+}
+
+// Return the historical patterns and the OCR pattern settings of the
+// language configuration.
+func getPatterns(lc gofiler.LanguageConfiguration, r *http.Request) interface{} {
+	rules, err := loadPatterns(lc)
+	if err != nil {
+		return err
+	}
+	ocr, err := loadOCRSettings(lc)
+	if err != nil {
+		return err
+	}
+	return api.Patterns{Language: lc.Language, Historical: rules, OCR: ocr}
+}
+
+// Load the settings of the OCR error patterns.  These are all keys of
+// the configuration that mention OCR (e.g. patternCutoff_ocr).
+func loadOCRSettings(lc gofiler.LanguageConfiguration) (map[string]string, error) {
+	cfg, err := readINI(lc.Path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read language configuration: %v", err)
+	}
+	var res map[string]string
+	for section, keys := range cfg {
+		for key, val := range keys {
+			if !strings.Contains(strings.ToLower(key), "ocr") {
+				continue
+			}
+			if res == nil {
+				res = make(map[string]string)
+			}
+			if section != "" {
+				key = section + "." + key
+			}
+			res[key] = val
+		}
+	}
+	return res, nil
+}
+
+// Load the historical patterns of the language configuration.  The
+// patterns are read from the patternFile of the language_model
+// section; their weights from the patternWeightsFile if it exists.
+func loadPatterns(lc gofiler.LanguageConfiguration) ([]api.PatternRule, error) {
+	cfg, err := readINI(lc.Path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read language configuration: %v", err)
+	}
+	path, ok := cfg.path(lc.Path, "language_model", "patternFile")
+	if !ok {
+		return nil, nil
+	}
+	weights := make(map[string]float64)
+	if wpath, ok := cfg.path(lc.Path, "language_model", "patternWeightsFile"); ok {
+		err := readPatterns(wpath, func(left, right string, rest []string) {
+			if len(rest) > 0 {
+				if w, err := strconv.ParseFloat(rest[0], 64); err == nil {
+					weights[left+":"+right] = w
+				}
+			}
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot read pattern weights: %v", err)
+		}
+	}
+	var rules []api.PatternRule
+	err = readPatterns(path, func(left, right string, _ []string) {
+		rules = append(rules, api.PatternRule{
+			Left:   left,
+			Right:  right,
+			Weight: weights[left+":"+right],
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot read patterns: %v", err)
+	}
+	return rules, nil
+}
+
+// Read a pattern file.  Each line contains a pattern (left:right or
+// left right) optionally followed by further fields.
+func readPatterns(path string, f func(left, right string, rest []string)) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	s := bufio.NewScanner(in)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if pos := strings.IndexByte(fields[0], ':'); pos != -1 {
+			f(fields[0][:pos], fields[0][pos+1:], fields[1:])
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("%s: invalid pattern: %s", path, s.Text())
+		}
+		f(fields[0], fields[1], fields[2:])
+	}
+	return s.Err()
+}
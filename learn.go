@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// The adaptive state of a corpus namespace is its recorded feedback
+// (see feedback.go).  Besides the accepted corrections of single OCR
+// tokens, the OCR error patterns of all corrections are learned, so
+// every new document of the corpus profits from all previous
+// corrections.
+
+// Return the OCR error patterns of the corrections of the namespace
+// with the number of corrections that contain them.
+func corpusPatterns(ns string) map[gofiler.Pattern]int {
+	feedback.l.RLock()
+	defer feedback.l.RUnlock()
+	res := make(map[gofiler.Pattern]int)
+	for ocr, corrections := range feedback.m[ns] {
+		for cor, n := range corrections {
+			for _, pat := range correctionPatterns(ocr, cor) {
+				res[pat] += n
+			}
+		}
+	}
+	return res
+}
+
+// Align the OCR token with its correction and return the differences
+// as OCR error patterns.  Left is the true pattern of the correction,
+// Right the pattern of the OCR token and Pos the position in the
+// correction.  Adjacent edits form one pattern (e.g. m:rn).
+func correctionPatterns(ocr, cor string) []gofiler.Pattern {
+	a, b := []rune(cor), []rune(ocr)
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			sub := d[i-1][j-1]
+			if a[i-1] != b[j-1] {
+				sub++
+			}
+			d[i][j] = min3(sub, d[i-1][j]+1, d[i][j-1]+1)
+		}
+	}
+	var res []gofiler.Pattern
+	var left, right []rune
+	flush := func(pos int) {
+		if len(left) > 0 || len(right) > 0 {
+			res = append(res, gofiler.Pattern{
+				Left:  string(reverse(left)),
+				Right: string(reverse(right)),
+				Pos:   pos,
+			})
+			left, right = nil, nil
+		}
+	}
+	i, j := len(a), len(b)
+	for i > 0 || j > 0 {
+		switch {
+		case i > 0 && j > 0 && a[i-1] == b[j-1] && d[i][j] == d[i-1][j-1]:
+			flush(i)
+			i, j = i-1, j-1
+		case i > 0 && j > 0 && d[i][j] == d[i-1][j-1]+1:
+			left, right = append(left, a[i-1]), append(right, b[j-1])
+			i, j = i-1, j-1
+		case i > 0 && d[i][j] == d[i-1][j]+1:
+			left = append(left, a[i-1])
+			i--
+		default:
+			right = append(right, b[j-1])
+			j--
+		}
+	}
+	flush(0)
+	// The patterns were collected from the end of the words.
+	for x, y := 0, len(res)-1; x < y; x, y = x+1, y-1 {
+		res[x], res[y] = res[y], res[x]
+	}
+	return res
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func reverse(rs []rune) []rune {
+	for i, j := 0, len(rs)-1; i < j; i, j = i+1, j-1 {
+		rs[i], rs[j] = rs[j], rs[i]
+	}
+	return rs
+}
+
+// Boost candidates whose OCR patterns were learned from the
+// corrections of the namespace.  The weight of a candidate is
+// multiplied with 1 + b*log10(1+n) for each learned pattern, where n
+// is the number of corrections with the pattern and b is
+// -frequency-boost.
+func boostPatterns(p gofiler.Profile, ns string) {
+	patterns := corpusPatterns(ns)
+	if len(patterns) == 0 {
+		return
+	}
+	for w, e := range p {
+		factors := make([]float64, len(e.Candidates))
+		for j, c := range e.Candidates {
+			factors[j] = 1
+			for _, pat := range c.OCRPatterns {
+				n := patterns[gofiler.Pattern{Left: pat.Left, Right: pat.Right}]
+				factors[j] *= 1 + frequencyBoost*math.Log10(1+float64(n))
+			}
+		}
+		p[w] = reweight(e, factors)
+	}
+}
+
+// Get the adaptive state of a namespace:
+// [GET] adaptive?namespace=NAMESPACE
+func getAdaptiveState(w http.ResponseWriter, r *http.Request) interface{} {
+	ns := r.URL.Query().Get("namespace")
+	if !hasFeedback(ns) {
+		return http.StatusNotFound
+	}
+	state := api.AdaptiveState{Namespace: ns}
+	feedback.l.RLock()
+	for _, corrections := range feedback.m[ns] {
+		state.Forms++
+		for _, n := range corrections {
+			state.Corrections += n
+		}
+	}
+	feedback.l.RUnlock()
+	for pat, n := range corpusPatterns(ns) {
+		state.Patterns = append(state.Patterns, api.PatternCount{
+			Left:   pat.Left,
+			Right:  pat.Right,
+			Tokens: n,
+		})
+	}
+	sort.Slice(state.Patterns, func(i, j int) bool {
+		a, b := state.Patterns[i], state.Patterns[j]
+		if a.Tokens != b.Tokens {
+			return a.Tokens > b.Tokens
+		}
+		if a.Left != b.Left {
+			return a.Left < b.Left
+		}
+		return a.Right < b.Right
+	})
+	return state
+}
+
+// Reset the adaptive state of a namespace:
+// [DELETE] adaptive?namespace=NAMESPACE
+func deleteAdaptiveState(w http.ResponseWriter, r *http.Request) interface{} {
+	ns := r.URL.Query().Get("namespace")
+	feedback.l.Lock()
+	defer feedback.l.Unlock()
+	if _, ok := feedback.m[ns]; !ok {
+		return http.StatusNotFound
+	}
+	if dataDir != "" {
+		err := os.Remove(filepath.Join(feedbackDir(), ns+".json"))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot reset feedback: %v", err)
+		}
+	}
+	delete(feedback.m, ns)
+	log.Infof("reset adaptive state of %s", ns)
+	return api.AdaptiveState{Namespace: ns}
+}
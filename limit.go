@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Counts resources (connections or requests) per client address.
+type ipCounter struct {
+	m map[string]uint
+	l sync.Mutex
+}
+
+// Increment the counter for the given address.  Returns false if the
+// counter already reached max.  A max of 0 means unlimited.
+func (c *ipCounter) acquire(ip string, max uint) bool {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.m == nil {
+		c.m = make(map[string]uint)
+	}
+	if max > 0 && c.m[ip] >= max {
+		return false
+	}
+	c.m[ip]++
+	return true
+}
+
+// Decrement the counter for the given address.
+func (c *ipCounter) release(ip string) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	if c.m[ip] <= 1 {
+		delete(c.m, ip)
+		return
+	}
+	c.m[ip]--
+}
+
+var inFlight ipCounter
+
+// Limit the number of concurrent requests per client.  Requests that
+// exceed the limit are answered with 429 Too Many Requests.
+func withRequestLimit(
+	h func(http.ResponseWriter, *http.Request),
+) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r)
+		if !inFlight.acquire(ip, maxRequestsPerIP) {
+			log.Infof("too many concurrent requests from %s", ip)
+			http.Error(w, "", http.StatusTooManyRequests)
+			return
+		}
+		defer inFlight.release(ip)
+		h(w, r)
+	}
+}
+
+// Report the load of the daemon in the headers of every response:
+// X-Queue-Length is the number of accepted jobs (running or waiting
+// to be fetched), X-Running-Jobs the number of running profiler
+// processes and X-Capacity the maximal number of accepted jobs.
+func withBackpressure(
+	h func(http.ResponseWriter, *http.Request),
+) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Queue-Length", strconv.Itoa(jobs.len()))
+		w.Header().Set("X-Running-Jobs", strconv.FormatInt(atomic.LoadInt64(&running), 10))
+		w.Header().Set("X-Capacity", strconv.FormatUint(uint64(maxJobs), 10))
+		h(w, r)
+	}
+}
+
+// limitListener closes new connections of clients that already have
+// too many open connections.  Connections from trusted proxies are
+// never limited.
+type limitListener struct {
+	net.Listener
+	conns ipCounter
+	max   uint
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := hostOf(c.RemoteAddr().String())
+		if containsIP(trustedNets, ip) {
+			return c, nil
+		}
+		if !l.conns.acquire(ip, l.max) {
+			log.Infof("too many open connections from %s", ip)
+			c.Close()
+			continue
+		}
+		return &limitConn{Conn: c, release: func() { l.conns.release(ip) }}, nil
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
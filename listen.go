@@ -0,0 +1,28 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/finkf/gofilerd/listeners"
+	log "github.com/sirupsen/logrus"
+)
+
+// The daemon listens on a comma separated list of addresses
+// (-listen and -admin-listen, see package listeners).  The bound
+// addresses are logged and written to -addr-file.
+
+// Log the bound addresses of the listeners.  Returns the NAME ADDRESS
+// lines of -addr-file.
+func reportAddrs(name string, ls listeners.List) []string {
+	var lines []string
+	for _, addr := range ls.Addrs() {
+		log.Infof("%s server listening on %s", name, addr)
+		lines = append(lines, name+" "+addr)
+	}
+	return lines
+}
+
+func writeAddrFile(path string, lines []string) error {
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
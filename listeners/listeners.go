@@ -0,0 +1,92 @@
+// Package listeners opens the listeners of a comma separated list of
+// addresses and reports the addresses they are bound to.  Addresses
+// without a host (e.g. :9998) listen on all IPv4 and IPv6 addresses.
+// IPv4 and IPv6 hosts listen on their protocol only, so
+// 0.0.0.0:9998,[::]:9998 binds both stacks separately.  With port 0,
+// the system chooses a free port.
+package listeners
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// List is the list of listeners of a comma separated list of
+// addresses.
+type List []net.Listener
+
+// Open listens on the comma separated addresses.  If any address
+// cannot be bound, the already opened listeners are closed.
+func Open(addrs string) (List, error) {
+	var ls List
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		l, err := net.Listen(Network(addr), addr)
+		if err != nil {
+			ls.Close()
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	if len(ls) == 0 {
+		return nil, fmt.Errorf("no address to listen on: %q", addrs)
+	}
+	return ls, nil
+}
+
+// Network returns the network of the address: tcp4 and tcp6 for IPv4
+// and IPv6 hosts and tcp (dual-stack) otherwise.
+func Network(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "tcp" // net.Listen reports the error
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "tcp"
+	case ip.To4() != nil:
+		return "tcp4"
+	default:
+		return "tcp6"
+	}
+}
+
+// Addrs returns the bound addresses of the listeners.  With port 0,
+// they contain the chosen ports.
+func (ls List) Addrs() []string {
+	addrs := make([]string, len(ls))
+	for i, l := range ls {
+		addrs[i] = l.Addr().String()
+	}
+	return addrs
+}
+
+// Serve serves the handler on all listeners.  Each listener is
+// wrapped with wrap (e.g. to limit its connections).  Returns the first
+// error.
+func (ls List) Serve(wrap func(net.Listener) net.Listener, h http.Handler) error {
+	errs := make(chan error, len(ls))
+	for _, l := range ls {
+		go func(l net.Listener) {
+			errs <- http.Serve(wrap(l), h)
+		}(l)
+	}
+	return <-errs
+}
+
+// Close closes all listeners.  Returns the first error.
+func (ls List) Close() error {
+	var first error
+	for _, l := range ls {
+		if err := l.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,24 @@
+package listeners
+
+import "testing"
+
+func TestNetwork(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{":9998", "tcp"},
+		{"localhost:9998", "tcp"},
+		{"example.org:0", "tcp"},
+		{"0.0.0.0:9998", "tcp4"},
+		{"127.0.0.1:0", "tcp4"},
+		{"[::]:9998", "tcp6"},
+		{"[::1]:0", "tcp6"},
+		{"[::ffff:127.0.0.1]:9998", "tcp4"},
+		{"invalid", "tcp"},
+	}
+	for _, tc := range tests {
+		if got := Network(tc.addr); got != tc.want {
+			t.Errorf("Network(%q) = %q; want %q", tc.addr, got, tc.want)
+		}
+	}
+}
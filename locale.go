@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Languages of the human readable status messages.  The first one is
+// the default.
+var locales = []string{"en", "de"}
+
+type localeKey struct{}
+
+// Select the language of the status messages using the
+// Accept-Language header of the request.
+func withLocale(
+	h func(http.ResponseWriter, *http.Request),
+) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lang := negotiateLocale(r.Header["Accept-Language"])
+		h(w, r.WithContext(context.WithValue(r.Context(), localeKey{}, lang)))
+	}
+}
+
+// Return the language of the status messages of the request.
+func locale(ctx context.Context) string {
+	if lang, ok := ctx.Value(localeKey{}).(string); ok {
+		return lang
+	}
+	return locales[0]
+}
+
+// Return the supported language with the highest quality value.
+// Regional variants (de-AT) match their language (de).
+func negotiateLocale(header []string) string {
+	best, bestq := locales[0], 0.0
+	for _, vals := range header {
+		for _, val := range strings.Split(vals, ",") {
+			params := strings.Split(val, ";")
+			tag := strings.ToLower(strings.TrimSpace(params[0]))
+			if i := strings.IndexByte(tag, '-'); i >= 0 {
+				tag = tag[:i]
+			}
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, _ = strconv.ParseFloat(param[2:], 64)
+				}
+			}
+			if q <= bestq {
+				continue
+			}
+			for _, l := range locales {
+				if tag == l {
+					best, bestq = l, q
+				}
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximal number of cached lookups.
+const maxLookups = 10000
+
+// Maximal run time of the profiler for a lookup.
+const lookupTimeout = 30 * time.Second
+
+// Lookups are cached by the checksum of the language configuration
+// and the word.  The cache is persisted in lookups.json below
+// -data-dir (unless -no-content-logging is set), so it survives
+// restarts.  Lookups of changed language configurations are dropped
+// when the cache is loaded.  The clients that looked up a word are
+// recorded with the cached lookup, so that purges can remove it.
+var lookups struct {
+	m       map[string]api.Lookup
+	clients map[string][]requester  // key -> clients that looked up the word
+	dirty   bool                    // Changed since it was saved
+	counts  map[string]*lookupCount // language -> hits and misses
+	warming map[string]bool         // languages that are pre-warmed
+	l       sync.Mutex
+}
+
+// cachedLookup is a persisted lookup.
+type cachedLookup struct {
+	Checksum string // Checksum of the language configuration
+	Lookup   api.Lookup
+	Clients  []requester `json:",omitempty"`
+}
+
+func lookupsPath() string {
+	return filepath.Join(dataDir, "lookups.json")
+}
+
+// Check if a word is in the lexica of the language:
+// [GET] languages/NAME/lookup?q=WORD.  The profiler is run for the
+// single word.  The word is in the lexica if the profiler suggests the
+// word itself without any patterns.  Suggestions with historical but
+// without OCR patterns are historical variants of lexicon entries.
+func lookupWord(lc gofiler.LanguageConfiguration, r *http.Request) interface{} {
+	q := r.URL.Query().Get("q")
+	if !isLookupWord(q) {
+		return http.StatusBadRequest
+	}
+	res, hit, err := lookup(r.Context(), lc, q, requesterOf(r))
+	if e, ok := err.(errLookupRefused); ok {
+		return e.apiError()
+	}
+	if err != nil {
+		return err
+	}
+	countLookup(lc.Language, hit)
+	return res
+}
+
+// Only single words can be looked up.
+func isLookupWord(q string) bool {
+	return q != "" && !strings.ContainsAny(q, " \t\r\n")
+}
+
+// Look up a word for a client (the zero requester if the cache is
+// pre-warmed).  Returns true if the lookup was cached.  Lookups that
+// are not cached run the profiler and are subject to the limits of
+// jobs (see acquireLookup).
+func lookup(
+	ctx context.Context, lc gofiler.LanguageConfiguration, q string, client requester,
+) (api.Lookup, bool, error) {
+	sum, err := languageChecksum(lc.Path)
+	if err != nil {
+		return api.Lookup{}, false, err
+	}
+	key := sum + " " + q
+	lookups.l.Lock()
+	res, ok := lookups.m[key]
+	if ok {
+		addLookupClient(key, client)
+	}
+	lookups.l.Unlock()
+	if ok {
+		return res, true, nil
+	}
+	est, err := acquireLookup(lc.Language)
+	if err != nil {
+		return api.Lookup{}, false, err
+	}
+	defer releaseLookup(est)
+	tctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+	exe, err := profilerCommand(profilerFor(lc.Language))
+	if err != nil {
+		return api.Lookup{}, false, err
+	}
+	p, err := runGofiler(tctx, exe, lc.Path, []gofiler.Token{{OCR: q}}, nil)
+	breakers.record(ctx, lc.Language, err) // exceeding lookupTimeout is a failure
+	if err != nil {
+		return api.Lookup{}, false, err
+	}
+	res = api.Lookup{Language: lc.Language, Word: q}
+	for _, c := range p[q].Candidates {
+		if len(c.OCRPatterns) > 0 {
+			continue
+		}
+		if len(c.HistPatterns) == 0 && strings.EqualFold(c.Suggestion, q) {
+			res.Found = true
+			continue
+		}
+		if len(c.HistPatterns) > 0 {
+			res.Variants = append(res.Variants, api.Variant{
+				Suggestion: c.Suggestion,
+				Modern:     c.Modern,
+				Dict:       c.Dict,
+			})
+		}
+	}
+	if !noContentLogging {
+		log.Infof("lookup %s in %s: found: %t, variants: %d",
+			q, lc.Language, res.Found, len(res.Variants))
+	}
+	lookups.l.Lock()
+	defer lookups.l.Unlock()
+	if lookups.m == nil || len(lookups.m) >= maxLookups {
+		lookups.m = make(map[string]api.Lookup)
+		lookups.clients = make(map[string][]requester)
+	}
+	lookups.m[key] = res
+	addLookupClient(key, client)
+	lookups.dirty = true
+	return res, false, nil
+}
+
+// Record the client of a cached lookup.  Must be called with the
+// lookups locked.
+func addLookupClient(key string, client requester) {
+	if client == (requester{}) {
+		return
+	}
+	for _, c := range lookups.clients[key] {
+		if c == client {
+			return
+		}
+	}
+	if lookups.clients == nil {
+		lookups.clients = make(map[string][]requester)
+	}
+	lookups.clients[key] = append(lookups.clients[key], client)
+	lookups.dirty = true
+}
+
+// Remove the cached lookups of the clients that match the predicate.
+// Returns the number of removed lookups.
+func purgeLookups(match func(requester) bool) int {
+	lookups.l.Lock()
+	defer lookups.l.Unlock()
+	n := 0
+	for key, clients := range lookups.clients {
+		for _, c := range clients {
+			if match(c) {
+				delete(lookups.m, key)
+				delete(lookups.clients, key)
+				n++
+				break
+			}
+		}
+	}
+	if n > 0 {
+		lookups.dirty = true
+	}
+	return n
+}
+
+// errLookupRefused is the error of lookups that cannot run now.
+type errLookupRefused struct {
+	err api.Error
+}
+
+func (e errLookupRefused) Error() string {
+	return e.err.Message
+}
+
+func (e errLookupRefused) apiError() api.Error {
+	return e.err
+}
+
+// Reserve a job slot and the budget of a lookup of the language.
+// Running lookups count as jobs with normal priority against -max-jobs
+// and -soft-max-jobs.  Lookups of languages with an open circuit
+// breaker are refused.  The reservation must be released with
+// releaseLookup.
+func acquireLookup(language string) (cost, error) {
+	if until, open := breakers.isOpen(language); open {
+		return cost{}, errLookupRefused{errBreakerOpen{language: language, until: until}.apiError()}
+	}
+	if isDraining() {
+		return cost{}, errLookupRefused{refuseJob(reasonDraining)}
+	}
+	est, _ := costs.estimate(language, 1)
+	if reason := reserveLookup(est); reason != "" {
+		return cost{}, errLookupRefused{refuseJob(reason)}
+	}
+	return est, nil
+}
+
+// Reserve a job slot and the budget.  Returns the reason if the
+// lookup is refused.
+func reserveLookup(est cost) string {
+	jobs.l.Lock()
+	defer jobs.l.Unlock()
+	n := jobs.active()
+	switch {
+	case n >= int(maxJobs):
+		return reasonAtCapacity
+	case !admits(n, api.PriorityNormal):
+		return reasonOverloaded
+	case !budgets.acquire(est):
+		return reasonAtCapacity
+	}
+	jobs.lookups++
+	return ""
+}
+
+func releaseLookup(est cost) {
+	jobs.l.Lock()
+	jobs.lookups--
+	jobs.l.Unlock()
+	budgets.release(est)
+}
+
+// Load the persisted lookups.  Lookups of unknown languages or changed
+// language configurations are dropped.
+func loadLookups() error {
+	if dataDir == "" || noContentLogging {
+		return nil
+	}
+	var cached []cachedLookup
+	if err := readJSON(lookupsPath(), &cached); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	sums := make(map[string]string) // language -> checksum
+	lookups.l.Lock()
+	defer lookups.l.Unlock()
+	lookups.m = make(map[string]api.Lookup, len(cached))
+	lookups.clients = make(map[string][]requester)
+	for _, c := range cached {
+		sum, ok := sums[c.Lookup.Language]
+		if !ok {
+			if lc, err := findLanguage(c.Lookup.Language); err == nil {
+				sum, _ = languageChecksum(lc.Path)
+			}
+			sums[c.Lookup.Language] = sum
+		}
+		if sum == "" || sum != c.Checksum || len(lookups.m) >= maxLookups {
+			continue
+		}
+		key := c.Checksum + " " + c.Lookup.Word
+		lookups.m[key] = c.Lookup
+		if len(c.Clients) > 0 {
+			lookups.clients[key] = c.Clients
+		}
+	}
+	if dropped := len(cached) - len(lookups.m); dropped > 0 {
+		log.Infof("dropped %d outdated lookups", dropped)
+		lookups.dirty = true
+	}
+	log.Infof("loaded %d lookups", len(lookups.m))
+	return nil
+}
+
+// Persist the lookups if they changed.
+func saveLookups() {
+	if dataDir == "" || noContentLogging {
+		return
+	}
+	lookups.l.Lock()
+	defer lookups.l.Unlock()
+	if !lookups.dirty {
+		return
+	}
+	cached := make([]cachedLookup, 0, len(lookups.m))
+	for key, l := range lookups.m {
+		cached = append(cached, cachedLookup{
+			Checksum: key[:strings.IndexByte(key, ' ')],
+			Lookup:   l,
+			Clients:  lookups.clients[key],
+		})
+	}
+	if err := os.MkdirAll(dataDir, 0750); err != nil {
+		log.Errorf("cannot save lookups: %v", err)
+		return
+	}
+	if err := writeJSON(lookupsPath(), cached); err != nil {
+		log.Errorf("cannot save lookups: %v", err)
+		return
+	}
+	lookups.dirty = false
+}
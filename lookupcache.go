@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default number of words to pre-warm the lookup cache with.
+const defaultWarmWords = 1000
+
+// Hits and misses of the lookup cache of a language.
+type lookupCount struct {
+	hits, misses int
+}
+
+// Count a lookup of the language.
+func countLookup(language string, hit bool) {
+	lookups.l.Lock()
+	defer lookups.l.Unlock()
+	if lookups.counts == nil {
+		lookups.counts = make(map[string]*lookupCount)
+	}
+	c, ok := lookups.counts[language]
+	if !ok {
+		c = new(lookupCount)
+		lookups.counts[language] = c
+	}
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+}
+
+// Inspect the lookup cache: [GET] cache
+func getCacheStats(w http.ResponseWriter, r *http.Request) interface{} {
+	return cacheStats()
+}
+
+// Return the statistics of the lookup cache.
+func cacheStats() api.CacheStats {
+	lookups.l.Lock()
+	defer lookups.l.Unlock()
+	res := api.CacheStats{
+		Entries:   len(lookups.m),
+		Capacity:  maxLookups,
+		Languages: make(map[string]api.LanguageCacheStats),
+	}
+	for _, l := range lookups.m {
+		ls := res.Languages[l.Language]
+		ls.Entries++
+		res.Languages[l.Language] = ls
+	}
+	for language, c := range lookups.counts {
+		ls := res.Languages[language]
+		ls.Hits, ls.Misses = c.hits, c.misses
+		if n := c.hits + c.misses; n > 0 {
+			ls.HitRate = float64(c.hits) / float64(n)
+		}
+		res.Languages[language] = ls
+		res.Hits += c.hits
+		res.Misses += c.misses
+	}
+	if n := res.Hits + res.Misses; n > 0 {
+		res.HitRate = float64(res.Hits) / float64(n)
+		res.MissRate = float64(res.Misses) / float64(n)
+	}
+	for language := range lookups.warming {
+		ls := res.Languages[language]
+		ls.Warming = true
+		res.Languages[language] = ls
+	}
+	return res
+}
+
+// Flush the lookup cache of a language (of all languages if the
+// language is empty): [DELETE] cache?language=LANGUAGE
+func flushCache(w http.ResponseWriter, r *http.Request) interface{} {
+	language := r.URL.Query().Get("language")
+	lookups.l.Lock()
+	defer lookups.l.Unlock()
+	res := api.CacheFlush{Language: language}
+	for key, l := range lookups.m {
+		if language == "" || l.Language == language {
+			delete(lookups.m, key)
+			delete(lookups.clients, key)
+			res.Removed++
+		}
+	}
+	if res.Removed > 0 {
+		lookups.dirty = true
+	}
+	log.Infof("flushed %d lookups", res.Removed)
+	return res
+}
+
+// Pre-warm the lookup cache of a language with the most frequent forms
+// of a frequency list:
+// [POST] cache/warm?language=LANGUAGE&namespace=NAMESPACE&limit=N.  The
+// list is the uploaded frequency list of the namespace (see [PUT]
+// frequencies) or, without a namespace, the api.FrequencyList posted
+// with the request.  Forms that are not single words are skipped.  The
+// forms are looked up in the background, waiting while the daemon is
+// at capacity; a language cannot be pre-warmed twice at the same time.
+func warmCache(w http.ResponseWriter, r *http.Request) interface{} {
+	q := r.URL.Query()
+	lc, res := usableLanguage(q.Get("language"))
+	if res != nil {
+		return res
+	}
+	limit := defaultWarmWords
+	if str := q.Get("limit"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n <= 0 || n > maxLookups {
+			return api.Error{
+				Status:  http.StatusBadRequest,
+				Message: fmt.Sprintf("invalid limit: %q", str),
+			}
+		}
+		limit = n
+	}
+	var words []string
+	ns := q.Get("namespace")
+	if ns != "" {
+		frequencies.l.RLock()
+		freqs, ok := frequencies.m[ns]
+		words = warmWords(freqs, limit)
+		frequencies.l.RUnlock()
+		if !ok {
+			return api.Error{
+				Status:  http.StatusNotFound,
+				Message: fmt.Sprintf("no frequency list: %s", ns),
+			}
+		}
+	} else {
+		var list api.FrequencyList
+		if err := decodeBody(r, &list); err != nil {
+			return decodeError(err)
+		}
+		words = warmWords(list.Frequencies, limit)
+	}
+	lookups.l.Lock()
+	if lookups.warming[lc.Language] {
+		lookups.l.Unlock()
+		return api.Error{
+			Status:  http.StatusConflict,
+			Message: fmt.Sprintf("cache of %s is already being pre-warmed", lc.Language),
+		}
+	}
+	if lookups.warming == nil {
+		lookups.warming = make(map[string]bool)
+	}
+	lookups.warming[lc.Language] = true
+	lookups.l.Unlock()
+	go func() {
+		defer func() {
+			lookups.l.Lock()
+			delete(lookups.warming, lc.Language)
+			lookups.l.Unlock()
+		}()
+		n := 0
+		for i := 0; i < len(words) && !isDraining(); {
+			_, hit, err := lookup(context.Background(), lc, words[i], requester{})
+			if e, ok := err.(errLookupRefused); ok &&
+				(e.err.Reason == reasonAtCapacity || e.err.Reason == reasonOverloaded) {
+				time.Sleep(requeueInterval)
+				continue
+			}
+			if err != nil {
+				log.Errorf("cannot pre-warm cache of %s: %v", lc.Language, err)
+				return
+			}
+			if !hit {
+				n++
+			}
+			i++
+		}
+		log.Infof("pre-warmed cache of %s with %d lookups", lc.Language, n)
+	}()
+	return api.CacheWarming{Language: lc.Language, Namespace: ns, Words: len(words)}
+}
+
+// Return the (at most limit) most frequent forms of the frequency list
+// that can be looked up.
+func warmWords(freqs map[string]int, limit int) []string {
+	words := make([]string, 0, len(freqs))
+	for form, freq := range freqs {
+		if freq > 0 && isLookupWord(form) {
+			words = append(words, form)
+		}
+	}
+	sort.Slice(words, func(i, j int) bool {
+		if freqs[words[i]] != freqs[words[j]] {
+			return freqs[words[i]] > freqs[words[j]]
+		}
+		return words[i] < words[j]
+	})
+	if len(words) > limit {
+		words = words[:limit]
+	}
+	return words
+}
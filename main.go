@@ -2,14 +2,23 @@ package main // import "github.com/finkf/gofilerd"
 
 import (
 	"compress/gzip"
-	"encoding/json"
+	"context"
 	"flag"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/finkf/gofiler"
 	"github.com/finkf/gofilerd/api"
+	"github.com/finkf/gofilerd/listeners"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,66 +28,453 @@ var (
 	executable string
 	timeout    uint
 	maxJobs    uint
+
+	hardTimeout  uint
+	stallTimeout uint
+	softMaxJobs  uint
+	preemption   string
+
+	memoryBudget   uint
+	cpuBudget      uint
+	maxParallelism uint
+	checkpointSize uint
+
+	sandbox        bool
+	sandboxNetwork bool
+	sandboxUID     int
+	sandboxGID     int
+
+	auditLogPath     string
+	eventsURL        string
+	intakeURL        string
+	redisURL         string
+	postprocessHook  string
+	preprocessHook   string
+	dataDir          string
+	dataKeyPath      string
+	frequencyBoost   float64
+	noContentLogging bool
+	adminKey         string
+	maxWait          time.Duration
+	statusMode       string
+	signingKey       string
+	signingAlg       string
+
+	maxConnsPerIP     uint
+	maxRequestsPerIP  uint
+	trustedProxies    string
+	allowCIDR         string
+	denyCIDR          string
+	basePath          string
+	adminListen       string
+	drainTimeout      time.Duration
+	tokenLength       uint
+	tokenAlphabet     string
+	gzipLevel         int
+	maxTokens         uint
+	maxBodyBytes      uint
+	maxGunzipBytes    uint
+	namespacesPath    string
+	authRequired      string
+	oidcIssuer        string
+	oidcAudience      string
+	oidcScope         string
+	fallbackLanguages string
+	profilerLanguages string
+	serviceName       string
+	logFile           string
+	tmpDir            string
+	quotaStoreURL     string
+	breakerThreshold  uint
+	breakerCooldown   time.Duration
+	canaryBackends    string
+	backendManifest   string
+	compressResults   bool
+	maxResultMemory   uint
+	spillDir          string
+	reprofileAfter    uint
+	retention         string
+
+	cacheMaxAge        time.Duration
+	profileCacheMaxAge time.Duration
+	webhookSecretPath  string
+	callbackAllowCIDR  string
+	addrFile           string
 )
 
 func init() {
-	flag.StringVar(&listen, "listen", ":9998", "listen on host")
+	flag.StringVar(&listen, "listen", ":9998", "listen on these comma separated addresses (e.g. 0.0.0.0:9998,[::]:9998)")
+	flag.StringVar(&addrFile, "addr-file", "", "write the bound public and admin addresses to this file (useful with port 0)")
 	flag.StringVar(&backend, "backend", "", "path to profiler's language backend")
 	flag.StringVar(&executable, "profiler", "profiler", "path to the profiler executable")
 	flag.UintVar(&timeout, "timeout", 45, "timeout for jobs (in minutes)")
+	flag.UintVar(&hardTimeout, "hard-timeout", 180, "timeout for jobs that still make progress (in minutes, 0 means unlimited)")
+	flag.UintVar(&stallTimeout, "stall-timeout", 5, "cancel jobs exceeding the timeout without profiler output for this time (in minutes)")
 	flag.UintVar(&maxJobs, "max-jobs", 10, "maximal number of pending jobs")
+	flag.UintVar(&softMaxJobs, "soft-max-jobs", 0, "only accept jobs with high priority above this number of pending jobs (0 disables)")
+	flag.StringVar(&preemption, "preemption", preemptOff, "preempt running jobs with normal priority for jobs with high priority (off, checkpoint or cancel)")
+	flag.UintVar(&memoryBudget, "memory-budget", 0, "maximal estimated memory of all running jobs (in MB, 0 means unlimited)")
+	flag.UintVar(&cpuBudget, "cpu-budget", 0, "maximal estimated run time of all running jobs (in seconds, 0 means unlimited)")
+	flag.UintVar(&maxParallelism, "max-parallelism", 1, "maximal number of parallel profiler processes per job")
+	flag.UintVar(&checkpointSize, "checkpoint-size", 10000, "number of OCR tokens per checkpoint of jobs with checkpoints")
+	flag.BoolVar(&sandbox, "sandbox", false, "run the profiler in a restricted environment")
+	flag.BoolVar(&sandboxNetwork, "sandbox-network", false, "allow network access in the sandbox")
+	flag.IntVar(&sandboxUID, "sandbox-uid", -1, "run the sandboxed profiler with this user id")
+	flag.IntVar(&sandboxGID, "sandbox-gid", -1, "run the sandboxed profiler with this group id")
+	flag.StringVar(&auditLogPath, "audit-log", "", "append audit records (JSON lines) to this file")
+	flag.StringVar(&webhookSecretPath, "webhook-secret", "", "sign webhook deliveries (events and group callbacks) with the HMAC secret in this file")
+	flag.StringVar(&callbackAllowCIDR, "callback-allow-cidr", "", "comma separated list of private networks that callbacks may be delivered to")
+	flag.StringVar(&eventsURL, "events", "", "publish job events to this URL (http, https or nats; kafka and amqp are not supported)")
+	flag.StringVar(&intakeURL, "intake", "", "consume profiling requests from this NATS subject (nats://host/subject)")
+	flag.StringVar(&redisURL, "redis", "", "share jobs with other daemons using this Redis server (redis://host/db)")
+	flag.StringVar(&preprocessHook, "preprocess", "", "transform the tokens of jobs with this executable (JSON on stdin and stdout)")
+	flag.StringVar(&postprocessHook, "postprocess", "", "filter finished profiles with this executable (JSON on stdin and stdout)")
+	flag.StringVar(&dataDir, "data-dir", "", "persist uploaded data (frequency lists, feedback, whitelists, kept profiles, dead letters, usage and lookups) in this directory")
+	flag.StringVar(&dataKeyPath, "data-key", "", "encrypt persisted data (-data-dir, spilled profiles and -redis) with the base64 encoded AES-256 key in this file")
+	flag.Float64Var(&frequencyBoost, "frequency-boost", 1, "boost of frequent and accepted corpus forms")
+	flag.StringVar(&retention, "retention", api.RetentionForever, "retention of kept profiles without a retention (forever, until-fetched or days like 30d)")
+	flag.UintVar(&reprofileAfter, "reprofile-after", 0, "re-profile the uncorrected tokens of jobs with a corpus after this many accepted corrections (0 disables adaptive rounds)")
+	flag.BoolVar(&noContentLogging, "no-content-logging", false, "never log or store the content of profiled documents (feedback, whitelists and dead letters are kept in memory; cannot be used with -redis)")
+	flag.StringVar(&adminKey, "admin-key", "", "bearer token for administrative requests")
+	flag.StringVar(&statusMode, "status", "phase", "status messages of unfinished jobs (phase or random)")
+	flag.StringVar(&signingKey, "signing-key", "", "sign finished profiles with the key in this file")
+	flag.StringVar(&signingAlg, "signing-algorithm", signEd25519, "signature algorithm (ed25519 or hmac-sha256)")
+	flag.DurationVar(&cacheMaxAge, "cache-max-age", time.Hour, "let clients and proxies cache /languages and /version for this duration (0 disables)")
+	flag.DurationVar(&profileCacheMaxAge, "profile-cache-max-age", 24*time.Hour, "let clients cache finished profiles for this duration (0 disables)")
+	flag.DurationVar(&maxWait, "max-wait", time.Minute, "maximal wait duration for GET /profile?wait=")
+	flag.UintVar(&maxConnsPerIP, "max-conns-per-ip", 0, "maximal number of open connections per client (0 means unlimited)")
+	flag.UintVar(&maxRequestsPerIP, "max-requests-per-ip", 0, "maximal number of concurrent requests per client (0 means unlimited)")
+	flag.StringVar(&trustedProxies, "trusted-proxies", "", "comma separated list of trusted proxy addresses or networks")
+	flag.StringVar(&allowCIDR, "allow-cidr", "", "comma separated list of client addresses or networks that are allowed (all if empty)")
+	flag.StringVar(&denyCIDR, "deny-cidr", "", "comma separated list of client addresses or networks that are denied")
+	flag.UintVar(&tokenLength, "token-length", 16, "length of job tokens")
+	flag.StringVar(&tokenAlphabet, "token-alphabet", defaultTokenAlphabet, "characters of job tokens (letters, digits, - and _)")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 10*time.Minute, "maximal time to wait for jobs to finish and be fetched after SIGTERM")
+	flag.StringVar(&adminListen, "admin-listen", "localhost:9999", "serve administrative and debugging routes on these comma separated addresses (on the public addresses if empty)")
+	flag.StringVar(&basePath, "base-path", "", "serve all routes below this path (e.g. /profiler)")
+	flag.UintVar(&maxTokens, "max-tokens", 0, "maximal number of tokens of profiling requests (0 means unlimited)")
+	flag.UintVar(&maxBodyBytes, "max-body-bytes", 0, "maximal size of request bodies in bytes (0 means unlimited)")
+	flag.UintVar(&maxGunzipBytes, "max-decompressed-bytes", 256<<20, "maximal size of decompressed gzipped request bodies in bytes (0 means -max-body-bytes)")
+	flag.StringVar(&namespacesPath, "namespaces", "", "read request defaults and limits of namespaces from this INI file")
+	flag.StringVar(&authRequired, "auth-required", "", "comma separated path prefixes of routes that require the admin key or a namespace key (or all)")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "accept JWTs of this OIDC issuer as bearer tokens")
+	flag.StringVar(&oidcAudience, "oidc-audience", "", "required audience of JWTs")
+	flag.StringVar(&oidcScope, "oidc-scope", "", "required scope of JWTs")
+	flag.StringVar(&profilerLanguages, "language-profilers", "", "comma separated LANGUAGE=PROFILER pairs of languages with their own profiler executable")
+	flag.StringVar(&fallbackLanguages, "fallback", "", "comma separated LANGUAGE=FALLBACK pairs of fallback languages")
+	flag.UintVar(&breakerThreshold, "breaker-threshold", 0, "do not use a language after this many consecutive failures of its profiler (0 disables the circuit breaker)")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", 5*time.Minute, "time a language is not used after its circuit breaker opened")
+	flag.BoolVar(&compressResults, "compress-results", true, "keep finished profiles gzipped in memory until they are fetched")
+	flag.UintVar(&maxResultMemory, "max-result-memory", 0, "spill the oldest unfetched profiles to disk if they exceed this many MB in memory (0 means unlimited; never spilled with -no-content-logging)")
+	flag.StringVar(&spillDir, "spill-dir", "", "directory of spilled profiles (default: spill in -data-dir or a temporary directory)")
+	flag.StringVar(&backendManifest, "backend-manifest", "", "verify the files of the language configurations against this sha256sum manifest")
+	flag.StringVar(&canaryBackends, "canary", "", "comma separated LANGUAGE:PERCENT:DIRECTORY triples to route a percentage of the jobs of a language to an alternative backend")
+	flag.StringVar(&serviceName, "service-name", "gofilerd", "name of the Windows service")
+	flag.StringVar(&quotaStoreURL, "quota-store", "memory:", "count the quotas of namespaces in this store (memory: or redis://host/db)")
+	flag.StringVar(&tmpDir, "tmpdir", "", "directory for scratch files of the profiler (default: the system's temporary directory)")
+	flag.StringVar(&logFile, "log-file", "", "append the log to this file instead of stderr")
+	flag.IntVar(&gzipLevel, "gzip-level", gzip.BestSpeed+1, "compression level of gzipped responses (1-9, 0 disables compression)")
 }
 
 func main() {
+	if cfg, ok := sandboxFromEnv(); ok {
+		runSandboxed(cfg)
+	}
 	flag.Parse()
 	log.SetLevel(log.DebugLevel)
-	http.HandleFunc("/languages", withLogging(handle(withGet(getLanguages))))
-	http.HandleFunc("/profile", withLogging(handle(withGetOrPost(
-		withToken(getProfile),
-		withRequest(withValidLanguage(profile))))))
-	log.Infof("executable: %s", executable)
+	if logFile != "" {
+		out, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("cannot open log file: %v", err)
+		}
+		log.SetOutput(out)
+	}
+	startService()
+	if err := setupScratchDir(); err != nil {
+		log.Fatal(err)
+	}
+	if sandbox {
+		if err := setupSandbox(); err != nil {
+			log.Fatalf("cannot setup sandbox: %v", err)
+		}
+	}
+	if auditLogPath != "" {
+		if err := openAuditLog(auditLogPath); err != nil {
+			log.Fatalf("cannot open audit log: %v", err)
+		}
+	}
+	if eventsURL != "" {
+		if err := openEvents(eventsURL); err != nil {
+			log.Fatalf("cannot open notification backend: %v", err)
+		}
+	}
+	if dataKeyPath != "" {
+		if err := loadDataKey(dataKeyPath); err != nil {
+			log.Fatalf("cannot load data key: %v", err)
+		}
+	} else if dataDir != "" || redisURL != "" {
+		log.Infof("persisted data is not encrypted (see -data-key)")
+	}
+	if err := loadFrequencies(); err != nil {
+		log.Fatalf("cannot load frequency lists: %v", err)
+	}
+	if err := loadFeedback(); err != nil {
+		log.Fatalf("cannot load feedback: %v", err)
+	}
+	if err := loadWhitelists(); err != nil {
+		log.Fatalf("cannot load whitelists: %v", err)
+	}
+	if _, err := parseRetention(retention); err != nil {
+		log.Fatalf("invalid -retention: %v", err)
+	}
+	if err := loadRepository(); err != nil {
+		log.Fatalf("cannot load stored profiles: %v", err)
+	}
+	if err := loadDeadLetters(); err != nil {
+		log.Fatalf("cannot load dead letters: %v", err)
+	}
+	if err := loadUsage(); err != nil {
+		log.Fatalf("cannot load usage: %v", err)
+	}
+	if err := loadLookups(); err != nil {
+		log.Fatalf("cannot load lookups: %v", err)
+	}
+	if checkpointSize == 0 {
+		log.Fatalf("invalid checkpoint size: 0")
+	}
+	if redisURL != "" {
+		if noContentLogging {
+			log.Fatalf("cannot use -redis with -no-content-logging: " +
+				"finished profiles are stored in the shared job store")
+		}
+		if err := openShared(redisURL); err != nil {
+			log.Fatalf("cannot open shared job store: %v", err)
+		}
+	}
+	if intakeURL != "" {
+		if err := openIntake(intakeURL); err != nil {
+			log.Fatalf("cannot open intake: %v", err)
+		}
+	}
+	nets, err := parseNets(trustedProxies)
+	if err != nil {
+		log.Fatalf("invalid trusted proxies: %v", err)
+	}
+	trustedNets = nets
+	if allowedNets, err = parseNets(allowCIDR); err != nil {
+		log.Fatalf("invalid allowed networks: %v", err)
+	}
+	if deniedNets, err = parseNets(denyCIDR); err != nil {
+		log.Fatalf("invalid denied networks: %v", err)
+	}
+	if callbackNets, err = parseNets(callbackAllowCIDR); err != nil {
+		log.Fatalf("invalid callback networks: %v", err)
+	}
+	if webhookSecretPath != "" {
+		if err := loadWebhookSecret(webhookSecretPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if signingKey != "" {
+		if err := loadSigningKey(signingAlg, signingKey); err != nil {
+			log.Fatalf("cannot load signing key: %v", err)
+		}
+	}
+	if _, ok := statusProviders[statusMode]; !ok {
+		log.Fatalf("invalid status provider: %s", statusMode)
+	}
+	if namespacesPath != "" {
+		if err := loadNamespaces(namespacesPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := openQuotaStore(quotaStoreURL); err != nil {
+		log.Fatalf("cannot open quota store: %v", err)
+	}
+	if oidcIssuer != "" {
+		if err := openOIDC(oidcIssuer, oidcAudience, oidcScope); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if fallbacks, err = parseFallbacks(fallbackLanguages); err != nil {
+		log.Fatal(err)
+	}
+	if languageProfilers, err = parseLanguageProfilers(profilerLanguages); err != nil {
+		log.Fatal(err)
+	}
+	if backendManifest != "" {
+		if err := openManifest(backendManifest); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if maxResultMemory > 0 {
+		if err := setupSpillDir(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if canaries, err = parseCanaries(canaryBackends); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkTokenFormat(tokenAlphabet, tokenLength); err != nil {
+		log.Fatal(err)
+	}
+	if gzipLevel < gzip.NoCompression || gzipLevel > gzip.BestCompression {
+		log.Fatalf("invalid gzip level: %d", gzipLevel)
+	}
+	if softMaxJobs > maxJobs {
+		log.Fatalf("soft-max-jobs (%d) exceeds max-jobs (%d)", softMaxJobs, maxJobs)
+	}
+	if err := checkPreemption(preemption); err != nil {
+		log.Fatal(err)
+	}
+	rt := new(router)
+	rt.handle("/version", methods{http.MethodGet: withCache(cacheMaxAge, getVersion)})
+	rt.handle("/ready", methods{http.MethodGet: getReady})
+	rt.handle("/languages", methods{http.MethodGet: withCache(cacheMaxAge, getLanguages)})
+	rt.handle("/languages/{language}/patterns", methods{http.MethodGet: withLanguage(getPatterns)})
+	rt.handle("/languages/{language}/lookup", methods{http.MethodGet: withLanguage(lookupWord)})
+	rt.handle("/languages/{language}/variants", methods{http.MethodGet: withLanguage(getVariants)})
+	rt.handle("/profile", methods{
+		http.MethodGet:  withProfileCache(withToken(getProfile)),
+		http.MethodPost: withRequest(withValidLanguage(profile)),
+	})
+	rt.handle("/profile/{token}", methods{http.MethodGet: withProfileCache(withToken(getProfile))})
+	rt.handle("/profile/validate", methods{http.MethodPost: withRequest(withValidLanguage(validateProfile))})
+	rt.handle("/profile/export", methods{http.MethodGet: exportProfile})
+	rt.handle("/profiles", methods{http.MethodGet: listProfiles})
+	rt.handle("/profiles/search", methods{http.MethodGet: searchProfiles})
+	rt.handle("/profiles/merge", methods{http.MethodPost: mergeRounds})
+	rt.handle("/profiles/{id}", methods{
+		http.MethodGet:    getStoredProfile,
+		http.MethodDelete: deleteStoredProfile,
+	})
+	rt.handle("/profile/status", methods{http.MethodPost: getStatuses})
+	rt.handle("/profile/cancel", methods{http.MethodPost: cancelJobs})
+	rt.handle("/profile/ack", methods{http.MethodPost: ackJobs})
+	rt.handle("/groups", methods{
+		http.MethodGet:  getGroup,
+		http.MethodPost: createGroup,
+	})
+	rt.handle("/groups/close", methods{http.MethodPost: closeGroup})
+	rt.handleFunc("/groups/events", http.MethodGet, withCommon(groupEvents))
+	rt.handle("/webhooks/test", methods{http.MethodPost: testWebhook})
+	rt.handle("/signing-key", methods{http.MethodGet: getSigningKey})
+	rt.handle("/frequencies", methods{http.MethodGet: getFrequencies})
+	rt.handle("/adaptive", methods{
+		http.MethodGet:    getAdaptiveState,
+		http.MethodDelete: deleteAdaptiveState,
+	})
+	rt.handle("/whitelist", methods{
+		http.MethodGet:    getWhitelist,
+		http.MethodPut:    putWhitelist,
+		http.MethodPost:   postWhitelist,
+		http.MethodDelete: deleteWhitelist,
+	})
+	rt.handle("/estimate", methods{http.MethodPost: postEstimate})
+	rt.handle("/jobs", methods{http.MethodPost: withRequest(withValidLanguage(profile))})
+	rt.handle("/jobs/{token}", methods{
+		http.MethodGet:    getJob,
+		http.MethodDelete: deleteJob,
+	})
+	rt.handle("/jobs/{token}/result", methods{http.MethodGet: withToken(getProfile)})
+	rt.handle("/jobs/{token}/feedback", methods{http.MethodPost: postJobFeedback})
+	rt.handleFunc("/jobs/{token}/log", http.MethodGet, withCommon(getJobLog))
+	admin := rt
+	if adminListen != "" {
+		admin = new(router)
+	}
+	handleAdmin(admin)
+	log.Infof("executable: %s", currentProfiler())
 	log.Infof("backend:    %s", backend)
 	log.Infof("timeout:    %dm", timeout)
+	log.Infof("hard-timeout: %dm", hardTimeout)
 	log.Infof("max-jobs:   %d", maxJobs)
+	log.Infof("soft-max-jobs: %d", softMaxJobs)
+	log.Infof("preemption: %s", preemption)
+	log.Infof("sandbox:    %t", sandbox)
+	log.Infof("no-content-logging: %t", noContentLogging)
+	log.Infof("trusted-proxies: %s", trustedProxies)
+	log.Infof("allow-cidr: %s", allowCIDR)
+	log.Infof("deny-cidr:  %s", denyCIDR)
+	log.Infof("callback-allow-cidr: %s", callbackAllowCIDR)
+	log.Infof("base-path:  %s", basePath)
+	log.Infof("auth-required: %s", authRequired)
+	log.Infof("oidc-issuer: %s", oidcIssuer)
+	log.Infof("gzip-level: %d", gzipLevel)
+	log.Infof("max-tokens: %d", maxTokens)
+	log.Infof("max-body-bytes: %d", maxBodyBytes)
+	log.Infof("max-decompressed-bytes: %d", maxDecompressedBytes())
+	log.Infof("fallback:   %s", fallbackLanguages)
+	log.Infof("language-profilers: %s", profilerLanguages)
+	log.Infof("breaker-threshold: %d", breakerThreshold)
+	log.Infof("canary:     %s", canaryBackends)
+	log.Infof("backend-manifest: %s", backendManifest)
+	log.Infof("compress-results: %t", compressResults)
+	log.Infof("max-result-memory: %dMB", maxResultMemory)
+	log.Infof("spill-dir:  %s", spillDir)
+	log.Infof("tmpdir:     %s", scratchDir)
+	log.Infof("reprofile-after: %d", reprofileAfter)
+	log.Infof("retention:  %s", retention)
+	log.Infof("cache-max-age: %s", cacheMaxAge)
+	log.Infof("profile-cache-max-age: %s", profileCacheMaxAge)
+	log.Infof("webhook-secret: %s", webhookSecretPath)
+	handleSignals()
+	resumeJobs()
+	go cleanJobs()
 	log.Infof("starting server listening on %s", listen)
-	log.Fatal(http.ListenAndServe(listen, nil))
+	ls, err := listeners.Open(listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	addrs := reportAddrs("public", ls)
+	if adminListen != "" {
+		log.Infof("starting admin server listening on %s", adminListen)
+		als, err := listeners.Open(adminListen)
+		if err != nil {
+			log.Fatalf("cannot listen on admin address: %v", err)
+		}
+		addrs = append(addrs, reportAddrs("admin", als)...)
+		go serveAdmin(als, admin)
+	}
+	if addrFile != "" {
+		if err := writeAddrFile(addrFile, addrs); err != nil {
+			log.Fatalf("cannot write address file: %v", err)
+		}
+	}
+	log.Fatal(ls.Serve(func(l net.Listener) net.Listener {
+		return &limitListener{Listener: l, max: maxConnsPerIP}
+	}, withIPFilter(withBasePath(basePath, rt))))
+}
+
+// Serve the handler below the given base path.  Requests outside of
+// the base path are answered with 404.
+func withBasePath(path string, h http.Handler) http.Handler {
+	path = "/" + strings.Trim(path, "/")
+	if path == "/" {
+		return h
+	}
+	return http.StripPrefix(path, h)
+}
+
+// Wrap the handler with the middleware common to all routes.
+func withCommon(
+	h func(http.ResponseWriter, *http.Request),
+) func(http.ResponseWriter, *http.Request) {
+	return withRequestID(withRecovery(withLogging(withBackpressure(withRequestLimit(withLocale(h))))))
 }
 
 func withLogging(
 	h func(http.ResponseWriter, *http.Request),
 ) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Infof("handling request: [%s] %s", r.Method, r.URL)
+		log.Infof("handling request %s from %s: [%s] %s",
+			requestID(r), remoteIP(r), r.Method, r.URL)
 		h(w, r)
 	}
 }
 
-func withGet(
-	h func(http.ResponseWriter, *http.Request) interface{},
-) func(http.ResponseWriter, *http.Request) interface{} {
-	return func(w http.ResponseWriter, r *http.Request) interface{} {
-		if r.Method != http.MethodGet {
-			return http.StatusMethodNotAllowed
-		}
-		return h(w, r)
-	}
-}
-
-func withGetOrPost(
-	get func(http.ResponseWriter, *http.Request) interface{},
-	post func(http.ResponseWriter, *http.Request) interface{},
-) func(http.ResponseWriter, *http.Request) interface{} {
-	return func(w http.ResponseWriter, r *http.Request) interface{} {
-		switch r.Method {
-		case http.MethodGet:
-			return get(w, r)
-		case http.MethodPost:
-			return post(w, r)
-		default:
-			return http.StatusMethodNotAllowed
-		}
-	}
-}
+// methods maps request methods to handlers.
+type methods map[string]func(http.ResponseWriter, *http.Request) interface{}
 
 func handle(
 	h func(http.ResponseWriter, *http.Request) interface{},
@@ -93,6 +489,14 @@ func handle(
 		case error:
 			log.Infof("[%s] %s: error: %v", r.Method, r.URL, t)
 			http.Error(w, "", http.StatusInternalServerError)
+		case api.Error:
+			log.Infof("[%s] %s: status: %d (%s)",
+				r.Method, r.URL, t.Status, t.Message)
+			sendError(w, r, t)
+		case text:
+			sendText(w, r, t)
+		case file:
+			sendFile(w, r, t)
 		default:
 			sendResponse(w, r, x)
 		}
@@ -105,14 +509,112 @@ func handle(
 func sendResponse(w http.ResponseWriter, r *http.Request, x interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.Header().Set("Server", "gofilerd/"+api.Version)
-	if containsVal(r.Header, "Accept-Encoding", "gzip") {
+	w.Header().Add("Vary", "Accept-Encoding")
+	fw := newFlushWriter(w, r)
+	if acceptsGzip(r) {
 		w.Header().Set("Content-Encoding", "gzip")
-		writer := gzip.NewWriter(w)
+		writer := getGzipWriter(fw)
+		defer putGzipWriter(writer)
 		defer writer.Close()
 		encodeJSON(writer, x)
 		return
 	}
-	encodeJSON(w, x)
+	encodeJSON(fw, x)
+}
+
+// text is a plain text response.
+type text string
+
+// Send a plain text response (gzipped if the client accepts it).
+func sendText(w http.ResponseWriter, r *http.Request, t text) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Server", "gofilerd/"+api.Version)
+	w.Header().Add("Vary", "Accept-Encoding")
+	fw := newFlushWriter(w, r)
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		writer := getGzipWriter(fw)
+		defer putGzipWriter(writer)
+		defer writer.Close()
+		io.WriteString(writer, string(t))
+		return
+	}
+	io.WriteString(fw, string(t))
+}
+
+// file is a response that is meant to be saved as a file.
+type file struct {
+	name        string // Suggested file name
+	contentType string
+	data        []byte
+}
+
+// Send a file as attachment.  Text files are gzipped if the client
+// accepts it.
+func sendFile(w http.ResponseWriter, r *http.Request, f file) {
+	w.Header().Set("Content-Type", f.contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": f.name}))
+	w.Header().Set("Server", "gofilerd/"+api.Version)
+	w.Header().Add("Vary", "Accept-Encoding")
+	fw := newFlushWriter(w, r)
+	if strings.HasPrefix(f.contentType, "text/") && acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		writer := getGzipWriter(fw)
+		defer putGzipWriter(writer)
+		defer writer.Close()
+		writer.Write(f.data)
+		return
+	}
+	fw.Write(f.data)
+}
+
+// Send an error response encoded as JSON.
+func sendError(w http.ResponseWriter, r *http.Request, e api.Error) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Server", "gofilerd/"+api.Version)
+	if e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfter))
+	}
+	w.WriteHeader(e.Status)
+	e.RequestID = requestID(r)
+	encodeJSON(w, e)
+}
+
+// Check if gzipped responses are enabled and acceptable for the
+// client.  Encodings with a quality value of 0 are not acceptable.
+// All entries are evaluated; an explicit gzip entry takes precedence
+// over the * wildcard regardless of their order.
+func acceptsGzip(r *http.Request) bool {
+	if gzipLevel == gzip.NoCompression {
+		return false
+	}
+	gzipQ, anyQ := -1.0, -1.0 // -1 if the entry is missing
+	for _, vals := range r.Header["Accept-Encoding"] {
+		for _, val := range strings.Split(vals, ",") {
+			params := strings.Split(val, ";")
+			coding := strings.ToLower(strings.TrimSpace(params[0]))
+			if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+				continue
+			}
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, _ = strconv.ParseFloat(param[2:], 64)
+				}
+			}
+			if coding == "*" {
+				anyQ = math.Max(anyQ, q)
+			} else {
+				gzipQ = math.Max(gzipQ, q)
+			}
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
 }
 
 func containsVal(header http.Header, key, val string) bool {
@@ -124,81 +626,347 @@ func containsVal(header http.Header, key, val string) bool {
 	return false
 }
 
+// Encode x into a pooled buffer and write it to w.  Large profiles are
+// encoded straight to w, so they are streamed to the client instead of
+// being held in memory as a whole.
 func encodeJSON(w io.Writer, x interface{}) {
-	if err := json.NewEncoder(w).Encode(x); err != nil {
+	n := sizeHint(x)
+	if n > flushSize {
+		if err := newJSONEncoder(w).Encode(x); err != nil {
+			log.Infof("error: cannot encode result: %v", err)
+		}
+		return
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	buf.Grow(n)
+	if err := newJSONEncoder(buf).Encode(x); err != nil {
+		log.Infof("error: cannot encode result: %v", err)
+		return
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
 		log.Infof("error: cannot write result: %v", err)
 	}
 }
 
-// Check if the post request data is valid.  Decode post data.  Accept
-// only application/json; charset=utf-8
+// Check if the post request data is valid.  Decode post data.
 func withRequest(
-	h func(api.Request) interface{},
+	h func(submission) interface{},
 ) func(http.ResponseWriter, *http.Request) interface{} {
 	return func(w http.ResponseWriter, r *http.Request) interface{} {
-		if !containsVal(r.Header, "Content-Type", "application/json") ||
-			!containsVal(r.Header, "Content-Type", "charset=utf-8") {
-			log.Infof("invalid Content-Type: %s", r.Header.Get("Content-Type"))
-			return http.StatusBadRequest
+		data := submission{remoteIP: remoteIP(r), requestID: requestID(r), received: time.Now()}
+		ns, ok := findNamespace(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			return http.StatusUnauthorized
 		}
-		if containsVal(r.Header, "Content-Encoding", "gzip") {
-			reader, err := gzip.NewReader(r.Body)
-			if err != nil {
-				log.Infof("cannot decode gzipped data: %v", err)
-				return http.StatusBadRequest
+		var err error
+		if isUpload(r) {
+			err = decodeUpload(r, &data.Request)
+		} else {
+			err = decodeBody(r, &data.Request)
+		}
+		if err != nil {
+			return decodeError(err)
+		}
+		if ns != nil {
+			if err, ok := ns.apply(&data); !ok {
+				return err
 			}
-			defer reader.Close()
-			return decodeJSON(reader, h)
 		}
-		return decodeJSON(r.Body, h)
+		return h(data)
+	}
+}
+
+// Decode the JSON encoded (and optionally gzipped) body of the
+// request.  Accept only application/json; charset=utf-8
+func decodeBody(r *http.Request, x interface{}) error {
+	if !containsVal(r.Header, "Content-Type", "application/json") ||
+		!containsVal(r.Header, "Content-Type", "charset=utf-8") {
+		return fmt.Errorf("invalid Content-Type: %s", r.Header.Get("Content-Type"))
+	}
+	in := limitBody(r.Body, maxBodyBytes)
+	if containsVal(r.Header, "Content-Encoding", "gzip") {
+		reader, err := gzip.NewReader(in)
+		if err != nil {
+			if _, ok := err.(tooLargeError); ok {
+				return err
+			}
+			return fmt.Errorf("cannot decode gzipped data: %v", err)
+		}
+		defer reader.Close()
+		in = limitBody(reader, maxDecompressedBytes())
+	}
+	buf, err := ioutil.ReadAll(in)
+	if _, ok := err.(tooLargeError); ok {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read request: %v", err)
 	}
+	if err := unmarshalJSON(buf, x); err != nil {
+		return fmt.Errorf("cannot decode request: %v", err)
+	}
+	return nil
+}
+
+// Return the limit of decompressed request bodies.  Gzipped bodies
+// are limited to -max-decompressed-bytes, so that small bodies cannot
+// expand into gigabytes of JSON.
+func maxDecompressedBytes() uint {
+	if maxGunzipBytes == 0 {
+		return maxBodyBytes
+	}
+	return maxGunzipBytes
+}
+
+// Return the response for errors of decodeBody and decodeUpload.
+// Requests exceeding -max-body-bytes are answered with 413.
+func decodeError(err error) interface{} {
+	log.Info(err)
+	if _, ok := err.(tooLargeError); ok {
+		return api.Error{Status: http.StatusRequestEntityTooLarge, Message: err.Error()}
+	}
+	if e, ok := err.(uploadError); ok {
+		return api.Error{Status: e.status, Message: e.Error()}
+	}
+	return http.StatusBadRequest
+}
+
+// tooLargeError is the error of requests exceeding a size limit.
+type tooLargeError struct {
+	limit uint
+	unit  string
+}
+
+func (err tooLargeError) Error() string {
+	return fmt.Sprintf("request exceeds the limit of %d %s", err.limit, err.unit)
 }
 
-func decodeJSON(r io.Reader, h func(api.Request) interface{}) interface{} {
-	var data api.Request
-	if err := json.NewDecoder(r).Decode(&data); err != nil {
-		log.Infof("cannot decode request: %v", err)
-		return http.StatusBadRequest
+// Limit the reader to max bytes (0 means unlimited).  Reading beyond
+// the limit fails with a tooLargeError.
+func limitBody(r io.Reader, max uint) io.Reader {
+	if max == 0 {
+		return r
 	}
-	return h(data)
+	return &bodyLimiter{r: r, n: int64(max), max: max}
 }
 
-// Check if the requested language is valid.
+type bodyLimiter struct {
+	r   io.Reader
+	n   int64 // remaining bytes
+	max uint
+}
+
+func (l *bodyLimiter) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, tooLargeError{limit: l.max, unit: "bytes"}
+	}
+	if int64(len(p)) > l.n+1 { // read one more byte to detect the overflow
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), tooLargeError{limit: l.max, unit: "bytes"}
+	}
+	return n, err
+}
+
+// Check if the requested language is valid.  If the request pins
+// the checksum of the language configuration, the checksum must match
+// the current configuration (409 otherwise).  Requests may be served
+// by the fallback of their language (see selectLanguage).
 func withValidLanguage(
-	h func(string, api.Request) interface{},
-) func(api.Request) interface{} {
-	return func(request api.Request) interface{} {
-		lc, err := gofiler.FindLanguage(backend, request.Language)
+	h func(string, submission) interface{},
+) func(submission) interface{} {
+	return func(request submission) interface{} {
+		lc, err := selectLanguage(&request)
 		if err == gofiler.ErrorLanguageNotFound {
 			return http.StatusNotFound
 		}
+		if c, ok := err.(languageConflict); ok {
+			return c.apiError()
+		}
+		if e, ok := err.(errBreakerOpen); ok {
+			return e.apiError()
+		}
+		if e, ok := err.(errUnverified); ok {
+			log.Errorf("cannot serve %s: %v", request.Language, e)
+			return e.apiError()
+		}
+		if err != nil {
+			return err
+		}
+		sum, err := languageChecksum(lc.Path)
 		if err != nil {
 			return err
 		}
+		if request.Checksum != "" && request.Checksum != sum {
+			return api.Error{
+				Status: http.StatusConflict,
+				Message: fmt.Sprintf("checksum mismatch for %s: expected %s, got %s",
+					request.Language, request.Checksum, sum),
+			}
+		}
+		if err, ok := checkOptions(lc, request); !ok {
+			return err
+		}
+		request.checksum = sum
 		return h(lc.Path, request)
 	}
 }
 
+// Check the optional features of the request.  If a feature is not
+// available, the according api.Error is returned.
+func checkOptions(lc gofiler.LanguageConfiguration, request submission) (api.Error, bool) {
+	if err := checkClientID(request.ID); err != nil {
+		return api.Error{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		}, false
+	}
+	if maxTokens > 0 && uint(len(request.Tokens)) > maxTokens {
+		return api.Error{
+			Status:  http.StatusRequestEntityTooLarge,
+			Message: tooLargeError{limit: maxTokens, unit: "tokens"}.Error(),
+		}, false
+	}
+	if err := checkTokens(request.Request); err != nil {
+		return api.Error{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		}, false
+	}
+	if err, ok := checkAlphabet(lc, request.Request); !ok {
+		return err, false
+	}
+	if request.Rerank {
+		if _, err := os.Stat(languageModelPath(lc.Path)); err != nil {
+			return api.Error{
+				Status:  http.StatusBadRequest,
+				Message: fmt.Sprintf("no language model for %s", request.Language),
+			}, false
+		}
+	}
+	if request.Lowercase && request.PreserveCase {
+		return api.Error{
+			Status:  http.StatusBadRequest,
+			Message: "Lowercase and PreserveCase are mutually exclusive",
+		}, false
+	}
+	if _, err := compileSkipRules(request.Skip); err != nil {
+		return api.Error{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		}, false
+	}
+	if request.Corpus != "" && !hasFrequencies(request.Corpus) && !hasFeedback(request.Corpus) &&
+		!hasWhitelist(request.Corpus) {
+		return api.Error{
+			Status:  http.StatusBadRequest,
+			Message: fmt.Sprintf("unknown corpus: %s", request.Corpus),
+		}, false
+	}
+	if request.Checkpoint && (dataDir == "" || noContentLogging) {
+		return api.Error{
+			Status:  http.StatusBadRequest,
+			Message: "checkpoints are not available",
+		}, false
+	}
+	if request.Keep && noContentLogging {
+		return api.Error{
+			Status:  http.StatusBadRequest,
+			Message: "profiles cannot be kept",
+		}, false
+	}
+	if err := checkRetention(request.Request); err != nil {
+		return api.Error{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		}, false
+	}
+	if err := checkPriority(request.Priority); err != nil {
+		return api.Error{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+		}, false
+	}
+	return api.Error{}, true
+}
+
+// Read the token from the request's query.  If the query contains a
+// wait duration (e.g. wait=30s), the handler may block for at most
+// this duration (bounded by -max-wait).  With partial=true, unfinished
+// jobs report the profiles of their finished chunks.  The handler's context is
+// canceled if the client disconnects.
 func withToken(
-	h func(api.Token) interface{},
+	h func(context.Context, api.Token) interface{},
 ) func(http.ResponseWriter, *http.Request) interface{} {
 	return func(w http.ResponseWriter, r *http.Request) interface{} {
-		id := r.URL.Query().Get("token")
+		id := pathParam(r, "token")
+		if id == "" {
+			id = r.URL.Query().Get("token")
+		}
 		if id == "" {
 			return http.StatusBadRequest
 		}
-		return h(api.Token{ID: id})
+		if !mayAccess(r, id) {
+			return http.StatusForbidden
+		}
+		var wait time.Duration
+		if str := r.URL.Query().Get("wait"); str != "" {
+			d, err := time.ParseDuration(str)
+			if err != nil || d < 0 {
+				return http.StatusBadRequest
+			}
+			wait = d
+		}
+		if wait > maxWait {
+			wait = maxWait
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		defer cancel()
+		if r.URL.Query().Get("partial") == "true" {
+			ctx = context.WithValue(ctx, partialKey{}, true)
+		}
+		x := h(ctx, api.Token{ID: id})
+		if r.Context().Err() != nil {
+			log.Infof("client %s disconnected", remoteIP(r))
+		}
+		return x
 	}
 }
 
+func getVersion(w http.ResponseWriter, r *http.Request) interface{} {
+	return api.VersionInfo{Version: api.Version}
+}
+
 func getLanguages(w http.ResponseWriter, r *http.Request) interface{} {
 	lcs, err := gofiler.ListLanguages(backend)
 	if err != nil {
 		return err
 	}
-	var ls api.Languages
+	ls := api.Languages{
+		Checksums: make(map[string]string),
+		Conflicts: languageConflicts(lcs),
+	}
 	for _, lc := range lcs {
+		if _, ok := ls.Conflicts[lc.Language]; ok {
+			continue
+		}
 		ls.Languages = append(ls.Languages, lc.Language)
+		sum, err := languageChecksum(lc.Path)
+		if err != nil {
+			return err
+		}
+		ls.Checksums[lc.Language] = sum
+		if backendManifest != "" {
+			if ls.Verification == nil {
+				ls.Verification = make(map[string]string)
+			}
+			ls.Verification[lc.Language] = verificationState(lc.Path)
+		}
 	}
 	return ls
 }
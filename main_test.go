@@ -0,0 +1,42 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	defer func(level int) { gzipLevel = level }(gzipLevel)
+	tests := []struct {
+		level  int
+		header []string
+		want   bool
+	}{
+		{gzip.DefaultCompression, nil, false},
+		{gzip.DefaultCompression, []string{"gzip"}, true},
+		{gzip.DefaultCompression, []string{"x-gzip"}, true},
+		{gzip.DefaultCompression, []string{"GZIP"}, true},
+		{gzip.DefaultCompression, []string{"deflate, gzip;q=0.5"}, true},
+		{gzip.DefaultCompression, []string{"deflate", "gzip"}, true},
+		{gzip.DefaultCompression, []string{"identity"}, false},
+		{gzip.DefaultCompression, []string{"gzip;q=0"}, false},
+		{gzip.DefaultCompression, []string{"*"}, true},
+		{gzip.DefaultCompression, []string{"*;q=0"}, false},
+		{gzip.DefaultCompression, []string{"*, gzip;q=0"}, false},
+		{gzip.DefaultCompression, []string{"gzip;q=0, *"}, false},
+		{gzip.DefaultCompression, []string{"*;q=0, gzip"}, true},
+		{gzip.DefaultCompression, []string{"*;q=0", "gzip;q=0.1"}, true},
+		{gzip.NoCompression, []string{"gzip"}, false},
+	}
+	for _, tc := range tests {
+		gzipLevel = tc.level
+		r := httptest.NewRequest("GET", "/", nil)
+		for _, h := range tc.header {
+			r.Header.Add("Accept-Encoding", h)
+		}
+		if got := acceptsGzip(r); got != tc.want {
+			t.Errorf("acceptsGzip(%q) with level %d = %t; want %t", tc.header, tc.level, got, tc.want)
+		}
+	}
+}
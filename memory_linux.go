@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The profiler processes are started by gofiler, so their pids are
+// not known.  memWatcher searches for a new child process of the
+// daemon and samples its peak resident memory (VmHWM) until the job
+// is done.  Watchers are started one after the other, so each watcher
+// finds the process of its own job.
+type memWatcher struct {
+	pid  int
+	peak uint64
+	quit chan struct{}
+	done chan struct{}
+}
+
+var spawn struct {
+	pids map[int]bool // child processes claimed by a watcher
+	l    sync.Mutex   // held by a watcher until it finds its process
+	m    sync.Mutex   // protects pids
+}
+
+// Start watching for the next profiler process.  It must be called
+// right before the profiler is started.
+func watchMemory() *memWatcher {
+	w := &memWatcher{quit: make(chan struct{}), done: make(chan struct{})}
+	spawn.l.Lock()
+	go w.run()
+	return w
+}
+
+// Stop watching and return the peak resident memory in bytes (or 0
+// if the process could not be found).
+func (w *memWatcher) stop() uint64 {
+	close(w.quit)
+	<-w.done
+	return w.peak
+}
+
+func (w *memWatcher) run() {
+	defer close(w.done)
+	w.pid = w.find()
+	spawn.l.Unlock()
+	if w.pid == 0 {
+		return
+	}
+	defer func() {
+		spawn.m.Lock()
+		delete(spawn.pids, w.pid)
+		spawn.m.Unlock()
+	}()
+	tick := time.NewTicker(500 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if hwm := vmHWM(w.pid); hwm > w.peak {
+			w.peak = hwm
+		}
+		select {
+		case <-w.quit:
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// Search for an unclaimed child process for at most 5 seconds.
+func (w *memWatcher) find() int {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, pid := range children() {
+			spawn.m.Lock()
+			claimed := spawn.pids[pid]
+			if !claimed {
+				if spawn.pids == nil {
+					spawn.pids = make(map[int]bool)
+				}
+				spawn.pids[pid] = true
+			}
+			spawn.m.Unlock()
+			if !claimed {
+				return pid
+			}
+		}
+		select {
+		case <-w.quit:
+			return 0
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return 0
+}
+
+// Return the pids of the child processes of the daemon.
+func children() []int {
+	dirs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	self := os.Getpid()
+	var pids []int
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile("/proc/" + dir.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+		// The fields after the command name (which is enclosed in
+		// parentheses) are: state ppid ...
+		i := bytes.LastIndexByte(stat, ')')
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[i+1:]))
+		if len(fields) > 1 && fields[1] == strconv.Itoa(self) {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// Return the peak resident memory of the process in bytes.
+func vmHWM(pid int) uint64 {
+	f, err := os.Open("/proc/" + strconv.Itoa(pid) + "/status")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 3 && fields[0] == "VmHWM:" {
+			kb, _ := strconv.ParseUint(fields[1], 10, 64)
+			return kb * 1024
+		}
+	}
+	return 0
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// The memory of profiler processes can only be measured on Linux.
+type memWatcher struct{}
+
+func watchMemory() *memWatcher {
+	return &memWatcher{}
+}
+
+func (*memWatcher) stop() uint64 {
+	return 0
+}
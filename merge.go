@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+)
+
+// The dictionary of accepted corrections that are not a candidate of
+// their entry.
+const feedbackDict = "feedback"
+
+// Merge the profile of an adaptive round with the profile of the
+// previous round of the same document: [POST] profiles/merge.  The
+// profiles are given inline or as IDs of kept profiles.
+func mergeRounds(w http.ResponseWriter, r *http.Request) interface{} {
+	var req api.MergeRequest
+	if err := decodeBody(r, &req); err != nil {
+		return decodeError(err)
+	}
+	prev, err := mergeInput(r, req.Previous, req.PreviousID)
+	if err != nil {
+		return api.Error{Status: http.StatusBadRequest, Message: "previous: " + err.Error()}
+	}
+	cur, err := mergeInput(r, req.Current, req.CurrentID)
+	if err != nil {
+		return api.Error{Status: http.StatusBadRequest, Message: "current: " + err.Error()}
+	}
+	res := mergeRound(prev, cur, req.Corrections)
+	res.Classes = classify(res.Profile)
+	return res
+}
+
+// Return the given profile or the kept profile with the ID.
+func mergeInput(r *http.Request, p gofiler.Profile, id string) (gofiler.Profile, error) {
+	switch {
+	case id != "" && p != nil:
+		return nil, fmt.Errorf("profile and ID given")
+	case id == "" && p == nil:
+		return nil, fmt.Errorf("missing profile")
+	case p != nil:
+		return p, nil
+	}
+	repository.l.RLock()
+	defer repository.l.RUnlock()
+	sp, ok := repository.m[id]
+	if !ok || !mayRead(r, sp) {
+		return nil, fmt.Errorf("no such profile: %s", id)
+	}
+	return sp.Profile, nil
+}
+
+// Merge the profiles of two adaptive rounds.  Entries of the current
+// round replace the entries of the previous round; entries whose best
+// suggestion changed are reported.  Entries with an accepted
+// correction keep the correction as their only candidate.  The
+// corrections are matched case insensitively.
+func mergeRound(prev, cur gofiler.Profile, corrections []api.Correction) api.MergedProfile {
+	accepted := make(map[string]string)
+	for _, c := range corrections {
+		if c.OCR != "" && c.Correction != "" {
+			accepted[strings.ToLower(c.OCR)] = c.Correction
+		}
+	}
+	res := api.MergedProfile{Profile: make(gofiler.Profile, len(prev)+len(cur))}
+	for ocr, e := range prev {
+		res.Profile[ocr] = e
+	}
+	for ocr, e := range cur {
+		old, ok := prev[ocr]
+		res.Profile[ocr] = e
+		if !ok {
+			continue
+		}
+		was, is := bestSuggestion(old), bestSuggestion(e)
+		if was != is {
+			res.Changed = append(res.Changed, api.SuggestionChange{
+				OCR:      ocr,
+				Previous: was,
+				Current:  is,
+			})
+		}
+	}
+	for ocr, e := range res.Profile {
+		correction, ok := accepted[strings.ToLower(ocr)]
+		if !ok {
+			continue
+		}
+		res.Profile[ocr] = acceptCorrection(e, correction)
+		if res.Corrected == nil {
+			res.Corrected = make(map[string]string)
+		}
+		res.Corrected[ocr] = correction
+	}
+	sort.Slice(res.Changed, func(i, j int) bool {
+		return res.Changed[i].OCR < res.Changed[j].OCR
+	})
+	return res
+}
+
+// Return the suggestion of the best candidate of the entry or "" if
+// it has no candidates.
+func bestSuggestion(e gofiler.Interpretation) string {
+	if len(e.Candidates) == 0 {
+		return ""
+	}
+	return bestCandidates(e.Candidates, 1)[0].Suggestion
+}
+
+// Return the entry with the accepted correction as its only candidate.
+// The candidate of the entry with the correction as suggestion is
+// used if it exists.
+func acceptCorrection(e gofiler.Interpretation, correction string) gofiler.Interpretation {
+	c := gofiler.Candidate{Suggestion: correction, Modern: correction, Dict: feedbackDict}
+	for _, cand := range e.Candidates {
+		if strings.EqualFold(cand.Suggestion, correction) {
+			c = cand
+			break
+		}
+	}
+	c.Weight = 1
+	e.Candidates = []gofiler.Candidate{c}
+	return e
+}
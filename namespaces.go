@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// namespace holds the request defaults and limits of the clients
+// that authenticate with the key of the namespace as bearer token.
+// Namespaces are read from the -namespaces file with one section per
+// namespace.  Only the key is required:
+//
+//	[project]
+//	key = SECRET
+//	language = german
+//	corpus = project
+//	max-candidates = 5
+//	max-tokens = 100000
+//	timeout = 30
+//	monthly-tokens = 10000000
+//	jobs-per-minute = 60
+//	retention = 30d
+//
+// The language and corpus are used if a request omits them.
+// Requests get at most max-candidates candidates per entry (also if
+// they omit MaxCandidates) and at most max-tokens tokens.  The
+// timeout of jobs is given in minutes.  The jobs of a namespace may
+// profile at most monthly-tokens tokens per calendar month (UTC) and
+// it may submit at most jobs-per-minute jobs per minute (see
+// chargeQuota).  Kept profiles of the namespace use the retention
+// class if a request omits its Retention (see parseRetention).
+type namespace struct {
+	name          string
+	key           string
+	language      string
+	corpus        string
+	maxCandidates int
+	maxTokens     uint
+	timeout       uint
+	monthlyTokens uint
+	jobsPerMinute uint
+	retention     string
+	priority      string
+}
+
+var namespaces []namespace
+
+// Load the namespaces from the INI file.
+func loadNamespaces(path string) error {
+	config, err := readINI(path)
+	if err != nil {
+		return fmt.Errorf("cannot read namespaces: %v", err)
+	}
+	for name, vals := range config {
+		if name == "" {
+			continue
+		}
+		ns := namespace{
+			name:      name,
+			key:       vals["key"],
+			language:  vals["language"],
+			corpus:    vals["corpus"],
+			retention: vals["retention"],
+			priority:  vals["priority"],
+		}
+		if ns.key == "" {
+			return fmt.Errorf("missing key of namespace %s", name)
+		}
+		for key, dest := range map[string]*uint{
+			"max-tokens":      &ns.maxTokens,
+			"timeout":         &ns.timeout,
+			"monthly-tokens":  &ns.monthlyTokens,
+			"jobs-per-minute": &ns.jobsPerMinute,
+		} {
+			if val, ok := vals[key]; ok {
+				n, err := strconv.ParseUint(val, 10, 32)
+				if err != nil {
+					return fmt.Errorf("invalid %s of namespace %s: %v", key, name, err)
+				}
+				*dest = uint(n)
+			}
+		}
+		if val, ok := vals["max-candidates"]; ok {
+			if ns.maxCandidates, err = strconv.Atoi(val); err != nil || ns.maxCandidates < 0 {
+				return fmt.Errorf("invalid max-candidates of namespace %s: %s", name, val)
+			}
+		}
+		if ns.retention != "" {
+			if _, err := parseRetention(ns.retention); err != nil {
+				return fmt.Errorf("invalid retention of namespace %s: %s", name, ns.retention)
+			}
+		}
+		if err := checkPriority(ns.priority); err != nil {
+			return fmt.Errorf("invalid priority of namespace %s: %s", name, ns.priority)
+		}
+		namespaces = append(namespaces, ns)
+	}
+	return nil
+}
+
+// Find the namespace of the request's bearer token.  Returns nil if
+// the request is anonymous or authenticated with the admin key.
+// Returns false if the bearer token is unknown or an invalid JWT.
+func findNamespace(r *http.Request) (*namespace, bool) {
+	key := bearerToken(r)
+	if key == "" || isAdmin(r) {
+		return nil, true
+	}
+	for i := range namespaces {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(namespaces[i].key)) == 1 {
+			return &namespaces[i], true
+		}
+	}
+	if oidc != nil && isJWT(key) {
+		sub, err := oidc.verify(key)
+		if err != nil {
+			log.Infof("invalid token: %v", err)
+			return nil, false
+		}
+		return &namespace{name: "oidc:" + sub}, true
+	}
+	return nil, false
+}
+
+// Return the namespace with the given name.  Returns nil for unknown
+// namespaces (and the namespaces of OIDC subjects).
+func lookupNamespace(name string) *namespace {
+	for i := range namespaces {
+		if namespaces[i].name == name {
+			return &namespaces[i]
+		}
+	}
+	return nil
+}
+
+// Fill in the defaults of the namespace and enforce its limits.
+func (ns *namespace) apply(request *submission) (api.Error, bool) {
+	request.namespace = ns.name
+	if request.Language == "" {
+		request.Language = ns.language
+	}
+	if request.Corpus == "" {
+		request.Corpus = ns.corpus
+	}
+	if request.Keep && request.Retention == "" {
+		request.Retention = ns.retention
+	}
+	if ns.maxCandidates > 0 &&
+		(request.MaxCandidates == 0 || request.MaxCandidates > ns.maxCandidates) {
+		request.MaxCandidates = ns.maxCandidates
+	}
+	if ns.maxTokens > 0 && uint(len(request.Tokens)) > ns.maxTokens {
+		return api.Error{
+			Status:  http.StatusRequestEntityTooLarge,
+			Message: tooLargeError{limit: ns.maxTokens, unit: "tokens"}.Error(),
+		}, false
+	}
+	request.timeout = ns.timeout
+	return api.Error{}, true
+}
+
+// Keep only the n best candidates of each entry of the profile.
+func limitCandidates(p gofiler.Profile, n int) {
+	for w, e := range p {
+		if len(e.Candidates) <= n {
+			continue
+		}
+		cands := append([]gofiler.Candidate{}, e.Candidates...)
+		sort.SliceStable(cands, func(a, b int) bool {
+			return cands[a].Weight > cands[b].Weight
+		})
+		e.Candidates = cands[:n]
+		p[w] = e
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// natsConn is a minimal client for the plain text NATS protocol.  It
+// reconnects if the connection to the server is lost and renews its
+// subscriptions.
+type natsConn struct {
+	addr string
+	auth map[string]string
+	subs []natsSub // the index is the subscription id
+	conn net.Conn
+	l    sync.Mutex
+}
+
+type natsSub struct {
+	subject string
+	queue   string
+	h       func(natsMsg)
+}
+
+type natsMsg struct {
+	subject string
+	reply   string
+	data    []byte
+}
+
+// Connect to the NATS server of the given URL
+// (nats://[user[:password]@]host[:port]).  A user without a password
+// is used as authentication token.
+func dialNATS(u *url.URL) (*natsConn, error) {
+	n := &natsConn{addr: u.Host, auth: make(map[string]string)}
+	if u.Port() == "" {
+		n.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			n.auth["user"] = u.User.Username()
+			n.auth["pass"] = pass
+		} else {
+			n.auth["auth_token"] = u.User.Username()
+		}
+	}
+	n.l.Lock()
+	defer n.l.Unlock()
+	return n, n.connect()
+}
+
+// Connect to the server and renew all subscriptions.  Must be called
+// with the connection locked.
+func (n *natsConn) connect() error {
+	conn, err := net.DialTimeout("tcp", n.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	// The server greets with an INFO line.
+	if _, err := r.ReadString('\n'); err != nil {
+		conn.Close()
+		return err
+	}
+	opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": "gofilerd"}
+	for k, v := range n.auth {
+		opts[k] = v
+	}
+	buf, err := json.Marshal(opts)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", buf); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := r.ReadString('\n')
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "PONG") {
+		conn.Close()
+		return fmt.Errorf("cannot connect to %s: %s", n.addr, strings.TrimSpace(line))
+	}
+	for sid, sub := range n.subs {
+		if err := sub.send(conn, sid); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	n.conn = conn
+	go n.read(conn, r)
+	return nil
+}
+
+// Handle the messages of the server until the connection is closed.
+func (n *natsConn) read(conn net.Conn, r *bufio.Reader) {
+loop:
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			n.l.Lock()
+			fmt.Fprint(conn, "PONG\r\n")
+			n.l.Unlock()
+		case strings.HasPrefix(line, "MSG "):
+			if err := n.dispatch(line, r); err != nil {
+				log.Errorf("nats %s: %v", n.addr, err)
+				break loop
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			log.Errorf("nats %s: %s", n.addr, strings.TrimSpace(line))
+		}
+	}
+	n.l.Lock()
+	defer n.l.Unlock()
+	conn.Close()
+	if n.conn == conn {
+		n.conn = nil
+	}
+	if n.conn == nil && len(n.subs) > 0 {
+		go n.reconnect()
+	}
+}
+
+// Read the payload of a message (MSG subject sid [reply] size) and
+// pass it to the handler of its subscription.
+func (n *natsConn) dispatch(line string, r *bufio.Reader) error {
+	args := strings.Fields(line)
+	if len(args) != 4 && len(args) != 5 {
+		return fmt.Errorf("invalid message: %s", strings.TrimSpace(line))
+	}
+	sid, err := strconv.Atoi(args[2])
+	if err != nil {
+		return fmt.Errorf("invalid message: %s", strings.TrimSpace(line))
+	}
+	size, err := strconv.Atoi(args[len(args)-1])
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid message: %s", strings.TrimSpace(line))
+	}
+	data := make([]byte, size+2) // payload\r\n
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	msg := natsMsg{subject: args[1], data: data[:size]}
+	if len(args) == 5 {
+		msg.reply = args[3]
+	}
+	n.l.Lock()
+	var h func(natsMsg)
+	if sid >= 0 && sid < len(n.subs) {
+		h = n.subs[sid].h
+	}
+	n.l.Unlock()
+	if h != nil {
+		go h(msg)
+	}
+	return nil
+}
+
+// Reconnect with an exponential backoff.
+func (n *natsConn) reconnect() {
+	backoff := time.Second
+	for {
+		time.Sleep(backoff)
+		n.l.Lock()
+		err := error(nil)
+		if n.conn == nil {
+			err = n.connect()
+		}
+		n.l.Unlock()
+		if err == nil {
+			log.Infof("reconnected to nats %s", n.addr)
+			return
+		}
+		log.Infof("cannot reconnect to nats %s: %v", n.addr, err)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+// Publish a message.  The connection is reestablished if needed.
+func (n *natsConn) publish(subject string, buf []byte) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+	var err error
+	for i := 0; i < 2; i++ {
+		if n.conn == nil {
+			if err = n.connect(); err != nil {
+				continue
+			}
+		}
+		if _, err = fmt.Fprintf(n.conn, "PUB %s %d\r\n%s\r\n", subject, len(buf), buf); err == nil {
+			return nil
+		}
+		n.conn.Close()
+		n.conn = nil
+	}
+	return err
+}
+
+// Subscribe to a subject.  Messages are distributed among all
+// subscribers of the same queue group.  The handler is called in its
+// own go routine for each message.
+func (n *natsConn) subscribe(subject, queue string, h func(natsMsg)) error {
+	n.l.Lock()
+	defer n.l.Unlock()
+	sid := len(n.subs)
+	n.subs = append(n.subs, natsSub{subject: subject, queue: queue, h: h})
+	if n.conn == nil {
+		return n.connect()
+	}
+	return n.subs[sid].send(n.conn, sid)
+}
+
+func (s natsSub) send(w io.Writer, sid int) error {
+	if s.queue == "" {
+		_, err := fmt.Fprintf(w, "SUB %s %d\r\n", s.subject, sid)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "SUB %s %s %d\r\n", s.subject, s.queue, sid)
+	return err
+}
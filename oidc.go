@@ -0,0 +1,328 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Clients can authenticate with JWTs of an OIDC issuer
+// (-oidc-issuer) instead of the static keys of the namespaces.  The
+// tokens must be signed with a key of the issuer (RS256 or ES256),
+// must be issued for -oidc-audience and must grant -oidc-scope (if
+// given).  Clients authenticated with a JWT use the namespace
+// oidc:SUBJECT.
+
+// Allowed clock skew for the expiration and not before times.
+const jwtLeeway = time.Minute
+
+// Minimal time between two reloads of the issuer's keys.  After
+// failed reloads, the time doubles up to jwksMaxBackoff.
+const (
+	jwksRefresh    = time.Minute
+	jwksMaxBackoff = 15 * time.Minute
+)
+
+type oidcVerifier struct {
+	issuer   string
+	audience string
+	scope    string
+	jwksURL  string
+
+	l         sync.Mutex
+	keys      map[string]crypto.PublicKey // kid -> key
+	attempted time.Time                   // time of the last (re)load
+	failures  int                         // consecutive failed reloads
+}
+
+var oidc *oidcVerifier
+
+// jwtClaims are the registered claims of a JWT that are checked.
+type jwtClaims struct {
+	Issuer    string          `json:"iss"`
+	Subject   string          `json:"sub"`
+	Audience  json.RawMessage `json:"aud"` // string or array of strings
+	Expires   int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+	Scope     string          `json:"scope"` // space separated scopes
+	Scopes    []string        `json:"scp"`
+}
+
+// Discover the keys of the OIDC issuer.
+func openOIDC(issuer, audience, scope string) error {
+	if audience == "" {
+		return fmt.Errorf("missing audience for issuer %s", issuer)
+	}
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURL string `json:"jwks_uri"`
+	}
+	u := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := getJSON(u, &discovery); err != nil {
+		return fmt.Errorf("cannot discover issuer %s: %v", issuer, err)
+	}
+	if discovery.Issuer != issuer {
+		return fmt.Errorf("issuer mismatch: expected %s, got %s", issuer, discovery.Issuer)
+	}
+	v := &oidcVerifier{
+		issuer:   issuer,
+		audience: audience,
+		scope:    scope,
+		jwksURL:  discovery.JWKSURL,
+	}
+	if err := v.loadKeys(); err != nil {
+		return err
+	}
+	oidc = v
+	return nil
+}
+
+// Check if the token looks like a JWT (header.payload.signature).
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify the JWT and return its subject.
+func (v *oidcVerifier) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", fmt.Errorf("invalid header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("invalid signature: %v", err)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(header.Alg, key, hash[:], sig); err != nil {
+		return "", err
+	}
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("invalid claims: %v", err)
+	}
+	if err := v.check(claims, time.Now()); err != nil {
+		return "", err
+	}
+	return claims.Subject, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, hash, sig []byte) error {
+	switch alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match algorithm %s", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, hash, sig); err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return fmt.Errorf("key does not match algorithm %s", alg)
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, hash, r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm: %s", alg)
+	}
+}
+
+// Check the registered claims of the token.
+func (v *oidcVerifier) check(claims jwtClaims, now time.Time) error {
+	if claims.Issuer != v.issuer {
+		return fmt.Errorf("invalid issuer: %s", claims.Issuer)
+	}
+	if claims.Subject == "" {
+		return fmt.Errorf("missing subject")
+	}
+	var auds []string
+	if err := json.Unmarshal(claims.Audience, &auds); err != nil {
+		var aud string
+		if err := json.Unmarshal(claims.Audience, &aud); err != nil {
+			return fmt.Errorf("invalid audience")
+		}
+		auds = []string{aud}
+	}
+	if !containsString(auds, v.audience) {
+		return fmt.Errorf("invalid audience: %s", strings.Join(auds, " "))
+	}
+	if claims.Expires == 0 || now.Add(-jwtLeeway).Unix() >= claims.Expires {
+		return fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != 0 && now.Add(jwtLeeway).Unix() < claims.NotBefore {
+		return fmt.Errorf("token not valid yet")
+	}
+	if v.scope != "" && !containsString(strings.Fields(claims.Scope), v.scope) &&
+		!containsString(claims.Scopes, v.scope) {
+		return fmt.Errorf("missing scope: %s", v.scope)
+	}
+	return nil
+}
+
+// Return the key with the given id.  The keys are reloaded if the id
+// is unknown (the issuer might have rotated its keys).  Only one
+// request reloads the keys at a time and reloads back off while the
+// issuer fails.
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.l.Lock()
+	key, ok := v.keys[kid]
+	reload := !ok && time.Since(v.attempted) > v.backoff()
+	if reload {
+		v.attempted = time.Now()
+	}
+	v.l.Unlock()
+	if ok {
+		return key, nil
+	}
+	if reload {
+		if err := v.loadKeys(); err != nil {
+			log.Errorf("cannot reload keys of %s: %v", v.issuer, err)
+		}
+		v.l.Lock()
+		key, ok = v.keys[kid]
+		v.l.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key: %s", kid)
+}
+
+// Return the minimal time between two reloads.  Must be called with
+// the verifier locked.
+func (v *oidcVerifier) backoff() time.Duration {
+	d := jwksRefresh
+	for i := 0; i < v.failures && d < jwksMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > jwksMaxBackoff {
+		return jwksMaxBackoff
+	}
+	return d
+}
+
+// Load the keys of the issuer.  Keys of unsupported types are
+// skipped.
+func (v *oidcVerifier) loadKeys() error {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(v.jwksURL, &set); err != nil {
+		v.l.Lock()
+		v.failures++
+		v.l.Unlock()
+		return fmt.Errorf("cannot load keys: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil || len(e) > 4 {
+				log.Infof("skipping invalid key %s", k.Kid)
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				log.Infof("skipping invalid key %s", k.Kid)
+				continue
+			}
+			key := &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+			if !key.Curve.IsOnCurve(key.X, key.Y) {
+				log.Infof("skipping invalid key %s", k.Kid)
+				continue
+			}
+			keys[k.Kid] = key
+		}
+	}
+	v.l.Lock()
+	v.keys = keys
+	v.attempted = time.Now()
+	v.failures = 0
+	v.l.Unlock()
+	log.Infof("loaded %d keys of %s", len(keys), v.issuer)
+	return nil
+}
+
+func decodeSegment(seg string, x interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, x)
+}
+
+// Get JSON encoded data from an URL.
+func getJSON(u string, x interface{}) error {
+	client := http.Client{Timeout: 10 * time.Second}
+	res, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(x)
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sync"
+
+	"github.com/finkf/gofilerd/api"
+)
+
+// Buffers larger than this are not put back into the pool, so that a
+// single large profile does not pin its memory.
+const maxPooledBuffer = 4 << 20
+
+var (
+	gzipWriters = sync.Pool{New: newGzipWriter}
+	buffers     = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+)
+
+// Create a gzip writer with the configured compression level.
+func newGzipWriter() interface{} {
+	writer, err := gzip.NewWriterLevel(nil, gzipLevel)
+	if err != nil { // the level is checked in main
+		panic(err)
+	}
+	return writer
+}
+
+// Get a gzip writer from the pool that writes to w.  The writer must
+// be returned with putGzipWriter after it was closed.
+func getGzipWriter(w io.Writer) *gzip.Writer {
+	writer := gzipWriters.Get().(*gzip.Writer)
+	writer.Reset(w)
+	return writer
+}
+
+func putGzipWriter(writer *gzip.Writer) {
+	writer.Reset(nil)
+	gzipWriters.Put(writer)
+}
+
+func getBuffer() *bytes.Buffer {
+	return buffers.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	buffers.Put(buf)
+}
+
+// Estimate the size of the JSON encoding of x.  Profiles are
+// estimated using the number of their entries and candidates.
+func sizeHint(x interface{}) int {
+	const entry, candidate = 64, 128
+	var p *api.Profile
+	switch t := x.(type) {
+	case api.Profile:
+		p = &t
+	case *api.Profile:
+		p = t
+	default:
+		return 0
+	}
+	n := 512
+	for _, e := range p.Profile {
+		n += entry + len(e.OCR) + candidate*len(e.Candidates)
+	}
+	return n
+}
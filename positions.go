@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+)
+
+// Map the entries of the profile to the positions of their tokens.
+// If the preprocessing hook did not change the number of tokens, the
+// positions are mapped using the preprocessed tokens.  Otherwise the
+// original tokens of the request are used.  Tokens without an entry
+// in the profile are skipped.
+func positions(
+	p gofiler.Profile, request api.Request, tokens []gofiler.Token,
+) map[string][]api.Position {
+	if len(request.Positions) == 0 {
+		return nil
+	}
+	if len(tokens) != len(request.Tokens) {
+		tokens = request.Tokens
+	}
+	res := make(map[string][]api.Position)
+	for i, t := range tokens {
+		if i >= len(request.Positions) || t.LE != "" {
+			continue
+		}
+		key := t.OCR
+		if _, ok := p[key]; !ok {
+			key = strings.ToLower(key)
+		}
+		if _, ok := p[key]; !ok {
+			continue
+		}
+		res[key] = append(res[key], request.Positions[i])
+	}
+	return res
+}
+
+// Return the segments of the request together with the OCR of their
+// tokens.  Like the positions, the words are taken from the
+// preprocessed tokens if the preprocessing hook did not change the
+// number of tokens.
+func segments(request api.Request, tokens []gofiler.Token) []api.Segment {
+	if len(request.Segments) == 0 {
+		return nil
+	}
+	if len(tokens) != len(request.Tokens) {
+		tokens = request.Tokens
+	}
+	res := make([]api.Segment, len(request.Segments))
+	for i, s := range request.Segments {
+		res[i] = s
+		res[i].Words = make([]string, 0, s.Length)
+		for _, t := range tokens[s.Start : s.Start+s.Length] {
+			res[i].Words = append(res[i].Words, t.OCR)
+		}
+	}
+	return res
+}
+
+// Return the index of the segment of each token or -1 for tokens
+// outside of all segments.  If the preprocessing hook changed the
+// number of tokens, the segments are unknown and nil is returned.
+func segmentIndex(request api.Request, tokens []gofiler.Token) []int {
+	if len(request.Segments) == 0 || len(tokens) != len(request.Tokens) {
+		return nil
+	}
+	res := make([]int, len(tokens))
+	for i := range res {
+		res[i] = -1
+	}
+	for i, s := range request.Segments {
+		for j := s.Start; j < s.Start+s.Length; j++ {
+			res[j] = i
+		}
+	}
+	return res
+}
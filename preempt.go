@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// If a job with high priority is refused because the daemon is at
+// capacity, a running job with normal priority can be preempted to
+// make room (-preemption):
+//
+//	off         jobs are never preempted
+//	checkpoint  only jobs with checkpoints are preempted; they resume
+//	            from their last finished chunk
+//	cancel      all jobs are preempted; jobs without checkpoints are
+//	            profiled again from the start
+//
+// The profiler of a preempted job is canceled.  The job keeps its
+// token, does not count against -max-jobs and -soft-max-jobs and is
+// requeued as soon as a job with normal priority would be accepted.
+const (
+	preemptOff        = "off"
+	preemptCheckpoint = "checkpoint"
+	preemptCancel     = "cancel"
+)
+
+// Interval to check if preempted jobs can be requeued.
+const requeueInterval = time.Second
+
+func checkPreemption(mode string) error {
+	switch mode {
+	case preemptOff, preemptCheckpoint, preemptCancel:
+		return nil
+	default:
+		return fmt.Errorf("invalid preemption: %q", mode)
+	}
+}
+
+func (s *jobState) isPreempted() bool {
+	return atomic.LoadInt32(&s.preempt) != 0
+}
+
+// Remove the profiles of the finished chunks.  Requeued jobs add them
+// again from their checkpoints.
+func (s *jobState) resetChunks() {
+	s.partial.l.Lock()
+	defer s.partial.l.Unlock()
+	s.partial.profiles = nil
+}
+
+// Return the number of jobs that are not preempted plus the number of
+// running lookups.  Must be called with the map locked.
+func (m *jobMap) active() int {
+	n := m.lookups
+	for _, j := range m.m {
+		if !j.state.isPreempted() {
+			n++
+		}
+	}
+	return n
+}
+
+// Preempt the running job with normal priority that started last (it
+// loses the least work).  Returns false if no job can be preempted.
+func (m *jobMap) preempt() bool {
+	m.l.Lock()
+	defer m.l.Unlock()
+	var id string
+	var victim job
+	for token, j := range m.m {
+		if j.priority == api.PriorityHigh || j.imported || j.state.isPreempted() ||
+			j.state.getPhase() != phaseRunning ||
+			(preemption == preemptCheckpoint && !j.chunked) {
+			continue
+		}
+		if id == "" || j.start.After(victim.start) {
+			id, victim = token, j
+		}
+	}
+	if id == "" {
+		return false
+	}
+	atomic.StoreInt32(&victim.state.preempt, 1)
+	victim.cancel()
+	log.Infof("preempted job %s", id)
+	return true
+}
+
+// Requeue the preempted job if a job with its priority would be
+// accepted.  Returns false if the job was removed.
+func (m *jobMap) requeue(id string, est cost, cancel context.CancelFunc) (requeued, ok bool) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	j, ok := m.m[id]
+	if !ok {
+		return false, false
+	}
+	if isDraining() || !admits(m.active(), j.priority) || !budgets.acquire(est) {
+		return false, true
+	}
+	j.cancel = cancel
+	m.m[id] = j
+	atomic.StoreInt32(&j.state.preempt, 0)
+	return true, true
+}
+
+// Preempt a job to make room for the request.  Returns true if a job
+// was preempted.
+func preemptFor(request submission) bool {
+	if preemption == preemptOff || request.Priority != api.PriorityHigh {
+		return false
+	}
+	return jobs.preempt()
+}
+
+// Wait until the preempted job can run again and run it.  The
+// deadlines of the job are extended by the waiting time.  Jobs that
+// are removed while they wait are dropped.
+func requeue(config, id string, request submission, est cost, state *jobState, pchan chan<- result) {
+	now := time.Now()
+	state.setPhase(phaseQueued)
+	state.record("preempted", now)
+	publishJob("preempted", id, request, nil)
+	updateSharedJob(id, sharedJob{
+		Phase:     phaseNames[phaseQueued],
+		Start:     now,
+		Language:  request.Language,
+		Owner:     request.remoteIP,
+		Checksum:  request.checksum,
+		Namespace: request.namespace,
+	})
+	ticker := time.NewTicker(requeueInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithCancel(context.Background())
+		requeued, ok := jobs.requeue(id, est, cancel)
+		if !ok {
+			cancel()
+			log.Infof("preempted job %s was removed", id)
+			return
+		}
+		if !requeued {
+			cancel()
+			continue
+		}
+		state.extend(time.Since(now))
+		state.touch()
+		state.resetChunks()
+		state.record("requeued", time.Now())
+		publishJob("requeued", id, request, nil)
+		log.Infof("requeued job %s after %s", id, time.Since(now))
+		runProfiler(ctx, cancel, state, config, id, request, est, pchan)
+		return
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/finkf/gofilerd/api"
+)
+
+// The daemon sheds load in two steps: with more than -soft-max-jobs
+// jobs, only jobs with high priority are accepted; with -max-jobs
+// jobs, no jobs are accepted.  Interactive users stay responsive
+// during batch floods without partitioning the capacity.  Only
+// namespaces with priority high may submit jobs with high priority.
+
+// Check the priority of a request.
+func checkPriority(priority string) error {
+	switch priority {
+	case "", api.PriorityNormal, api.PriorityHigh:
+		return nil
+	default:
+		return fmt.Errorf("invalid priority: %q", priority)
+	}
+}
+
+// Return true if jobs with the priority are accepted if there are n
+// jobs.
+func admits(n int, priority string) bool {
+	if n >= int(maxJobs) {
+		return false
+	}
+	return softMaxJobs == 0 || n < int(softMaxJobs) || priority == api.PriorityHigh
+}
+
+// Return the priority of a request of the namespace.  Only namespaces
+// with priority high may submit jobs with high priority; their
+// priority is also the default of their requests.  All other requests
+// (including anonymous requests with a nil namespace) have normal
+// priority.
+func (ns *namespace) applyPriority(priority string) string {
+	switch {
+	case ns == nil || ns.priority != api.PriorityHigh:
+		return api.PriorityNormal
+	case priority == "":
+		return api.PriorityHigh
+	default:
+		return priority
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/finkf/gofilerd/api"
+)
+
+func TestAdmits(t *testing.T) {
+	defer func(max, soft uint) { maxJobs, softMaxJobs = max, soft }(maxJobs, softMaxJobs)
+	tests := []struct {
+		max, soft uint
+		n         int
+		priority  string
+		want      bool
+	}{
+		{4, 0, 3, api.PriorityNormal, true},
+		{4, 0, 4, api.PriorityNormal, false},
+		{4, 0, 4, api.PriorityHigh, false},
+		{4, 2, 1, api.PriorityNormal, true},
+		{4, 2, 2, api.PriorityNormal, false},
+		{4, 2, 2, api.PriorityHigh, true},
+		{4, 2, 3, api.PriorityHigh, true},
+		{4, 2, 4, api.PriorityHigh, false},
+	}
+	for _, tc := range tests {
+		maxJobs, softMaxJobs = tc.max, tc.soft
+		if got := admits(tc.n, tc.priority); got != tc.want {
+			t.Errorf("admits(%d, %q) with max %d and soft max %d = %t; want %t",
+				tc.n, tc.priority, tc.max, tc.soft, got, tc.want)
+		}
+	}
+}
+
+func TestApplyPriority(t *testing.T) {
+	high := &namespace{name: "high", priority: api.PriorityHigh}
+	normal := &namespace{name: "normal", priority: api.PriorityNormal}
+	tests := []struct {
+		ns       *namespace
+		priority string
+		want     string
+	}{
+		{nil, "", api.PriorityNormal},
+		{nil, api.PriorityHigh, api.PriorityNormal},
+		{&namespace{name: "default"}, api.PriorityHigh, api.PriorityNormal},
+		{normal, "", api.PriorityNormal},
+		{normal, api.PriorityHigh, api.PriorityNormal},
+		{high, "", api.PriorityHigh},
+		{high, api.PriorityHigh, api.PriorityHigh},
+		{high, api.PriorityNormal, api.PriorityNormal},
+	}
+	for _, tc := range tests {
+		if got := tc.ns.applyPriority(tc.priority); got != tc.want {
+			t.Errorf("applyPriority(%q) of %v = %q; want %q", tc.priority, tc.ns, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// The profiler executable can be replaced at runtime:
+// [PUT] profiler.  New jobs use the new executable, jobs that were
+// started before keep the executable they started with.  The checksum
+// of the executable is recorded with the invocation of each job.
+//
+// Languages can be mapped to their own profiler executables
+// (-language-profilers german-dta=/opt/profiler-1.2/bin/profiler,...).
+// Mapped languages are not affected by [PUT] profiler.
+
+var profilerState struct {
+	path string // The profiler of new jobs
+	l    sync.RWMutex
+}
+
+// Profiler executables by (lower case) language.
+var languageProfilers map[string]string
+
+// Parse the comma separated LANGUAGE=PROFILER pairs.  All profilers
+// must exist and must be runnable (in the sandbox if -sandbox is set).
+func parseLanguageProfilers(str string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(str, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid language profiler: %s", pair)
+		}
+		language := strings.ToLower(strings.TrimSpace(kv[0]))
+		if language == "" || strings.TrimSpace(kv[1]) == "" {
+			return nil, fmt.Errorf("invalid language profiler: %s", pair)
+		}
+		if _, ok := m[language]; ok {
+			return nil, fmt.Errorf("duplicate language profiler for %s", language)
+		}
+		path, err := resolveProfiler(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid profiler for %s: %v", language, err)
+		}
+		if _, err := profilerCommand(path); err != nil {
+			return nil, fmt.Errorf("invalid profiler for %s: %v", language, err)
+		}
+		if _, err := findLanguage(language); err != nil {
+			log.Warnf("profiler for unknown language %s: %v", language, err)
+		}
+		m[language] = path
+	}
+	return m, nil
+}
+
+// Return the profiler executable of new jobs of the language.
+func profilerFor(language string) string {
+	if path, ok := languageProfilers[strings.ToLower(language)]; ok {
+		return path
+	}
+	return currentProfiler()
+}
+
+// Return the profiler executable of new jobs.
+func currentProfiler() string {
+	profilerState.l.RLock()
+	defer profilerState.l.RUnlock()
+	if profilerState.path == "" {
+		return executable
+	}
+	return profilerState.path
+}
+
+// Replace the profiler executable of new jobs.
+func setProfiler(path string) error {
+	path, err := resolveProfiler(path)
+	if err != nil {
+		return err
+	}
+	if _, err := profilerCommand(path); err != nil {
+		return err
+	}
+	profilerState.l.Lock()
+	defer profilerState.l.Unlock()
+	profilerState.path = path
+	return nil
+}
+
+// Return the absolute path of the executable.
+func resolveProfiler(path string) (string, error) {
+	path, err := exec.LookPath(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot find profiler: %v", err)
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return "", fmt.Errorf("cannot find profiler: %v", err)
+	}
+	return path, nil
+}
+
+// Return the command that runs the profiler: the profiler itself or
+// its sandbox trampoline.
+func profilerCommand(profiler string) (string, error) {
+	if sandboxExecutable == "" {
+		return profiler, nil
+	}
+	path, err := resolveProfiler(profiler)
+	if err != nil {
+		return "", err
+	}
+	return sandboxTrampoline(path)
+}
+
+var profilerChecksums struct {
+	m map[string]checksum // path -> checksum
+	l sync.Mutex
+}
+
+// Return the checksum of the profiler executable.  Checksums are
+// cached and only recomputed if the size or modification time of the
+// executable changes.
+func profilerChecksum(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	stamp := fmt.Sprintf("%d:%d", fi.Size(), fi.ModTime().UnixNano())
+	profilerChecksums.l.Lock()
+	defer profilerChecksums.l.Unlock()
+	if c, ok := profilerChecksums.m[path]; ok && c.stamp == stamp {
+		return c.sum, nil
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, in); err != nil {
+		return "", err
+	}
+	sum := "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if profilerChecksums.m == nil {
+		profilerChecksums.m = make(map[string]checksum)
+	}
+	profilerChecksums.m[path] = checksum{stamp: stamp, sum: sum}
+	return sum, nil
+}
+
+// Return the profiler executable of new jobs: [GET] profiler.
+func getProfiler(w http.ResponseWriter, r *http.Request) interface{} {
+	return profilerInfo(currentProfiler())
+}
+
+// Replace the profiler executable of new jobs: [PUT] profiler.
+func putProfiler(w http.ResponseWriter, r *http.Request) interface{} {
+	var info api.Profiler
+	if err := decodeBody(r, &info); err != nil {
+		return decodeError(err)
+	}
+	if err := setProfiler(info.Executable); err != nil {
+		return api.Error{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	log.Infof("profiler of new jobs: %s", currentProfiler())
+	return profilerInfo(currentProfiler())
+}
+
+func profilerInfo(path string) interface{} {
+	if p, err := resolveProfiler(path); err == nil {
+		path = p
+	}
+	sum, err := profilerChecksum(path)
+	if err != nil {
+		return err
+	}
+	return api.Profiler{
+		Executable: path,
+		Checksum:   sum,
+		Languages:  languageProfilers,
+	}
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"context"
+	crand "crypto/rand"
 	"fmt"
+	"math"
 	"math/rand"
 	"net/http"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/finkf/gofiler"
@@ -18,32 +23,251 @@ func init() {
 }
 
 var (
-	verbs = []string{
-		"eating", "smelling", "seeing", "kicking", "liking", "tasting", "licking",
-	}
-	adjectives = []string{
-		"sweet", "old", "dead", "tiny", "small", "bitter", "cold",
-	}
-	nouns = []string{
-		"pancakes", "farts", "people", "kittens", "feet", "ashes", "steel",
-	}
 	jobs jobMap
+	// Number of running profiler processes.
+	running int64
 )
 
 type result struct {
-	profile gofiler.Profile
-	err     error
+	profile  *storedProfile
+	pre      *api.Preprocessing
+	pos      map[string][]api.Position
+	summary  *api.Summary
+	segs     []api.Segment
+	skipped  map[string]string
+	warnings []string
+	err      error
+}
+
+// submission is a decoded profiling request together with
+// information about the submitting client.
+type submission struct {
+	api.Request
+	remoteIP  string
+	requestID string
+	checksum  string // Checksum of the language configuration
+	namespace string // Namespace of the client (see -namespaces)
+	timeout   uint   // Timeout of the job in minutes (0 uses -timeout)
+	requested string // Requested language if a fallback is used
+	backend   string // Backend that serves the job (default or canary)
+	profiler  string // Profiler executable of the job
+	received  time.Time
+
+	invocation *api.Invocation // Set once the job was accepted
+}
+
+// jobState is shared between the profiler goroutine and the job map.
+type jobState struct {
+	phase    int32 // Phase of the job
+	activity int64 // Time of the last profiler output (unix nanoseconds)
+	finished int64 // Time the profiler finished (0 while running)
+	timeout  int64 // Soft deadline of the job (unix nanoseconds)
+	deadline int64 // Hard deadline of the job (0 if unlimited)
+	output   int32 // Set once the profiler wrote its first output
+	preempt  int32 // Set while the job is preempted (see -preemption)
+	partial  struct {
+		profiles []gofiler.Profile // Profiles of the finished chunks
+		l        sync.Mutex
+	}
+	timeline struct {
+		events []api.JobEvent // Lifecycle events of the job
+		l      sync.Mutex
+	}
+	warnings struct {
+		lines []string // Warnings of the profiler (at most maxWarnings)
+		l     sync.Mutex
+	}
+	console jobLog // Captured output of the profiler
+	result  struct {
+		res *result // The delivered result (see peekResult)
+		l   sync.Mutex
+	}
+}
+
+// Set the deadlines of a new job.  The timeout is given in minutes;
+// 0 uses -timeout.
+func newJobState(minutes uint) *jobState {
+	if minutes == 0 {
+		minutes = timeout
+	}
+	now := time.Now()
+	s := &jobState{
+		activity: now.UnixNano(),
+		timeout:  now.Add(time.Duration(minutes) * time.Minute).UnixNano(),
+	}
+	if hardTimeout > 0 {
+		s.deadline = now.Add(time.Duration(hardTimeout) * time.Minute).UnixNano()
+	}
+	return s
+}
+
+// Extend both deadlines of the job.
+func (s *jobState) extend(d time.Duration) {
+	atomic.AddInt64(&s.timeout, int64(d))
+	if atomic.LoadInt64(&s.deadline) != 0 {
+		atomic.AddInt64(&s.deadline, int64(d))
+	}
+}
+
+// Return the soft and hard deadlines of the job.  The hard deadline
+// is the zero time if it is unlimited.
+func (s *jobState) deadlines() (time.Time, time.Time) {
+	soft := time.Unix(0, atomic.LoadInt64(&s.timeout))
+	hard := atomic.LoadInt64(&s.deadline)
+	if hard == 0 {
+		return soft, time.Time{}
+	}
+	return soft, time.Unix(0, hard)
+}
+
+func (s *jobState) setPhase(phase int32) {
+	atomic.StoreInt32(&s.phase, phase)
+}
+
+func (s *jobState) getPhase() int32 {
+	return atomic.LoadInt32(&s.phase)
+}
+
+// Add the profile of a finished chunk.
+func (s *jobState) addChunk(p gofiler.Profile) {
+	s.partial.l.Lock()
+	defer s.partial.l.Unlock()
+	s.partial.profiles = append(s.partial.profiles, p)
+}
+
+// Return the merged profiles of the finished chunks (nil if no chunk
+// is finished).
+func (s *jobState) partialProfile() gofiler.Profile {
+	s.partial.l.Lock()
+	defer s.partial.l.Unlock()
+	if len(s.partial.profiles) == 0 {
+		return nil
+	}
+	return mergeProfiles(s.partial.profiles)
+}
+
+// Deliver the result of the job.  The result is kept, so that it can
+// be read without fetching the job.
+func (s *jobState) deliver(pchan chan<- result, res result) {
+	s.result.l.Lock()
+	s.result.res = &res
+	s.result.l.Unlock()
+	pchan <- res
+}
+
+// Return the delivered result of the job without fetching it.  Returns
+// false if the job has no result yet.
+func (s *jobState) peekResult() (result, bool) {
+	s.result.l.Lock()
+	defer s.result.l.Unlock()
+	if s.result.res == nil {
+		return result{}, false
+	}
+	return *s.result.res, true
+}
+
+// Record activity of the profiler.  The first activity is recorded
+// as first-output event.
+func (s *jobState) touch() {
+	atomic.StoreInt64(&s.activity, time.Now().UnixNano())
+	if atomic.CompareAndSwapInt32(&s.output, 0, 1) {
+		s.record("first-output", time.Now())
+	}
+}
+
+// Record a lifecycle event of the job (received, queued, started,
+// first-output, preempted, requeued, finished, failed or fetched).
+func (s *jobState) record(event string, t time.Time) {
+	s.timeline.l.Lock()
+	defer s.timeline.l.Unlock()
+	s.timeline.events = append(s.timeline.events, api.JobEvent{Event: event, Time: t})
+}
+
+// Maximal number of profiler warnings of a job.
+const maxWarnings = 100
+
+// Record a warning of the profiler.  Repeated warnings are recorded
+// once.
+func (s *jobState) warn(str string) {
+	s.warnings.l.Lock()
+	defer s.warnings.l.Unlock()
+	if len(s.warnings.lines) >= maxWarnings {
+		return
+	}
+	for _, line := range s.warnings.lines {
+		if line == str {
+			return
+		}
+	}
+	s.warnings.lines = append(s.warnings.lines, str)
+}
+
+// Return a copy of the recorded warnings.
+func (s *jobState) getWarnings() []string {
+	s.warnings.l.Lock()
+	defer s.warnings.l.Unlock()
+	return append([]string(nil), s.warnings.lines...)
+}
+
+// Return a copy of the recorded lifecycle events.
+func (s *jobState) events() []api.JobEvent {
+	s.timeline.l.Lock()
+	defer s.timeline.l.Unlock()
+	return append([]api.JobEvent(nil), s.timeline.events...)
+}
+
+func (s *jobState) lastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.activity))
+}
+
+func (s *jobState) finish() {
+	s.setPhase(phaseDone)
+	atomic.StoreInt64(&s.finished, time.Now().UnixNano())
+	s.console.close()
+	// the profiles of the chunks are part of the result
+	s.partial.l.Lock()
+	s.partial.profiles = nil
+	s.partial.l.Unlock()
+}
+
+// Return the time the profiler finished and true or false if it is
+// still running.
+func (s *jobState) finishedAt() (time.Time, bool) {
+	t := atomic.LoadInt64(&s.finished)
+	return time.Unix(0, t), t != 0
 }
 
 type job struct {
-	pending  <-chan result
-	language string
-	start    time.Time
+	pending   <-chan result
+	cancel    context.CancelFunc
+	state     *jobState
+	language  string
+	checksum  string // Checksum of the language configuration
+	requested string // Requested language if a fallback is used
+	backend   string // Backend that serves the job (default or canary)
+	owner     string // Address of the submitting client
+	namespace string // Namespace of the submitting client (see -namespaces)
+	hash      string // Hash of the submitted request
+	est       cost   // Estimated cost of the job
+	imported  bool   // Imported profiles are never signed
+	priority  string // Priority of the job (see -soft-max-jobs)
+	chunked   bool   // The job has checkpoints
+	start     time.Time
+
+	invocation *api.Invocation // How the profiler is invoked
 }
 
 type jobMap struct {
-	m map[string]job
-	l sync.RWMutex
+	m       map[string]job
+	lookups int // Running lookups (see acquireLookup)
+	l       sync.RWMutex
+}
+
+// Return the number of jobs in the map.
+func (m *jobMap) len() int {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	return len(m.m)
 }
 
 // Check for an entry in the map.
@@ -54,48 +278,90 @@ func (m *jobMap) get(token string) (job, bool) {
 	return pp, ok
 }
 
+// Call f for each entry in the map.  The map must not be modified by f.
+func (m *jobMap) each(f func(string, job)) {
+	m.l.RLock()
+	defer m.l.RUnlock()
+	for token, job := range m.m {
+		f(token, job)
+	}
+}
+
 // Delete an entry from the map. The according channel is not closed
 // (the writer of the channel is supposed to do this).
 func (m *jobMap) del(token string) {
 	m.l.Lock()
 	defer m.l.Unlock()
 	delete(m.m, token)
+	go removeCheckpoint(token)
+	go removeStoredProfile(token)
 }
 
 const (
 	putJobOK int = iota
 	putJobNotUnique
 	putJobFull
+	putJobOverloaded
 )
 
 // Insert a new unique entry into the map.  If the entry was unique
 // and could be put into the map, putJobOK is returned.  Otherwise if
 // the token is not unique, putJobNotUnique is returned.  If the map
-// is full, putJobFull is returend.
-func (m *jobMap) put(language, token string, pchan <-chan result) int {
+// is full, putJobFull is returend.  If the map only accepts jobs with
+// high priority, putJobOverloaded is returned.
+func (m *jobMap) put(token string, j job) int {
 	// make sure that no one writes into the map
 	m.l.Lock()
 	defer m.l.Unlock()
 	if m.m == nil {
 		m.m = make(map[string]job)
 	}
-	// check if the map is full
-	if len(m.m) >= int(maxJobs) {
+	// check if the map is full; preempted jobs do not count
+	n := m.active()
+	if n >= int(maxJobs) {
 		return putJobFull
 	}
+	if !admits(n, j.priority) {
+		return putJobOverloaded
+	}
 	// check if the map entry already exists
 	_, ok := m.m[token]
 	if ok {
 		return putJobNotUnique
 	}
-	m.m[token] = job{
-		pending:  pchan,
-		language: language,
-		start:    time.Now(),
-	}
+	j.start = time.Now()
+	m.m[token] = j
 	return putJobOK
 }
 
+// Remove all jobs that match the given predicate.  Running jobs are
+// canceled.  Returns the tokens of the removed jobs.
+func (m *jobMap) purge(match func(string, job) bool) []string {
+	m.l.Lock()
+	defer m.l.Unlock()
+	var tokens []string
+	for token, job := range m.m {
+		if match(token, job) {
+			job.cancel()
+			delete(m.m, token)
+			tokens = append(tokens, token)
+		}
+	}
+	go func() {
+		for _, token := range tokens {
+			takeSharedJob(token)
+			removeCheckpoint(token)
+			removeStoredProfile(token)
+		}
+	}()
+	return tokens
+}
+
+// Cancel stale jobs and delete finished jobs that were not fetched
+// within the timeout.  A running job is stale if it exceeded its
+// (soft) deadline and the profiler did not write any output within
+// the stall timeout.  Jobs that still make progress keep on running
+// until they reach their hard deadline.
 func (m *jobMap) clean() {
 	m.l.Lock()
 	defer m.l.Unlock()
@@ -103,106 +369,546 @@ func (m *jobMap) clean() {
 	// search for timed out jobs
 	var forDeletion []string
 	delta := time.Duration(timeout) * time.Minute
+	stall := time.Duration(stallTimeout) * time.Minute
 	now := time.Now()
 	for token, job := range m.m {
-		if now.After(job.start.Add(delta)) {
+		end, finished := job.state.finishedAt()
+		if !finished {
+			soft, hard := job.state.deadlines()
+			if !hard.IsZero() && now.After(hard) {
+				log.Infof("canceling job %s (hard deadline: %s)", token, hard)
+				job.cancel()
+				continue
+			}
+			if now.After(soft) && now.After(job.state.lastActivity().Add(stall)) {
+				log.Infof("canceling stale job %s (last activity: %s)",
+					token, job.state.lastActivity())
+				job.cancel()
+				breakers.record(context.Background(), job.language, errStalled)
+			}
+			continue
+		}
+		if now.After(end.Add(delta)) {
 			forDeletion = append(forDeletion, token)
 		}
 	}
 	// delete timed out jobs
 	for _, token := range forDeletion {
-		log.Debugf("deleting job %s started at: %s",
+		log.Debugf("deleting unfetched job %s started at: %s",
 			token, m.m[token].start)
+		m.m[token].cancel()
 		delete(m.m, token)
+		go removeCheckpoint(token)
+		go removeStoredProfile(token)
 	}
 }
 
+// Periodically clean the jobs and groups maps and the profile
+// repository and save the lookups.
+func cleanJobs() {
+	for range time.Tick(time.Minute) {
+		jobs.clean()
+		groups.clean()
+		collectProfiles()
+		saveLookups()
+	}
+}
+
+// partialKey is the context key that requests the profiles of the
+// finished chunks of running jobs.
+type partialKey struct{}
+
 // Check if the job specified by the given token is done and return
-// the profile if its done.
-func getProfile(token api.Token) interface{} {
+// the profile if its done.  Waits until the job is done or the context
+// is done.
+func getProfile(ctx context.Context, token api.Token) interface{} {
 	job, ok := jobs.get(token.ID)
 	if !ok {
-		return http.StatusNotFound
+		return getSharedProfile(ctx, token)
 	}
-	// check if result for the token is available
+	// check if result for the token is available; an available
+	// result is preferred over a done context
+	var p result
 	select {
-	case p := <-job.pending:
-		defer func() { jobs.del(token.ID) }()
-		if p.err != nil {
-			return p.err
-		}
-		log.Infof("job %v is done", token)
-		return api.Profile{
-			Profile:  p.profile,
-			Status:   "done",
-			Language: job.language,
-			Token:    token,
-			Done:     true,
+	case p, ok = <-job.pending:
+	default:
+		select {
+		case p, ok = <-job.pending:
+		case <-ctx.Done():
+			// profile is not available yet
+			log.Infof("job %s is not done yet", token)
+			phase := phaseNames[job.state.getPhase()]
+			elapsed := time.Since(job.start)
+			res := api.Profile{
+				Status:  statusProvider()(phase, elapsed, locale(ctx)),
+				Phase:   phase,
+				Elapsed: elapsed.Seconds(),
+				Done:    false,
+				Token:   token,
+
+				Warnings: job.state.getWarnings(),
+			}
+			if partial, _ := ctx.Value(partialKey{}).(bool); partial {
+				res.Profile = job.state.partialProfile()
+				res.Partial = res.Profile != nil
+				res.Classes = classify(res.Profile)
+			}
+			return res
 		}
 	}
-	// profile is not available yet
-	log.Infof("job %s is not done yet", token)
-	return api.Profile{
-		Status: fmt.Sprintf("%s %s %s",
-			verbs[rand.Intn(len(verbs))],
-			adjectives[rand.Intn(len(adjectives))],
-			nouns[rand.Intn(len(nouns))]),
-		Done:  false,
-		Token: token,
+	if !ok { // the result was fetched by another request
+		return http.StatusNotFound
+	}
+	defer func() { jobs.del(token.ID) }()
+	if !takeSharedJob(token.ID) { // fetched from another daemon
+		return http.StatusNotFound
+	}
+	job.state.record("fetched", time.Now())
+	if p.err != nil {
+		return p.err
+	}
+	profile, err := p.profile.get()
+	if err != nil {
+		return err
+	}
+	log.Infof("job %v is done", token)
+	return doneProfile(ctx, token, sharedJob{
+		Phase:     phaseNames[phaseDone],
+		Start:     job.start,
+		Language:  job.language,
+		Checksum:  job.checksum,
+		Profile:   profile,
+		Imported:  job.imported,
+		Requested: job.requested,
+		Backend:   job.backend,
+		Timeline:  job.state.events(),
+
+		Preprocessing: p.pre,
+		Positions:     p.pos,
+		Summary:       p.summary,
+		Segments:      p.segs,
+		Skipped:       p.skipped,
+		Warnings:      p.warnings,
+	})
+}
+
+// Return the response for the finished profile of a job (local or
+// shared).  The profile is signed unless it was imported.
+func doneProfile(ctx context.Context, token api.Token, rec sharedJob) interface{} {
+	res := api.Profile{
+		Profile:  rec.Profile,
+		Status:   doneStatus(locale(ctx)),
+		Phase:    phaseNames[phaseDone],
+		Elapsed:  time.Since(rec.Start).Seconds(),
+		Language: rec.Language,
+		Checksum: rec.Checksum,
+		Token:    token,
+		Done:     true,
+
+		Preprocessing: rec.Preprocessing,
+		Positions:     rec.Positions,
+		Segments:      rec.Segments,
+		Skipped:       rec.Skipped,
+		Warnings:      rec.Warnings,
+		Classes:       classify(rec.Profile),
+		Summary:       rec.Summary,
+		Timeline:      rec.Timeline,
+		Requested:     rec.Requested,
+		Backend:       rec.Backend,
+	}
+	if rec.Imported {
+		return res
 	}
+	if err := sign(&res); err != nil {
+		return err
+	}
+	return res
 }
 
 // Insert the job into the jobs map using a unique ID. Then start the
 // job in the background. The result is read from the channel in the
 // accorant GET /profile?token=ID request.
-func profile(path string, request api.Request) interface{} {
-	pchan := make(chan result)
+func profile(path string, request submission) interface{} {
+	// The channel is buffered, so the profiler never blocks even
+	// if the job was removed from the map.
+	pchan := make(chan result, 1)
+	request.Priority = lookupNamespace(request.namespace).applyPriority(request.Priority)
+	hash := requestHash(request.Request)
+	if res, ok := existingJob(request.ID, hash, request.namespace); ok {
+		return res
+	}
+	if isDraining() {
+		log.Infof("cannot accept more jobs: draining")
+		auditJob("rejected", "", request, nil)
+		stats.reject()
+		return refuseJob(reasonDraining)
+	}
+	est, _ := costs.estimate(request.Language, len(request.Tokens))
+	if !budgets.acquire(est) {
+		log.Infof("cannot accept more jobs: budget exceeded")
+		auditJob("rejected", "", request, nil)
+		stats.reject()
+		return refuseJob(reasonAtCapacity)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	state := newJobState(request.timeout)
+	state.record("received", request.received)
+	path = routeCanary(path, &request)
+	request.profiler = profilerFor(request.Language)
+	request.invocation = newInvocation(path, request.checksum, request.profiler)
 	var token api.Token
 	jobs.clean()
 	for {
-		token.ID = generateRandomID()
-		res := jobs.put(request.Language, token.ID, pchan)
+		token.ID = request.ID
+		if token.ID == "" {
+			token.ID = generateRandomID()
+		}
+		res := jobs.put(token.ID, job{
+			pending:   pchan,
+			cancel:    cancel,
+			state:     state,
+			language:  request.Language,
+			checksum:  request.checksum,
+			requested: request.requested,
+			backend:   request.backend,
+			owner:     request.remoteIP,
+			namespace: request.namespace,
+			hash:      hash,
+			est:       est,
+			priority:  request.Priority,
+			chunked:   request.Checkpoint,
+
+			invocation: request.invocation,
+		})
+		if (res == putJobFull || res == putJobOverloaded) && preemptFor(request) {
+			continue
+		}
 		switch res {
 		case putJobOK:
+			if !shareJob(token.ID, sharedJob{
+				Phase:     phaseNames[phaseQueued],
+				Start:     time.Now(),
+				Language:  request.Language,
+				Checksum:  request.checksum,
+				Owner:     request.remoteIP,
+				Namespace: request.namespace,
+				Hash:      hash,
+			}) {
+				// The token is used by another instance.
+				jobs.del(token.ID)
+				if request.ID == "" {
+					continue // try another token
+				}
+				cancel()
+				budgets.release(est)
+				if res, ok := existingJob(request.ID, hash, request.namespace); ok {
+					return res
+				}
+				return api.Error{
+					Status:  http.StatusConflict,
+					Message: fmt.Sprintf("id %s already in use", request.ID),
+				}
+			}
+			state.record("queued", time.Now())
+			refund, err, ok := chargeQuota(request)
+			if !ok {
+				jobs.del(token.ID)
+				takeSharedJob(token.ID)
+				cancel()
+				budgets.release(est)
+				auditJob("rejected", "", request, nil)
+				stats.reject()
+				return err
+			}
+			if request.Group != "" {
+				if err, ok := groups.add(request.Group, token.ID); !ok {
+					jobs.del(token.ID)
+					takeSharedJob(token.ID)
+					cancel()
+					budgets.release(est)
+					refund()
+					return err
+				}
+			}
 			// We have a job. Start running it.
 			log.Infof("starting job %s", token.ID)
-			go runProfiler(path, request.Tokens, pchan)
+			auditJob("submitted", token.ID, request, nil)
+			publishJob("submitted", token.ID, request, nil)
+			stats.submit()
+			go runProfiler(ctx, cancel, state, path, token.ID, request, est, pchan)
+			registerRound(token.ID, path, request)
 			return token
+		case putJobNotUnique:
+			if request.ID == "" {
+				continue // try another token
+			}
+			// A concurrent submission of the same ID.
+			cancel()
+			budgets.release(est)
+			if res, ok := existingJob(request.ID, hash, request.namespace); ok {
+				return res
+			}
+			return api.Error{
+				Status:  http.StatusConflict,
+				Message: fmt.Sprintf("id %s already in use", request.ID),
+			}
 		case putJobFull:
+			cancel()
+			budgets.release(est)
 			log.Infof("cannot accept more jobs")
-			return http.StatusServiceUnavailable
+			auditJob("rejected", "", request, nil)
+			stats.reject()
+			return refuseJob(reasonAtCapacity)
+		case putJobOverloaded:
+			cancel()
+			budgets.release(est)
+			log.Infof("cannot accept more jobs: overloaded")
+			auditJob("rejected", "", request, nil)
+			stats.reject()
+			return refuseJob(reasonOverloaded)
 		}
 	}
 }
 
 // Run the profiler and insert the result into the channel.
-func runProfiler(config string, tokens []gofiler.Token, pchan chan<- result) {
-	defer close(pchan)
+func runProfiler(
+	ctx context.Context,
+	cancel context.CancelFunc,
+	state *jobState,
+	config, id string,
+	request submission,
+	est cost,
+	pchan chan<- result,
+) {
+	preempted := false
+	defer func() {
+		if !preempted { // the requeued job delivers the result
+			state.finish()
+			close(pchan)
+		}
+	}()
+	defer budgets.release(est)
+	atomic.AddInt64(&running, 1)
+	defer atomic.AddInt64(&running, -1)
+	start := time.Now()
+	state.setPhase(phaseRunning)
+	state.record("started", start)
+	rec := sharedJob{
+		Phase:     phaseNames[phaseRunning],
+		Start:     start,
+		Language:  request.Language,
+		Checksum:  request.checksum,
+		Owner:     request.remoteIP,
+		Namespace: request.namespace,
+		Requested: request.requested,
+		Backend:   request.backend,
+	}
+	updateSharedJob(id, rec)
+	var mem uint64
+	var pre *api.Preprocessing
+	var pos map[string][]api.Position
+	var summary *api.Summary
+	var segs []api.Segment
+	var skipped map[string]string
+	tokens := request.Tokens
+	n := 1 // number of shards
 	// make sure to defer cancel before channel can be read
 	p, err := func() (gofiler.Profile, error) {
-		ctx, cancel := context.WithTimeout(
-			context.Background(),
-			time.Duration(timeout)*time.Minute,
-		)
 		defer cancel()
-		return gofiler.Run(ctx, executable, config, tokens, logger{})
+		if preprocessHook != "" {
+			var err error
+			if tokens, pre, err = preprocess(ctx, tokens, request.Language); err != nil {
+				return nil, err
+			}
+		}
+		tokens = foldCase(request.Request, tokens)
+		run, verified := whitelisted(request.Corpus, tokens)
+		run, sk, err := skipTokens(request.Skip, run)
+		if err != nil {
+			return nil, err
+		}
+		skipped = sk
+		if len(run) == 0 {
+			p := make(gofiler.Profile)
+			addVerified(p, verified)
+			return p, nil
+		}
+		n = shards(request, run)
+		profiler := request.profiler
+		if profiler == "" { // resumed job
+			profiler = profilerFor(request.Language)
+		}
+		exe, err := profilerCommand(profiler)
+		if err != nil {
+			return nil, err
+		}
+		var p gofiler.Profile
+		if request.Checkpoint {
+			p, mem, err = runChunks(ctx, exe, config, id, request, run, n, state)
+		} else {
+			p, mem, err = runShards(ctx, exe, config, run, n, logger{state: state})
+		}
+		if err == nil {
+			addVerified(p, verified)
+		}
+		return p, err
 	}()
-	log.Infof("profiled %d tokens with config %s", len(tokens), config)
-	pchan <- result{profile: p, err: err}
+	if state.isPreempted() {
+		if err != nil {
+			preempted = true
+			go requeue(config, id, request, est, state, pchan)
+			return
+		}
+		// The profiler finished before it was canceled.
+		atomic.StoreInt32(&state.preempt, 0)
+	}
+	state.setPhase(phasePostprocessing)
+	if err == nil && request.Rerank {
+		var model *ngramModel
+		if model, err = loadLanguageModel(config); err == nil {
+			rerank(p, tokens, segmentIndex(request.Request, tokens), model)
+		}
+	}
+	if err == nil && request.Corpus != "" {
+		boost(p, request.Corpus)
+		boostAccepted(p, request.Corpus)
+		boostPatterns(p, request.Corpus)
+	}
+	if err == nil && postprocessHook != "" {
+		p, err = postprocess(p, request.Language)
+	}
+	if err == nil && request.PreserveCase {
+		preserveCase(p)
+	}
+	if err == nil && request.MaxCandidates > 0 {
+		limitCandidates(p, request.MaxCandidates)
+	}
+	if err == nil {
+		pos = positions(p, request.Request, tokens)
+		summary = summarize(p, tokens)
+		segs = segments(request.Request, tokens)
+	}
+	log.Infof("profiled %d tokens with config %s", len(request.Tokens), config)
+	stats.finish(request.Language, time.Since(start), err)
+	if err == nil {
+		recordUsage(request.namespace, request.Language, len(request.Tokens))
+	}
+	log.Debugf("job %s: run time: %s, peak memory: %dMB",
+		id, time.Since(start), mem>>20)
+	// The cost model assumes a single profiler process per job.
+	if err == nil && n == 1 && !request.Checkpoint {
+		costs.observe(request.Language, len(request.Tokens), countTypes(request.Tokens), cost{
+			seconds: time.Since(start).Seconds(),
+			memory:  float64(mem),
+		})
+	}
+	if err != nil {
+		state.record("failed", time.Now())
+	} else {
+		state.record("finished", time.Now())
+	}
+	groups.finish(request.Group, id, err)
+	if _, ok := jobs.get(id); !ok {
+		log.Infof("job %s was removed", id)
+		return
+	}
+	breakers.record(ctx, request.Language, err)
+	rec.Phase = phaseNames[phaseDone]
+	rec.Timeline = state.events()
+	if err != nil {
+		auditJob("failed", id, request, err)
+		publishJob("failed", id, request, err)
+		rec.Error = err.Error()
+	} else {
+		auditJob("done", id, request, nil)
+		publishJob("done", id, request, nil)
+		rec.Profile = p
+		rec.Preprocessing = pre
+		rec.Positions = pos
+		rec.Summary = summary
+		rec.Segments = segs
+		rec.Skipped = skipped
+		rec.Warnings = state.getWarnings()
+		if request.Keep {
+			keepProfile(id, request, p, summary)
+		}
+	}
+	updateSharedJob(id, rec)
+	res := result{pre: pre, pos: pos, summary: summary, segs: segs, skipped: skipped,
+		warnings: state.getWarnings(), err: err}
+	if err == nil {
+		res.profile = storeProfile(id, profileKey(request), p)
+	}
+	state.deliver(pchan, res)
 }
 
-var letters = []byte("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+const defaultTokenAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 
+// Generate a random ID of -token-length characters of the
+// -token-alphabet.  The IDs are drawn from crypto/rand, since they
+// grant access to the jobs.  Random bytes beyond the largest multiple
+// of the alphabet size are skipped, so that every character is
+// equally likely.
 func generateRandomID() string {
-	id := make([]byte, 16)
-	for i := 0; i < len(id); i++ {
-		id[i] = letters[rand.Intn(len(letters))]
+	n := len(tokenAlphabet)
+	limit := 256 - 256%n
+	id := make([]byte, 0, tokenLength)
+	buf := make([]byte, tokenLength)
+	for len(id) < cap(id) {
+		crand.Read(buf) // never fails
+		for _, b := range buf {
+			if int(b) < limit && len(id) < cap(id) {
+				id = append(id, tokenAlphabet[int(b)%n])
+			}
+		}
 	}
 	return string(id)
 }
 
-type logger struct{}
+// Check that the IDs are URL and file name safe and hard to guess.
+// The alphabet may only contain unique ASCII letters, digits, '-' and
+// '_' and the IDs must have at least 64 bits of entropy.
+func checkTokenFormat(alphabet string, length uint) error {
+	seen := make(map[rune]bool)
+	for _, c := range alphabet {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("invalid character %q in token alphabet", c)
+		}
+		if seen[c] {
+			return fmt.Errorf("duplicate character %q in token alphabet", c)
+		}
+		seen[c] = true
+	}
+	if len(alphabet) < 2 {
+		return fmt.Errorf("token alphabet too small: %q", alphabet)
+	}
+	if bits := float64(length) * math.Log2(float64(len(alphabet))); bits < 64 {
+		return fmt.Errorf("tokens of length %d have only %.0f bits of entropy", length, bits)
+	}
+	return nil
+}
+
+// Lines of the profiler's output that are warnings.
+var warningRegex = regexp.MustCompile(`(?i)\bwarn(ing)?\b`)
 
-func (logger) Log(str string) {
+// logger logs the profiler's output and records the activity of the
+// profiler.
+type logger struct {
+	state *jobState
+}
+
+// Log and capture the profiler's output.  The output may contain
+// tokens of the document, so nothing is logged or captured if
+// -no-content-logging is set.  Warnings are recorded for the client
+// in any case.
+func (l logger) Log(str string) {
+	l.state.touch()
+	if warningRegex.MatchString(str) {
+		l.state.warn(strings.TrimSpace(str))
+	}
+	if noContentLogging {
+		return
+	}
+	l.state.console.append(str)
 	log.Debug(str)
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateRandomID(t *testing.T) {
+	defer func(alphabet string, length uint) {
+		tokenAlphabet, tokenLength = alphabet, length
+	}(tokenAlphabet, tokenLength)
+	tokenAlphabet, tokenLength = "abc", 3000
+	id := generateRandomID()
+	if len(id) != 3000 {
+		t.Fatalf("len(id) = %d; want 3000", len(id))
+	}
+	for _, c := range tokenAlphabet {
+		if n := strings.Count(id, string(c)); n < 800 || n > 1200 {
+			t.Errorf("%q occurs %d times; want about 1000", c, n)
+		}
+	}
+	if strings.Trim(id, tokenAlphabet) != "" {
+		t.Errorf("id %q contains characters outside of %q", id, tokenAlphabet)
+	}
+	tokenAlphabet, tokenLength = defaultTokenAlphabet, 16
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := generateRandomID()
+		if seen[id] {
+			t.Fatalf("duplicate id %q", id)
+		}
+		seen[id] = true
+	}
+}
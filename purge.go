@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// requester identifies the client of a request by its address and by
+// its namespace (see -namespaces and -oidc-issuer).
+type requester struct {
+	Owner     string `json:",omitempty"` // Address of the client
+	Namespace string `json:",omitempty"` // Namespace of the client
+}
+
+// Return the client of a request.
+func requesterOf(r *http.Request) requester {
+	c := requester{Owner: remoteIP(r)}
+	if ns, ok := findNamespace(r); ok && ns != nil {
+		c.Namespace = ns.name
+	}
+	return c
+}
+
+// Remove all data of a client (DELETE /jobs?owner=ADDRESS or DELETE
+// /jobs?namespace=NAMESPACE) or of a single job (DELETE
+// /jobs?token=ID):
+//
+//   - pending and finished jobs (running jobs are canceled) with their
+//     checkpoints and spilled profiles,
+//   - the records of the jobs in the shared store (-redis), also of
+//     jobs of other daemons,
+//   - the records of the jobs and of the client in the audit log,
+//   - kept profiles of the jobs and of the namespace,
+//   - dead letters of the jobs,
+//   - cached lookups of the client and
+//   - the feedback (of the namespace and its corpus) and the usage
+//     of a namespace.
+//
+// The jobs of an owner that are no longer running or waiting to be
+// fetched are found in the audit log.  A purged record that names the
+// purge request is appended to the audit log for each removed job.
+// Returns a report of the deleted data.
+func purgeJobs(w http.ResponseWriter, r *http.Request) interface{} {
+	q := r.URL.Query()
+	owner, ns, token := q.Get("owner"), q.Get("namespace"), q.Get("token")
+	if n := len(q["owner"]) + len(q["namespace"]) + len(q["token"]); n != 1 || owner+ns+token == "" {
+		return http.StatusBadRequest
+	}
+	matchClient := func(c requester) bool {
+		return (owner != "" && c.Owner == owner) || (ns != "" && c.Namespace == ns)
+	}
+	report := api.DeletionReport{Owner: owner, Namespace: ns, Token: token}
+	report.Jobs = jobs.purge(func(id string, j job) bool {
+		return id == token || matchClient(requester{j.owner, j.namespace})
+	})
+	sort.Strings(report.Jobs)
+	tokens := make(map[string]bool) // all jobs of the client
+	for _, id := range report.Jobs {
+		tokens[id] = true
+	}
+	// The records of the removed jobs are removed by jobs.purge.
+	removed, err := purgeSharedJobs(func(id string, rec sharedJob) bool {
+		return !tokens[id] && (id == token || matchClient(requester{rec.Owner, rec.Namespace}))
+	})
+	report.SharedJobs = removed
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		tokens[token] = true
+	}
+	for _, id := range report.SharedJobs {
+		tokens[id] = true
+	}
+	records, err := purgeAuditLog(func(rec auditRecord) bool {
+		return tokens[rec.Job] || matchClient(requester{rec.RemoteIP, rec.Namespace})
+	})
+	if err != nil {
+		return err
+	}
+	report.AuditRecords = len(records)
+	for _, rec := range records {
+		if rec.Job != "" {
+			tokens[rec.Job] = true
+		}
+	}
+	report.KeptProfiles = purgeRepository(func(sp *api.StoredProfile) bool {
+		return tokens[sp.ID] || (ns != "" && sp.Namespace == ns)
+	})
+	report.DeadLetters = purgeDeadLetters(tokens)
+	report.Lookups = purgeLookups(matchClient)
+	if ns != "" {
+		corpora := []string{ns}
+		if x := lookupNamespace(ns); x != nil && x.corpus != "" && x.corpus != ns {
+			corpora = append(corpora, x.corpus)
+		}
+		report.Feedback = purgeFeedback(corpora...)
+		report.UsageRecords = purgeUsage(ns)
+	}
+	request := submission{remoteIP: remoteIP(r), requestID: requestID(r)}
+	for _, ids := range [][]string{report.Jobs, report.SharedJobs} {
+		for _, id := range ids {
+			auditJob("purged", id, request, nil)
+		}
+	}
+	log.Infof("purged %d jobs, %d shared jobs, %d audit records, %d kept profiles, "+
+		"%d dead letters, %d lookups, %d feedback and %d usage records "+
+		"(owner: %q, namespace: %q, token: %q)",
+		len(report.Jobs), len(report.SharedJobs), report.AuditRecords,
+		len(report.KeptProfiles), len(report.DeadLetters), report.Lookups,
+		len(report.Feedback), report.UsageRecords, owner, ns, token)
+	return report
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/finkf/gofilerd/api"
+)
+
+func TestPurgeJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := openAuditLog(path); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		auditLog.file.Close()
+		auditLog.enc = nil
+	}()
+	newJob := func(owner, ns string) job {
+		_, cancel := context.WithCancel(context.Background())
+		return job{cancel: cancel, state: new(jobState), owner: owner, namespace: ns}
+	}
+	jobs.m = map[string]job{
+		"job-a": newJob("10.0.0.1", "project"),
+		"job-b": newJob("10.0.0.2", ""),
+		"job-c": newJob("10.0.0.3", "other"),
+	}
+	for _, rec := range []struct{ id, owner, ns string }{
+		{"job-a", "10.0.0.1", "project"},
+		{"job-b", "10.0.0.2", ""},
+		{"job-c", "10.0.0.3", "other"},
+		{"old", "10.0.0.2", ""}, // fetched and removed before
+	} {
+		auditJob("submitted", rec.id, submission{remoteIP: rec.owner, namespace: rec.ns}, nil)
+	}
+	repository.m = map[string]*api.StoredProfile{
+		"kept-a": {ProfileInfo: api.ProfileInfo{ID: "kept-a", Namespace: "project"}},
+		"old":    {ProfileInfo: api.ProfileInfo{ID: "old"}},
+		"job-c":  {ProfileInfo: api.ProfileInfo{ID: "job-c", Namespace: "other"}},
+	}
+	event, _ := json.Marshal(api.Event{Event: "done", Token: "old"})
+	group, _ := json.Marshal(api.Group{Jobs: []api.GroupJob{{Token: api.Token{ID: "job-a"}}}})
+	deadLetters.m = map[uint64]*api.DeadLetter{
+		1: {Delivery: 1, Payload: event},
+		2: {Delivery: 2, Payload: group},
+	}
+	lookups.m = map[string]api.Lookup{"x a": {}, "x b": {}, "x c": {}}
+	lookups.clients = map[string][]requester{
+		"x a": {{Owner: "10.0.0.1", Namespace: "project"}},
+		"x b": {{Owner: "10.0.0.3", Namespace: "other"}, {Owner: "10.0.0.2"}},
+		"x c": {{Owner: "10.0.0.3", Namespace: "other"}},
+	}
+	feedback.m = map[string]map[string]map[string]int{"project": {}, "other": {}}
+	recordUsage("project", "german", 10)
+	recordUsage("other", "german", 10)
+
+	tests := []struct {
+		query string
+		want  api.DeletionReport
+	}{
+		{"namespace=project", api.DeletionReport{
+			Namespace:    "project",
+			Jobs:         []string{"job-a"},
+			AuditRecords: 1,
+			KeptProfiles: []string{"kept-a"},
+			DeadLetters:  []uint64{2},
+			Lookups:      1,
+			Feedback:     []string{"project"},
+			UsageRecords: 1,
+		}},
+		{"owner=10.0.0.2", api.DeletionReport{
+			Owner:        "10.0.0.2",
+			Jobs:         []string{"job-b"},
+			AuditRecords: 2,
+			KeptProfiles: []string{"old"},
+			DeadLetters:  []uint64{1},
+			Lookups:      1,
+		}},
+		{"token=job-c", api.DeletionReport{
+			Token:        "job-c",
+			Jobs:         []string{"job-c"},
+			AuditRecords: 1,
+			KeptProfiles: []string{"job-c"},
+		}},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest("DELETE", "/jobs?"+tc.query, nil)
+		got, ok := purgeJobs(httptest.NewRecorder(), r).(api.DeletionReport)
+		if !ok || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("purge %s = %+v; want %+v", tc.query, got, tc.want)
+		}
+	}
+	if len(jobs.m) != 0 || len(repository.m) != 0 || len(deadLetters.m) != 0 {
+		t.Errorf("not purged: %d jobs, %d kept profiles, %d dead letters",
+			len(jobs.m), len(repository.m), len(deadLetters.m))
+	}
+	if _, ok := lookups.m["x c"]; !ok || len(lookups.m) != 1 {
+		t.Errorf("lookups = %v; want only x c", lookups.m)
+	}
+	if _, ok := feedback.m["other"]; !ok || len(feedback.m) != 1 {
+		t.Errorf("feedback = %v; want only other", feedback.m)
+	}
+	// Only the purged records remain in the audit log.
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for s := bufio.NewScanner(f); s.Scan(); {
+		var rec auditRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil || rec.Event != "purged" {
+			t.Errorf("unexpected audit record %s", s.Text())
+		}
+	}
+	for _, query := range []string{"", "owner=a&token=b", "namespace=", "owner=a&owner=b"} {
+		r := httptest.NewRequest("DELETE", "/jobs?"+query, nil)
+		if got := purgeJobs(httptest.NewRecorder(), r); got != 400 {
+			t.Errorf("purge %q = %v; want 400", query, got)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Namespaces can limit the tokens their jobs profile per calendar
+// month (monthly-tokens) and the jobs they submit per minute
+// (jobs-per-minute), see namespace.  The usage is counted in the
+// quota store (-quota-store).  The default store (memory:) counts per
+// daemon; with redis://host/db all daemons share their counters.  If
+// the store cannot be reached, jobs are not limited.
+
+// A quotaStore holds the usage counters of the namespaces.
+type quotaStore interface {
+	// Add n to the counter and return its new value.  The counter
+	// expires at the given time.
+	add(key string, n int64, expire time.Time) (int64, error)
+}
+
+// Quota stores by URL scheme.
+var quotaStores = map[string]func(*url.URL) (quotaStore, error){
+	"memory": newMemoryQuotaStore,
+	"redis":  newRedisQuotaStore,
+}
+
+var quotas quotaStore = new(memoryQuotaStore)
+
+// Open the quota store for the given URL.
+func openQuotaStore(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	open, ok := quotaStores[u.Scheme]
+	if !ok {
+		return fmt.Errorf("unsupported quota store: %s", u.Scheme)
+	}
+	s, err := open(u)
+	if err != nil {
+		return err
+	}
+	quotas = s
+	return nil
+}
+
+// quotaLimit is a limit of a namespace in the current period.
+type quotaLimit struct {
+	what  string    // What is limited
+	key   string    // Key of the counter of the period
+	limit int64     // Maximal usage in the period
+	n     int64     // Usage of the job
+	until time.Time // End of the period
+}
+
+// Return the limits of the namespace of the request.
+func quotaLimits(request submission, now time.Time) []quotaLimit {
+	ns := lookupNamespace(request.namespace)
+	if ns == nil {
+		return nil
+	}
+	var limits []quotaLimit
+	if ns.monthlyTokens > 0 {
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		limits = append(limits, quotaLimit{
+			what:  "monthly token quota",
+			key:   "tokens:" + ns.name + ":" + month.Format("2006-01"),
+			limit: int64(ns.monthlyTokens),
+			n:     int64(len(request.Tokens)),
+			until: month.AddDate(0, 1, 0),
+		})
+	}
+	if ns.jobsPerMinute > 0 {
+		minute := now.UTC().Truncate(time.Minute)
+		limits = append(limits, quotaLimit{
+			what:  "rate limit",
+			key:   "jobs:" + ns.name + ":" + minute.Format("200601021504"),
+			limit: int64(ns.jobsPerMinute),
+			n:     1,
+			until: minute.Add(time.Minute),
+		})
+	}
+	return limits
+}
+
+// Return the error of a job that exceeds the limit.
+func (q quotaLimit) exceeded(namespace string, now time.Time) api.Error {
+	return api.Error{
+		Status:     http.StatusTooManyRequests,
+		Message:    fmt.Sprintf("%s of namespace %s exceeded", q.what, namespace),
+		Reason:     reasonQuotaExceeded,
+		RetryAfter: int(q.until.Sub(now).Seconds()) + 1,
+	}
+}
+
+// Charge the job to the limits of its namespace.  Returns a function
+// that refunds the charge if the job is not accepted after all.
+func chargeQuota(request submission) (func(), api.Error, bool) {
+	now := time.Now()
+	var charged []quotaLimit
+	refund := func() {
+		for _, q := range charged {
+			if _, err := quotas.add(q.key, -q.n, q.until); err != nil {
+				log.Errorf("cannot refund %s of namespace %s: %v", q.what, request.namespace, err)
+			}
+		}
+	}
+	for _, q := range quotaLimits(request, now) {
+		used, err := quotas.add(q.key, q.n, q.until)
+		if err != nil {
+			log.Errorf("cannot charge %s of namespace %s: %v", q.what, request.namespace, err)
+			continue
+		}
+		charged = append(charged, q)
+		if used > q.limit {
+			log.Infof("%s of namespace %s exceeded", q.what, request.namespace)
+			refund()
+			return nil, q.exceeded(request.namespace, now), false
+		}
+	}
+	return refund, api.Error{}, true
+}
+
+// Check if the job would exceed the limits of its namespace without
+// charging it.
+func checkQuota(request submission) (api.Error, bool) {
+	now := time.Now()
+	for _, q := range quotaLimits(request, now) {
+		used, err := quotas.add(q.key, 0, q.until)
+		if err != nil {
+			log.Errorf("cannot check %s of namespace %s: %v", q.what, request.namespace, err)
+			continue
+		}
+		if used+q.n > q.limit {
+			return q.exceeded(request.namespace, now), false
+		}
+	}
+	return api.Error{}, true
+}
+
+// memoryQuotaStore counts the usage of this daemon only.
+type memoryQuotaStore struct {
+	m map[string]quotaCounter
+	l sync.Mutex
+}
+
+type quotaCounter struct {
+	n      int64
+	expire time.Time
+}
+
+func newMemoryQuotaStore(*url.URL) (quotaStore, error) {
+	return new(memoryQuotaStore), nil
+}
+
+func (s *memoryQuotaStore) add(key string, n int64, expire time.Time) (int64, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.m == nil {
+		s.m = make(map[string]quotaCounter)
+	}
+	now := time.Now()
+	for k, c := range s.m {
+		if now.After(c.expire) {
+			delete(s.m, k)
+		}
+	}
+	c, ok := s.m[key]
+	if !ok {
+		c.expire = expire
+	}
+	c.n += n
+	s.m[key] = c
+	return c.n, nil
+}
+
+const quotaPrefix = "gofilerd:quota:"
+
+// redisQuotaStore shares the counters between daemons.
+type redisQuotaStore struct {
+	c *redisClient
+}
+
+func newRedisQuotaStore(u *url.URL) (quotaStore, error) {
+	c, err := newRedisClient(u)
+	if err != nil {
+		return nil, err
+	}
+	return redisQuotaStore{c: c}, nil
+}
+
+func (s redisQuotaStore) add(key string, n int64, expire time.Time) (int64, error) {
+	res, err := s.c.do("INCRBY", quotaPrefix+key, strconv.FormatInt(n, 10))
+	if err != nil {
+		return 0, err
+	}
+	used, ok := res.(int64)
+	if !ok {
+		return 0, fmt.Errorf("invalid reply: %v", res)
+	}
+	if _, err := s.c.do("EXPIREAT", quotaPrefix+key, strconv.FormatInt(expire.Unix(), 10)); err != nil {
+		return 0, err
+	}
+	return used, nil
+}
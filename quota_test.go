@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+)
+
+func TestQuotaLimits(t *testing.T) {
+	defer func(ns []namespace) { namespaces = ns }(namespaces)
+	namespaces = []namespace{
+		{name: "free"},
+		{name: "monthly", monthlyTokens: 1000},
+		{name: "rate", jobsPerMinute: 10},
+		{name: "both", monthlyTokens: 1000, jobsPerMinute: 10},
+	}
+	now := time.Date(2026, time.December, 31, 23, 59, 30, 0, time.UTC)
+	minute := time.Date(2026, time.December, 31, 23, 59, 0, 0, time.UTC)
+	monthly := quotaLimit{
+		what:  "monthly token quota",
+		key:   "tokens:NS:2026-12",
+		limit: 1000,
+		n:     3,
+		until: time.Date(2027, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+	rate := quotaLimit{
+		what:  "rate limit",
+		key:   "jobs:NS:202612312359",
+		limit: 10,
+		n:     1,
+		until: minute.Add(time.Minute),
+	}
+	with := func(q quotaLimit, key string) quotaLimit {
+		q.key = key
+		return q
+	}
+	tests := []struct {
+		namespace string
+		want      []quotaLimit
+	}{
+		{"", nil},
+		{"unknown", nil},
+		{"free", nil},
+		{"monthly", []quotaLimit{with(monthly, "tokens:monthly:2026-12")}},
+		{"rate", []quotaLimit{with(rate, "jobs:rate:202612312359")}},
+		{"both", []quotaLimit{
+			with(monthly, "tokens:both:2026-12"),
+			with(rate, "jobs:both:202612312359"),
+		}},
+	}
+	for _, tc := range tests {
+		request := submission{
+			Request:   api.Request{Tokens: make([]gofiler.Token, 3)},
+			namespace: tc.namespace,
+		}
+		if got := quotaLimits(request, now); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("quotaLimits(%q) = %+v; want %+v", tc.namespace, got, tc.want)
+		}
+	}
+}
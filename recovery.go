@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Number of recovered panics in request handlers.
+var panics = expvar.NewInt("panics")
+
+type requestIDKey struct{}
+
+// Assign a unique ID to each request.  The ID is taken from the
+// X-Request-ID header of the request if present.  The ID is sent back
+// in the X-Request-ID header of the response.
+func withRequestID(
+	h func(http.ResponseWriter, *http.Request),
+) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" {
+			id = generateRandomID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		h(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	}
+}
+
+// Return the ID of the request or the empty string.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// Recover from panics in the handler.  The panic is logged together
+// with the stack trace and answered with 500 Internal Server Error.
+func withRecovery(
+	h func(http.ResponseWriter, *http.Request),
+) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			x := recover()
+			if x == nil {
+				return
+			}
+			if x == http.ErrAbortHandler {
+				panic(x)
+			}
+			panics.Add(1)
+			// The panic value could contain document content.
+			if noContentLogging {
+				x = fmt.Sprintf("%T", x)
+			}
+			log.Errorf("[%s] %s: request %s: panic: %v\n%s",
+				r.Method, r.URL, requestID(r), x, debug.Stack())
+			sendError(w, r, api.Error{
+				Status:  http.StatusInternalServerError,
+				Message: "internal server error",
+			})
+		}()
+		h(w, r)
+	}
+}
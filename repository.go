@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// The profile repository keeps the finished profiles of requests with
+// Keep after they were fetched.  Kept profiles are listed with
+// [GET] profiles and searched with [GET] profiles/search.  They are
+// persisted as JSON files (ID.json) in the profiles directory below
+// -data-dir.  Without a data directory, they are kept in memory only.
+var repository struct {
+	m map[string]*api.StoredProfile // ID -> profile
+	l sync.RWMutex
+}
+
+// Default and maximal number of search hits.
+const (
+	defaultSearchHits = 100
+	maxSearchHits     = 1000
+)
+
+func repositoryDir() string {
+	return filepath.Join(dataDir, "profiles")
+}
+
+// Load the persisted profiles of the repository.
+func loadRepository() error {
+	repository.l.Lock()
+	defer repository.l.Unlock()
+	repository.m = make(map[string]*api.StoredProfile)
+	if dataDir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(repositoryDir(), "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		var sp api.StoredProfile
+		if err := readJSON(file, &sp); err != nil {
+			return fmt.Errorf("invalid stored profile %s: %v", file, err)
+		}
+		if sp.Retention == "" { // kept before retention classes
+			sp.Retention = api.RetentionForever
+		}
+		repository.m[sp.ID] = &sp
+	}
+	log.Infof("loaded %d stored profiles", len(repository.m))
+	return nil
+}
+
+// Keep the finished profile of a job in the repository.
+func keepProfile(id string, request submission, p gofiler.Profile, summary *api.Summary) {
+	sp := &api.StoredProfile{
+		ProfileInfo: api.ProfileInfo{
+			ID:        id,
+			Language:  request.Language,
+			Checksum:  request.checksum,
+			Labels:    request.Labels,
+			Namespace: request.namespace,
+			Created:   time.Now(),
+			Entries:   len(p),
+		},
+		Profile: p,
+		Summary: summary,
+	}
+	if summary != nil {
+		sp.Tokens = summary.Tokens
+	}
+	setRetention(sp, request.Request)
+	if dataDir != "" {
+		if err := os.MkdirAll(repositoryDir(), 0750); err != nil {
+			log.Errorf("cannot keep profile %s: %v", id, err)
+			return
+		}
+		if err := writeJSON(filepath.Join(repositoryDir(), id+".json"), sp); err != nil {
+			log.Errorf("cannot keep profile %s: %v", id, err)
+			return
+		}
+	}
+	repository.l.Lock()
+	defer repository.l.Unlock()
+	repository.m[id] = sp
+	log.Infof("kept profile %s", id)
+}
+
+// Return true if the client may read the stored profile.  Profiles of
+// namespaces can only be read by the clients of the namespace and
+// administrators.
+func mayRead(r *http.Request, sp *api.StoredProfile) bool {
+	if sp.Namespace == "" || isAdmin(r) {
+		return true
+	}
+	ns, ok := findNamespace(r)
+	return ok && ns != nil && ns.name == sp.Namespace
+}
+
+// profileFilter selects stored profiles by the query parameters
+// language, label and since.  Since is a time (RFC 3339) or a
+// duration before now (e.g. 24h).
+type profileFilter struct {
+	language string
+	label    string
+	since    time.Time
+}
+
+func newProfileFilter(r *http.Request) (profileFilter, error) {
+	q := r.URL.Query()
+	f := profileFilter{language: q.Get("language"), label: q.Get("label")}
+	if since := q.Get("since"); since != "" {
+		if d, err := time.ParseDuration(since); err == nil {
+			f.since = time.Now().Add(-d)
+		} else if f.since, err = time.Parse(time.RFC3339, since); err != nil {
+			return f, fmt.Errorf("invalid since: %q", since)
+		}
+	}
+	return f, nil
+}
+
+func (f profileFilter) match(sp *api.StoredProfile) bool {
+	if f.language != "" && !strings.EqualFold(f.language, sp.Language) {
+		return false
+	}
+	if sp.Created.Before(f.since) {
+		return false
+	}
+	if f.label == "" {
+		return true
+	}
+	for _, l := range sp.Labels {
+		if l == f.label {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the readable stored profiles that match the filter of the
+// request ordered by their creation time.
+func selectProfiles(r *http.Request) ([]*api.StoredProfile, interface{}) {
+	f, err := newProfileFilter(r)
+	if err != nil {
+		return nil, api.Error{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	repository.l.RLock()
+	defer repository.l.RUnlock()
+	var res []*api.StoredProfile
+	for _, sp := range repository.m {
+		if f.match(sp) && mayRead(r, sp) {
+			res = append(res, sp)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].Created.Equal(res[j].Created) {
+			return res[i].Created.Before(res[j].Created)
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
+
+// List the stored profiles:
+// [GET] profiles?language=LANGUAGE&label=LABEL&since=SINCE
+func listProfiles(w http.ResponseWriter, r *http.Request) interface{} {
+	sps, err := selectProfiles(r)
+	if err != nil {
+		return err
+	}
+	list := api.ProfileList{Profiles: make([]api.ProfileInfo, len(sps))}
+	for i, sp := range sps {
+		list.Profiles[i] = sp.ProfileInfo
+	}
+	return list
+}
+
+// Search the OCR tokens of the stored profiles.  The query matches
+// tokens that contain it (case insensitive):
+// [GET] profiles/search?q=QUERY&language=LANGUAGE&label=LABEL&since=SINCE&limit=N
+func searchProfiles(w http.ResponseWriter, r *http.Request) interface{} {
+	q := strings.ToLower(r.URL.Query().Get("q"))
+	if q == "" {
+		return api.Error{Status: http.StatusBadRequest, Message: "missing query"}
+	}
+	limit := defaultSearchHits
+	if str := r.URL.Query().Get("limit"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n <= 0 || n > maxSearchHits {
+			return api.Error{
+				Status:  http.StatusBadRequest,
+				Message: fmt.Sprintf("invalid limit: %q", str),
+			}
+		}
+		limit = n
+	}
+	sps, err := selectProfiles(r)
+	if err != nil {
+		return err
+	}
+	res := api.SearchResult{Query: q, Hits: []api.SearchHit{}}
+	for _, sp := range sps {
+		ocrs := make([]string, 0, len(sp.Profile))
+		for ocr := range sp.Profile {
+			if strings.Contains(strings.ToLower(ocr), q) {
+				ocrs = append(ocrs, ocr)
+			}
+		}
+		sort.Strings(ocrs)
+		for _, ocr := range ocrs {
+			if len(res.Hits) == limit {
+				res.Truncated = true
+				return res
+			}
+			res.Hits = append(res.Hits, api.SearchHit{ID: sp.ID, Entry: sp.Profile[ocr]})
+		}
+	}
+	return res
+}
+
+// Get a stored profile: [GET] profiles/{id}.  Profiles that are kept
+// until-fetched are removed.
+func getStoredProfile(w http.ResponseWriter, r *http.Request) interface{} {
+	id := pathParam(r, "id")
+	repository.l.Lock()
+	defer repository.l.Unlock()
+	sp, ok := repository.m[id]
+	if !ok || !mayRead(r, sp) {
+		return http.StatusNotFound
+	}
+	if sp.Retention == api.RetentionUntilFetched {
+		if err := unkeepProfile(id); err != nil {
+			return err
+		}
+		log.Infof("removed fetched profile %s", id)
+	}
+	return sp
+}
+
+// Remove a stored profile: [DELETE] profiles/{id}
+func deleteStoredProfile(w http.ResponseWriter, r *http.Request) interface{} {
+	id := pathParam(r, "id")
+	repository.l.Lock()
+	defer repository.l.Unlock()
+	sp, ok := repository.m[id]
+	if !ok || !mayRead(r, sp) {
+		return http.StatusNotFound
+	}
+	if err := unkeepProfile(id); err != nil {
+		return err
+	}
+	log.Infof("deleted stored profile %s", id)
+	return sp.ProfileInfo
+}
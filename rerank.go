@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/finkf/gofiler"
+)
+
+// The language model of a language configuration (e.g.
+// backend/german.ini) is the ARPA file language-model.arpa in the
+// directory of the same name (e.g. backend/german/).  It is covered by
+// the checksum of the language configuration.
+const languageModelName = "language-model.arpa"
+
+// Log10 probability of words that are not in the model and the
+// model has no <unk> entry.
+const unknownLogProb = -7
+
+// ngramModel is a back-off n-gram language model.
+type ngramModel struct {
+	order  int
+	ngrams map[string]ngram // space separated words -> ngram
+}
+
+type ngram struct {
+	prob    float64 // log10 probability
+	backoff float64 // log10 back-off weight
+}
+
+var languageModels struct {
+	m map[string]cachedModel // path -> model
+	l sync.Mutex
+}
+
+type cachedModel struct {
+	stamp string
+	model *ngramModel
+}
+
+// Return the path to the language model of the configuration.
+func languageModelPath(config string) string {
+	return filepath.Join(strings.TrimSuffix(config, filepath.Ext(config)), languageModelName)
+}
+
+// Load the language model of the configuration.  Models are cached
+// until their file changes.
+func loadLanguageModel(config string) (*ngramModel, error) {
+	path := languageModelPath(config)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	stamp := fmt.Sprintf("%d:%d", fi.Size(), fi.ModTime().UnixNano())
+	languageModels.l.Lock()
+	defer languageModels.l.Unlock()
+	if c, ok := languageModels.m[path]; ok && c.stamp == stamp {
+		return c.model, nil
+	}
+	model, err := readARPA(path)
+	if err != nil {
+		return nil, err
+	}
+	if languageModels.m == nil {
+		languageModels.m = make(map[string]cachedModel)
+	}
+	languageModels.m[path] = cachedModel{stamp: stamp, model: model}
+	return model, nil
+}
+
+// Read a language model in ARPA format.
+func readARPA(path string) (*ngramModel, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	model := &ngramModel{ngrams: make(map[string]ngram)}
+	n := 0 // order of the current section
+	s := bufio.NewScanner(in)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "" || line == "\\data\\" || line == "\\end\\":
+			continue
+		case strings.HasPrefix(line, "ngram "):
+			continue
+		case strings.HasPrefix(line, "\\") && strings.HasSuffix(line, "-grams:"):
+			if n, err = strconv.Atoi(strings.TrimSuffix(line[1:], "-grams:")); err != nil {
+				return nil, fmt.Errorf("%s: invalid section: %s", path, line)
+			}
+			if n > model.order {
+				model.order = n
+			}
+			continue
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("%s: invalid line: %s", path, line)
+		}
+		fields := strings.Fields(line)
+		if len(fields) != n+1 && len(fields) != n+2 {
+			return nil, fmt.Errorf("%s: invalid %d-gram: %s", path, n, line)
+		}
+		var g ngram
+		if g.prob, err = strconv.ParseFloat(fields[0], 64); err != nil {
+			return nil, fmt.Errorf("%s: invalid %d-gram: %s", path, n, line)
+		}
+		if len(fields) == n+2 {
+			if g.backoff, err = strconv.ParseFloat(fields[n+1], 64); err != nil {
+				return nil, fmt.Errorf("%s: invalid %d-gram: %s", path, n, line)
+			}
+		}
+		model.ngrams[strings.Join(fields[1:n+1], " ")] = g
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if model.order == 0 {
+		return nil, fmt.Errorf("%s: empty language model", path)
+	}
+	return model, nil
+}
+
+// Return the log10 probability of the word given its history.
+func (m *ngramModel) logProb(history []string, word string) float64 {
+	if len(history) >= m.order {
+		history = history[len(history)-m.order+1:]
+	}
+	var backoff float64
+	for ; len(history) > 0; history = history[1:] {
+		h := strings.Join(history, " ")
+		if g, ok := m.ngrams[h+" "+word]; ok {
+			return backoff + g.prob
+		}
+		backoff += m.ngrams[h].backoff
+	}
+	if g, ok := m.ngrams[word]; ok {
+		return backoff + g.prob
+	}
+	if g, ok := m.ngrams["<unk>"]; ok {
+		return backoff + g.prob
+	}
+	return backoff + unknownLogProb
+}
+
+// Re-rank the candidates of the profile using the language model.
+// Each candidate is scored in the context of every occurrence of its
+// OCR token in the document: the probability of the candidate given
+// the preceding words and the probability of the following word given
+// the candidate.  The weight of a candidate is multiplied with its
+// mean probability.  If segs is not nil, it holds the segment of each
+// token (see segmentIndex) and the context does not cross the
+// boundaries of segments.
+func rerank(p gofiler.Profile, tokens []gofiler.Token, segs []int, model *ngramModel) {
+	var words []string
+	var bounds []int // segment of each word
+	for i, t := range tokens {
+		if t.LE != "" {
+			continue
+		}
+		words = append(words, t.OCR)
+		if segs != nil {
+			bounds = append(bounds, segs[i])
+		}
+	}
+	same := func(i, j int) bool {
+		return bounds == nil || bounds[i] == bounds[j]
+	}
+	// The context uses the best suggestion for profiled tokens.
+	context := make([]string, len(words))
+	for i, w := range words {
+		context[i] = strings.ToLower(w)
+		if e, ok := p[w]; ok && len(e.Candidates) > 0 {
+			context[i] = strings.ToLower(e.Candidates[0].Suggestion)
+		}
+	}
+	scores := make(map[string][]float64) // OCR -> summed log probs
+	counts := make(map[string]int)
+	for i, w := range words {
+		e, ok := p[w]
+		if !ok || len(e.Candidates) < 2 {
+			continue
+		}
+		if _, ok := scores[w]; !ok {
+			scores[w] = make([]float64, len(e.Candidates))
+		}
+		counts[w]++
+		start := i - model.order + 1
+		if start < 0 {
+			start = 0
+		}
+		for !same(start, i) {
+			start++
+		}
+		history := append([]string{}, context[start:i]...)
+		for j, c := range e.Candidates {
+			cand := strings.ToLower(c.Suggestion)
+			lp := model.logProb(history, cand)
+			if i+1 < len(words) && same(i, i+1) {
+				lp += model.logProb(append(history, cand), context[i+1])
+			}
+			scores[w][j] += lp
+		}
+	}
+	for w, sums := range scores {
+		factors := make([]float64, len(sums))
+		for j := range sums {
+			factors[j] = math.Pow(10, sums[j]/float64(counts[w]))
+		}
+		p[w] = reweight(p[w], factors)
+	}
+}
+
+// Multiply the weights of the candidates with the given factors and
+// sort the candidates by their new weights.  The weights are rescaled
+// to keep their sum.
+func reweight(e gofiler.Interpretation, factors []float64) gofiler.Interpretation {
+	var total float32
+	for _, c := range e.Candidates {
+		total += c.Weight
+	}
+	combined := make([]float64, len(e.Candidates))
+	var norm float64
+	for j, c := range e.Candidates {
+		combined[j] = float64(c.Weight) * factors[j]
+		norm += combined[j]
+	}
+	if norm == 0 {
+		return e
+	}
+	cands := append([]gofiler.Candidate{}, e.Candidates...)
+	for j := range cands {
+		cands[j].Weight = float32(combined[j] / norm * float64(total))
+	}
+	sort.SliceStable(cands, func(a, b int) bool {
+		return cands[a].Weight > cands[b].Weight
+	})
+	e.Candidates = cands
+	return e
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// The garbage collection of the profile repository removes kept
+// profiles whose retention expired.  It runs every minute together
+// with the cleanup of the jobs and on demand: [POST] repository/gc.
+var gc struct {
+	last    time.Time // Time of the last run
+	removed int       // Number of removed profiles since the start
+}
+
+// Parse a retention class: forever, until-fetched or a duration in
+// days (e.g. 30d) or as Go duration (e.g. 12h).  Returns the duration
+// of the retention (0 for forever and until-fetched).
+func parseRetention(retention string) (time.Duration, error) {
+	switch retention {
+	case api.RetentionForever, api.RetentionUntilFetched:
+		return 0, nil
+	}
+	if days := strings.TrimSuffix(retention, "d"); days != retention {
+		if n, err := strconv.ParseUint(days, 10, 32); err == nil && n > 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
+		}
+	} else if d, err := time.ParseDuration(retention); err == nil && d > 0 {
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid retention: %q", retention)
+}
+
+// Return the retention class of a request.  Requests without a
+// Retention use -retention.
+func retentionOf(request api.Request) string {
+	if request.Retention != "" {
+		return request.Retention
+	}
+	return retention
+}
+
+// Check the retention class of a request.
+func checkRetention(request api.Request) error {
+	if request.Retention == "" {
+		return nil
+	}
+	if !request.Keep {
+		return fmt.Errorf("retention without keep")
+	}
+	_, err := parseRetention(request.Retention)
+	return err
+}
+
+// Set the retention and expiration of a new stored profile.
+func setRetention(sp *api.StoredProfile, request api.Request) {
+	sp.Retention = retentionOf(request)
+	if d, _ := parseRetention(sp.Retention); d > 0 {
+		expires := sp.Created.Add(d)
+		sp.Expires = &expires
+	}
+}
+
+// Remove the stored profiles whose retention expired.  Returns the
+// IDs of the removed profiles.
+func collectProfiles() []string {
+	repository.l.Lock()
+	defer repository.l.Unlock()
+	now := time.Now()
+	var removed []string
+	for id, sp := range repository.m {
+		if sp.Expires == nil || now.Before(*sp.Expires) {
+			continue
+		}
+		if err := unkeepProfile(id); err != nil {
+			log.Errorf("cannot remove expired profile %s: %v", id, err)
+			continue
+		}
+		removed = append(removed, id)
+	}
+	gc.last = now
+	gc.removed += len(removed)
+	if len(removed) > 0 {
+		log.Infof("removed %d expired profiles", len(removed))
+	}
+	return removed
+}
+
+// Remove the stored profiles that match the predicate.  Returns the
+// IDs of the removed profiles.
+func purgeRepository(match func(*api.StoredProfile) bool) []string {
+	repository.l.Lock()
+	defer repository.l.Unlock()
+	var removed []string
+	for id, sp := range repository.m {
+		if !match(sp) {
+			continue
+		}
+		if err := unkeepProfile(id); err != nil {
+			log.Errorf("cannot remove stored profile %s: %v", id, err)
+			continue
+		}
+		removed = append(removed, id)
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// Remove a stored profile.  Must be called with the repository
+// locked.
+func unkeepProfile(id string) error {
+	if dataDir != "" {
+		err := os.Remove(filepath.Join(repositoryDir(), id+".json"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	delete(repository.m, id)
+	return nil
+}
+
+// Report the state of the garbage collection of the profile
+// repository.  Must be called with the repository locked.
+func gcReport() api.GCReport {
+	report := api.GCReport{
+		Profiles:    len(repository.m),
+		ByRetention: make(map[string]int),
+		Removed:     gc.removed,
+	}
+	if !gc.last.IsZero() {
+		last := gc.last
+		report.LastRun = &last
+	}
+	now := time.Now()
+	for _, sp := range repository.m {
+		report.ByRetention[sp.Retention]++
+		if sp.Expires != nil && !now.Before(*sp.Expires) {
+			report.Expired++
+		}
+	}
+	return report
+}
+
+// Inspect the garbage collection of the profile repository:
+// [GET] repository/gc
+func getGC(w http.ResponseWriter, r *http.Request) interface{} {
+	repository.l.RLock()
+	defer repository.l.RUnlock()
+	return gcReport()
+}
+
+// Run the garbage collection of the profile repository:
+// [POST] repository/gc
+func postGC(w http.ResponseWriter, r *http.Request) interface{} {
+	removed := collectProfiles()
+	repository.l.RLock()
+	defer repository.l.RUnlock()
+	report := gcReport()
+	report.RemovedIDs = removed
+	return report
+}
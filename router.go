@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// router dispatches requests by their path and method.  Patterns
+// consist of literal segments and parameters of the form {name} that
+// match exactly one segment.  Trailing slashes are ignored.  If more
+// than one pattern matches a path, the pattern with the fewest
+// parameters wins.  Requests for a known path with an unsupported
+// method are answered with 405 and the allowed methods.
+type router struct {
+	routes []*route
+}
+
+type route struct {
+	segments []string
+	params   int
+	auth     bool // Authentication is required (see -auth-required)
+	handlers map[string]http.HandlerFunc
+}
+
+type pathParamsKey struct{}
+
+// Register the handlers of the methods for the pattern.  The
+// handlers are wrapped with the common middleware.
+func (rt *router) handle(pattern string, ms methods) {
+	for method, h := range ms {
+		rt.handleFunc(pattern, method, withCommon(handle(h)))
+	}
+}
+
+// Register a plain handler for the pattern and method.
+func (rt *router) handleFunc(pattern, method string, h http.HandlerFunc) {
+	segments := splitPath(pattern)
+	for _, r := range rt.routes {
+		if strings.Join(r.segments, "/") == strings.Join(segments, "/") {
+			r.handlers[method] = h
+			return
+		}
+	}
+	r := &route{
+		segments: segments,
+		auth:     requiresAuth(segments),
+		handlers: map[string]http.HandlerFunc{method: h},
+	}
+	for _, s := range segments {
+		if isParam(s) {
+			r.params++
+		}
+	}
+	rt.routes = append(rt.routes, r)
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var best *route
+	var params map[string]string
+	segments := splitPath(r.URL.Path)
+	for _, route := range rt.routes {
+		if best != nil && route.params >= best.params {
+			continue
+		}
+		if ps, ok := route.match(segments); ok {
+			best, params = route, ps
+		}
+	}
+	if best == nil {
+		withCommon(handle(notFound))(w, r)
+		return
+	}
+	if best.auth && !authenticated(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		withCommon(handle(unauthorized))(w, r)
+		return
+	}
+	h, ok := best.handlers[r.Method]
+	if !ok {
+		w.Header().Set("Allow", strings.Join(best.methods(), ", "))
+		withCommon(handle(methodNotAllowed))(w, r)
+		return
+	}
+	if len(params) > 0 {
+		r = r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params))
+	}
+	h(w, r)
+}
+
+// Match the segments of a path.  Returns the values of the parameters.
+func (r *route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(r.segments) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, s := range r.segments {
+		if !isParam(s) {
+			if s != segments[i] {
+				return nil, false
+			}
+			continue
+		}
+		if segments[i] == "" {
+			return nil, false
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[s[1:len(s)-1]] = segments[i]
+	}
+	return params, true
+}
+
+func (r *route) methods() []string {
+	ms := make([]string, 0, len(r.handlers))
+	for m := range r.handlers {
+		ms = append(ms, m)
+	}
+	sort.Strings(ms)
+	return ms
+}
+
+// Return the value of the path parameter or the empty string.
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+func isParam(segment string) bool {
+	return len(segment) > 2 && segment[0] == '{' && segment[len(segment)-1] == '}'
+}
+
+func notFound(http.ResponseWriter, *http.Request) interface{} {
+	return http.StatusNotFound
+}
+
+func unauthorized(http.ResponseWriter, *http.Request) interface{} {
+	return http.StatusUnauthorized
+}
+
+func methodNotAllowed(http.ResponseWriter, *http.Request) interface{} {
+	return http.StatusMethodNotAllowed
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/finkf/gofiler"
+)
+
+// Maximal time to wait for the output of a profiler process after it
+// was killed.
+const profilerWaitDelay = 5 * time.Second
+
+// Profile the tokens with the profiler executable.  Works like
+// gofiler.Run, but runs the profiler in its own scratch directory
+// (see setupScratchDir), which is removed afterwards.
+func runGofiler(
+	ctx context.Context, exe, config string, tokens []gofiler.Token, l gofiler.Logger,
+) (gofiler.Profile, error) {
+	config, err := filepath.Abs(config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot profile tokens: %v", err)
+	}
+	dir, err := newScratchDir(scratchRun)
+	if err != nil {
+		return nil, fmt.Errorf("cannot profile tokens: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cmd := exec.CommandContext(ctx, exe, profilerArgs(config)...)
+	cmd.Dir = dir
+	cmd.Env = append(scratchEnv(dir), sandboxEnviron()...)
+	// Children of a killed profiler might keep its output open.
+	cmd.WaitDelay = profilerWaitDelay
+	if l != nil {
+		cmd.Stderr = &lineWriter{logger: l}
+	}
+	return runProfilerCommand(cmd, tokens)
+}
+
+// Write the tokens in the input format of the profiler.
+func writeTokens(out io.Writer, tokens []gofiler.Token) error {
+	w := bufio.NewWriter(out)
+	for _, t := range tokens {
+		if _, err := fmt.Fprintln(w, t); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// lineWriter passes the lines written to it to the logger.
+type lineWriter struct {
+	logger gofiler.Logger
+	buffer []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+	for pos := bytes.IndexByte(w.buffer, '\n'); pos != -1; pos = bytes.IndexByte(w.buffer, '\n') {
+		w.logger.Log(string(bytes.TrimRight(w.buffer[:pos], "\r")))
+		w.buffer = w.buffer[pos+1:]
+	}
+	return len(p), nil
+}
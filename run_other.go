@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+
+	"github.com/finkf/gofiler"
+)
+
+// The profiler reads the tokens from stdin and writes the profile to
+// stdout.
+const (
+	profilerInput  = "/dev/stdin"
+	profilerOutput = "/dev/stdout"
+)
+
+// Run the profiler command with the tokens and read its profile.
+func runProfilerCommand(cmd *exec.Cmd, tokens []gofiler.Token) (gofiler.Profile, error) {
+	var stdin, stdout bytes.Buffer
+	if err := writeTokens(&stdin, tokens); err != nil {
+		return nil, fmt.Errorf("cannot write tokens: %v", err)
+	}
+	cmd.Stdin = &stdin
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("cannot profile tokens: %v", err)
+	}
+	var profile gofiler.Profile
+	if err := json.NewDecoder(&stdout).Decode(&profile); err != nil {
+		return nil, fmt.Errorf("cannot read profile: %v", err)
+	}
+	return profile, nil
+}
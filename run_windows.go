@@ -0,0 +1,53 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/finkf/gofiler"
+)
+
+// There is no /dev/stdin on Windows.  The profiler reads the tokens
+// from and writes the profile to files in its scratch directory.
+const (
+	profilerInput  = "tokens.txt"
+	profilerOutput = "profile.json"
+)
+
+// Run the profiler command with the tokens and read its profile.
+func runProfilerCommand(cmd *exec.Cmd, tokens []gofiler.Token) (gofiler.Profile, error) {
+	if err := writeTokenFile(filepath.Join(cmd.Dir, profilerInput), tokens); err != nil {
+		return nil, fmt.Errorf("cannot write tokens: %v", err)
+	}
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("cannot profile tokens: %v", err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(cmd.Dir, profilerOutput))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read profile: %v", err)
+	}
+	var profile gofiler.Profile
+	if err := json.Unmarshal(buf, &profile); err != nil {
+		return nil, fmt.Errorf("cannot read profile: %v", err)
+	}
+	return profile, nil
+}
+
+func writeTokenFile(path string, tokens []gofiler.Token) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeTokens(out, tokens); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// The sandbox works as a trampoline: instead of the profiler,
+// gofiler executes the daemon's own binary.  The daemon finds the
+// sandbox configuration in its environment, restricts itself and
+// then replaces itself with the real profiler executable.  The
+// configuration is only passed to profiler processes (see
+// sandboxEnviron); the environment of the daemon and of its hooks
+// does not contain it.
+
+// sandboxEnv is the name of the environment variable that holds the
+// JSON encoded sandbox configuration.
+const sandboxEnv = "GOFILERD_SANDBOX"
+
+type sandboxConfig struct {
+	Profiler string // Absolute path to the profiler executable
+	TmpDir   string // Writable temporary directory
+	UID, GID int    // User and group ids (-1 keeps the current ids)
+	Network  bool   // Allow network access
+
+	// Other profiler executables by the name of their trampoline
+	// (see sandboxTrampoline).
+	Profilers map[string]string `json:",omitempty"`
+}
+
+// Path to the trampoline that is executed instead of the profiler.
+// It is empty if the profiler does not run in a sandbox.
+var sandboxExecutable string
+
+// The configuration of the trampolines.  Trampolines of profilers
+// other than -profiler are symbolic links to the daemon's binary in a
+// temporary directory.  The trampoline finds its profiler by the name
+// of the link.
+var trampolines struct {
+	cfg sandboxConfig
+	env string // The encoded configuration (sandboxEnv=JSON)
+	dir string
+	l   sync.Mutex
+}
+
+// Setup the sandbox, so that any profiler process is started using
+// the sandbox trampoline.
+func setupSandbox() error {
+	if !sandboxSupported {
+		return fmt.Errorf("sandboxing is not supported on %s", runtime.GOOS)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot determine executable: %v", err)
+	}
+	profiler, err := resolveProfiler(executable)
+	if err != nil {
+		return err
+	}
+	trampolines.cfg = sandboxConfig{
+		Profiler:  profiler,
+		Profilers: make(map[string]string),
+		TmpDir:    scratchDir,
+		UID:       sandboxUID,
+		GID:       sandboxGID,
+		Network:   sandboxNetwork,
+	}
+	if err := encodeSandboxConfig(); err != nil {
+		return err
+	}
+	sandboxExecutable = self
+	return nil
+}
+
+// Encode the configuration of the trampolines.
+func encodeSandboxConfig() error {
+	buf, err := json.Marshal(trampolines.cfg)
+	if err != nil {
+		return fmt.Errorf("cannot encode sandbox configuration: %v", err)
+	}
+	trampolines.env = sandboxEnv + "=" + string(buf)
+	return nil
+}
+
+// Return the additional environment of profiler processes: the
+// configuration of the trampolines if the profiler runs in a sandbox.
+func sandboxEnviron() []string {
+	if sandboxExecutable == "" {
+		return nil
+	}
+	trampolines.l.Lock()
+	defer trampolines.l.Unlock()
+	return []string{trampolines.env}
+}
+
+// Return the trampoline of the profiler (an absolute path).
+func sandboxTrampoline(profiler string) (string, error) {
+	trampolines.l.Lock()
+	defer trampolines.l.Unlock()
+	if profiler == trampolines.cfg.Profiler {
+		return sandboxExecutable, nil
+	}
+	sum := sha256.Sum256([]byte(profiler))
+	name := "profiler-" + hex.EncodeToString(sum[:8])
+	if trampolines.dir == "" {
+		dir, err := newScratchDir(scratchSandbox)
+		if err != nil {
+			return "", fmt.Errorf("cannot create trampoline: %v", err)
+		}
+		trampolines.dir = dir
+	}
+	link := filepath.Join(trampolines.dir, name)
+	if _, ok := trampolines.cfg.Profilers[name]; ok {
+		return link, nil
+	}
+	if err := os.Symlink(sandboxExecutable, link); err != nil {
+		return "", fmt.Errorf("cannot create trampoline: %v", err)
+	}
+	trampolines.cfg.Profilers[name] = profiler
+	if err := encodeSandboxConfig(); err != nil {
+		delete(trampolines.cfg.Profilers, name)
+		os.Remove(link)
+		return "", err
+	}
+	return link, nil
+}
+
+// Check if the process was started as sandbox trampoline.
+func sandboxFromEnv() (sandboxConfig, bool) {
+	val, ok := os.LookupEnv(sandboxEnv)
+	if !ok {
+		return sandboxConfig{}, false
+	}
+	var cfg sandboxConfig
+	if err := json.Unmarshal([]byte(val), &cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+	return cfg, true
+}
+
+// Restrict the process and execute the profiler with the arguments
+// of the trampoline.  This function does not return.
+func runSandboxed(cfg sandboxConfig) {
+	os.Unsetenv(sandboxEnv)
+	profiler := cfg.Profiler
+	if p, ok := cfg.Profilers[filepath.Base(os.Args[0])]; ok {
+		profiler = p
+	}
+	args := append([]string{profiler}, os.Args[1:]...)
+	err := execSandboxed(cfg, args)
+	fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const sandboxSupported = true
+
+// Restrict the current thread and replace the process with the
+// profiler.  Network isolation uses a new network namespace and
+// falls back to a seccomp filter if the namespace cannot be created.
+// The file system is made read-only (except for /dev and the
+// temporary directory) using landlock if the kernel supports it.
+func execSandboxed(cfg sandboxConfig, args []string) error {
+	// Namespaces, landlock and seccomp apply to the calling thread
+	// only.  Make sure that the exec happens on the same thread.
+	runtime.LockOSThread()
+	netns := false
+	if !cfg.Network {
+		netns = syscall.Unshare(syscall.CLONE_NEWNET) == nil
+	}
+	if cfg.GID >= 0 {
+		if err := syscall.Setgroups([]int{cfg.GID}); err != nil {
+			return fmt.Errorf("cannot set groups: %v", err)
+		}
+		if err := syscall.Setgid(cfg.GID); err != nil {
+			return fmt.Errorf("cannot set gid %d: %v", cfg.GID, err)
+		}
+	}
+	if cfg.UID >= 0 {
+		if err := syscall.Setuid(cfg.UID); err != nil {
+			return fmt.Errorf("cannot set uid %d: %v", cfg.UID, err)
+		}
+	}
+	if err := prctl(prSetNoNewPrivs, 1, 0); err != nil {
+		return fmt.Errorf("cannot set no_new_privs: %v", err)
+	}
+	if err := landlockReadOnly("/dev", cfg.TmpDir); err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox: file system not restricted: %v\n", err)
+	}
+	if !cfg.Network && !netns {
+		if err := seccompDenyNetwork(); err != nil {
+			return fmt.Errorf("cannot restrict network: %v", err)
+		}
+	}
+	return syscall.Exec(args[0], args, os.Environ())
+}
+
+const (
+	prSetNoNewPrivs = 38
+	prSetSeccomp    = 22
+	oPath           = 0x200000
+)
+
+func prctl(option, arg2, arg3 uintptr) error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, option, arg2, arg3)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Landlock system calls and access rights (ABI version 1).
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockRulePathBeneath = 1
+
+	landlockAccessWriteFile  = 1 << 1
+	landlockAccessRemoveDir  = 1 << 4
+	landlockAccessRemoveFile = 1 << 5
+	landlockAccessMakeChar   = 1 << 6
+	landlockAccessMakeDir    = 1 << 7
+	landlockAccessMakeReg    = 1 << 8
+	landlockAccessMakeSock   = 1 << 9
+	landlockAccessMakeFifo   = 1 << 10
+	landlockAccessMakeBlock  = 1 << 11
+	landlockAccessMakeSym    = 1 << 12
+
+	landlockAccessWrite = landlockAccessWriteFile |
+		landlockAccessRemoveDir | landlockAccessRemoveFile |
+		landlockAccessMakeChar | landlockAccessMakeDir |
+		landlockAccessMakeReg | landlockAccessMakeSock |
+		landlockAccessMakeFifo | landlockAccessMakeBlock |
+		landlockAccessMakeSym
+)
+
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFD      int32
+}
+
+// Deny any write access to the file system except beneath the given
+// directories.
+func landlockReadOnly(writable ...string) error {
+	attr := landlockRulesetAttr{handledAccessFS: landlockAccessWrite}
+	fd, _, errno := syscall.RawSyscall(sysLandlockCreateRuleset,
+		uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock not available: %v", errno)
+	}
+	defer syscall.Close(int(fd))
+	for _, dir := range writable {
+		dfd, err := syscall.Open(dir, oPath|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("cannot open %s: %v", dir, err)
+		}
+		rule := landlockPathBeneathAttr{
+			allowedAccess: landlockAccessWrite,
+			parentFD:      int32(dfd),
+		}
+		_, _, errno = syscall.RawSyscall6(sysLandlockAddRule, fd,
+			landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		syscall.Close(dfd)
+		if errno != 0 {
+			return fmt.Errorf("cannot add landlock rule for %s: %v", dir, errno)
+		}
+	}
+	if _, _, errno = syscall.RawSyscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("cannot restrict file system: %v", errno)
+	}
+	return nil
+}
+
+// Audit architectures and socket system call numbers for the
+// supported (little endian) architectures.
+var seccompArchs = map[string]struct {
+	audit  uint32
+	socket uint32
+}{
+	"amd64":   {0xc000003e, 41},
+	"arm64":   {0xc00000b7, 198},
+	"riscv64": {0xc00000f3, 198},
+	"ppc64le": {0xc0000015, 326},
+}
+
+const (
+	seccompModeFilter = 2
+	seccompRetKill    = 0x00000000
+	seccompRetErrno   = 0x00050000
+	seccompRetAllow   = 0x7fff0000
+)
+
+// Install a seccomp filter that denies the creation of IPv4 and IPv6
+// sockets.
+func seccompDenyNetwork() error {
+	arch, ok := seccompArchs[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("seccomp not supported on %s", runtime.GOARCH)
+	}
+	const (
+		ld  = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+		jeq = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+		ret = syscall.BPF_RET | syscall.BPF_K
+	)
+	filter := []syscall.SockFilter{
+		{Code: ld, K: 4}, // seccomp_data.arch
+		{Code: jeq, Jt: 1, Jf: 0, K: arch.audit},
+		{Code: ret, K: seccompRetKill},
+		{Code: ld, K: 0}, // seccomp_data.nr
+		{Code: jeq, Jt: 0, Jf: 4, K: arch.socket},
+		{Code: ld, K: 16}, // seccomp_data.args[0]
+		{Code: jeq, Jt: 1, Jf: 0, K: syscall.AF_INET},
+		{Code: jeq, Jt: 0, Jf: 1, K: syscall.AF_INET6},
+		{Code: ret, K: seccompRetErrno | uint32(syscall.EPERM)},
+		{Code: ret, K: seccompRetAllow},
+	}
+	prog := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	return prctl(prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog)))
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const sandboxSupported = false
+
+func execSandboxed(cfg sandboxConfig, args []string) error {
+	return fmt.Errorf("sandboxing is not supported on %s", runtime.GOOS)
+}
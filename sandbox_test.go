@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/finkf/gofiler"
+)
+
+// The test binary is the trampoline of the sandbox tests.
+func TestMain(m *testing.M) {
+	if cfg, ok := sandboxFromEnv(); ok {
+		runSandboxed(cfg)
+	}
+	os.Exit(m.Run())
+}
+
+func TestSandboxTrampoline(t *testing.T) {
+	if !sandboxSupported {
+		t.Skip("sandboxing is not supported")
+	}
+	defer func(dir, exe, profiler string, uid, gid int, network bool) {
+		scratchDir, sandboxExecutable, executable = dir, exe, profiler
+		sandboxUID, sandboxGID, sandboxNetwork = uid, gid, network
+		trampolines.cfg, trampolines.env, trampolines.dir = sandboxConfig{}, "", ""
+	}(scratchDir, sandboxExecutable, executable, sandboxUID, sandboxGID, sandboxNetwork)
+	dir := t.TempDir()
+	scratchDir = dir
+	// The profilers answer with a profile of a single token that
+	// tells which profiler ran and if it sees the sandbox
+	// configuration.
+	profilers := make(map[string]string)
+	for _, name := range []string{"default", "other"} {
+		path := filepath.Join(dir, name)
+		script := "#!/bin/sh\ncat >/dev/null\nenv=clean\n" +
+			"[ -n \"$" + sandboxEnv + "\" ] && env=leaked\n" +
+			"echo \"{\\\"" + name + "-$env\\\":{}}\"\n"
+		if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		profilers[name] = path
+	}
+	executable = profilers["default"]
+	sandboxUID, sandboxGID, sandboxNetwork = -1, -1, true
+	if err := setupSandbox(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := os.LookupEnv(sandboxEnv); ok {
+		t.Fatalf("%s is set in the environment of the daemon", sandboxEnv)
+	}
+	for _, name := range []string{"default", "other", "other"} {
+		exe, err := profilerCommand(profilers[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exe == profilers[name] {
+			t.Fatalf("profiler %s does not use a trampoline", name)
+		}
+		p, err := runGofiler(context.Background(), exe, dir, []gofiler.Token{{OCR: "x"}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := gofiler.Profile{name + "-clean": {}}
+		if !reflect.DeepEqual(p, want) {
+			t.Errorf("profile of %s = %v; want %v", name, p, want)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+)
+
+// Return the load of the daemon as a signal for autoscalers:
+// [GET] scale
+func getScale(w http.ResponseWriter, r *http.Request) interface{} {
+	res := api.Scale{Capacity: int(maxJobs)}
+	now := time.Now()
+	jobs.each(func(_ string, j job) {
+		res.Jobs++
+		if _, finished := j.state.finishedAt(); finished {
+			res.Pending++
+			return
+		}
+		if j.state.getPhase() == phaseQueued {
+			res.Queued++
+		} else {
+			res.Running++
+		}
+		// The remaining run time of the job is its estimated run
+		// time minus its elapsed time.
+		if rest := j.est.seconds - now.Sub(j.start).Seconds(); rest > 0 {
+			res.Backlog += rest
+		}
+	})
+	if res.Capacity > 0 {
+		res.Utilization = float64(res.Queued+res.Running) / float64(res.Capacity)
+	}
+	return res
+}
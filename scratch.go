@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Scratch files of the profiler are kept in the directory gofilerd
+// below -tmpdir.  Every profiler process runs in its own scratch
+// directory, which is its working and temporary directory and is
+// removed after the process finished, failed or timed out.  Scratch
+// directories that are left over after a crash are removed on
+// startup, so daemons must not share -tmpdir.
+
+// Prefixes of the entries of the scratch directory.
+const (
+	scratchRun     = "run-"     // Working directories of profiler processes
+	scratchSandbox = "sandbox-" // Trampolines of the sandbox
+	scratchSpill   = "spill-"   // Spilled profiles (if neither -spill-dir nor -data-dir are set)
+)
+
+// The scratch directory.
+var scratchDir string
+
+// Create the scratch directory and remove leftovers of earlier runs.
+func setupScratchDir() error {
+	dir := tmpDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	dir, err := filepath.Abs(filepath.Join(dir, "gofilerd"))
+	if err != nil {
+		return fmt.Errorf("cannot create scratch directory: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("cannot create scratch directory: %v", err)
+	}
+	scratchDir = dir
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("cannot clean scratch directory: %v", err)
+	}
+	for _, fi := range fis {
+		name := fi.Name()
+		if !strings.HasPrefix(name, scratchRun) &&
+			!strings.HasPrefix(name, scratchSandbox) &&
+			!strings.HasPrefix(name, scratchSpill) {
+			continue
+		}
+		log.Infof("removing leftover scratch directory %s", name)
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("cannot clean scratch directory: %v", err)
+		}
+	}
+	return nil
+}
+
+// Create a new directory in the scratch directory.
+func newScratchDir(prefix string) (string, error) {
+	return ioutil.TempDir(scratchDir, prefix)
+}
+
+// Return the environment of a profiler process that uses the given
+// scratch directory as its temporary directory.
+func scratchEnv(dir string) []string {
+	vars := []string{"TMPDIR"}
+	if runtime.GOOS == "windows" {
+		vars = []string{"TEMP", "TMP"}
+	}
+	var env []string
+	for _, kv := range os.Environ() {
+		if key := strings.SplitN(kv, "=", 2)[0]; !containsFold(vars, key) {
+			env = append(env, kv)
+		}
+	}
+	for _, key := range vars {
+		env = append(env, key+"="+dir)
+	}
+	return env
+}
+
+func containsFold(strs []string, str string) bool {
+	for _, s := range strs {
+		if strings.EqualFold(s, str) {
+			return true
+		}
+	}
+	return false
+}
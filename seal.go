@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// With -data-key, everything the daemon persists is encrypted with
+// AES-256-GCM: checkpoints, spilled profiles, kept profiles, the
+// lookup cache, feedback, whitelists, frequency lists, dead letters,
+// usage and the job records in the shared store (-redis).  A stolen
+// data directory or Redis dump does not leak the documents.  All
+// daemons that share a Redis server need the same key.  Files that
+// were written without the key cannot be read with it (and vice
+// versa).
+
+// The cipher of -data-key; nil if data is stored in plaintext.
+var dataKey cipher.AEAD
+
+// Prefix of sealed data.
+var sealedMagic = []byte("gfd-aes256gcm\n")
+
+// Load the data key.  The file contains the base64 encoded 32 byte
+// key (e.g. head -c 32 /dev/urandom | base64).
+func loadDataKey(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read data key: %v", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("invalid data key: expected 32 base64 encoded bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("invalid data key: %v", err)
+	}
+	if dataKey, err = cipher.NewGCM(block); err != nil {
+		return fmt.Errorf("invalid data key: %v", err)
+	}
+	return nil
+}
+
+// Encrypt data with the data key.  Returns the data as is if no data
+// key is used.
+func seal(data []byte) ([]byte, error) {
+	if dataKey == nil {
+		return data, nil
+	}
+	n := len(sealedMagic)
+	buf := make([]byte, n+dataKey.NonceSize(), n+dataKey.NonceSize()+len(data)+dataKey.Overhead())
+	copy(buf, sealedMagic)
+	nonce := buf[n:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return dataKey.Seal(buf, nonce, data, sealedMagic), nil
+}
+
+// Decrypt data that was encrypted with seal.
+func unseal(data []byte) ([]byte, error) {
+	sealed := bytes.HasPrefix(data, sealedMagic)
+	switch {
+	case dataKey == nil && sealed:
+		return nil, errors.New("data is encrypted: -data-key is required")
+	case dataKey == nil:
+		return data, nil
+	case !sealed:
+		return nil, errors.New("data is not encrypted with -data-key")
+	}
+	data = data[len(sealedMagic):]
+	if len(data) < dataKey.NonceSize() {
+		return nil, errors.New("invalid encrypted data")
+	}
+	nonce, data := data[:dataKey.NonceSize()], data[dataKey.NonceSize():]
+	plain, err := dataKey.Open(nil, nonce, data, sealedMagic)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt data: %v", err)
+	}
+	return plain, nil
+}
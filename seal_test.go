@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestSeal(t *testing.T) {
+	defer func(key cipher.AEAD) { dataKey = key }(dataKey)
+	path := filepath.Join(t.TempDir(), "key")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	if err := ioutil.WriteFile(path, []byte(key+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	plain := []byte(`{"Vnd":"und"}`)
+	dataKey = nil
+	unsealed, err := seal(plain)
+	if err != nil || !bytes.Equal(unsealed, plain) {
+		t.Fatalf("seal without key = %q, %v; want %q", unsealed, err, plain)
+	}
+	if err := loadDataKey(path); err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, plain) {
+		t.Fatalf("sealed data contains the plaintext: %q", sealed)
+	}
+	if got, err := unseal(sealed); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("unseal = %q, %v; want %q", got, err, plain)
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+	tests := []struct {
+		name string
+		key  bool
+		data []byte
+	}{
+		{"tampered", true, tampered},
+		{"truncated", true, sealed[:len(sealedMagic)+4]},
+		{"plaintext with key", true, plain},
+		{"sealed without key", false, sealed},
+	}
+	aead := dataKey
+	for _, tc := range tests {
+		dataKey = nil
+		if tc.key {
+			dataKey = aead
+		}
+		if _, err := unseal(tc.data); err == nil {
+			t.Errorf("%s: unseal succeeded", tc.name)
+		}
+	}
+}
+
+func TestLoadDataKey(t *testing.T) {
+	defer func(key cipher.AEAD) { dataKey = key }(dataKey)
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		ok      bool
+	}{
+		{base64.StdEncoding.EncodeToString(make([]byte, 32)), true},
+		{base64.StdEncoding.EncodeToString(make([]byte, 16)), false},
+		{"not base64", false},
+	}
+	for i, tc := range tests {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		if err := ioutil.WriteFile(path, []byte(tc.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := loadDataKey(path); (err == nil) != tc.ok {
+			t.Errorf("loadDataKey(%q) = %v; want ok: %t", tc.content, err, tc.ok)
+		}
+	}
+	if err := loadDataKey(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("loadDataKey of a missing file succeeded")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+// The daemon runs as a service on Windows only.
+func startService() {}
+
+func stopService(code int) {}
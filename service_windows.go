@@ -0,0 +1,91 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+)
+
+// If started by the service control manager, the daemon runs as the
+// Windows service -service-name.  Install it with:
+//
+//	sc.exe create gofilerd start= auto binPath= "C:\gofilerd\gofilerd.exe -log-file C:\gofilerd\gofilerd.log ..."
+//
+// Stopping the service drains the daemon like SIGTERM; a second stop
+// request exits immediately.  Fatal errors report the stop of the
+// service with exit code 1 before the daemon exits.
+
+var service struct {
+	stop chan uint32   // Exit code of the service
+	done chan struct{} // Closed after the service reported its stop
+}
+
+// Run as a Windows service if the daemon was started by the service
+// control manager.
+func startService() {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		log.Fatalf("cannot detect session: %v", err)
+	}
+	if interactive {
+		return
+	}
+	service.stop = make(chan uint32, 1)
+	service.done = make(chan struct{})
+	log.StandardLogger().ExitFunc = func(code int) {
+		stopService(code)
+		os.Exit(code)
+	}
+	go func() {
+		defer close(service.done)
+		if err := svc.Run(serviceName, serviceHandler{}); err != nil {
+			log.Errorf("cannot run service %s: %v", serviceName, err)
+		}
+	}()
+	log.Infof("running as service %s", serviceName)
+}
+
+// Report the stop of the service before the daemon exits.
+func stopService(code int) {
+	if service.stop == nil {
+		return
+	}
+	service.stop <- uint32(code)
+	<-service.done
+}
+
+type serviceHandler struct{}
+
+func (serviceHandler) Execute(
+	args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status,
+) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	s <- svc.Status{State: svc.Running, Accepts: accepts}
+	for {
+		select {
+		case code := <-service.stop:
+			s <- svc.Status{State: svc.StopPending}
+			return false, code
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				s <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				s <- svc.Status{
+					State:    svc.StopPending,
+					Accepts:  accepts,
+					WaitHint: uint32(drainTimeout / time.Millisecond),
+				}
+				select {
+				case stopSignals <- os.Interrupt:
+				default:
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/finkf/gofiler"
+)
+
+// Minimal number of OCR tokens per shard.
+const minShardTokens = 1000
+
+// Return the number of shards for a job: the requested parallelism
+// bounded by -max-parallelism and the number of tokens.
+func shards(request submission, tokens []gofiler.Token) int {
+	n := request.MaxParallelism
+	if n > int(maxParallelism) {
+		n = int(maxParallelism)
+	}
+	if max := countOCR(tokens) / minShardTokens; n > max {
+		n = max
+	}
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// Profile the tokens with n parallel profiler processes and merge
+// their profiles.
+// Returns the merged profile and the summed peak memory of the
+// processes.
+func runShards(
+	ctx context.Context, exe, config string, tokens []gofiler.Token, n int, l gofiler.Logger,
+) (gofiler.Profile, uint64, error) {
+	if n <= 1 {
+		w := watchMemory()
+		p, err := runGofiler(ctx, exe, config, tokens, l)
+		return p, w.stop(), err
+	}
+	parts := splitTokens(tokens, n)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	profiles := make([]gofiler.Profile, n)
+	errs := make([]error, n)
+	mems := make([]uint64, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		// Watchers must be started one after the other right before
+		// their profiler.
+		w := watchMemory()
+		go func(i int) {
+			defer wg.Done()
+			profiles[i], errs[i] = runGofiler(ctx, exe, config, parts[i], l)
+			mems[i] = w.stop()
+			if errs[i] != nil {
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	var mem uint64
+	for i := range errs {
+		if errs[i] != nil {
+			return nil, 0, errs[i]
+		}
+		mem += mems[i]
+	}
+	return mergeProfiles(profiles), mem, nil
+}
+
+// Return the number of OCR tokens.
+func countOCR(tokens []gofiler.Token) int {
+	n := 0
+	for _, t := range tokens {
+		if t.LE == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// Split the OCR tokens into n contiguous parts.  The extended lexicon
+// entries (LE) are passed to every part.
+func splitTokens(tokens []gofiler.Token, n int) [][]gofiler.Token {
+	var le, ocr []gofiler.Token
+	for _, t := range tokens {
+		if t.LE != "" {
+			le = append(le, t)
+		} else {
+			ocr = append(ocr, t)
+		}
+	}
+	parts := make([][]gofiler.Token, n)
+	for i := range parts {
+		parts[i] = append(append([]gofiler.Token{}, le...), ocr[i*len(ocr)/n:(i+1)*len(ocr)/n]...)
+	}
+	return parts
+}
+
+// Merge the profiles of the shards.  Candidates of entries that occur
+// in more than one profile are merged by their suggestion, modern form
+// and dictionary; their weights are averaged over the shards that
+// produced the candidate.
+func mergeProfiles(profiles []gofiler.Profile) gofiler.Profile {
+	type key struct{ suggestion, modern, dict string }
+	res := make(gofiler.Profile)
+	shards := make(map[string]int)   // number of shards per entry
+	counts := make(map[string][]int) // number of shards per candidate
+	for _, p := range profiles {
+		for ocr, e := range p {
+			shards[ocr]++
+			m, ok := res[ocr]
+			if !ok {
+				res[ocr] = gofiler.Interpretation{
+					OCR:        e.OCR,
+					Candidates: append([]gofiler.Candidate{}, e.Candidates...),
+				}
+				counts[ocr] = make([]int, len(e.Candidates))
+				for i := range e.Candidates {
+					counts[ocr][i] = 1
+				}
+				continue
+			}
+			index := make(map[key]int)
+			for i, c := range m.Candidates {
+				index[key{c.Suggestion, c.Modern, c.Dict}] = i
+			}
+			for _, c := range e.Candidates {
+				if i, ok := index[key{c.Suggestion, c.Modern, c.Dict}]; ok {
+					m.Candidates[i].Weight += c.Weight
+					counts[ocr][i]++
+					continue
+				}
+				m.Candidates = append(m.Candidates, c)
+				counts[ocr] = append(counts[ocr], 1)
+			}
+			res[ocr] = m
+		}
+	}
+	for ocr, n := range shards {
+		if n == 1 {
+			continue
+		}
+		e := res[ocr]
+		factors := make([]float64, len(e.Candidates))
+		for i := range e.Candidates {
+			e.Candidates[i].Weight /= float32(counts[ocr][i])
+			factors[i] = 1
+		}
+		// sort the merged candidates by their weights
+		res[ocr] = reweight(e, factors)
+	}
+	return res
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/finkf/gofiler"
+)
+
+func TestMergeProfiles(t *testing.T) {
+	type cand struct {
+		suggestion string
+		weight     float32
+	}
+	profile := func(ocr string, cs ...cand) gofiler.Profile {
+		e := gofiler.Interpretation{OCR: ocr}
+		for _, c := range cs {
+			e.Candidates = append(e.Candidates, gofiler.Candidate{
+				Suggestion: c.suggestion, Modern: c.suggestion, Weight: c.weight,
+			})
+		}
+		return gofiler.Profile{ocr: e}
+	}
+	tests := []struct {
+		name     string
+		profiles []gofiler.Profile
+		ocr      string
+		want     []cand
+	}{
+		{"single shard", []gofiler.Profile{
+			profile("vnd", cand{"und", 0.7}, cand{"vnd", 0.3}),
+		}, "vnd", []cand{{"und", 0.7}, {"vnd", 0.3}}},
+		{"disjoint entries", []gofiler.Profile{
+			profile("vnd", cand{"und", 1}),
+			profile("jch", cand{"ich", 1}),
+		}, "jch", []cand{{"ich", 1}}},
+		{"same candidates", []gofiler.Profile{
+			profile("vnd", cand{"und", 0.8}, cand{"vnd", 0.2}),
+			profile("vnd", cand{"und", 0.4}, cand{"vnd", 0.6}),
+		}, "vnd", []cand{{"und", 0.6}, {"vnd", 0.4}}},
+		{"candidate of one shard", []gofiler.Profile{
+			profile("vnd", cand{"und", 0.6}, cand{"vnd", 0.4}),
+			profile("vnd", cand{"und", 0.2}, cand{"wnd", 0.8}),
+			profile("jch", cand{"ich", 1}),
+		}, "vnd", []cand{{"wnd", 0.8}, {"und", 0.4}, {"vnd", 0.4}}},
+	}
+	for _, tc := range tests {
+		got := mergeProfiles(tc.profiles)[tc.ocr].Candidates
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %d candidates; want %d", tc.name, len(got), len(tc.want))
+			continue
+		}
+		for i, c := range tc.want {
+			if got[i].Suggestion != c.suggestion || math.Abs(float64(got[i].Weight-c.weight)) > 1e-6 {
+				t.Errorf("%s: candidate %d = %s (%g); want %s (%g)", tc.name, i,
+					got[i].Suggestion, got[i].Weight, c.suggestion, c.weight)
+			}
+		}
+	}
+}
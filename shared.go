@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// With a shared job store (-redis), every daemon mirrors the state
+// and the result of its jobs into Redis.  A daemon that does not know
+// a token looks it up in the store, so any instance behind a load
+// balancer can answer GET /profile.  Only the owning daemon runs and
+// cancels its jobs.  Since finished profiles are written to the
+// store, -redis cannot be used with -no-content-logging.
+
+// Shared job store; nil if jobs are not shared.
+var shared *redisClient
+
+const sharedPrefix = "gofilerd:job:"
+
+// sharedJob is the record of a job in the shared store.
+type sharedJob struct {
+	Phase    string
+	Start    time.Time
+	Language string
+	Checksum string
+	Profile  gofiler.Profile `json:",omitempty"`
+	Error    string          `json:",omitempty"`
+
+	Preprocessing *api.Preprocessing        `json:",omitempty"`
+	Positions     map[string][]api.Position `json:",omitempty"`
+	Imported      bool                      `json:",omitempty"`
+	Requested     string                    `json:",omitempty"` // Requested language if a fallback is used
+	Backend       string                    `json:",omitempty"` // Backend that serves the job (default or canary)
+	Timeline      []api.JobEvent            `json:",omitempty"` // Lifecycle events of finished jobs
+	Owner         string                    `json:",omitempty"` // Address of the submitting client
+	Namespace     string                    `json:",omitempty"` // Namespace of the submitting client
+	Hash          string                    `json:",omitempty"` // Hash of the submitted request
+	Summary       *api.Summary              `json:",omitempty"`
+	Segments      []api.Segment             `json:",omitempty"`
+	Skipped       map[string]string         `json:",omitempty"`
+	Warnings      []string                  `json:",omitempty"`
+}
+
+func openShared(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	c, err := newRedisClient(u)
+	if err != nil {
+		return err
+	}
+	shared = c
+	return nil
+}
+
+// Records of unfinished jobs live as long as the job may run.
+// Records of finished jobs expire with the timeout.
+func sharedTTL(phase string) string {
+	ttl := time.Duration(timeout) * time.Minute
+	if phase != phaseNames[phaseDone] {
+		if hardTimeout > 0 {
+			ttl += time.Duration(hardTimeout) * time.Minute
+		} else {
+			ttl += 24 * time.Hour
+		}
+	}
+	return strconv.Itoa(int(ttl.Seconds()))
+}
+
+// Reserve the token in the shared store.  Returns false if another
+// daemon uses the same token.  If the store cannot be reached, the
+// job stays local.
+func shareJob(id string, rec sharedJob) bool {
+	if shared == nil {
+		return true
+	}
+	buf, err := marshalSharedJob(rec)
+	if err != nil {
+		log.Errorf("cannot share job %s: %v", id, err)
+		return true
+	}
+	res, err := shared.do("SET", sharedPrefix+id, string(buf), "NX", "EX", sharedTTL(rec.Phase))
+	if err != nil {
+		log.Errorf("cannot share job %s: %v", id, err)
+		return true
+	}
+	return res != nil
+}
+
+// Update the record of an existing job.
+func updateSharedJob(id string, rec sharedJob) {
+	if shared == nil {
+		return
+	}
+	buf, err := marshalSharedJob(rec)
+	if err != nil {
+		log.Errorf("cannot update shared job %s: %v", id, err)
+		return
+	}
+	if _, err := shared.do("SET", sharedPrefix+id, string(buf), "XX", "EX", sharedTTL(rec.Phase)); err != nil {
+		log.Errorf("cannot update shared job %s: %v", id, err)
+	}
+}
+
+// Remove the record of a job from the store.  Returns true if the
+// record existed.  Since results are fetched only once, the daemon
+// that removes the record of a finished job delivers its result.
+func takeSharedJob(id string) bool {
+	if shared == nil {
+		return true
+	}
+	res, err := shared.do("DEL", sharedPrefix+id)
+	if err != nil {
+		log.Errorf("cannot remove shared job %s: %v", id, err)
+		return true
+	}
+	n, _ := res.(int64)
+	return n > 0
+}
+
+func getSharedJob(id string) (sharedJob, bool) {
+	var rec sharedJob
+	if shared == nil {
+		return rec, false
+	}
+	res, err := shared.do("GET", sharedPrefix+id)
+	if err != nil {
+		log.Errorf("cannot get shared job %s: %v", id, err)
+		return rec, false
+	}
+	str, ok := res.(string)
+	if !ok {
+		return rec, false
+	}
+	buf, err := unseal([]byte(str))
+	if err != nil {
+		log.Errorf("invalid shared job %s: %v", id, err)
+		return rec, false
+	}
+	if err := json.Unmarshal(buf, &rec); err != nil {
+		log.Errorf("invalid shared job %s: %v", id, err)
+		return rec, false
+	}
+	return rec, true
+}
+
+// Remove the records of all jobs that match the predicate from the
+// store, including the jobs of other daemons.  Returns the tokens of
+// the removed jobs.
+func purgeSharedJobs(match func(string, sharedJob) bool) ([]string, error) {
+	if shared == nil {
+		return nil, nil
+	}
+	var removed []string
+	for cursor := "0"; ; {
+		res, err := shared.do("SCAN", cursor, "MATCH", sharedPrefix+"*", "COUNT", "100")
+		if err != nil {
+			return removed, fmt.Errorf("cannot scan shared jobs: %v", err)
+		}
+		reply, ok := res.([]interface{})
+		if !ok || len(reply) != 2 {
+			return removed, fmt.Errorf("cannot scan shared jobs: invalid reply")
+		}
+		keys, _ := reply[1].([]interface{})
+		for _, key := range keys {
+			id := strings.TrimPrefix(fmt.Sprint(key), sharedPrefix)
+			if rec, ok := getSharedJob(id); ok && match(id, rec) && takeSharedJob(id) {
+				removed = append(removed, id)
+			}
+		}
+		if cursor, _ = reply[0].(string); cursor == "0" || cursor == "" {
+			break
+		}
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// Return the JSON encoded record encrypted with -data-key.
+func marshalSharedJob(rec sharedJob) ([]byte, error) {
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return seal(buf)
+}
+
+// Get the profile of a job of another daemon.  Polls the store
+// until the job is done or the context is done.
+func getSharedProfile(ctx context.Context, token api.Token) interface{} {
+	if shared == nil {
+		return http.StatusNotFound
+	}
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		rec, ok := getSharedJob(token.ID)
+		if !ok {
+			return http.StatusNotFound
+		}
+		if rec.Phase == phaseNames[phaseDone] {
+			if !takeSharedJob(token.ID) {
+				return http.StatusNotFound
+			}
+			log.Infof("shared job %v is done", token)
+			if rec.Error != "" {
+				return errors.New(rec.Error)
+			}
+			rec.Timeline = append(rec.Timeline, api.JobEvent{Event: "fetched", Time: time.Now()})
+			return doneProfile(ctx, token, rec)
+		}
+		select {
+		case <-tick.C:
+			continue
+		case <-ctx.Done():
+		}
+		elapsed := time.Since(rec.Start)
+		return api.Profile{
+			Status:  statusProvider()(rec.Phase, elapsed, locale(ctx)),
+			Phase:   rec.Phase,
+			Elapsed: elapsed.Seconds(),
+			Token:   token,
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/finkf/gofilerd/api"
+)
+
+// Signing algorithms.
+const (
+	signHMAC    = "hmac-sha256"
+	signEd25519 = "ed25519"
+)
+
+var signing struct {
+	alg    string
+	sign   func([]byte) []byte
+	public ed25519.PublicKey
+}
+
+// Load the signing key.  For hmac-sha256, the file contains the
+// secret.  For ed25519, the file contains the base64 encoded 32 byte
+// seed of the private key.
+func loadSigningKey(alg, path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read signing key: %v", err)
+	}
+	switch alg {
+	case signHMAC:
+		secret := []byte(strings.TrimSpace(string(buf)))
+		signing.sign = func(data []byte) []byte {
+			mac := hmac.New(sha256.New, secret)
+			mac.Write(data)
+			return mac.Sum(nil)
+		}
+	case signEd25519:
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return fmt.Errorf("invalid ed25519 seed in %s", path)
+		}
+		key := ed25519.NewKeyFromSeed(seed)
+		signing.public = key.Public().(ed25519.PublicKey)
+		signing.sign = func(data []byte) []byte {
+			return ed25519.Sign(key, data)
+		}
+	default:
+		return fmt.Errorf("invalid signing algorithm: %s", alg)
+	}
+	signing.alg = alg
+	return nil
+}
+
+// Sign the finished profile.  Does nothing if no signing key is
+// configured.
+func sign(p *api.Profile) error {
+	if signing.sign == nil {
+		return nil
+	}
+	p.SignatureAlgorithm = signing.alg
+	payload, err := api.SignaturePayload(*p)
+	if err != nil {
+		return fmt.Errorf("cannot sign profile: %v", err)
+	}
+	p.Signature = base64.StdEncoding.EncodeToString(signing.sign(payload))
+	return nil
+}
+
+// Return the public key to verify ed25519 signatures.
+func getSigningKey(w http.ResponseWriter, r *http.Request) interface{} {
+	if signing.public == nil {
+		return http.StatusNotFound
+	}
+	return api.SigningKey{
+		Algorithm: signing.alg,
+		PublicKey: base64.StdEncoding.EncodeToString(signing.public),
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+)
+
+var (
+	numberRegex       = regexp.MustCompile(`^[+-]?\pN+([.,:/-]\pN+)*[.%]?$`)
+	romanRegex        = regexp.MustCompile(`^(M{0,4}(CM|CD|D?C{0,3})(XC|XL|L?X{0,3})(IX|IV|V?I{0,3}J?)|m{0,4}(cm|cd|d?c{0,3})(xc|xl|l?x{0,3})(ix|iv|v?i{0,3}j?))\.?$`)
+	abbreviationRegex = regexp.MustCompile(`^(\pL{1,3}\.)+$`)
+)
+
+// The built-in skip rules.
+var skipClasses = map[string]func(string) bool{
+	api.SkipNumbers: numberRegex.MatchString,
+	api.SkipRoman: func(token string) bool {
+		return strings.IndexFunc(token, unicode.IsLetter) != -1 && romanRegex.MatchString(token)
+	},
+	api.SkipSingle: func(token string) bool {
+		return utf8.RuneCountInString(token) == 1
+	},
+	api.SkipAbbreviations: abbreviationRegex.MatchString,
+}
+
+// skipRule is a rule of tokens that bypass the profiler.
+type skipRule struct {
+	name  string
+	match func(string) bool
+}
+
+// Compile the skip rules of a request.  A rule is either the name of
+// a built-in class (see api.SkipNumbers) or a regular expression that
+// must match the whole token.
+func compileSkipRules(rules []string) ([]skipRule, error) {
+	res := make([]skipRule, 0, len(rules))
+	for _, rule := range rules {
+		if match, ok := skipClasses[rule]; ok {
+			res = append(res, skipRule{name: rule, match: match})
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + rule + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid skip rule %q: %v", rule, err)
+		}
+		res = append(res, skipRule{name: rule, match: re.MatchString})
+	}
+	return res, nil
+}
+
+// Remove the tokens that match one of the skip rules.  Returns the
+// remaining tokens and the skipped tokens together with the name of
+// the first matching rule.
+func skipTokens(
+	rules []string, tokens []gofiler.Token,
+) ([]gofiler.Token, map[string]string, error) {
+	if len(rules) == 0 {
+		return tokens, nil, nil
+	}
+	compiled, err := compileSkipRules(rules)
+	if err != nil {
+		return nil, nil, err
+	}
+	var res []gofiler.Token
+	skipped := make(map[string]string)
+	for _, t := range tokens {
+		if t.LE == "" && skip(compiled, t.OCR, skipped) {
+			continue
+		}
+		res = append(res, t)
+	}
+	if len(skipped) == 0 {
+		return tokens, nil, nil
+	}
+	return res, skipped, nil
+}
+
+func skip(rules []skipRule, token string, skipped map[string]string) bool {
+	if _, ok := skipped[token]; ok {
+		return true
+	}
+	for _, r := range rules {
+		if r.match(token) {
+			skipped[token] = r.name
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+)
+
+// Rolling windows of the job statistics.
+var statsWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+	{"7d", 7 * 24 * time.Hour},
+}
+
+// A finished job.
+type sample struct {
+	end      time.Time
+	language string
+	duration time.Duration
+	failed   bool
+}
+
+type statistics struct {
+	start     time.Time
+	submitted int
+	rejected  int
+	done      int
+	failed    int
+	languages map[string]int
+	samples   []sample // finished jobs within the largest window
+	l         sync.Mutex
+}
+
+var stats = statistics{start: time.Now(), languages: make(map[string]int)}
+
+func (s *statistics) submit() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.submitted++
+}
+
+func (s *statistics) reject() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.rejected++
+}
+
+// Record a finished job.  Samples that are older than the largest
+// window are dropped.
+func (s *statistics) finish(language string, d time.Duration, err error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if err != nil {
+		s.failed++
+	} else {
+		s.done++
+	}
+	s.languages[language]++
+	now := time.Now()
+	max := statsWindows[len(statsWindows)-1].d
+	i := 0
+	for i < len(s.samples) && now.Sub(s.samples[i].end) > max {
+		i++
+	}
+	s.samples = append(s.samples[i:], sample{
+		end:      now,
+		language: language,
+		duration: d,
+		failed:   err != nil,
+	})
+}
+
+func (s *statistics) get() api.Stats {
+	s.l.Lock()
+	defer s.l.Unlock()
+	now := time.Now()
+	running := int(atomic.LoadInt64(&running))
+	res := api.Stats{
+		Uptime: now.Sub(s.start).Seconds(),
+		Jobs: api.JobCounts{
+			Submitted: s.submitted,
+			Rejected:  s.rejected,
+			Running:   running,
+			Pending:   jobs.len() - running,
+			Done:      s.done,
+			Failed:    s.failed,
+		},
+		Languages: make(map[string]int, len(s.languages)),
+	}
+	for lang, n := range s.languages {
+		res.Languages[lang] = n
+	}
+	for _, w := range statsWindows {
+		var samples []sample
+		for _, x := range s.samples {
+			if now.Sub(x.end) <= w.d {
+				samples = append(samples, x)
+			}
+		}
+		ws := api.WindowStats{
+			Window:    w.name,
+			Languages: make(map[string]api.LanguageStats),
+		}
+		ws.Jobs, ws.Failed, ws.FailureRate = count(samples)
+		bylang := make(map[string][]sample)
+		for _, x := range samples {
+			bylang[x.language] = append(bylang[x.language], x)
+		}
+		for lang, samples := range bylang {
+			ws.Languages[lang] = languageStats(samples)
+		}
+		res.Windows = append(res.Windows, ws)
+	}
+	return res
+}
+
+func count(samples []sample) (int, int, float64) {
+	failed := 0
+	for _, x := range samples {
+		if x.failed {
+			failed++
+		}
+	}
+	if len(samples) == 0 {
+		return 0, 0, 0
+	}
+	return len(samples), failed, float64(failed) / float64(len(samples))
+}
+
+func languageStats(samples []sample) api.LanguageStats {
+	var ls api.LanguageStats
+	ls.Jobs, ls.Failed, ls.FailureRate = count(samples)
+	ds := make([]float64, len(samples))
+	sum := 0.0
+	for i, x := range samples {
+		ds[i] = x.duration.Seconds()
+		sum += ds[i]
+	}
+	sort.Float64s(ds)
+	ls.MeanDuration = sum / float64(len(ds))
+	ls.P50Duration = percentile(ds, 50)
+	ls.P90Duration = percentile(ds, 90)
+	ls.P99Duration = percentile(ds, 99)
+	return ls
+}
+
+// Nearest-rank percentile of the sorted values.
+func percentile(sorted []float64, p int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (p*len(sorted)+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func getStats(w http.ResponseWriter, r *http.Request) interface{} {
+	res := stats.get()
+	res.Cache = cacheStats()
+	res.Usage = currentUsage()
+	return res
+}
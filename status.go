@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Phases of a profiling job.
+const (
+	phaseQueued int32 = iota
+	phaseRunning
+	phasePostprocessing
+	phaseDone
+)
+
+var phaseNames = map[int32]string{
+	phaseQueued:         "queued",
+	phaseRunning:        "running",
+	phasePostprocessing: "postprocessing",
+	phaseDone:           "done",
+}
+
+// Human readable names of the phases (see locales).
+var phaseTexts = map[string]map[string]string{
+	"de": {
+		"queued":         "wartet",
+		"running":        "läuft",
+		"postprocessing": "wird nachbearbeitet",
+		"done":           "fertig",
+	},
+}
+
+// statusFunc generates the status string of an unfinished job from
+// its phase, the time since it was submitted and the language of the
+// client.
+type statusFunc func(phase string, elapsed time.Duration, lang string) string
+
+// Status providers selectable with -status.
+var statusProviders = map[string]statusFunc{
+	"phase":  phaseStatus,
+	"random": randomStatus,
+}
+
+// Return the status provider selected with -status.
+func statusProvider() statusFunc {
+	return statusProviders[statusMode]
+}
+
+// Return the phase of the job.  This is the default.
+func phaseStatus(phase string, elapsed time.Duration, lang string) string {
+	if text, ok := phaseTexts[lang][phase]; ok {
+		return text
+	}
+	return phase
+}
+
+// Return the status of finished jobs.
+func doneStatus(lang string) string {
+	return phaseStatus(phaseNames[phaseDone], 0, lang)
+}
+
+// Words of the random phrases (see locales).
+var phrases = map[string]struct{ verbs, adjectives, nouns []string }{
+	"en": {
+		verbs: []string{
+			"eating", "smelling", "seeing", "kicking", "liking", "tasting", "licking",
+		},
+		adjectives: []string{
+			"sweet", "old", "dead", "tiny", "small", "bitter", "cold",
+		},
+		nouns: []string{
+			"pancakes", "farts", "people", "kittens", "feet", "ashes", "steel",
+		},
+	},
+	"de": {
+		verbs: []string{
+			"isst", "riecht", "sieht", "tritt", "mag", "kostet", "leckt",
+		},
+		adjectives: []string{
+			"süße", "alte", "tote", "winzige", "kleine", "bittere", "kalte",
+		},
+		nouns: []string{
+			"Pfannkuchen", "Fürze", "Leute", "Kätzchen", "Füße", "Aschen", "Kiesel",
+		},
+	},
+}
+
+// Return a random phrase.
+func randomStatus(phase string, elapsed time.Duration, lang string) string {
+	words, ok := phrases[lang]
+	if !ok {
+		words = phrases[locales[0]]
+	}
+	return fmt.Sprintf("%s %s %s",
+		words.verbs[rand.Intn(len(words.verbs))],
+		words.adjectives[rand.Intn(len(words.adjectives))],
+		words.nouns[rand.Intn(len(words.nouns))])
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Finished profiles wait in memory until they are fetched.  With
+// -compress-results they are kept as gzipped JSON and decoded again
+// when they are fetched, which cuts the memory of large unfetched
+// profiles by an order of magnitude.  Profiles of identical inputs
+// are stored only once.  If the stored profiles exceed
+// -max-result-memory, the oldest profiles are spilled to files in
+// -spill-dir and read back when they are fetched.  With
+// -no-content-logging, profiles are never spilled.
+
+// storedProfile is a finished profile that waits to be fetched.
+// Profiles are stored by the hash of their input (see profileKey), so
+// jobs for identical pages (e.g. reprocessed pages) share a stored
+// profile.
+type storedProfile struct {
+	hash       string
+	refs       int // Number of jobs that reference the profile
+	profile    gofiler.Profile
+	compressed []byte // Gzipped JSON of the profile
+	path       string // File of the spilled profile
+	size       int    // Bytes held in memory
+	l          sync.Mutex
+}
+
+// The stored profiles in the order they were stored.
+var stored struct {
+	list   []*storedProfile
+	byHash map[string]*storedProfile
+	byJob  map[string]*storedProfile
+	used   int // Bytes held in memory
+	l      sync.Mutex
+}
+
+// Store the finished profile of a job under the given key.  Without a
+// key (imported profiles), the profile is stored by the hash of its
+// content.
+func storeProfile(id, key string, p gofiler.Profile) *storedProfile {
+	var buf []byte
+	if compressResults || key == "" {
+		var hash string
+		var err error
+		if buf, hash, err = compressProfile(p); err != nil { // cannot happen
+			log.Errorf("cannot store profile of job %s: %v", id, err)
+			return &storedProfile{profile: p, refs: 1}
+		}
+		if key == "" {
+			key = hash
+		}
+	}
+	stored.l.Lock()
+	defer stored.l.Unlock()
+	if stored.byHash == nil {
+		stored.byHash = make(map[string]*storedProfile)
+		stored.byJob = make(map[string]*storedProfile)
+	}
+	if sp, ok := stored.byHash[key]; ok {
+		log.Debugf("job %s shares stored profile %s", id, key)
+		sp.refs++
+		stored.byJob[id] = sp
+		return sp
+	}
+	sp := &storedProfile{hash: key, refs: 1, profile: p}
+	if compressResults {
+		sp.compressed = buf
+		sp.profile = nil
+		sp.size = len(buf)
+	} else {
+		sp.size = sizeHint(api.Profile{Profile: p})
+	}
+	stored.list = append(stored.list, sp)
+	stored.byHash[key] = sp
+	stored.byJob[id] = sp
+	stored.used += sp.size
+	for i := 0; maxResultMemory > 0 && !noContentLogging && stored.used > int(maxResultMemory)<<20 && i < len(stored.list); i++ {
+		stored.used -= stored.list[i].spill()
+	}
+	return sp
+}
+
+// Return the key of the stored profile of a request: the hex encoded
+// sha256 hash of the language, the checksum of its configuration, the
+// tokens and the options that change the profile.
+func profileKey(request submission) string {
+	buf, err := json.Marshal(struct {
+		Language, Checksum, Corpus      string
+		Rerank, Lowercase, PreserveCase bool
+		SentenceCase                    bool
+		MaxCandidates                   int
+		Skip                            []string
+		Tokens                          []gofiler.Token
+		Segments                        []api.Segment
+	}{
+		request.Language, request.checksum, request.Corpus,
+		request.Rerank, request.Lowercase, request.PreserveCase,
+		request.SentenceCase, request.MaxCandidates, request.Skip,
+		request.Tokens, request.Segments,
+	})
+	if err != nil { // cannot happen
+		panic(err)
+	}
+	h := sha256.Sum256(buf)
+	return hex.EncodeToString(h[:])
+}
+
+// Prepare the directory for spilled profiles.  Without -spill-dir
+// the profiles are spilled to the spill directory of -data-dir or to
+// a new temporary directory.  Profiles spilled before a restart are
+// removed (their jobs are gone).
+func setupSpillDir() error {
+	switch {
+	case spillDir != "":
+	case dataDir != "":
+		spillDir = filepath.Join(dataDir, "spill")
+	default:
+		dir, err := newScratchDir(scratchSpill)
+		if err != nil {
+			return fmt.Errorf("cannot create spill directory: %v", err)
+		}
+		spillDir = dir
+	}
+	files, err := filepath.Glob(filepath.Join(spillDir, "*.json.gz"))
+	if err != nil {
+		return fmt.Errorf("cannot clean spill directory: %v", err)
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return fmt.Errorf("cannot clean spill directory: %v", err)
+		}
+	}
+	return nil
+}
+
+// Return the profile.  Compressed and spilled profiles are read back.
+func (sp *storedProfile) get() (gofiler.Profile, error) {
+	sp.l.Lock()
+	defer sp.l.Unlock()
+	if sp.path != "" {
+		buf, err := ioutil.ReadFile(sp.path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read spilled profile: %v", err)
+		}
+		if buf, err = unseal(buf); err != nil {
+			return nil, fmt.Errorf("cannot read spilled profile: %v", err)
+		}
+		return decompressProfile(bytes.NewReader(buf))
+	}
+	if sp.compressed != nil {
+		return decompressProfile(bytes.NewReader(sp.compressed))
+	}
+	return sp.profile, nil
+}
+
+// Write the profile to a file in -spill-dir.  Returns the number of
+// freed bytes.  The caller must hold the lock of the stored profiles.
+func (sp *storedProfile) spill() int {
+	sp.l.Lock()
+	defer sp.l.Unlock()
+	if sp.path != "" {
+		return 0
+	}
+	buf := sp.compressed
+	if buf == nil {
+		var err error
+		if buf, _, err = compressProfile(sp.profile); err != nil {
+			log.Errorf("cannot spill profile %s: %v", sp.hash, err)
+			return 0
+		}
+	}
+	if err := os.MkdirAll(spillDir, 0750); err != nil {
+		log.Errorf("cannot spill profile %s: %v", sp.hash, err)
+		return 0
+	}
+	buf, err := seal(buf)
+	if err != nil {
+		log.Errorf("cannot spill profile %s: %v", sp.hash, err)
+		return 0
+	}
+	path := filepath.Join(spillDir, sp.hash+".json.gz")
+	if err := ioutil.WriteFile(path, buf, 0640); err != nil {
+		log.Errorf("cannot spill profile %s: %v", sp.hash, err)
+		os.Remove(path)
+		return 0
+	}
+	log.Debugf("spilled profile %s to %s", sp.hash, path)
+	sp.path = path
+	sp.profile = nil
+	sp.compressed = nil
+	return sp.size
+}
+
+// Release the stored profile of a job.  The profile is removed (and
+// its file if it was spilled) once no job references it.
+func removeStoredProfile(id string) {
+	stored.l.Lock()
+	defer stored.l.Unlock()
+	sp, ok := stored.byJob[id]
+	if !ok {
+		return
+	}
+	delete(stored.byJob, id)
+	if sp.refs--; sp.refs > 0 {
+		return
+	}
+	delete(stored.byHash, sp.hash)
+	for i := range stored.list {
+		if stored.list[i] == sp {
+			stored.list = append(stored.list[:i], stored.list[i+1:]...)
+			break
+		}
+	}
+	sp.l.Lock()
+	defer sp.l.Unlock()
+	if sp.path == "" {
+		stored.used -= sp.size
+		return
+	}
+	if err := os.Remove(sp.path); err != nil {
+		log.Errorf("cannot remove spilled profile %s: %v", sp.hash, err)
+	}
+}
+
+// Return the gzipped JSON of the profile and the hex encoded sha256
+// hash of the JSON.
+func compressProfile(p gofiler.Profile) ([]byte, string, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+	if err != nil {
+		return nil, "", err
+	}
+	h := sha256.New()
+	if err := json.NewEncoder(io.MultiWriter(w, h)).Encode(p); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func decompressProfile(in io.Reader) (gofiler.Profile, error) {
+	r, err := gzip.NewReader(in)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress profile: %v", err)
+	}
+	defer r.Close()
+	var p gofiler.Profile
+	if err := json.NewDecoder(r).Decode(&p); err != nil {
+		return nil, fmt.Errorf("cannot decompress profile: %v", err)
+	}
+	return p, nil
+}
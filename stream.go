@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// Size of the chunks that are written and flushed to the client.
+const flushSize = 32 << 10
+
+// flushWriter writes the response in chunks of at most flushSize
+// bytes and flushes each chunk to the client.  A slow client does not
+// pin the whole encoded response in the buffers of the server and a
+// fast client sees the first bytes of large responses sooner.  Writes
+// fail as soon as the client has gone away.  Small responses are not
+// flushed, so they are still sent with a Content-Length header.
+type flushWriter struct {
+	ctx     context.Context
+	w       http.ResponseWriter
+	f       http.Flusher
+	written int
+}
+
+func newFlushWriter(w http.ResponseWriter, r *http.Request) *flushWriter {
+	f, _ := w.(http.Flusher)
+	return &flushWriter{ctx: r.Context(), w: w, f: f}
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if err := fw.ctx.Err(); err != nil {
+			return n, err
+		}
+		chunk := p
+		if len(chunk) > flushSize {
+			chunk = chunk[:flushSize]
+		}
+		m, err := fw.w.Write(chunk)
+		n += m
+		fw.written += m
+		if err != nil {
+			return n, err
+		}
+		if fw.f != nil && fw.written >= flushSize {
+			fw.f.Flush()
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
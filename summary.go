@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+)
+
+// Maximal number of error patterns of the summary.
+const summaryPatterns = 10
+
+// Summarize the quality of the profiled tokens.  If tokens is nil,
+// every entry of the profile counts as one token.  Tokens without an
+// entry (e.g. extended lexicon entries) are not counted.
+func summarize(p gofiler.Profile, tokens []gofiler.Token) *api.Summary {
+	counts := make(map[string]int, len(p))
+	if tokens == nil {
+		for word := range p {
+			counts[word] = 1
+		}
+	}
+	for _, t := range tokens {
+		if _, ok := p[t.OCR]; ok && t.LE == "" {
+			counts[t.OCR]++
+		}
+	}
+	var s api.Summary
+	var errors float64
+	patterns := make(map[gofiler.Pattern]int)
+	for word, n := range counts {
+		cs := p[word].Candidates
+		s.Tokens += n
+		// The probability of an OCR error is the weight of the
+		// candidates with OCR patterns.
+		var perr float64
+		for _, c := range cs {
+			if len(c.OCRPatterns) > 0 {
+				perr += float64(c.Weight)
+			}
+		}
+		if perr > 1 {
+			perr = 1
+		}
+		errors += perr * float64(n)
+		switch classifyCandidates(cs) {
+		case api.ClassLexicon:
+			s.Lexicon += n
+		case api.ClassHistorical:
+			s.Historical += n
+		case api.ClassUnknown:
+			s.Unknown += n
+		case api.ClassVerified:
+			s.Verified += n
+		case api.ClassOCRError:
+			s.Suspicious += n
+			for _, pat := range bestCandidates(cs, 1)[0].OCRPatterns {
+				patterns[gofiler.Pattern{Left: pat.Left, Right: pat.Right}] += n
+			}
+		}
+	}
+	if s.Tokens > 0 {
+		s.Coverage = float64(s.Lexicon+s.Historical+s.Verified) / float64(s.Tokens)
+		s.ErrorRate = errors / float64(s.Tokens)
+	}
+	for pat, n := range patterns {
+		s.Patterns = append(s.Patterns, api.PatternCount{Left: pat.Left, Right: pat.Right, Tokens: n})
+	}
+	sort.Slice(s.Patterns, func(i, j int) bool {
+		a, b := s.Patterns[i], s.Patterns[j]
+		if a.Tokens != b.Tokens {
+			return a.Tokens > b.Tokens
+		}
+		if a.Left != b.Left {
+			return a.Left < b.Left
+		}
+		return a.Right < b.Right
+	})
+	if len(s.Patterns) > summaryPatterns {
+		s.Patterns = s.Patterns[:summaryPatterns]
+	}
+	return &s
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+)
+
+// The profiling endpoints accept multipart/form-data uploads as well:
+//
+//	curl -F language=german -F file=@document.txt .../profile
+//
+// The field file holds the document and the field language its
+// language.  The format of the document is inferred from the file
+// name or, if the extension is unknown, from the content type of the
+// field:
+//
+//   - json: an api.Request (language overrides its Language)
+//   - txt: plain text; tokens are separated by white space and their
+//     line and offset are recorded as positions
+//   - xml: ALTO (String elements), PAGE (Word elements) or, for any
+//     other XML, the white space separated words of the text; the IDs
+//     of String and Word elements are recorded as positions
+
+// Upload formats by file extension and content type.
+var uploadFormats = map[string]string{
+	".json":            "json",
+	".txt":             "txt",
+	".xml":             "xml",
+	"application/json": "json",
+	"text/plain":       "txt",
+	"application/xml":  "xml",
+	"text/xml":         "xml",
+}
+
+// Check if the request is a multipart/form-data upload.
+func isUpload(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "multipart/form-data"
+}
+
+// Decode the uploaded document into the request.  Errors are
+// tooLargeErrors or uploadErrors.
+func decodeUpload(r *http.Request, request *api.Request) error {
+	r.Body = ioutil.NopCloser(limitBody(r.Body, maxBodyBytes))
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return uploadError{status: http.StatusBadRequest, err: err}
+	}
+	var language string
+	var file bool
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return uploadErr(err)
+		}
+		switch part.FormName() {
+		case "language":
+			buf, err := ioutil.ReadAll(io.LimitReader(part, 256))
+			if err != nil {
+				return uploadErr(err)
+			}
+			language = strings.TrimSpace(string(buf))
+		case "file":
+			if file {
+				return uploadError{status: http.StatusBadRequest, err: fmt.Errorf("more than one file")}
+			}
+			file = true
+			if err := decodeDocument(part, request); err != nil {
+				return err
+			}
+		}
+		part.Close()
+	}
+	if !file {
+		return uploadError{status: http.StatusBadRequest, err: fmt.Errorf("missing file")}
+	}
+	if language != "" {
+		request.Language = language
+	}
+	return nil
+}
+
+// Decode the document of the file field according to its format.
+func decodeDocument(part *multipart.Part, request *api.Request) error {
+	format, ok := uploadFormats[strings.ToLower(filepath.Ext(part.FileName()))]
+	if !ok {
+		mt, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if format, ok = uploadFormats[mt]; !ok {
+			return uploadError{
+				status: http.StatusUnsupportedMediaType,
+				err:    fmt.Errorf("unsupported document: %s", part.FileName()),
+			}
+		}
+	}
+	var err error
+	switch format {
+	case "json":
+		var buf []byte
+		if buf, err = ioutil.ReadAll(part); err == nil {
+			err = unmarshalJSON(buf, request)
+		}
+	case "txt":
+		err = readText(part, request)
+	case "xml":
+		err = readXML(part, request)
+	}
+	if _, ok := err.(tooLargeError); ok {
+		return err
+	}
+	if err != nil {
+		return uploadError{
+			status: http.StatusBadRequest,
+			err:    fmt.Errorf("cannot decode %s document: %v", format, err),
+		}
+	}
+	return nil
+}
+
+// Read the white space separated tokens of the text into the
+// request.  The positions are the line (starting at 1) and the offset
+// of the token in the line (in characters).  Each non-empty line is a
+// segment.
+func readText(in io.Reader, r *api.Request) error {
+	var tokens []gofiler.Token
+	var pos []api.Position
+	var segs []api.Segment
+	s := bufio.NewScanner(in)
+	s.Buffer(nil, 1<<20)
+	for line := 1; s.Scan(); line++ {
+		first := len(tokens)
+		start := -1
+		runes := []rune(s.Text())
+		for i := 0; i <= len(runes); i++ {
+			if i < len(runes) && !unicode.IsSpace(runes[i]) {
+				if start < 0 {
+					start = i
+				}
+				continue
+			}
+			if start >= 0 {
+				tokens = append(tokens, gofiler.Token{OCR: string(runes[start:i])})
+				pos = append(pos, api.Position{Line: line, Offset: start})
+				start = -1
+			}
+		}
+		if len(tokens) > first {
+			segs = append(segs, api.Segment{
+				Type:   api.SegmentLine,
+				Start:  first,
+				Length: len(tokens) - first,
+			})
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	r.Tokens, r.Positions, r.Segments = tokens, pos, segs
+	return nil
+}
+
+// Read the tokens of an ALTO or PAGE document into the request.  The
+// TextLines of the document are the segments of the request.  Other
+// XML documents are read as text without positions and segments.
+func readXML(in io.Reader, r *api.Request) error {
+	var tokens, text []gofiler.Token
+	var pos []api.Position
+	var segs []api.Segment
+	var line api.Segment // the current TextLine
+	var word string      // ID of the current PAGE word
+	var elems []string   // Open elements
+	d := xml.NewDecoder(in)
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			elems = append(elems, t.Name.Local)
+			switch t.Name.Local {
+			case "TextLine": // ALTO and PAGE
+				line = api.Segment{Type: api.SegmentLine, Start: len(tokens)}
+				if line.ID = xmlAttr(t, "ID"); line.ID == "" {
+					line.ID = xmlAttr(t, "id")
+				}
+			case "String": // ALTO
+				if content := xmlAttr(t, "CONTENT"); content != "" {
+					tokens = append(tokens, gofiler.Token{OCR: content})
+					pos = append(pos, api.Position{ID: xmlAttr(t, "ID")})
+				}
+			case "Word": // PAGE
+				word = xmlAttr(t, "id")
+			}
+		case xml.EndElement:
+			elems = elems[:len(elems)-1]
+			switch t.Name.Local {
+			case "Word":
+				word = ""
+			case "TextLine":
+				if line.Length = len(tokens) - line.Start; line.Length > 0 {
+					segs = append(segs, line)
+				}
+			}
+		case xml.CharData:
+			// The first Unicode of the TextEquiv of a PAGE word.
+			if n := len(elems); word != "" && n >= 3 && elems[n-1] == "Unicode" &&
+				elems[n-2] == "TextEquiv" && elems[n-3] == "Word" {
+				if str := strings.TrimSpace(string(t)); str != "" {
+					tokens = append(tokens, gofiler.Token{OCR: str})
+					pos = append(pos, api.Position{ID: word})
+					word = ""
+				}
+			}
+			for _, str := range strings.Fields(string(t)) {
+				text = append(text, gofiler.Token{OCR: str})
+			}
+		}
+	}
+	if len(tokens) == 0 {
+		r.Tokens = text
+		return nil
+	}
+	r.Tokens, r.Positions, r.Segments = tokens, pos, segs
+	return nil
+}
+
+func xmlAttr(e xml.StartElement, name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// uploadError is the error of invalid uploads.
+type uploadError struct {
+	status int
+	err    error
+}
+
+func (e uploadError) Error() string {
+	return e.err.Error()
+}
+
+// Wrap the error of reading an upload.  Errors of exceeding
+// -max-body-bytes are passed through.
+func uploadErr(err error) error {
+	if _, ok := err.(tooLargeError); ok {
+		return err
+	}
+	return uploadError{status: http.StatusBadRequest, err: err}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// The usage of the daemon is accounted per namespace (i.e. per key),
+// language and calendar month (UTC).  Only successfully finished jobs
+// count.  The usage is persisted in usage.json below -data-dir.
+var usage = struct {
+	m map[usageKey]*api.UsageRecord
+	l sync.Mutex
+}{m: make(map[usageKey]*api.UsageRecord)}
+
+type usageKey struct {
+	namespace string
+	month     string
+	language  string
+}
+
+func usagePath() string {
+	return filepath.Join(dataDir, "usage.json")
+}
+
+func usageMonth(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// Load the persisted usage.
+func loadUsage() error {
+	if dataDir == "" {
+		return nil
+	}
+	var records []api.UsageRecord
+	if err := readJSON(usagePath(), &records); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	usage.l.Lock()
+	defer usage.l.Unlock()
+	for i := range records {
+		r := &records[i]
+		usage.m[usageKey{r.Namespace, r.Month, r.Language}] = r
+	}
+	log.Infof("loaded %d usage records", len(usage.m))
+	return nil
+}
+
+// Account the profiled tokens of a finished job.
+func recordUsage(namespace, language string, tokens int) {
+	usage.l.Lock()
+	defer usage.l.Unlock()
+	key := usageKey{namespace, usageMonth(time.Now()), language}
+	r, ok := usage.m[key]
+	if !ok {
+		r = &api.UsageRecord{Namespace: namespace, Month: key.month, Language: language}
+		usage.m[key] = r
+	}
+	r.Jobs++
+	r.Tokens += tokens
+	if dataDir == "" {
+		return
+	}
+	if err := os.MkdirAll(dataDir, 0750); err != nil {
+		log.Errorf("cannot save usage: %v", err)
+		return
+	}
+	if err := writeJSON(usagePath(), selectUsage(func(usageKey) bool { return true })); err != nil {
+		log.Errorf("cannot save usage: %v", err)
+	}
+}
+
+// Remove the usage records of a namespace.  Returns the number of
+// removed records.
+func purgeUsage(namespace string) int {
+	usage.l.Lock()
+	defer usage.l.Unlock()
+	n := 0
+	for key := range usage.m {
+		if key.namespace == namespace {
+			delete(usage.m, key)
+			n++
+		}
+	}
+	if n == 0 || dataDir == "" {
+		return n
+	}
+	if err := writeJSON(usagePath(), selectUsage(func(usageKey) bool { return true })); err != nil {
+		log.Errorf("cannot save usage: %v", err)
+	}
+	return n
+}
+
+// Return the selected usage records ordered by month, namespace and
+// language.  Must be called with the usage locked.
+func selectUsage(match func(usageKey) bool) []api.UsageRecord {
+	res := []api.UsageRecord{}
+	for key, r := range usage.m {
+		if match(key) {
+			res = append(res, *r)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, b := res[i], res[j]
+		if a.Month != b.Month {
+			return a.Month < b.Month
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Language < b.Language
+	})
+	return res
+}
+
+// Return the usage records of the current month.
+func currentUsage() []api.UsageRecord {
+	usage.l.Lock()
+	defer usage.l.Unlock()
+	month := usageMonth(time.Now())
+	return selectUsage(func(key usageKey) bool { return key.month == month })
+}
+
+// Report the usage:
+// [GET] usage?month=MONTH&namespace=NAMESPACE&language=LANGUAGE.  All
+// parameters are optional.  The namespace of requests without a
+// namespace is "-".
+func getUsage(w http.ResponseWriter, r *http.Request) interface{} {
+	q := r.URL.Query()
+	month, language := q.Get("month"), q.Get("language")
+	if month != "" {
+		if _, err := time.Parse("2006-01", month); err != nil {
+			return api.Error{Status: http.StatusBadRequest, Message: "invalid month: " + month}
+		}
+	}
+	_, filterNS := q["namespace"]
+	ns := q.Get("namespace")
+	if ns == "-" {
+		ns = ""
+	}
+	usage.l.Lock()
+	defer usage.l.Unlock()
+	report := api.UsageReport{Records: selectUsage(func(key usageKey) bool {
+		return (month == "" || key.month == month) &&
+			(language == "" || key.language == language) &&
+			(!filterNS || key.namespace == ns)
+	})}
+	for _, r := range report.Records {
+		report.Jobs += r.Jobs
+		report.Tokens += r.Tokens
+	}
+	return report
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/finkf/gofilerd/api"
+)
+
+// Validate a profiling request without submitting a job.  The request
+// passed the same checks as a POST /profile request (language, size
+// limits, options, tokens, client-supplied IDs and quotas).  Returns
+// the normalized request together with the estimated cost of the
+// job.
+func validateProfile(path string, request submission) interface{} {
+	if request.Group != "" {
+		groups.l.Lock()
+		err, ok := groups.accepts(request.Group)
+		groups.l.Unlock()
+		if !ok {
+			return err
+		}
+	}
+	if res, ok := existingJob(request.ID, requestHash(request.Request), request.namespace); ok {
+		if err, ok := res.(api.Error); ok {
+			return err
+		}
+	}
+	if err, ok := checkQuota(request); !ok {
+		return err
+	}
+	request.Checksum = request.checksum
+	request.MaxParallelism = shards(request, request.Tokens)
+	return api.Validation{
+		Request:  request.Request,
+		Estimate: estimate(request.Language, len(request.Tokens), 0),
+	}
+}
+
+// Check the tokens of the request.  The profiler reads one token per
+// line, so tokens must not contain line breaks.
+func checkTokens(request api.Request) error {
+	for i, t := range request.Tokens {
+		if strings.ContainsAny(t.OCR+t.COR+t.LE, "\r\n") {
+			return fmt.Errorf("invalid token %d: line break", i)
+		}
+	}
+	if len(request.Positions) > len(request.Tokens) {
+		return fmt.Errorf("too many positions: %d > %d",
+			len(request.Positions), len(request.Tokens))
+	}
+	return checkSegments(request)
+}
+
+// Check that the segments of the request are ordered and do not
+// overlap.
+func checkSegments(request api.Request) error {
+	end := 0
+	for i, s := range request.Segments {
+		switch s.Type {
+		case "", api.SegmentLine, api.SegmentSentence:
+		default:
+			return fmt.Errorf("invalid segment %d: type %q", i, s.Type)
+		}
+		if s.Start < end || s.Length < 0 || s.Start+s.Length > len(request.Tokens) {
+			return fmt.Errorf("invalid segment %d: tokens %d-%d",
+				i, s.Start, s.Start+s.Length)
+		}
+		end = s.Start + s.Length
+	}
+	return nil
+}
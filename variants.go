@@ -0,0 +1,161 @@
+package main
+
+import (
+	"container/heap"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+)
+
+const (
+	// Maximal number of returned spellings.
+	maxSpellings = 100
+	// Default and maximal number of applied patterns per spelling.
+	defaultPatterns = 2
+	maxPatterns     = 4
+	// Weight of patterns without a configured weight.
+	defaultPatternWeight = 0.01
+)
+
+// Expand a word using the historical patterns of the language:
+// [GET] languages/NAME/variants?q=WORD[&to=historical|modern][&max=N].
+// Historical spellings of a modern word are generated by rewriting the
+// left side of the patterns with their right side (and vice versa for
+// modern spellings of a historical word), applying at most max
+// patterns.  Spellings are ranked by the product of the weights of
+// their patterns (capped at 1) and the best spellings are returned.
+func getVariants(lc gofiler.LanguageConfiguration, r *http.Request) interface{} {
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		return http.StatusBadRequest
+	}
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		to = "historical"
+	}
+	if to != "historical" && to != "modern" {
+		return http.StatusBadRequest
+	}
+	max := defaultPatterns
+	if str := r.URL.Query().Get("max"); str != "" {
+		n, err := strconv.Atoi(str)
+		if err != nil || n < 1 || n > maxPatterns {
+			return http.StatusBadRequest
+		}
+		max = n
+	}
+	rules, err := loadPatterns(lc)
+	if err != nil {
+		return err
+	}
+	if to == "modern" {
+		for i := range rules {
+			rules[i].Left, rules[i].Right = rules[i].Right, rules[i].Left
+		}
+	}
+	res := api.Spellings{Language: lc.Language, Word: q, To: to}
+	scores := expand(strings.ToLower(q), rules, max)
+	for spelling, score := range scores {
+		res.Spellings = append(res.Spellings, api.Spelling{Spelling: spelling, Score: score})
+	}
+	sort.Slice(res.Spellings, func(i, j int) bool {
+		if res.Spellings[i].Score != res.Spellings[j].Score {
+			return res.Spellings[i].Score > res.Spellings[j].Score
+		}
+		return res.Spellings[i].Spelling < res.Spellings[j].Spelling
+	})
+	if len(res.Spellings) > maxSpellings {
+		res.Spellings = res.Spellings[:maxSpellings]
+	}
+	return res
+}
+
+// match is an occurrence of the left side of a rule in a word.
+type match struct {
+	pos  int
+	rule api.PatternRule
+}
+
+// derivation is a partial spelling that applied n rules and continues
+// with the matches from i on that start at or after end.
+type derivation struct {
+	i, end, n int
+	prefix    string
+	score     float64
+}
+
+// derivations is a max-heap of derivations by their scores.
+type derivations []derivation
+
+func (ds derivations) Len() int            { return len(ds) }
+func (ds derivations) Less(i, j int) bool  { return ds[i].score > ds[j].score }
+func (ds derivations) Swap(i, j int)       { ds[i], ds[j] = ds[j], ds[i] }
+func (ds *derivations) Push(x interface{}) { *ds = append(*ds, x.(derivation)) }
+func (ds *derivations) Pop() interface{} {
+	old := *ds
+	d := old[len(old)-1]
+	*ds = old[:len(old)-1]
+	return d
+}
+
+// Generate the maxSpellings best spellings of the word that apply
+// between 1 and max rules at non-overlapping positions of the word.
+// Each spelling maps to the best score of its derivations.  The
+// derivations are expanded best first; since weights are capped at
+// 1, no later derivation scores better than an earlier one.
+func expand(word string, rules []api.PatternRule, max int) map[string]float64 {
+	var matches []match
+	for _, rule := range rules {
+		if rule.Left == "" {
+			continue
+		}
+		if rule.Weight <= 0 {
+			rule.Weight = defaultPatternWeight
+		}
+		if rule.Weight > 1 {
+			rule.Weight = 1
+		}
+		for pos := 0; ; pos++ {
+			off := strings.Index(word[pos:], rule.Left)
+			if off == -1 {
+				break
+			}
+			pos += off
+			matches = append(matches, match{pos: pos, rule: rule})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].pos < matches[j].pos
+	})
+	scores := make(map[string]float64)
+	queue := &derivations{{score: 1}}
+	for steps := 0; queue.Len() > 0 && len(scores) < maxSpellings && steps < 10*maxSpellings; steps++ {
+		d := heap.Pop(queue).(derivation)
+		if v := d.prefix + word[d.end:]; d.n > 0 && v != word {
+			if _, ok := scores[v]; !ok {
+				scores[v] = d.score
+			}
+		}
+		if d.n == max {
+			continue
+		}
+		for i := d.i; i < len(matches); i++ {
+			m := matches[i]
+			if m.pos < d.end {
+				continue
+			}
+			heap.Push(queue, derivation{
+				i:      i + 1,
+				end:    m.pos + len(m.rule.Left),
+				n:      d.n + 1,
+				prefix: d.prefix + word[d.end:m.pos] + m.rule.Right,
+				score:  d.score * m.rule.Weight,
+			})
+		}
+	}
+	return scores
+}
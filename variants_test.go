@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/finkf/gofilerd/api"
+)
+
+func TestExpand(t *testing.T) {
+	rules := []api.PatternRule{
+		{Left: "t", Right: "th", Weight: 0.5},
+		{Left: "u", Right: "v", Weight: 0.9},
+	}
+	tests := []struct {
+		word  string
+		rules []api.PatternRule
+		max   int
+		want  map[string]float64
+	}{
+		{"teilung", rules, 1, map[string]float64{"theilung": 0.5, "teilvng": 0.9}},
+		{"teilung", rules, 2, map[string]float64{"theilung": 0.5, "teilvng": 0.9, "theilvng": 0.45}},
+		{"haus", rules, 2, map[string]float64{"havs": 0.9}},
+		{"haus", []api.PatternRule{{Left: "u", Right: "v"}}, 1, map[string]float64{"havs": defaultPatternWeight}},
+		{"haus", []api.PatternRule{{Left: "u", Right: "v", Weight: 2}}, 1, map[string]float64{"havs": 1}},
+		{"haus", []api.PatternRule{{Left: "", Right: "x", Weight: 1}}, 1, map[string]float64{}},
+		{"haus", []api.PatternRule{{Left: "u", Right: "u", Weight: 1}}, 1, map[string]float64{}},
+		{"uu", []api.PatternRule{{Left: "u", Right: "v", Weight: 0.5}}, 2,
+			map[string]float64{"vu": 0.5, "uv": 0.5, "vv": 0.25}},
+		{"aaa", []api.PatternRule{{Left: "aa", Right: "x", Weight: 0.5}}, 2,
+			map[string]float64{"xa": 0.5, "ax": 0.5}},
+		{"tu", []api.PatternRule{
+			{Left: "t", Right: "d", Weight: 0.1},
+			{Left: "tu", Right: "tv", Weight: 0.8},
+			{Left: "u", Right: "v", Weight: 0.5},
+		}, 2, map[string]float64{"du": 0.1, "tv": 0.8, "dv": 0.05}},
+	}
+	for _, tc := range tests {
+		got := expand(tc.word, tc.rules, tc.max)
+		if len(got) != len(tc.want) {
+			t.Errorf("expand(%q, %v, %d) = %v; want %v", tc.word, tc.rules, tc.max, got, tc.want)
+			continue
+		}
+		for spelling, score := range tc.want {
+			if s, ok := got[spelling]; !ok || math.Abs(s-score) > 1e-9 {
+				t.Errorf("expand(%q, %v, %d) = %v; want %v", tc.word, tc.rules, tc.max, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestExpandKeepsBestSpellings(t *testing.T) {
+	// Many low-weight rules match before the single high-weight rule
+	// at the end of the word.
+	word := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaz"
+	rules := []api.PatternRule{
+		{Left: "a", Right: "b", Weight: 0.01},
+		{Left: "a", Right: "c", Weight: 0.01},
+		{Left: "z", Right: "y", Weight: 0.9},
+	}
+	got := expand(word, rules, 2)
+	if len(got) > maxSpellings {
+		t.Errorf("expand returned %d spellings; want at most %d", len(got), maxSpellings)
+	}
+	best := word[:len(word)-1] + "y"
+	if got[best] != 0.9 {
+		t.Errorf("expand lost the best spelling %q: %v", best, got[best])
+	}
+}
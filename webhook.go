@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximal number of attempts of a webhook delivery.
+const maxDeliveryAttempts = 5
+
+// The secret to sign webhook deliveries (see -webhook-secret).
+var webhookSecret []byte
+
+// The ID of the last webhook delivery.  It starts with the start time
+// of the daemon in nanoseconds, so delivery IDs keep increasing after
+// restarts.
+var lastDelivery = uint64(time.Now().UnixNano())
+
+// Callback URLs are chosen by clients.  Deliveries to callbacks must
+// not reach loopback, private, link-local (e.g. cloud metadata) or
+// other special addresses of the daemon's network unless the address
+// is in one of the networks of -callback-allow-cidr.  Only the -events
+// webhook, which is configured by the operator, is not restricted.
+// Addresses are checked when connecting, so host names that resolve to
+// restricted addresses are refused as well.
+var callbackNets []*net.IPNet
+
+// Clients for the -events webhook and for callbacks.
+var (
+	eventsClient   = &http.Client{Timeout: 10 * time.Second}
+	callbackClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			// No proxy: the proxy would connect on our behalf.
+			DialContext: (&net.Dialer{
+				Timeout: 10 * time.Second,
+				Control: checkCallbackDial,
+			}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+)
+
+// Check the URL of a callback.  Callbacks must be absolute http or
+// https URLs; IP addresses must not be restricted.
+func checkCallback(u string) error {
+	p, err := url.Parse(u)
+	if err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+		return fmt.Errorf("invalid callback: %q", u)
+	}
+	if ip := net.ParseIP(p.Hostname()); ip != nil && !allowedCallbackIP(ip) {
+		return fmt.Errorf("callback address not allowed: %s", ip)
+	}
+	return nil
+}
+
+// Return true if callbacks may be delivered to the address.
+func allowedCallbackIP(ip net.IP) bool {
+	for _, n := range callbackNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+func checkCallbackDial(network, address string, _ syscall.RawConn) error {
+	ip := net.ParseIP(hostOf(address))
+	if ip == nil || !allowedCallbackIP(ip) {
+		return fmt.Errorf("callback address not allowed: %s", address)
+	}
+	return nil
+}
+
+// Return the HTTP client for deliveries to the URL.
+func deliveryClient(u string) *http.Client {
+	if eventsURL != "" && u == eventsURL {
+		return eventsClient
+	}
+	return callbackClient
+}
+
+// Load the secret to sign webhook deliveries.
+func loadWebhookSecret(path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read webhook secret: %v", err)
+	}
+	webhookSecret = []byte(strings.TrimSpace(string(buf)))
+	if len(webhookSecret) == 0 {
+		return fmt.Errorf("empty webhook secret in %s", path)
+	}
+	return nil
+}
+
+// Post JSON encoded data to an URL.  Failed deliveries are retried
+// with an exponential backoff.  If all attempts fail, the delivery is
+// kept as dead letter.
+func postJSON(u string, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	id := atomic.AddUint64(&lastDelivery, 1)
+	backoff := time.Second
+	for i := 1; i <= maxDeliveryAttempts; i++ {
+		if i > 1 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if _, err = deliver(u, buf, id, i, maxDeliveryAttempts); err == nil {
+			return nil
+		}
+		log.Infof("cannot post to %s: %v", u, err)
+	}
+	addDeadLetter(api.DeadLetter{
+		Delivery: id,
+		URL:      u,
+		Payload:  buf,
+		Attempts: maxDeliveryAttempts,
+		Error:    err.Error(),
+		Failed:   time.Now(),
+	})
+	return fmt.Errorf("giving up: %v", err)
+}
+
+// Make one attempt of a webhook delivery with the given maximal number
+// of attempts.  Returns the HTTP status of the receiver.
+func deliver(u string, body []byte, id uint64, attempt, attempts int) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	delivery := strconv.FormatUint(id, 10)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("User-Agent", "gofilerd/"+api.Version)
+	req.Header.Set(api.HeaderWebhookDelivery, delivery)
+	req.Header.Set(api.HeaderWebhookTimestamp, timestamp)
+	req.Header.Set(api.HeaderWebhookAttempt, strconv.Itoa(attempt))
+	req.Header.Set(api.HeaderWebhookMaxAttempts, strconv.Itoa(attempts))
+	if webhookSecret != nil {
+		mac := hmac.New(sha256.New, webhookSecret)
+		mac.Write(api.WebhookSignaturePayload(timestamp, delivery, body))
+		req.Header.Set(api.HeaderWebhookSignature, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	res, err := deliveryClient(u).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("%s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// Maximal number of test deliveries per client and minute.
+const maxWebhookTestsPerMinute = 10
+
+// Deliver a test event to a receiver: [POST] webhooks/test.  The test
+// is delivered once and is not retried.  Receivers are restricted like
+// callbacks; only administrators may test the -events webhook.  Each
+// client may test at most maxWebhookTestsPerMinute deliveries per
+// minute (counted in the quota store).
+func testWebhook(w http.ResponseWriter, r *http.Request) interface{} {
+	var req api.WebhookTest
+	if err := decodeBody(r, &req); err != nil {
+		return decodeError(err)
+	}
+	if err := checkCallback(req.URL); err != nil && !(isAdmin(r) && req.URL == eventsURL) {
+		return api.Error{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	now := time.Now()
+	minute := now.UTC().Truncate(time.Minute)
+	key := "webhook-tests:" + remoteIP(r) + ":" + minute.Format("200601021504")
+	if n, err := quotas.add(key, 1, minute.Add(time.Minute)); err != nil {
+		log.Errorf("cannot count webhook tests: %v", err)
+	} else if n > maxWebhookTestsPerMinute {
+		return api.Error{
+			Status:     http.StatusTooManyRequests,
+			Message:    "too many webhook tests",
+			Reason:     reasonQuotaExceeded,
+			RetryAfter: int(minute.Add(time.Minute).Sub(now).Seconds()) + 1,
+		}
+	}
+	body, err := json.Marshal(api.Event{Time: time.Now(), Event: "test"})
+	if err != nil {
+		return err
+	}
+	res := api.WebhookTestResult{
+		URL:      req.URL,
+		Delivery: atomic.AddUint64(&lastDelivery, 1),
+		Signed:   webhookSecret != nil,
+	}
+	res.Status, err = deliver(req.URL, body, res.Delivery, 1, 1)
+	if err != nil {
+		res.Error = err.Error()
+	}
+	log.Infof("test delivery %d to %s: %d", res.Delivery, req.URL, res.Status)
+	return res
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/finkf/gofiler"
+	"github.com/finkf/gofilerd/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// Whitelists of corpus namespaces.  Whitelisted tokens (e.g. proper
+// names and recurring abbreviations) bypass the profiler and are
+// marked as verified in the profiles of requests with the according
+// Corpus.  Whitelists are persisted as JSON files (NAMESPACE.json) in
+// the whitelists directory below -data-dir (unless -no-content-logging
+// is set).
+var whitelists struct {
+	m map[string]map[string]bool // namespace -> lower case token
+	l sync.RWMutex
+}
+
+// The dictionary of the candidates of whitelisted tokens.
+const whitelistDict = "whitelist"
+
+func whitelistDir() string {
+	return filepath.Join(dataDir, "whitelists")
+}
+
+// Load the persisted whitelists.
+func loadWhitelists() error {
+	whitelists.l.Lock()
+	defer whitelists.l.Unlock()
+	whitelists.m = make(map[string]map[string]bool)
+	if dataDir == "" || noContentLogging {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(whitelistDir(), "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		var list api.Whitelist
+		if err := readJSON(file, &list); err != nil {
+			return fmt.Errorf("invalid whitelist %s: %v", file, err)
+		}
+		ns := strings.TrimSuffix(filepath.Base(file), ".json")
+		whitelists.m[ns] = make(map[string]bool, len(list.Tokens))
+		addWhitelisted(whitelists.m[ns], list.Tokens)
+	}
+	log.Infof("loaded %d whitelists", len(whitelists.m))
+	return nil
+}
+
+// Whitelisted tokens are looked up case insensitively.
+func addWhitelisted(m map[string]bool, tokens []string) {
+	for _, t := range tokens {
+		if t = strings.ToLower(strings.TrimSpace(t)); t != "" {
+			m[t] = true
+		}
+	}
+}
+
+func hasWhitelist(ns string) bool {
+	whitelists.l.RLock()
+	defer whitelists.l.RUnlock()
+	_, ok := whitelists.m[ns]
+	return ok
+}
+
+// Remove the whitelisted tokens of the namespace.  Returns the
+// remaining tokens and the whitelisted OCR forms.
+func whitelisted(ns string, tokens []gofiler.Token) ([]gofiler.Token, []string) {
+	whitelists.l.RLock()
+	defer whitelists.l.RUnlock()
+	list := whitelists.m[ns]
+	if len(list) == 0 {
+		return tokens, nil
+	}
+	var res []gofiler.Token
+	var verified []string
+	seen := make(map[string]bool)
+	for _, t := range tokens {
+		if t.LE != "" || !list[strings.ToLower(t.OCR)] {
+			res = append(res, t)
+			continue
+		}
+		if !seen[t.OCR] {
+			seen[t.OCR] = true
+			verified = append(verified, t.OCR)
+		}
+	}
+	return res, verified
+}
+
+// Add the verified tokens to the profile.  The only candidate of a
+// verified token is the token itself.
+func addVerified(p gofiler.Profile, verified []string) {
+	for _, ocr := range verified {
+		p[ocr] = gofiler.Interpretation{
+			OCR: ocr,
+			Candidates: []gofiler.Candidate{{
+				Suggestion: ocr,
+				Modern:     ocr,
+				Dict:       whitelistDict,
+				Weight:     1,
+			}},
+		}
+	}
+}
+
+// Get the whitelist of a namespace:
+// [GET] whitelist?namespace=NAMESPACE
+func getWhitelist(w http.ResponseWriter, r *http.Request) interface{} {
+	ns := r.URL.Query().Get("namespace")
+	whitelists.l.RLock()
+	defer whitelists.l.RUnlock()
+	list, ok := whitelists.m[ns]
+	if !ok {
+		return http.StatusNotFound
+	}
+	return whitelist(ns, list)
+}
+
+// Upload (and replace) the whitelist of a namespace:
+// [PUT] whitelist?namespace=NAMESPACE
+func putWhitelist(w http.ResponseWriter, r *http.Request) interface{} {
+	var list api.Whitelist
+	return editWhitelist(r, &list, func(map[string]bool) map[string]bool {
+		m := make(map[string]bool, len(list.Tokens))
+		addWhitelisted(m, list.Tokens)
+		return m
+	})
+}
+
+// Add tokens to and remove tokens from the whitelist of a namespace:
+// [POST] whitelist?namespace=NAMESPACE
+func postWhitelist(w http.ResponseWriter, r *http.Request) interface{} {
+	var changes api.WhitelistChanges
+	return editWhitelist(r, &changes, func(m map[string]bool) map[string]bool {
+		addWhitelisted(m, changes.Add)
+		for _, t := range changes.Remove {
+			delete(m, strings.ToLower(strings.TrimSpace(t)))
+		}
+		return m
+	})
+}
+
+// Decode the body of the request and replace the whitelist of the
+// namespace with the result of edit.
+func editWhitelist(
+	r *http.Request, body interface{}, edit func(map[string]bool) map[string]bool,
+) interface{} {
+	ns := r.URL.Query().Get("namespace")
+	if !validNamespace.MatchString(ns) {
+		return api.Error{
+			Status:  http.StatusBadRequest,
+			Message: fmt.Sprintf("invalid namespace: %q", ns),
+		}
+	}
+	if err := decodeBody(r, body); err != nil {
+		return decodeError(err)
+	}
+	whitelists.l.Lock()
+	defer whitelists.l.Unlock()
+	old := make(map[string]bool, len(whitelists.m[ns]))
+	for t := range whitelists.m[ns] {
+		old[t] = true
+	}
+	m := edit(old)
+	list := whitelist(ns, m)
+	if dataDir != "" && !noContentLogging {
+		if err := writeWhitelist(list); err != nil {
+			return err
+		}
+	}
+	whitelists.m[ns] = m
+	log.Infof("stored whitelist %s (%d tokens)", ns, len(m))
+	return list
+}
+
+// Delete the whitelist of a namespace:
+// [DELETE] whitelist?namespace=NAMESPACE
+func deleteWhitelist(w http.ResponseWriter, r *http.Request) interface{} {
+	ns := r.URL.Query().Get("namespace")
+	whitelists.l.Lock()
+	defer whitelists.l.Unlock()
+	if _, ok := whitelists.m[ns]; !ok {
+		return http.StatusNotFound
+	}
+	if dataDir != "" {
+		err := os.Remove(filepath.Join(whitelistDir(), ns+".json"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	delete(whitelists.m, ns)
+	log.Infof("deleted whitelist %s", ns)
+	return api.Whitelist{Namespace: ns}
+}
+
+// Return the sorted whitelist of the namespace.
+func whitelist(ns string, m map[string]bool) api.Whitelist {
+	list := api.Whitelist{Namespace: ns, Tokens: make([]string, 0, len(m))}
+	for t := range m {
+		list.Tokens = append(list.Tokens, t)
+	}
+	sort.Strings(list.Tokens)
+	return list
+}
+
+// Write the list to a temporary file that replaces the old list.
+func writeWhitelist(list api.Whitelist) error {
+	if err := os.MkdirAll(whitelistDir(), 0750); err != nil {
+		return fmt.Errorf("cannot write whitelist: %v", err)
+	}
+	if err := writeJSON(filepath.Join(whitelistDir(), list.Namespace+".json"), list); err != nil {
+		return fmt.Errorf("cannot write whitelist: %v", err)
+	}
+	return nil
+}
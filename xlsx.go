@@ -0,0 +1,216 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/finkf/gofilerd/api"
+)
+
+// The xlsx export is a minimal Office Open XML workbook with three
+// sheets: the tokens (see tokenTable), all candidates and the
+// statistics of the historical and OCR patterns of the candidates.
+// Strings are stored inline, so the workbook needs no shared strings
+// or styles.
+
+// sheet is a worksheet of a workbook.  Cells are strings, ints or
+// float64s (see tokenTable).
+type sheet struct {
+	name   string
+	header []string
+	rows   [][]interface{}
+}
+
+// Export the profile as xlsx workbook.
+func exportXLSX(p api.Profile, o exportOptions) interface{} {
+	header, rows := tokenTable(p, o.candidates)
+	sheets := []sheet{
+		{name: "Tokens", header: header, rows: rows},
+		candidateSheet(p),
+		patternSheet(p),
+	}
+	var buf bytes.Buffer
+	if err := writeXLSX(&buf, sheets); err != nil {
+		return err
+	}
+	return file{
+		name:        p.Token.ID + ".xlsx",
+		contentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		data:        buf.Bytes(),
+	}
+}
+
+// Return the sheet with one row per candidate.
+func candidateSheet(p api.Profile) sheet {
+	s := sheet{
+		name: "Candidates",
+		header: []string{"Token", "Suggestion", "Modern", "Dict", "Weight",
+			"Distance", "Historical patterns", "OCR patterns"},
+	}
+	for _, ocr := range sortedWords(p) {
+		for _, c := range bestCandidates(p.Profile[ocr].Candidates, len(p.Profile[ocr].Candidates)) {
+			s.rows = append(s.rows, []interface{}{ocr, c.Suggestion, c.Modern, c.Dict,
+				float64(c.Weight), c.Distance, formatPatterns(c.HistPatterns),
+				formatPatterns(c.OCRPatterns)})
+		}
+	}
+	return s
+}
+
+// Return the sheet with the statistics of the patterns.  Patterns are
+// counted once per candidate.  The weight of a pattern is the sum of
+// the weights of its candidates.
+func patternSheet(p api.Profile) sheet {
+	type key struct{ typ, left, right string }
+	type stat struct {
+		count  int
+		weight float64
+	}
+	stats := make(map[key]*stat)
+	add := func(typ, left, right string, weight float32) {
+		k := key{typ, left, right}
+		if stats[k] == nil {
+			stats[k] = new(stat)
+		}
+		stats[k].count++
+		stats[k].weight += float64(weight)
+	}
+	for _, e := range p.Profile {
+		for _, c := range e.Candidates {
+			for _, pat := range c.HistPatterns {
+				add("historical", pat.Left, pat.Right, c.Weight)
+			}
+			for _, pat := range c.OCRPatterns {
+				add("ocr", pat.Left, pat.Right, c.Weight)
+			}
+		}
+	}
+	keys := make([]key, 0, len(stats))
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := stats[keys[i]], stats[keys[j]]
+		if a.weight != b.weight {
+			return a.weight > b.weight
+		}
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	s := sheet{name: "Patterns", header: []string{"Type", "Left", "Right", "Count", "Weight"}}
+	for _, k := range keys {
+		s.rows = append(s.rows, []interface{}{k.typ, k.left, k.right, stats[k].count, stats[k].weight})
+	}
+	return s
+}
+
+func sortedWords(p api.Profile) []string {
+	words := make([]string, 0, len(p.Profile))
+	for word := range p.Profile {
+		words = append(words, word)
+	}
+	sort.Strings(words)
+	return words
+}
+
+// Write the sheets as xlsx workbook.
+func writeXLSX(w io.Writer, sheets []sheet) error {
+	z := zip.NewWriter(w)
+	add := func(name, content string) error {
+		f, err := z.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, xml.Header+content)
+		return err
+	}
+	var types, rels, list bytes.Buffer
+	for i, s := range sheets {
+		n := i + 1
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" `+
+			`ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&rels, `<Relationship Id="rId%d" `+
+			`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" `+
+			`Target="worksheets/sheet%d.xml"/>`, n, n)
+		fmt.Fprintf(&list, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(s.name), n, n)
+	}
+	files := []struct{ name, content string }{
+		{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ` +
+			`ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			types.String() + `</Types>`},
+		{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" ` +
+			`Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" ` +
+			`Target="xl/workbook.xml"/></Relationships>`},
+		{"xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" ` +
+			`xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets>` + list.String() + `</sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			rels.String() + `</Relationships>`},
+	}
+	for _, f := range files {
+		if err := add(f.name, f.content); err != nil {
+			return err
+		}
+	}
+	for i, s := range sheets {
+		if err := add(fmt.Sprintf("xl/worksheets/sheet%d.xml", i+1), sheetXML(s)); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+// Return the XML of the worksheet.  The header is the first row.
+func sheetXML(s sheet) string {
+	var b bytes.Buffer
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	header := make([]interface{}, len(s.header))
+	for i, h := range s.header {
+		header[i] = h
+	}
+	for i, row := range append([][]interface{}{header}, s.rows...) {
+		fmt.Fprintf(&b, `<row r="%d">`, i+1)
+		for j, cell := range row {
+			ref := columnName(j) + strconv.Itoa(i+1)
+			switch t := cell.(type) {
+			case int:
+				if t != 0 {
+					fmt.Fprintf(&b, `<c r="%s"><v>%d</v></c>`, ref, t)
+				}
+			case float64:
+				fmt.Fprintf(&b, `<c r="%s"><v>%s</v></c>`, ref, formatCell(t))
+			default:
+				if str := fmt.Sprint(t); str != "" {
+					fmt.Fprintf(&b, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">%s</t></is></c>`,
+						ref, xmlEscape(str))
+				}
+			}
+		}
+		b.WriteString(`</row>`)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	return b.String()
+}
+
+// Return the name of the column (A, B, ..., Z, AA, ...).
+func columnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+func xmlEscape(str string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(str))
+	return b.String()
+}